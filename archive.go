@@ -0,0 +1,253 @@
+package vrr
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// A replica with Options.Archive ships its state off the cluster, for the
+// disasters no surviving replica recovers from: every ArchiveInterval, a
+// goroutine of its own uploads the WAL segments sealed since the last round,
+// see WALSegments, and the latest snapshot, see Snapshotter. The consensus
+// path never waits for it: the archiver only reads files which are no
+// longer written and the snapshot in the storage, and a failed upload is
+// reported on Errors as a FailureArchive and retried on the next round.
+//
+// The objects are named after ArchivePrefix and the replica:
+//
+//	<prefix>/replica-<id>/wal/wal-<seq>              a sealed WAL segment
+//	<prefix>/replica-<id>/snapshots/snapshot-<opNum> a snapshot
+//
+// Replaying the segments in order from the last one starting with a
+// checkpoint, after the matching snapshot, rebuilds the state as of the
+// last sealed segment. A segment removed by a compaction before it was
+// uploaded is skipped, since the checkpoint replacing it will be uploaded
+// with the segment holding it. What was uploaded is only remembered in
+// memory: a restarted replica uploads its sealed segments and its snapshot
+// again, which overwrites the objects with the same content. Only the WAL
+// has segments; with another StorageEngine, only the snapshots are shipped.
+
+// ObjectStore is where Options.Archive uploads the objects, e.g. an
+// S3Store. Put replaces the object with the key, if any.
+type ObjectStore interface {
+	Put(ctx context.Context, key string, body []byte) error
+}
+
+// archiver uploads the state of a replica to its ObjectStore. It is only
+// used by the goroutine of runArchiver.
+type archiver struct {
+	store  ObjectStore
+	prefix string
+	// segment is the last sealed segment uploaded, and snapshotNum the
+	// opNum of the last snapshot.
+	segment     int
+	snapshotNum int
+}
+
+func newArchiver(store ObjectStore, prefix string, replicaID int) *archiver {
+	return &archiver{store: store, prefix: path.Join(prefix, fmt.Sprintf("replica-%d", replicaID))}
+}
+
+// runArchiver ships the state of the replica every Options.ArchiveInterval
+// until ctx is canceled, when the replica stops. A round which doesn't
+// finish within the interval is abandoned, so that a hung upload doesn't
+// hold the next ones back.
+func (r *Replica) runArchiver(ctx context.Context, a *archiver) {
+	r.mu.Lock()
+	interval := r.opts.ArchiveInterval
+	r.mu.Unlock()
+	ticker := r.clock.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C():
+		}
+		r.mu.Lock()
+		storage, snapshotNum := r.storage, r.snapshotNum
+		r.mu.Unlock()
+
+		round, cancel := context.WithTimeout(ctx, interval)
+		err := a.ship(round, storage, snapshotNum)
+		cancel()
+		if err != nil && ctx.Err() == nil {
+			r.dlog("failed archiving the state; err = %v", err)
+			r.reportFailure(FailureArchive, 0, 0, err)
+		}
+	}
+}
+
+// ship uploads the segments of the storage sealed since the last call, in
+// order, and the snapshot if the replica took one since, given the opNum of
+// its last one. It stops at the first failed upload, which the next call
+// retries.
+func (a *archiver) ship(ctx context.Context, storage Storage, snapshotNum int) error {
+	if w, ok := storage.(*WAL); ok {
+		for _, seq := range w.sealedSegments() {
+			if seq <= a.segment {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(w.dir, walSegmentName(seq)))
+			if os.IsNotExist(err) {
+				a.segment = seq
+				continue
+			} else if err != nil {
+				return err
+			}
+			key := path.Join(a.prefix, "wal", walSegmentName(seq))
+			if err := a.store.Put(ctx, key, data); err != nil {
+				return fmt.Errorf("uploading %s: %w", key, err)
+			}
+			a.segment = seq
+		}
+	}
+
+	if snapshotNum <= a.snapshotNum {
+		return nil
+	}
+	data, err := storage.Get(storageSnapshot)
+	if err != nil || data == nil {
+		return err
+	}
+	// The replica may have taken another snapshot meanwhile.
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
+		return err
+	}
+	key := path.Join(a.prefix, "snapshots", fmt.Sprintf("snapshot-%016d", snapshot.OpNum))
+	if err := a.store.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("uploading %s: %w", key, err)
+	}
+	a.snapshotNum = snapshot.OpNum
+	return nil
+}
+
+// S3Store is an ObjectStore in a bucket of an S3-compatible service, which
+// the objects are PUT to with path-style URLs, Endpoint/Bucket/key, signed
+// with AWS Signature Version 4.
+type S3Store struct {
+	// Endpoint is the URL of the service, e.g.
+	// https://s3.eu-west-1.amazonaws.com or http://minio:9000.
+	Endpoint string
+	Bucket   string
+	Region   string
+
+	// AccessKeyID and SecretAccessKey sign the requests, along with
+	// SessionToken for temporary credentials.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// Client sends the requests; nil uses http.DefaultClient.
+	Client *http.Client
+}
+
+// s3Service is the service the requests are signed for.
+const s3Service = "s3"
+
+// Put uploads the body as the object with the key.
+func (s *S3Store) Put(ctx context.Context, key string, body []byte) error {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return err
+	}
+	u.Path = "/" + s.Bucket + "/" + key
+	u.RawPath = "/" + s3Escape(s.Bucket) + "/" + s3Escape(key)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	s.sign(req, sha256.Sum256(body), time.Now().UTC())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(&io.LimitedReader{R: resp.Body, N: 512})
+		return fmt.Errorf("PUT %s: %s: %s", u.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// sign adds the headers of Signature Version 4 to the request, sent at the
+// time with a body of the hash.
+func (s *S3Store) sign(req *http.Request, bodyHash [sha256.Size]byte, at time.Time) {
+	payload := hex.EncodeToString(bodyHash[:])
+	amzDate := at.Format("20060102T150405Z")
+	day := at.Format("20060102")
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	// The headers are signed sorted, lowercase, with the host first.
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	values := []string{req.URL.Host, payload, amzDate}
+	if s.SessionToken != "" {
+		signed = append(signed, "x-amz-security-token")
+		values = append(values, s.SessionToken)
+	}
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n\n", req.Method, req.URL.EscapedPath())
+	for i, name := range signed {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, values[i])
+	}
+	fmt.Fprintf(&canonical, "\n%s\n%s", strings.Join(signed, ";"), payload)
+
+	scope := day + "/" + s.Region + "/" + s3Service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), day)
+	for _, part := range []string{s.Region, s3Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, strings.Join(signed, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes the path as Signature Version 4 wants it: every
+// byte but the unreserved characters and the slashes.
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
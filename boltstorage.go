@@ -0,0 +1,261 @@
+package vrr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A replica with a data directory may keep its state in a bbolt database
+// rather than in the WAL, see Options.StorageEngine: a B+tree file whose
+// writes are transactions, so that the file holds the state rather than its
+// history and CompactLog frees the pages of the dropped entries for the
+// later ones. The values of the Storage are in the meta bucket, the entries
+// of the log in the log bucket keyed by their big-endian opNum, and the
+// opNum the log starts after in the meta bucket too. An AppendLog, with the
+// entries it replaces, is a single transaction, and so is a SetBatch, which
+// storeMeta uses to write the view and commit numbers together.
+//
+// The SyncPolicy applies as for the WAL: under SyncAlways every transaction
+// is synced before it returns, under SyncInterval the file is synced every
+// interval, and under SyncNever by the operating system. bbolt keeps the
+// file consistent whatever the policy, only the latest transactions may be
+// lost.
+
+const boltFile = "state.db"
+
+// StorageEngine is the Storage a replica keeps its state in its DataDir with.
+type StorageEngine int
+
+const (
+	// StorageWAL is the write-ahead log, see WAL.
+	StorageWAL StorageEngine = iota
+
+	// StorageBolt is the bbolt database, see BoltStorage.
+	StorageBolt
+
+	// StorageMmap is the memory-mapped log, see MmapStorage.
+	StorageMmap
+)
+
+func (e StorageEngine) String() string {
+	switch e {
+	case StorageWAL:
+		return "WAL"
+	case StorageBolt:
+		return "Bolt"
+	case StorageMmap:
+		return "Mmap"
+	default:
+		panic("unreachable")
+	}
+}
+
+var (
+	boltMetaBucket = []byte("meta")
+	boltLogBucket  = []byte("log")
+	boltLogStart   = []byte("\x00logStart")
+)
+
+// BatchSetter is implemented by the storages able to set several keys
+// atomically, which the replica then uses to write its view and commit
+// numbers.
+type BatchSetter interface {
+	SetBatch(values map[string][]byte) error
+}
+
+// BoltStorage is a Storage in a bbolt database.
+type BoltStorage struct {
+	db   *bolt.DB
+	done chan struct{}
+}
+
+// OpenBoltStorage opens the database in the directory, creating it if
+// needed.
+func OpenBoltStorage(dir string, policy SyncPolicy, interval time.Duration) (*BoltStorage, error) {
+	path := filepath.Join(dir, boltFile)
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second, NoSync: policy != SyncAlways})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltMetaBucket, boltLogBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	s := &BoltStorage{db: db}
+	if policy == SyncInterval {
+		s.done = make(chan struct{})
+		go s.syncEvery(interval, s.done)
+	}
+	return s, nil
+}
+
+// syncEvery syncs the database every interval until it is closed.
+func (s *BoltStorage) syncEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.db.Sync()
+		}
+	}
+}
+
+func boltOpNum(opNum int) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(opNum))
+	return key
+}
+
+// boltLogBounds returns the opNum the log starts after and the one of its
+// last entry.
+func boltLogBounds(tx *bolt.Tx) (int, int) {
+	start := 0
+	if value := tx.Bucket(boltMetaBucket).Get(boltLogStart); value != nil {
+		start = int(binary.BigEndian.Uint64(value))
+	}
+	end := start
+	if key, _ := tx.Bucket(boltLogBucket).Cursor().Last(); key != nil {
+		end = int(binary.BigEndian.Uint64(key))
+	}
+	return start, end
+}
+
+// boltTruncate deletes the entries of the log from opNum from on.
+func boltTruncate(log *bolt.Bucket, from int) error {
+	c := log.Cursor()
+	for key, _ := c.Seek(boltOpNum(from)); key != nil; key, _ = c.Seek(boltOpNum(from)) {
+		if err := log.Delete(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *BoltStorage) Get(key string) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(boltMetaBucket).Get([]byte(key)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+func (s *BoltStorage) Set(key string, value []byte) error {
+	return s.SetBatch(map[string][]byte{key: value})
+}
+
+func (s *BoltStorage) SetBatch(values map[string][]byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(boltMetaBucket)
+		for key, value := range values {
+			// bbolt doesn't tell a nil value from an empty one.
+			if value == nil {
+				if err := meta.Delete([]byte(key)); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := meta.Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) AppendLog(first int, entries []StoredEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		log := tx.Bucket(boltLogBucket)
+		start, end := boltLogBounds(tx)
+		if first < 1 || first > end+1 {
+			return fmt.Errorf("vrr: can't append at opNum=%d to a log ending at opNum=%d", first, end)
+		}
+		if first <= start {
+			if err := tx.Bucket(boltMetaBucket).Put(boltLogStart, boltOpNum(first-1)); err != nil {
+				return err
+			}
+		}
+		if err := boltTruncate(log, first); err != nil {
+			return err
+		}
+		for i, e := range entries {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+				return err
+			}
+			if err := log.Put(boltOpNum(first+i), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) ReadLog(from int) ([]StoredEntry, error) {
+	var entries []StoredEntry
+	err := s.db.View(func(tx *bolt.Tx) error {
+		start, _ := boltLogBounds(tx)
+		if from <= start {
+			from = start + 1
+		}
+		c := tx.Bucket(boltLogBucket).Cursor()
+		for key, value := c.Seek(boltOpNum(from)); key != nil; key, value = c.Next() {
+			var e StoredEntry
+			if err := gob.NewDecoder(bytes.NewReader(value)).Decode(&e); err != nil {
+				return fmt.Errorf("entry at opNum=%d: %v", binary.BigEndian.Uint64(key), err)
+			}
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func (s *BoltStorage) CompactLog(upTo int) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		start, _ := boltLogBounds(tx)
+		if upTo <= start {
+			return nil
+		}
+		log := tx.Bucket(boltLogBucket)
+		c := log.Cursor()
+		for key, _ := c.First(); key != nil && int(binary.BigEndian.Uint64(key)) <= upTo; key, _ = c.First() {
+			if err := log.Delete(key); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(boltMetaBucket).Put(boltLogStart, boltOpNum(upTo))
+	})
+}
+
+// Close syncs and closes the database.
+func (s *BoltStorage) Close() error {
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	if err := s.db.Sync(); err != nil {
+		s.db.Close()
+		return err
+	}
+	return s.db.Close()
+}
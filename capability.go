@@ -0,0 +1,73 @@
+package vrr
+
+// An application asking the cluster for what it can't do waits for the
+// timeout of its request to find out: a write waits for a primary and a
+// quorum, which a partition or a view change takes away. Capability tells it
+// beforehand, from what a replica knows, so that it degrades its features
+// consciously, e.g. by turning read-only while the cluster can't commit.
+//
+// The writes are possible when the view is stable, the replica Normal, and a
+// quorum of the cluster reachable, counting the peers neither the last calls
+// to them nor the FailureDetector tell dead; a backup also needs its primary
+// reachable. The state machine of a replica which holds its state, i.e. isn't
+// Dead, recovering it or catching up, serves stale reads meanwhile. A primary
+// may still lose its quorum right after Capability said it had one, so the
+// writes must still handle their errors.
+
+// Capability is what a cluster can do, as seen from one of its replicas,
+// from the least to the most.
+type Capability int
+
+const (
+	// CapabilityUnavailable is a replica which can't serve anything.
+	CapabilityUnavailable Capability = iota
+
+	// CapabilityStaleReads is a replica whose state machine serves reads,
+	// which may miss the latest writes, while the cluster can't write.
+	CapabilityStaleReads
+
+	// CapabilityWrites is a cluster committing the requests, and a replica
+	// serving stale reads.
+	CapabilityWrites
+)
+
+func (c Capability) String() string {
+	switch c {
+	case CapabilityUnavailable:
+		return "Unavailable"
+	case CapabilityStaleReads:
+		return "StaleReads"
+	case CapabilityWrites:
+		return "Writes"
+	default:
+		panic("unreachable")
+	}
+}
+
+// Capability returns what the cluster can currently do, as seen from the
+// replica.
+func (r *Replica) Capability() Capability {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch r.status {
+	case Dead, Recovery, StateTransfer:
+		return CapabilityUnavailable
+	case Normal:
+	default:
+		return CapabilityStaleReads
+	}
+	if r.primaryID != r.ID && r.peerHealth(r.primaryID) == PeerDead {
+		return CapabilityStaleReads
+	}
+	reachable := 1
+	for peerID := range r.configuration {
+		if r.peerHealth(peerID) != PeerDead {
+			reachable++
+		}
+	}
+	if reachable < r.quorum() {
+		return CapabilityStaleReads
+	}
+	return CapabilityWrites
+}
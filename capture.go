@@ -0,0 +1,170 @@
+package vrr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// A protocol capture records, for a while, every protocol message a replica
+// handles along with its arguments and outcome, for the heavyweight debugging
+// which can't be afforded all the time, see CaptureProtocol. The capture is a
+// gob stream of captureRecords which ReadCapture turns back into the messages,
+// to be replayed through the handlers of a replica.
+
+// CapturedMessage is a protocol message handled by the capturing replica.
+type CapturedMessage struct {
+	Time     time.Time
+	Method   string
+	SenderID int
+
+	// Args are the arguments of the handler, e.g. a PrepareArgs, and Err
+	// the error it returned, empty if none.
+	Args interface{}
+	Err  string
+}
+
+// captureRecord is a CapturedMessage as written to the capture, with the
+// arguments encoded on their own as their type depends on the method.
+type captureRecord struct {
+	Time     time.Time
+	Method   string
+	SenderID int
+	Args     []byte
+	Err      string
+}
+
+// protocolCapture writes the captured messages to the capture file until it
+// is closed.
+type protocolCapture struct {
+	mu     sync.Mutex
+	f      *os.File
+	enc    *gob.Encoder
+	err    error
+	closed bool
+}
+
+// write records the message, unless the capture is over. The first error
+// ends the capture.
+func (c *protocolCapture) write(call InboundCall, at time.Time, handlerErr error) {
+	record := captureRecord{Time: at, Method: call.Method, SenderID: call.SenderID}
+	if handlerErr != nil {
+		record.Err = handlerErr.Error()
+	}
+	var args bytes.Buffer
+	if err := gob.NewEncoder(&args).Encode(call.Args); err != nil {
+		record.Err = fmt.Sprintf("can't encode the arguments: %v", err)
+	}
+	record.Args = args.Bytes()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.err != nil {
+		return
+	}
+	c.err = c.enc.Encode(record)
+}
+
+// close ends the capture, returning its first error.
+func (c *protocolCapture) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if err := c.f.Close(); c.err == nil {
+		c.err = err
+	}
+	return c.err
+}
+
+// CaptureProtocol records the protocol messages the replica handles during
+// the next d in the file at path, which is created or truncated. It returns
+// once the capture started; only one capture runs at a time.
+func (r *Replica) CaptureProtocol(path string, d time.Duration) error {
+	if d <= 0 {
+		return fmt.Errorf("vrr: capture duration must be positive, got %v", d)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.capturing {
+		return errors.New("vrr: the replica is already capturing its protocol messages")
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	c := &protocolCapture{f: f, enc: gob.NewEncoder(f)}
+	r.capturing = true
+	r.capture.Store(c)
+	ticker := r.clock.NewTicker(d)
+	r.dlog("captures the protocol messages in %s for %v", path, d)
+
+	go func() {
+		<-ticker.C()
+		ticker.Stop()
+
+		r.mu.Lock()
+		r.capture.Store((*protocolCapture)(nil))
+		r.capturing = false
+		r.mu.Unlock()
+		if err := c.close(); err != nil {
+			log.Printf("failed writing the protocol capture %s; err = %v", path, err.Error())
+			return
+		}
+		r.dlog("captured the protocol messages in %s", path)
+	}()
+	return nil
+}
+
+// captureInbound is the replica's innermost interceptor, recording the
+// messages reaching the handlers while a capture runs.
+func (r *Replica) captureInbound(next InboundHandler) InboundHandler {
+	return func(call InboundCall) error {
+		c, _ := r.capture.Load().(*protocolCapture)
+		if c == nil {
+			return next(call)
+		}
+		at := time.Now()
+		err := next(call)
+		c.write(call, at, err)
+		return err
+	}
+}
+
+// ReadCapture reads the messages of a capture written by CaptureProtocol.
+func ReadCapture(rd io.Reader) ([]CapturedMessage, error) {
+	var messages []CapturedMessage
+	dec := gob.NewDecoder(rd)
+	for {
+		var record captureRecord
+		if err := dec.Decode(&record); err == io.EOF {
+			return messages, nil
+		} else if err != nil {
+			return messages, err
+		}
+
+		// The arguments are of the type the handler of the method takes.
+		handler, ok := reflect.TypeOf((*Replica)(nil)).MethodByName(record.Method)
+		if !ok {
+			return messages, fmt.Errorf("vrr: captured message of unknown method %q", record.Method)
+		}
+		args := reflect.New(handler.Type.In(1))
+		if err := gob.NewDecoder(bytes.NewReader(record.Args)).DecodeValue(args); err != nil {
+			return messages, fmt.Errorf("vrr: captured %s message: %v", record.Method, err)
+		}
+		messages = append(messages, CapturedMessage{
+			Time:     record.Time,
+			Method:   record.Method,
+			SenderID: record.SenderID,
+			Args:     args.Elem().Interface(),
+			Err:      record.Err,
+		})
+	}
+}
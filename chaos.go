@@ -0,0 +1,434 @@
+package vrr
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RunChaos is the acceptance run of the implementation: it drives an
+// EmbeddedGroup through a randomized schedule of mixed faults, partitions,
+// isolated primaries, lossy links and crashes, while clients keep submitting
+// operations, and checks the history of the group as it goes. The schedule
+// is drawn from ChaosOptions.Seed, so that a failing run is replayed with its
+// seed; the timing of the messages isn't, a replay reproduces the faults but
+// not always their interleaving with the protocol.
+//
+// The replicas run with StrictInvariants, so that a violation detected by a
+// replica panics, and the commits of all of them are checked against each
+// other: every replica commits the same operation at an opNum, an operation
+// is committed at a single opNum, and the committed order is linearizable,
+// an operation committed before another one was submitted has the lower
+// opNum. Once the schedule is over the links are healed, and the live
+// replicas must commit a last operation within ChaosOptions.Settle.
+//
+// A crashed replica doesn't come back, and at most FailureThreshold of them
+// crash, so that the live ones keep a quorum.
+
+// ChaosFault is a fault of the schedule of RunChaos.
+type ChaosFault int
+
+const (
+	// ChaosHeal restores every link of the live replicas.
+	ChaosHeal ChaosFault = iota
+
+	// ChaosPartition cuts a random minority of the replicas off the rest.
+	ChaosPartition
+
+	// ChaosIsolatePrimary cuts the current primary off the rest.
+	ChaosIsolatePrimary
+
+	// ChaosLossyLink makes a random link drop and delay its messages.
+	ChaosLossyLink
+
+	// ChaosCrash stops a random live replica.
+	ChaosCrash
+
+	numChaosFaults
+)
+
+func (f ChaosFault) String() string {
+	switch f {
+	case ChaosHeal:
+		return "Heal"
+	case ChaosPartition:
+		return "Partition"
+	case ChaosIsolatePrimary:
+		return "IsolatePrimary"
+	case ChaosLossyLink:
+		return "LossyLink"
+	case ChaosCrash:
+		return "Crash"
+	default:
+		panic("unreachable")
+	}
+}
+
+// ChaosOptions parameterizes RunChaos.
+type ChaosOptions struct {
+	// Seed draws the schedule of faults.
+	Seed int64
+
+	// Faults is how many faults the schedule has, each lasting Step.
+	Faults int
+	Step   time.Duration
+
+	// Clients is how many clients submit an operation per step.
+	Clients int
+
+	// Settle is how long the healed group has to commit the last operation.
+	// It outlasts a couple of view changes backed off as far as they go
+	// after the failed ones of the run, see Options.ViewChangeTimeout.
+	Settle time.Duration
+}
+
+// DefaultChaosOptions returns the options of a short run, of a few seconds.
+func DefaultChaosOptions() ChaosOptions {
+	return ChaosOptions{
+		Faults:  50,
+		Step:    20 * time.Millisecond,
+		Clients: 3,
+		Settle:  time.Minute,
+	}
+}
+
+// ChaosReport is the outcome of a RunChaos which found no violation.
+type ChaosReport struct {
+	Faults map[ChaosFault]int
+
+	// Accepted counts the operations accepted by a primary, Committed
+	// those committed, the others having been lost in view changes.
+	Accepted  int
+	Committed int
+}
+
+// chaosOp identifies an operation of a client of the run.
+type chaosOp struct {
+	clientID int
+	reqNum   int
+}
+
+// String is the operation as submitted, which tells its client and request
+// number apart from those of the other operations.
+func (op chaosOp) String() string {
+	return fmt.Sprintf("client %d request %d", op.clientID, op.reqNum)
+}
+
+// chaosChecker checks the commits of the replicas of a chaos run.
+type chaosChecker struct {
+	mu sync.Mutex
+
+	// ops are the operations committed, by opNum, and opNums the opNum of
+	// each.
+	ops    map[int]chaosOp
+	opNums map[chaosOp]int
+
+	// submitted is when each operation was first submitted, committed
+	// when a replica first committed it.
+	submitted map[chaosOp]time.Time
+	committed map[chaosOp]time.Time
+
+	// lastOpNums is the opNum of the latest commit of each replica.
+	lastOpNums map[int]int
+
+	err error
+}
+
+func (c *chaosChecker) fail(format string, args ...interface{}) {
+	if c.err == nil {
+		c.err = fmt.Errorf(format, args...)
+	}
+}
+
+// check records the commit of the replica, failing on the first one which
+// contradicts the history.
+func (c *chaosChecker) check(commit EmbeddedCommit) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	req := commit.ClientReq
+	op := chaosOp{clientID: req.clientID, reqNum: req.reqNum}
+	if req.reqOp != op.String() {
+		c.fail("replica %d committed opNum=%d with the operation %v of client %d request %d", commit.ReplicaID, commit.OpNum, req.reqOp, req.clientID, req.reqNum)
+		return
+	}
+	if other, ok := c.ops[commit.OpNum]; ok && other != op {
+		c.fail("replica %d committed %+v at opNum=%d, another one committed %+v", commit.ReplicaID, op, commit.OpNum, other)
+		return
+	}
+	if opNum, ok := c.opNums[op]; ok && opNum != commit.OpNum {
+		c.fail("replica %d committed %+v at opNum=%d, it was committed at opNum=%d", commit.ReplicaID, op, commit.OpNum, opNum)
+		return
+	}
+	c.ops[commit.OpNum] = op
+	c.opNums[op] = commit.OpNum
+	if _, ok := c.committed[op]; !ok {
+		c.committed[op] = time.Now()
+	}
+	if commit.OpNum > c.lastOpNums[commit.ReplicaID] {
+		c.lastOpNums[commit.ReplicaID] = commit.OpNum
+	}
+}
+
+// checkLinearizable fails if an operation was committed, and its client
+// could have seen it, before an operation with a lower opNum was submitted.
+// Expects c.mu to be locked.
+func (c *chaosChecker) checkLinearizable() {
+	opNums := make([]int, 0, len(c.ops))
+	for opNum := range c.ops {
+		opNums = append(opNums, opNum)
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(opNums)))
+
+	// From the highest opNum down, the earliest commit of the operations
+	// following each one.
+	var earliest time.Time
+	var earliestOp chaosOp
+	for _, opNum := range opNums {
+		op := c.ops[opNum]
+		if !earliest.IsZero() && earliest.Before(c.submitted[op]) {
+			c.fail("%+v at opNum=%d was submitted after %+v at opNum=%d was committed", op, opNum, earliestOp, c.opNums[earliestOp])
+			return
+		}
+		if committed := c.committed[op]; earliest.IsZero() || committed.Before(earliest) {
+			earliest, earliestOp = committed, op
+		}
+	}
+}
+
+// chaosRun is the state of a RunChaos.
+type chaosRun struct {
+	g       *EmbeddedGroup
+	rand    *rand.Rand
+	checker *chaosChecker
+	report  ChaosReport
+
+	crashed map[int]bool
+	reqNums map[int]int
+}
+
+// RunChaos runs the schedule of faults on a group of n replicas with the
+// options, and returns the first violation of the history it finds.
+func RunChaos(n int, opts Options, chaos ChaosOptions) (ChaosReport, error) {
+	opts.InvariantMode = StrictInvariants
+	g, err := NewEmbeddedGroup(n, opts)
+	if err != nil {
+		return ChaosReport{}, err
+	}
+	defer g.Shutdown()
+
+	run := &chaosRun{
+		g:    g,
+		rand: rand.New(rand.NewSource(chaos.Seed)),
+		checker: &chaosChecker{
+			ops:        make(map[int]chaosOp),
+			opNums:     make(map[chaosOp]int),
+			submitted:  make(map[chaosOp]time.Time),
+			committed:  make(map[chaosOp]time.Time),
+			lastOpNums: make(map[int]int),
+		},
+		report:  ChaosReport{Faults: make(map[ChaosFault]int)},
+		crashed: make(map[int]bool),
+		reqNums: make(map[int]int),
+	}
+	go func() {
+		for {
+			select {
+			case commit := <-g.Commits():
+				run.checker.check(commit)
+			case <-g.quit:
+				return
+			}
+		}
+	}()
+
+	maxCrashed := opts.FailureThreshold
+	if maxCrashed == 0 {
+		maxCrashed = derivedFailureThreshold(n)
+	}
+	for i := 0; i < chaos.Faults; i++ {
+		fault := ChaosFault(run.rand.Intn(int(numChaosFaults)))
+		if fault == ChaosCrash && len(run.crashed) >= maxCrashed {
+			fault = ChaosHeal
+		}
+		run.inject(fault)
+		run.report.Faults[fault]++
+		for clientID := 1; clientID <= chaos.Clients; clientID++ {
+			run.submit(clientID)
+		}
+		time.Sleep(chaos.Step)
+
+		run.checker.mu.Lock()
+		err := run.checker.err
+		run.checker.mu.Unlock()
+		if err != nil {
+			return run.report, fmt.Errorf("seed %d, fault %d: %w", chaos.Seed, i, err)
+		}
+	}
+
+	run.inject(ChaosHeal)
+	if err := run.settle(chaos.Settle); err != nil {
+		return run.report, fmt.Errorf("seed %d: %w", chaos.Seed, err)
+	}
+
+	run.checker.mu.Lock()
+	defer run.checker.mu.Unlock()
+	run.checker.checkLinearizable()
+	run.report.Committed = len(run.checker.ops)
+	if run.checker.err != nil {
+		return run.report, fmt.Errorf("seed %d: %w", chaos.Seed, run.checker.err)
+	}
+	return run.report, nil
+}
+
+// chaosCut is the profile of a cut link.
+var chaosCut = LinkProfile{Name: "chaos-cut", Loss: 1}
+
+// inject applies the fault to the group.
+func (run *chaosRun) inject(fault ChaosFault) {
+	servers := run.g.servers
+	n := len(servers)
+	cut := func(a, b int) {
+		servers[a].SetLinkProfile(b, chaosCut)
+		servers[b].SetLinkProfile(a, chaosCut)
+	}
+	isolate := func(ID int) {
+		for j := 0; j < n; j++ {
+			if j != ID {
+				cut(ID, j)
+			}
+		}
+	}
+
+	switch fault {
+	case ChaosHeal:
+		for i := 0; i < n; i++ {
+			for j := 0; j < n; j++ {
+				if i != j {
+					servers[i].ClearLinkProfile(j)
+				}
+			}
+		}
+	case ChaosPartition:
+		minority := run.rand.Perm(n)[:1+run.rand.Intn((n-1)/2)]
+		inMinority := make(map[int]bool)
+		for _, ID := range minority {
+			inMinority[ID] = true
+		}
+		for i := 0; i < n; i++ {
+			for j := i + 1; j < n; j++ {
+				if inMinority[i] != inMinority[j] {
+					cut(i, j)
+				}
+			}
+		}
+	case ChaosIsolatePrimary:
+		for i := 0; i < n; i++ {
+			if _, _, isPrimary, status := run.g.Replica(i).Report(); isPrimary && status == Normal {
+				isolate(i)
+			}
+		}
+	case ChaosLossyLink:
+		from := run.rand.Intn(n)
+		to := (from + 1 + run.rand.Intn(n-1)) % n
+		servers[from].SetLinkProfile(to, LinkProfile{Name: "chaos-lossy", Latency: time.Millisecond, Jitter: 5 * time.Millisecond, Loss: 0.3})
+	case ChaosCrash:
+		var live []int
+		for i := 0; i < n; i++ {
+			if !run.crashed[i] {
+				live = append(live, i)
+			}
+		}
+		ID := live[run.rand.Intn(len(live))]
+		run.crashed[ID] = true
+		run.g.Replica(ID).Stop()
+	default:
+		panic("unreachable")
+	}
+}
+
+// submit submits the next operation of the client to the primary, or
+// submits its previous one again if no primary accepted it yet.
+func (run *chaosRun) submit(clientID int) bool {
+	reqNum := run.reqNums[clientID] + 1
+	op := chaosOp{clientID: clientID, reqNum: reqNum}
+	run.checker.mu.Lock()
+	if _, ok := run.checker.submitted[op]; !ok {
+		run.checker.submitted[op] = time.Now()
+	}
+	run.checker.mu.Unlock()
+
+	req := clientRequest{namespace: DefaultNamespace, clientID: clientID, reqNum: reqNum, reqOp: op.String()}
+	for i := range run.g.servers {
+		if run.crashed[i] {
+			continue
+		}
+		if err := run.g.Replica(i).Submit(req); err == nil {
+			run.reqNums[clientID] = reqNum
+			run.report.Accepted++
+			return true
+		}
+	}
+	return false
+}
+
+// settle submits a last operation to the healed group until every live
+// replica committed it, or the timeout expires.
+func (run *chaosRun) settle(timeout time.Duration) error {
+	const clientID = 0
+	deadline := time.Now().Add(timeout)
+	for !run.submit(clientID) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no primary accepted an operation %v after healing; %s", timeout, run.states())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	last := chaosOp{clientID: clientID, reqNum: run.reqNums[clientID]}
+
+	for time.Now().Before(deadline) {
+		run.checker.mu.Lock()
+		opNum, committed := run.checker.opNums[last]
+		caughtUp := committed
+		for i := range run.g.servers {
+			if !run.crashed[i] && run.checker.lastOpNums[i] < opNum {
+				caughtUp = false
+			}
+		}
+		err := run.checker.err
+		run.checker.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if caughtUp {
+			return nil
+		}
+		if !committed {
+			// The operation may have been lost in a view change.
+			req := clientRequest{namespace: DefaultNamespace, clientID: clientID, reqNum: last.reqNum, reqOp: last.String()}
+			for i := range run.g.servers {
+				if !run.crashed[i] {
+					run.g.Replica(i).Submit(req)
+				}
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return fmt.Errorf("live replicas didn't commit %+v within %v after healing; %s", last, timeout, run.states())
+}
+
+// states describes the live replicas, for the errors of settle.
+func (run *chaosRun) states() string {
+	var states []string
+	for i := range run.g.servers {
+		if run.crashed[i] {
+			continue
+		}
+		r := run.g.Replica(i)
+		_, viewNum, _, status := r.Report()
+		states = append(states, fmt.Sprintf("%d: view %d %v commitNum=%d", i, viewNum, status, r.CommitNum()))
+	}
+	return strings.Join(states, ", ")
+}
@@ -0,0 +1,60 @@
+package vrr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// A disk flipping a bit of an operation, or a buggy storage, makes a replica
+// replay garbage it then commits and serves, unnoticed as long as it still
+// decodes. So every entry of the opLog is stored with a CRC of it, see
+// StoredEntry.CRC, checked when the replica restores its state, and the
+// entries of a <NEW-STATE> are sent with theirs, see NewStateArgs.Checksums.
+// A replica finding a corrupt entry doesn't replay, commit nor serve it or
+// the ones after it: it recovers its state from the others instead, see
+// StartRecovery, as if it had lost it, and reports the corruption on Errors.
+//
+// The CRC covers the operation through its type and its JSON encoding,
+// which, unlike gob, doesn't depend on the types the process encoded before,
+// so it is the same once the replica restarted. An entry stored before the
+// CRCs, which is zero, isn't checked.
+
+// errCorruptLog is returned by restore when the stored opLog holds a corrupt
+// entry.
+var errCorruptLog = errors.New("vrr: corrupt entry in the stored opLog")
+
+// checksum returns the CRC of the entry.
+func (e opLogEntry) checksum() uint32 {
+	crc := crc32.NewIEEE()
+	fmt.Fprintf(crc, "%d %d %q %d %d %T ", e.opID, e.viewNum, e.namespace, e.clientID, e.reqNum, e.operation)
+	// An operation JSON can't encode is only covered by its type.
+	if data, err := json.Marshal(e.operation); err == nil {
+		crc.Write(data)
+	}
+	return crc.Sum32()
+}
+
+// checksums returns the CRCs of the entries.
+func checksums(entries []opLogEntry) []uint32 {
+	crcs := make([]uint32, len(entries))
+	for i, e := range entries {
+		crcs[i] = e.checksum()
+	}
+	return crcs
+}
+
+// firstCorrupt returns the index of the first of the entries not matching
+// its CRC, or -1. Entries sent without CRCs aren't checked.
+func firstCorrupt(entries []opLogEntry, crcs []uint32) int {
+	if len(crcs) != len(entries) {
+		return -1
+	}
+	for i, e := range entries {
+		if crcs[i] != 0 && crcs[i] != e.checksum() {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,501 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeqToken is the sequencing token of a client: it identifies the most recent
+// request of the client accepted by a primary, and where it sits in the opLog.
+// The primary only accepts the next request of the client along with the
+// token of the previous one, which makes the client's requests applied in
+// submission order even across failovers.
+type SeqToken struct {
+	ReqNum  int
+	ViewNum int
+	OpNum   int
+}
+
+// verifySeqToken checks that req directly follows the request identified by
+// the token, and that this request is in the primary's opLog.
+// Expects r.mu to be locked.
+func (r *Replica) verifySeqToken(t *tenant, req clientRequest, token SeqToken) error {
+	if req.reqNum != token.ReqNum+1 {
+		return ErrOutOfOrder
+	}
+
+	// First request of the client.
+	if token.ReqNum == 0 {
+		if _, ok := t.clientTable[req.clientID]; ok {
+			return ErrOutOfOrder
+		}
+		return nil
+	}
+
+	// The previous request may have been lost by a view change if it never
+	// got committed; the client must find out instead of silently skipping it.
+	if token.OpNum < 1 || token.OpNum > r.opNum {
+		return ErrSequenceBroken
+	}
+	// The previous request was committed if it is in the snapshot.
+	if token.OpNum <= r.logStart {
+		if entry := t.clientTable[req.clientID]; entry.reqNum != token.ReqNum || !entry.committed {
+			return ErrSequenceBroken
+		}
+		return nil
+	}
+	previous := r.logEntry(token.OpNum)
+	if previous.namespace != req.namespace || previous.clientID != req.clientID || previous.reqNum != token.ReqNum {
+		return ErrSequenceBroken
+	}
+	return nil
+}
+
+// duplicateToken returns the token of the most recent request of the client,
+// which is being submitted again because the reply accepting it was lost.
+// It's the zero token when the request isn't in the opLog anymore.
+// Expects r.mu to be locked.
+func (r *Replica) duplicateToken(req clientRequest) SeqToken {
+	for i := len(r.opLog) - 1; i >= 0; i-- {
+		e := r.opLog[i]
+		if e.namespace == req.namespace && e.clientID == req.clientID && e.reqNum == req.reqNum {
+			return SeqToken{ReqNum: req.reqNum, ViewNum: e.viewNum, OpNum: r.logStart + i + 1}
+		}
+	}
+	return SeqToken{}
+}
+
+type RequestArgs struct {
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Op        interface{}
+	Token     SeqToken
+
+	// Annotations are handed to the submit middlewares of the primary,
+	// e.g. credentials; they aren't replicated.
+	Annotations map[string]string
+	// RepliesFrom asks the primary answering the request as a duplicate
+	// for the responses to the earlier requests of the client from this
+	// reqNum on, see Client.Results.
+	RepliesFrom int
+}
+
+type RequestReply struct {
+	IsReplied bool
+	PrimaryID int
+	ViewNum   int
+	Token     SeqToken
+
+	// Err is the message of the error rejecting the request, if any.
+	Err string
+
+	// When the request is a duplicate of the most recent one of the client,
+	// whether it is committed, and the response of the state machine once
+	// recorded, see Replica.Reply.
+	Committed bool
+	Replied   bool
+	Resp      interface{}
+
+	// Replies are the responses to the earlier requests asked for by
+	// RepliesFrom which the primary still holds.
+	Replies []ClientReply
+}
+
+// Request is the client protocol entry point of the primary.
+func (r *Replica) Request(args RequestArgs, reply *RequestReply) error {
+	req := clientRequest{
+		namespace: args.Namespace,
+		clientID:  args.ClientID,
+		reqNum:    args.ReqNum,
+		reqOp:     args.Op,
+	}
+	token, err := r.submit(req, args.Annotations, &args.Token)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	reply.IsReplied = true
+	reply.PrimaryID = r.primaryID
+	reply.ViewNum = r.viewNum
+	reply.Token = token
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	if errors.Is(err, ErrDuplicateRequest) {
+		if t, ok := r.tenants[args.Namespace]; ok {
+			if entry := t.clientTable[args.ClientID]; entry.reqNum == args.ReqNum {
+				reply.Committed = entry.committed
+				reply.Replied = entry.replied
+				reply.Resp = entry.resp
+				if args.RepliesFrom > 0 && entry.replied {
+					reply.Replies = t.repliesBetween(args.ClientID, args.RepliesFrom, args.ReqNum)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Reply records resp as the response of the state machine to the committed
+// operation of the entry, for the primary to send it to the client resending
+// the request. Only the response to the most recent request of each client
+// is kept, so it must be called before the next entry of the client is
+// applied. Every replica should record them, to serve them once primary.
+// With Options.StateMachine, the responses of Apply are recorded instead.
+func (r *Replica) Reply(entry CommitEntry, resp interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.recordResponse(entry.ClientReq, resp)
+}
+
+// recordResponse is Reply. Expects r.mu to be locked.
+func (r *Replica) recordResponse(req clientRequest, resp interface{}) {
+	t := r.tenantFor(req.namespace)
+	t.recordReply(req.clientID, req.reqNum, resp)
+	if e, ok := t.clientTable[req.clientID]; ok && e.reqNum == req.reqNum {
+		e.resp = resp
+		e.replied = true
+		t.clientTable[req.clientID] = e
+	}
+}
+
+// requestErrors maps the messages of the errors replied through RPC
+// back to the exported errors.
+var requestErrors = map[string]error{}
+
+func init() {
+	for _, err := range []error{
+		ErrNotPrimary, ErrNotNormal, ErrDuplicateRequest, ErrRateLimited,
+		ErrOverloaded, ErrOutOfOrder, ErrSequenceBroken, ErrReplicaStopped,
+		ErrViewStampSuperseded,
+	} {
+		requestErrors[err.Error()] = err
+	}
+}
+
+func requestError(msg string) error {
+	if err, ok := requestErrors[msg]; ok {
+		return err
+	}
+	if strings.HasPrefix(msg, ErrInvalidOperation.Error()) {
+		return fmt.Errorf("%w%s", ErrInvalidOperation, strings.TrimPrefix(msg, ErrInvalidOperation.Error()))
+	}
+	return errors.New(msg)
+}
+
+// Client submits the operations of a single client to the replication group,
+// following the primary across view changes and enforcing with sequencing
+// tokens that its operations are applied in the order they are submitted.
+type Client struct {
+	mu sync.Mutex
+
+	ID        int
+	namespace string
+
+	addresses map[int]string
+	peers     map[int]*rpc.Client
+	primaryID int
+
+	token       SeqToken
+	annotations map[string]string
+
+	// last is the most recent accepted request, resent by Result, and
+	// collected the latest request whose response Results returned.
+	last      RequestArgs
+	collected int
+
+	metrics        ClientMetrics
+	attemptLatency durationWindow
+}
+
+// ClientMetrics is a snapshot of the counters kept by a Client, to tell from
+// the application side where the time of slow requests goes.
+type ClientMetrics struct {
+	// Requests counts the requests sent to the replicas, every attempt
+	// included, and Retries the attempts after the first one of a call.
+	Requests uint64
+	Retries  uint64
+
+	// Failovers counts the times the client moved to another replica it
+	// believes is the primary, PrimaryID being the current one.
+	Failovers uint64
+	PrimaryID int
+
+	// Resyncs counts the times the client found the primary out of sync
+	// with its session: a request accepted but whose reply got lost, or one
+	// submitted again by Result because a view change lost it.
+	Resyncs uint64
+
+	// Latency of the attempts, replied or not, over the most recent ones.
+	AttemptLatencyP50 time.Duration
+	AttemptLatencyP99 time.Duration
+}
+
+// NewClient returns a client with the given ID for the replicas at the
+// addresses, keyed by replica ID.
+func NewClient(ID int, namespace string, addresses map[int]string) (*Client, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("a client needs the address of at least one replica")
+	}
+	return &Client{
+		ID:        ID,
+		namespace: namespace,
+		addresses: addresses,
+		peers:     make(map[int]*rpc.Client),
+	}, nil
+}
+
+// clientRetryInterval is how long the client waits before retrying
+// when no replica could accept its request.
+const clientRetryInterval = 50 * time.Millisecond
+
+// Submit submits the operation and returns its sequencing token once a
+// primary accepted it, trying at most attempts times. Requests are strictly
+// sequential: Submit must not be called again before the previous call returned.
+func (c *Client) Submit(op interface{}, attempts int) (SeqToken, error) {
+	if attempts <= 0 {
+		return SeqToken{}, fmt.Errorf("attempts must be positive, got %d", attempts)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The request number always follows the token, so a request which
+	// isn't accepted doesn't leave a hole in the sequence of the client.
+	args := RequestArgs{
+		Namespace: c.namespace,
+		ClientID:  c.ID,
+		ReqNum:    c.token.ReqNum + 1,
+		Op:        op,
+		Token:     c.token,
+
+		Annotations: c.annotations,
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		var reply RequestReply
+		err := c.attempt(attempt, args, &reply)
+		if err != nil {
+			lastErr = err
+			c.followPrimary(c.nextReplica(c.primaryID))
+			time.Sleep(clientRetryInterval)
+			continue
+		}
+
+		if reply.Err == "" {
+			c.token = reply.Token
+			c.last = args
+			return reply.Token, nil
+		}
+
+		lastErr = requestError(reply.Err)
+		switch {
+		case errors.Is(lastErr, ErrNotPrimary):
+			if reply.PrimaryID == c.primaryID {
+				c.followPrimary(c.nextReplica(c.primaryID))
+			} else {
+				c.followPrimary(reply.PrimaryID)
+			}
+		case errors.Is(lastErr, ErrNotNormal), errors.Is(lastErr, ErrOverloaded), errors.Is(lastErr, ErrRateLimited):
+			time.Sleep(clientRetryInterval)
+		case errors.Is(lastErr, ErrDuplicateRequest) && reply.Token.ReqNum == args.ReqNum:
+			// A previous attempt was accepted but its reply got lost.
+			c.metrics.Resyncs++
+			c.token = reply.Token
+			c.last = args
+			return reply.Token, nil
+		default:
+			// Retrying wouldn't change the outcome.
+			return SeqToken{}, lastErr
+		}
+	}
+	return SeqToken{}, fmt.Errorf("request %d not accepted after %d attempts: %w", args.ReqNum, attempts, lastErr)
+}
+
+// Result returns the response of the state machine to the most recent
+// accepted request, once committed and recorded by Replica.Reply, or the
+// ApplyError of the state machine failing to apply it. It resends
+// the request, trying at most attempts times: the primary answers it as a
+// duplicate with the response, or accepts it again if a view change lost it.
+func (c *Client) Result(attempts int) (interface{}, error) {
+	if attempts <= 0 {
+		return nil, fmt.Errorf("attempts must be positive, got %d", attempts)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last.ReqNum == 0 {
+		return nil, errors.New("no request accepted yet")
+	}
+	reply, err := c.resend(c.last, attempts)
+	if err != nil {
+		return nil, err
+	}
+	if applyErr, ok := reply.Resp.(ApplyError); ok {
+		return nil, applyErr
+	}
+	return reply.Resp, nil
+}
+
+// resend sends the most recent accepted request again until the primary
+// answers it as a duplicate with its response, and returns that reply.
+// Expects c.mu to be locked.
+func (c *Client) resend(args RequestArgs, attempts int) (RequestReply, error) {
+	var lastErr error
+	for attempt := 0; attempt < attempts; attempt++ {
+		var reply RequestReply
+		err := c.attempt(attempt, args, &reply)
+		if err != nil {
+			lastErr = err
+			c.followPrimary(c.nextReplica(c.primaryID))
+			time.Sleep(clientRetryInterval)
+			continue
+		}
+
+		if reply.Err == "" {
+			c.metrics.Resyncs++
+			c.token = reply.Token
+			lastErr = fmt.Errorf("request %d submitted again", args.ReqNum)
+			time.Sleep(clientRetryInterval)
+			continue
+		}
+
+		lastErr = requestError(reply.Err)
+		switch {
+		case errors.Is(lastErr, ErrDuplicateRequest) && reply.Replied:
+			return reply, nil
+		case errors.Is(lastErr, ErrDuplicateRequest):
+			lastErr = fmt.Errorf("request %d has no response yet", args.ReqNum)
+			time.Sleep(clientRetryInterval)
+		case errors.Is(lastErr, ErrNotPrimary):
+			if reply.PrimaryID == c.primaryID {
+				c.followPrimary(c.nextReplica(c.primaryID))
+			} else {
+				c.followPrimary(reply.PrimaryID)
+			}
+		case errors.Is(lastErr, ErrNotNormal), errors.Is(lastErr, ErrOverloaded), errors.Is(lastErr, ErrRateLimited):
+			time.Sleep(clientRetryInterval)
+		default:
+			return RequestReply{}, lastErr
+		}
+	}
+	return RequestReply{}, fmt.Errorf("no response to request %d after %d attempts: %w", args.ReqNum, attempts, lastErr)
+}
+
+// Annotate sets an annotation sent along with all the following requests,
+// for the submit middlewares of the primary.
+func (c *Client) Annotate(key, value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.annotations == nil {
+		c.annotations = make(map[string]string)
+	}
+	c.annotations[key] = value
+}
+
+// Token returns the sequencing token of the most recent accepted request.
+func (c *Client) Token() SeqToken {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.token
+}
+
+// Metrics returns a snapshot of the counters of the client.
+func (c *Client) Metrics() ClientMetrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := c.metrics
+	m.PrimaryID = c.primaryID
+	m.AttemptLatencyP50 = c.attemptLatency.percentile(50)
+	m.AttemptLatencyP99 = c.attemptLatency.percentile(99)
+	return m
+}
+
+// Close closes the connections to the replicas.
+func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, peer := range c.peers {
+		peer.Close()
+		delete(c.peers, id)
+	}
+}
+
+// peer returns the connection to the replica, dialing it if needed.
+// Expects c.mu to be locked.
+func (c *Client) peer(replicaID int) (*rpc.Client, error) {
+	if peer, ok := c.peers[replicaID]; ok {
+		return peer, nil
+	}
+	addr, ok := c.addresses[replicaID]
+	if !ok {
+		return nil, fmt.Errorf("no address for replica %d", replicaID)
+	}
+	peer, err := rpc.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c.peers[replicaID] = peer
+	return peer, nil
+}
+
+// call sends the request to the replica, dialing it if needed.
+// Expects c.mu to be locked.
+func (c *Client) call(replicaID int, args RequestArgs, reply *RequestReply) error {
+	peer, err := c.peer(replicaID)
+	if err != nil {
+		return err
+	}
+
+	err = peer.Call("Replica.Request", args, reply)
+	if err == rpc.ErrShutdown {
+		peer.Close()
+		delete(c.peers, replicaID)
+	}
+	return err
+}
+
+// attempt sends the request to the replica believed to be the primary, as
+// the given attempt of a call, and records it in the metrics.
+// Expects c.mu to be locked.
+func (c *Client) attempt(attempt int, args RequestArgs, reply *RequestReply) error {
+	c.metrics.Requests++
+	if attempt > 0 {
+		c.metrics.Retries++
+	}
+	start := time.Now()
+	err := c.call(c.primaryID, args, reply)
+	c.attemptLatency.add(time.Since(start))
+	return err
+}
+
+// followPrimary makes the replica the one the requests are sent to.
+// Expects c.mu to be locked.
+func (c *Client) followPrimary(replicaID int) {
+	if replicaID != c.primaryID {
+		c.metrics.Failovers++
+		c.primaryID = replicaID
+	}
+}
+
+// nextReplica returns the ID following replicaID among the known replicas.
+func (c *Client) nextReplica(replicaID int) int {
+	ids := make([]int, 0, len(c.addresses))
+	for id := range c.addresses {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		if id > replicaID {
+			return id
+		}
+	}
+	return ids[0]
+}
@@ -0,0 +1,85 @@
+package vrr
+
+// The clientTable deduplicates the requests of the clients, and answers a
+// retried one with the response of its first execution. A replica rebuilds
+// it from the opLog of a new view, see rebuildClientTables, but the
+// responses are only known to the replicas which applied the requests, or
+// were told them with Reply. So that exactly-once survives a view change,
+// the replicas send the responses they know with <DO-VIEW-CHANGE>, and the
+// new primary sends the ones it gathered, its own included, with
+// <START-VIEW>.
+
+// clientResponse is the response to the latest request of a client, as
+// recorded in the clientTable of a replica.
+type clientResponse struct {
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Resp      interface{}
+}
+
+// clientResponses returns the responses recorded in the clientTables.
+// Expects r.mu to be locked.
+func (r *Replica) clientResponses() []clientResponse {
+	var responses []clientResponse
+	for namespace, t := range r.tenants {
+		for clientID, e := range t.clientTable {
+			if !e.replied {
+				continue
+			}
+			responses = append(responses, clientResponse{
+				Namespace: namespace,
+				ClientID:  clientID,
+				ReqNum:    e.reqNum,
+				Resp:      e.resp,
+			})
+		}
+	}
+	return responses
+}
+
+// rebuildClientTables rebuilds the clientTables from the opLog the replica
+// just installed, forgetting the requests the view change dropped; the
+// committed requests are kept, since those before the opLog are only known
+// from the clientTables. The responses of the latest requests are kept, or
+// taken from the ones sent by the other replicas. Expects r.mu to be locked.
+func (r *Replica) rebuildClientTables(responses []clientResponse) {
+	old := make(map[string]map[int]clientTableEntry, len(r.tenants))
+	for namespace, t := range r.tenants {
+		old[namespace] = t.clientTable
+		t.clientTable = make(map[int]clientTableEntry)
+		for clientID, entry := range old[namespace] {
+			if entry.committed {
+				t.clientTable[clientID] = entry
+			}
+		}
+	}
+	for i, e := range r.opLog {
+		r.tenantFor(e.namespace).clientTable[e.clientID] = clientTableEntry{
+			reqNum:    e.reqNum,
+			reqOp:     e.operation,
+			committed: r.logStart+i < r.commitNum,
+		}
+	}
+
+	for namespace, t := range r.tenants {
+		for clientID, entry := range t.clientTable {
+			if prev, ok := old[namespace][clientID]; ok && prev.reqNum == entry.reqNum && prev.replied {
+				entry.resp = prev.resp
+				entry.replied = true
+				t.clientTable[clientID] = entry
+			}
+		}
+	}
+	for _, resp := range responses {
+		t, ok := r.tenants[resp.Namespace]
+		if !ok {
+			continue
+		}
+		if entry, ok := t.clientTable[resp.ClientID]; ok && entry.reqNum == resp.ReqNum && !entry.replied {
+			entry.resp = resp.Resp
+			entry.replied = true
+			t.clientTable[resp.ClientID] = entry
+		}
+	}
+}
@@ -0,0 +1,172 @@
+// Command vrrd runs a single VRR replica described by a YAML configuration
+// file, see vrr.Config for its format.
+//
+//	vrrd -config replica0.yaml
+//
+// With -events, it instead prints the events persisted in the data directory
+// by the replica, e.g. to find out what it was doing before it crashed.
+//
+// With -force-new-cluster, the replica seeds a new cluster with the state a
+// surviving replica of a lost cluster exported, see vrr.ForceNewCluster:
+//
+//	vrrd -config replica0.yaml -force-new-cluster survivor.vrrx -reason "lost 2 of 3 replicas"
+//
+// With -from-raft-wal, it instead converts the WAL and snapshots of a member
+// of an etcd raft cluster into such a file, see vrr.ReadRaftWAL, which then
+// seeds the new cluster:
+//
+//	vrrd -from-raft-wal member/wal -raft-snap member/snap -export raft.vrrx
+//
+// On SIGUSR1, the replica captures the protocol messages it handles during the
+// next -capture duration in a capture-<time>.vrrc file of its data directory,
+// or of the working directory without one, see vrr.CaptureProtocol.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	vrr "github.com/joshuabezaleel/test-vrr"
+)
+
+// peerDialInterval is how long vrrd waits before dialing again a peer
+// which isn't up yet.
+const peerDialInterval = time.Second
+
+func main() {
+	configPath := flag.String("config", "vrr.yaml", "path to the replica's configuration file")
+	printEvents := flag.Bool("events", false, "print the event log of the data directory and exit")
+	forceFrom := flag.String("force-new-cluster", "", "seed a new cluster with the state exported to this file")
+	forceReason := flag.String("reason", "", "why a new cluster is forced, for the audit")
+	captureFor := flag.Duration("capture", 30*time.Second, "how long SIGUSR1 captures the protocol messages for")
+	raftWAL := flag.String("from-raft-wal", "", "convert the etcd raft WAL of this directory to -export and exit")
+	raftSnap := flag.String("raft-snap", "", "directory of the snapshots of the etcd raft WAL")
+	exportPath := flag.String("export", "raft.vrrx", "file the converted etcd raft WAL is exported to")
+	flag.Parse()
+
+	if *raftWAL != "" {
+		if err := convertRaftWAL(*raftWAL, *raftSnap, *exportPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	config, err := vrr.LoadConfig(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *printEvents {
+		if config.DataDir == "" {
+			log.Fatal("data_dir: required to read the event log")
+		}
+		events, err := vrr.ReadEventLog(config.DataDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, e := range events {
+			fmt.Printf("%s [%d] %v (%v): %s\n", e.Time.Format(time.RFC3339Nano), e.ReplicaID, e.Kind, e.Severity, e.Message)
+		}
+		return
+	}
+
+	ready := make(chan interface{})
+	commitChan := make(chan vrr.CommitEntry)
+	server := vrr.NewServer(ready, commitChan)
+	server.ServeOn(config.Listen)
+
+	if err := server.Configure(config.ID, config.Peers, config.Options()); err != nil {
+		log.Fatal(err)
+	}
+	if *forceFrom != "" {
+		if err := forceNewCluster(server.Replica(), *forceFrom, *forceReason); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for peerID, addr := range config.Peers {
+		go connectToPeer(server, peerID, addr)
+	}
+	close(ready)
+
+	if config.Gateway.Listen != "" {
+		// The gateways of the group share the key of their sessions.
+		gateway := vrr.NewGateway(server.Replica(), config.Gateway.Peers, time.Minute, []byte(os.Getenv("VRR_GATEWAY_SESSION_KEY")))
+		go func() {
+			log.Fatal(gateway.ListenAndServe(config.Gateway.Listen))
+		}()
+	}
+
+	go captureOnSignal(server.Replica(), config.DataDir, *captureFor)
+
+	for entry := range commitChan {
+		log.Printf("committed %+v", entry)
+	}
+}
+
+// forceNewCluster seeds the replica with the state exported to path.
+func forceNewCluster(replica *vrr.Replica, path string, reason string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return replica.ForceNewCluster(f, reason)
+}
+
+// convertRaftWAL exports the state of the etcd raft WAL to path.
+func convertRaftWAL(walDir, snapDir, path string) error {
+	state, report, err := vrr.ReadRaftWAL(walDir, snapDir)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := vrr.WriteExport(f, state); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	log.Printf("exported %d entries after the snapshot at index %d to %s; %+v", report.Entries, report.SnapshotIndex, path, report)
+	return nil
+}
+
+// connectToPeer dials the peer until it is up.
+func connectToPeer(server *vrr.Server, peerID int, addr string) {
+	for {
+		tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+		if err == nil {
+			err = server.ConnectToPeer(peerID, tcpAddr)
+		}
+		if err == nil {
+			log.Printf("connected to replica %d at %s", peerID, addr)
+			return
+		}
+		log.Printf("failed connecting to replica %d at %s; err = %v", peerID, addr, err)
+		time.Sleep(peerDialInterval)
+	}
+}
+
+// captureOnSignal starts a capture of the protocol messages of the replica on
+// every SIGUSR1.
+func captureOnSignal(replica *vrr.Replica, dir string, d time.Duration) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	for range signals {
+		path := filepath.Join(dir, fmt.Sprintf("capture-%d.vrrc", time.Now().Unix()))
+		if err := replica.CaptureProtocol(path, d); err != nil {
+			log.Printf("failed starting the capture; err = %v", err)
+			continue
+		}
+		log.Printf("capturing the protocol messages in %s for %v", path, d)
+	}
+}
@@ -0,0 +1,86 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A chatty client submits its requests one after the other without waiting
+// for their responses, since Submit returns once a request is accepted, and
+// many of them commit in the same batch. Reading their responses one by one
+// would take a round trip each, and the clientTable only holds the response
+// to the latest request anyway. So every replica also keeps the responses of
+// the latest requests of each client, as it applies them, and the primary
+// coalesces them into the reply to a single resent request, see
+// Client.Results: the responses from RequestArgs.RepliesFrom on ride along
+// with the one of the latest request.
+//
+// Those responses are only kept by the replicas which applied the requests,
+// and only the latest ones of the client, see coalescedReplies; unlike the
+// response of the latest request, they aren't sent along a view change. A
+// client which collects them too late, or from a primary which got its state
+// from another replica, misses some, and tells by their ReqNums.
+
+// coalescedReplies is how many responses a replica keeps for each client.
+const coalescedReplies = 64
+
+// ClientReply is the response of the state machine to a request of a client.
+type ClientReply struct {
+	ReqNum int
+	Resp   interface{}
+}
+
+// recordReply keeps the response to the request of the client, forgetting
+// the oldest ones beyond coalescedReplies. A request applied again, e.g.
+// once recovered, replaces the responses from it on.
+func (t *tenant) recordReply(clientID int, reqNum int, resp interface{}) {
+	if t.replies == nil {
+		t.replies = make(map[int][]ClientReply)
+	}
+	replies := t.replies[clientID]
+	for len(replies) > 0 && replies[len(replies)-1].ReqNum >= reqNum {
+		replies = replies[:len(replies)-1]
+	}
+	if len(replies) == coalescedReplies {
+		replies = append(replies[:0:0], replies[1:]...)
+	}
+	t.replies[clientID] = append(replies, ClientReply{ReqNum: reqNum, Resp: resp})
+}
+
+// repliesBetween returns the responses kept for the requests of the client
+// from reqNum from to reqNum to, excluded.
+func (t *tenant) repliesBetween(clientID int, from, to int) []ClientReply {
+	var replies []ClientReply
+	for _, reply := range t.replies[clientID] {
+		if reply.ReqNum >= from && reply.ReqNum < to {
+			replies = append(replies, reply)
+		}
+	}
+	return replies
+}
+
+// Results returns the responses to the accepted requests whose responses it
+// didn't return yet, up to the most recent one, in the order of the
+// requests, trying at most attempts times like Result. The responses the
+// primary no longer holds are missing; an ApplyError is returned as the
+// response of the request which failed.
+func (c *Client) Results(attempts int) ([]ClientReply, error) {
+	if attempts <= 0 {
+		return nil, fmt.Errorf("attempts must be positive, got %d", attempts)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.last.ReqNum == 0 {
+		return nil, errors.New("no request accepted yet")
+	}
+	args := c.last
+	args.RepliesFrom = c.collected + 1
+	reply, err := c.resend(args, attempts)
+	if err != nil {
+		return nil, err
+	}
+	c.collected = args.ReqNum
+	return append(reply.Replies, ClientReply{ReqNum: args.ReqNum, Resp: reply.Resp}), nil
+}
@@ -0,0 +1,233 @@
+package vrr
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/gob"
+	"io/ioutil"
+	"log"
+)
+
+func init() {
+	// Compressed operations travel inside the opLog of view change messages.
+	gob.Register(compressedOp{})
+	// So do the responses of failed operations, in replies to clients.
+	gob.Register(ApplyError{})
+	// And the internal operations, in <PREPARE>s.
+	gob.Register(addressChange{})
+	gob.Register(epochChange{})
+}
+
+// compressedOp is how an operation larger than Options.CompressionThreshold
+// is stored in the opLog. It is only decompressed when the operation
+// is actually needed, e.g. when it is applied.
+type compressedOp struct {
+	// IsString tells whether the original operation was a string or a []byte.
+	IsString bool
+	Data     []byte
+}
+
+// encodeOp returns the form in which op is stored in the opLog: compressed
+// when it is a payload larger than the threshold, as is otherwise.
+// A non-positive threshold disables compression.
+func encodeOp(op interface{}, threshold int) interface{} {
+	if threshold <= 0 {
+		return op
+	}
+
+	var payload []byte
+	isString := false
+	switch v := op.(type) {
+	case []byte:
+		payload = v
+	case string:
+		payload = []byte(v)
+		isString = true
+	default:
+		return op
+	}
+	if len(payload) <= threshold {
+		return op
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return op
+	}
+	if _, err := w.Write(payload); err != nil {
+		return op
+	}
+	if err := w.Close(); err != nil {
+		return op
+	}
+	// Not worth it for incompressible payloads.
+	if buf.Len() >= len(payload) {
+		return op
+	}
+	return compressedOp{IsString: isString, Data: buf.Bytes()}
+}
+
+// decodeOp returns the original operation of an opLog entry's operation.
+func decodeOp(stored interface{}) interface{} {
+	c, ok := stored.(compressedOp)
+	if !ok {
+		return stored
+	}
+
+	payload, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(c.Data)))
+	if err != nil {
+		// The data was compressed by encodeOp in this process or a peer's,
+		// so this can only be a corruption.
+		log.Printf("failed decompressing operation; err = %v", err)
+		return nil
+	}
+	if c.IsString {
+		return string(payload)
+	}
+	return payload
+}
+
+// op returns the decoded operation of the entry.
+func (e opLogEntry) op() interface{} {
+	if e.decoded != nil {
+		return e.decoded
+	}
+	return decodeOp(e.operation)
+}
+
+// cacheDecoded keeps the original op alongside the compressed operation of
+// the entry, as long as the decoded operations cached by the replica stay
+// within Options.DecodedCacheBytes, so that applying it doesn't decompress
+// it again. Expects r.mu to be locked.
+func (r *Replica) cacheDecoded(e *opLogEntry, op interface{}) {
+	if _, ok := e.operation.(compressedOp); !ok {
+		return
+	}
+	size := decodedSize(op)
+	if r.decodedCacheBytes+size > r.opts.DecodedCacheBytes {
+		return
+	}
+	e.decoded = op
+	r.decodedCacheBytes += size
+}
+
+// applyingOp returns the operation of the entry of the opLog with the opNum
+// for the state machine, evicting it from the cache of decoded operations
+// since it isn't needed again. Expects r.mu to be locked.
+func (r *Replica) applyingOp(opNum int) interface{} {
+	e := r.logEntry(opNum)
+	if _, ok := e.operation.(compressedOp); !ok {
+		return e.operation
+	}
+	if e.decoded == nil {
+		r.decodeCacheMisses++
+		return decodeOp(e.operation)
+	}
+	r.decodeCacheHits++
+	op := e.decoded
+	e.decoded = nil
+	r.decodedCacheBytes -= decodedSize(op)
+	return op
+}
+
+// recountDecodedCache recomputes the size of the cached decoded operations
+// after the opLog was replaced or truncated. Expects r.mu to be locked.
+func (r *Replica) recountDecodedCache() {
+	r.decodedCacheBytes = 0
+	for _, e := range r.opLog {
+		if e.decoded != nil {
+			r.decodedCacheBytes += decodedSize(e.decoded)
+		}
+	}
+}
+
+// storedSize returns the size of an operation as stored in the opLog, only
+// counting the payloads.
+func storedSize(operation interface{}) int {
+	if c, ok := operation.(compressedOp); ok {
+		return len(c.Data)
+	}
+	return decodedSize(operation)
+}
+
+func decodedSize(op interface{}) int {
+	switch v := op.(type) {
+	case []byte:
+		return len(v)
+	case string:
+		return len(v)
+	default:
+		return 0
+	}
+}
+
+// clientRequest and opLogEntry keep their fields unexported to the package
+// users, but they are part of the protocol messages so they need to be
+// encoded explicitly: gob refuses structs without exported fields.
+
+type wireClientRequest struct {
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	ReqOp     interface{}
+}
+
+func (c clientRequest) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(wireClientRequest{
+		Namespace: c.namespace,
+		ClientID:  c.clientID,
+		ReqNum:    c.reqNum,
+		ReqOp:     c.reqOp,
+	})
+	return buf.Bytes(), err
+}
+
+func (c *clientRequest) GobDecode(data []byte) error {
+	var w wireClientRequest
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&w); err != nil {
+		return err
+	}
+	c.namespace = w.Namespace
+	c.clientID = w.ClientID
+	c.reqNum = w.ReqNum
+	c.reqOp = w.ReqOp
+	return nil
+}
+
+type wireOpLogEntry struct {
+	OpID      int
+	ViewNum   int
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Operation interface{}
+}
+
+func (e opLogEntry) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(wireOpLogEntry{
+		OpID:      e.opID,
+		ViewNum:   e.viewNum,
+		Namespace: e.namespace,
+		ClientID:  e.clientID,
+		ReqNum:    e.reqNum,
+		Operation: e.operation,
+	})
+	return buf.Bytes(), err
+}
+
+func (e *opLogEntry) GobDecode(data []byte) error {
+	var w wireOpLogEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&w); err != nil {
+		return err
+	}
+	e.opID = w.OpID
+	e.viewNum = w.ViewNum
+	e.namespace = w.Namespace
+	e.clientID = w.ClientID
+	e.reqNum = w.ReqNum
+	e.operation = w.Operation
+	return nil
+}
@@ -0,0 +1,67 @@
+package vrr
+
+import (
+	"fmt"
+	"io"
+)
+
+// A cluster which lost more than f replicas can't make progress, and can't
+// safely elect a primary among the survivors either. Restoring it is an
+// operator decision: ForceNewCluster seeds a new cluster with the committed
+// state exported by one of the survivors, see Export. The replicas of the new
+// cluster are configured with a ClusterEpoch of their own, so that the old
+// members which come back are fenced off rather than mixing their logs in.
+
+// ForcedNewClusterEvidence is the evidence of an EventForcedNewCluster.
+type ForcedNewClusterEvidence struct {
+	Reason string
+
+	// SeedReplicaID is the replica of the old cluster which exported the
+	// state, and CommitNum how many operations it had committed.
+	SeedReplicaID int
+	CommitNum     int
+	ViewNum       int
+
+	ClusterEpoch uint64
+}
+
+// ForceNewCluster makes the replica the seed of a new cluster, starting from
+// the state exported by a surviving replica of the old one. The replica must
+// be the primary of a fresh replica group whose ClusterEpoch differs from the
+// old cluster's; the other replicas join empty and catch up with it. The
+// reason is recorded in an EventForcedNewCluster, which the event log
+// persists when the replica has a DataDir.
+func (r *Replica) ForceNewCluster(rd io.Reader, reason string) error {
+	if reason == "" {
+		return fmt.Errorf("vrr: forcing a new cluster requires a reason, for the audit")
+	}
+	state, err := ReadExport(rd)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.primaryID != r.ID {
+		return fmt.Errorf("vrr: replica %d can't seed a new cluster, it must be its primary %d", r.ID, r.primaryID)
+	}
+	if r.opts.ClusterEpoch == 0 {
+		return fmt.Errorf("vrr: the new cluster needs a ClusterEpoch to fence off the old members")
+	}
+	if err := r.importState(state); err != nil {
+		return err
+	}
+
+	evidence := ForcedNewClusterEvidence{
+		Reason:        reason,
+		SeedReplicaID: state.Metadata.ReplicaID,
+		CommitNum:     state.Metadata.CommitNum,
+		ViewNum:       state.Metadata.ViewNum,
+		ClusterEpoch:  r.opts.ClusterEpoch,
+	}
+	r.emit(EventForcedNewCluster, SeverityCritical, evidence,
+		"forced a new cluster of epoch %d from the %d operations of replica %d: %s",
+		evidence.ClusterEpoch, evidence.CommitNum, evidence.SeedReplicaID, reason)
+	return nil
+}
@@ -0,0 +1,417 @@
+package vrr
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the content of a replica's YAML configuration file:
+//
+//	id: 0                          # or a name, e.g. vrr-a.example.com
+//	listen: ":7000"
+//	advertise: "10.0.0.1:7000"
+//	peers:
+//	  1: "10.0.0.2:7000"
+//	  2: "10.0.0.3:7000"
+//	data_dir: /var/lib/vrr
+//	cluster_epoch: 0
+//	timeouts:
+//	  heartbeat: 50ms
+//	  view_change: 150ms
+//	  max_restart_hint: 30s
+//	features:
+//	  failure_threshold: 1
+//	  compression_threshold: 4096
+//	  pull_threshold: 1
+//	  reorder_window: 64
+//	  replay_buffer_size: 1024
+//	  state_transfer_rate: 0          # bytes per second per peer
+//	  snapshot_interval: 10000        # applied operations, 0 disables
+//	  snapshot_bytes: 0               # applied bytes, 0 disables
+//	  snapshot_chunk_size: 1048576    # bytes
+//	  shed_high_watermark: 1000
+//	  shed_low_watermark: 500
+//	  max_inbound_per_peer: 64
+//	  max_inbound_queue_per_peer: 256
+//	  unknown_peers: log-and-reject   # or reject, accept
+//	  invariants: lenient             # or strict
+//	  resync: suffix                  # or full, never
+//	  storage: wal                    # or bolt, mmap
+//	  fsync: always                   # or interval(10ms), never
+//	  wal_segment_bytes: 67108864
+//	  wal_compact_bytes: 268435456    # written since the last checkpoint, 0 disables
+//	  wal_compact_entries: 0          # compacted since the last checkpoint, 0 disables
+//	gateway:
+//	  listen: ":8080"
+//	  peers:
+//	    1: "http://10.0.0.2:8080"
+//	    2: "http://10.0.0.3:8080"
+//	archive:
+//	  endpoint: "https://s3.eu-west-1.amazonaws.com"
+//	  bucket: vrr-archive
+//	  region: eu-west-1
+//	  prefix: prod
+//	  interval: 1m
+//
+// Only id, listen and peers are required, everything else defaults to
+// DefaultOptions. Unknown keys are rejected so typos don't go unnoticed.
+// The gateway signs its sessions with the key of the VRR_GATEWAY_SESSION_KEY
+// variable of the environment, which the gateways of the group share, see
+// NewGateway. The archive is uploaded to an S3Store with the credentials of the
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN variables
+// of the environment, which are kept out of the file.
+// The replicas are named by ints or by strings, which ID, Peers and
+// Gateway.Peers hold the IDs of, see ParseID.
+type Config struct {
+	ID        int            `yaml:"id"`
+	Listen    string         `yaml:"listen"`
+	Advertise string         `yaml:"advertise"`
+	Peers     map[int]string `yaml:"peers"`
+	DataDir   string         `yaml:"data_dir"`
+
+	// Names are the names of the replicas named by strings, by ID.
+	Names map[int]string `yaml:"-"`
+
+	ClusterEpoch uint64 `yaml:"cluster_epoch"`
+
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	Features FeaturesConfig `yaml:"features"`
+	Gateway  GatewayConfig  `yaml:"gateway"`
+	Archive  ArchiveConfig  `yaml:"archive"`
+}
+
+type TimeoutsConfig struct {
+	Heartbeat      time.Duration `yaml:"heartbeat"`
+	ViewChange     time.Duration `yaml:"view_change"`
+	MaxRestartHint time.Duration `yaml:"max_restart_hint"`
+}
+
+type FeaturesConfig struct {
+	FailureThreshold     *int `yaml:"failure_threshold"`
+	CompressionThreshold *int `yaml:"compression_threshold"`
+	PullThreshold        *int `yaml:"pull_threshold"`
+	ReorderWindow        *int `yaml:"reorder_window"`
+	ReplayBufferSize     *int `yaml:"replay_buffer_size"`
+	StateTransferRate    *int `yaml:"state_transfer_rate"`
+	SnapshotInterval     *int `yaml:"snapshot_interval"`
+	SnapshotBytes        *int `yaml:"snapshot_bytes"`
+	SnapshotChunkSize    *int `yaml:"snapshot_chunk_size"`
+	ShedHighWatermark    *int `yaml:"shed_high_watermark"`
+	ShedLowWatermark     *int `yaml:"shed_low_watermark"`
+	WALSegmentBytes      *int `yaml:"wal_segment_bytes"`
+	WALCompactBytes      *int `yaml:"wal_compact_bytes"`
+	WALCompactEntries    *int `yaml:"wal_compact_entries"`
+
+	MaxInboundPerPeer      *int `yaml:"max_inbound_per_peer"`
+	MaxInboundQueuePerPeer *int `yaml:"max_inbound_queue_per_peer"`
+
+	UnknownPeers string `yaml:"unknown_peers"`
+	Invariants   string `yaml:"invariants"`
+	Resync       string `yaml:"resync"`
+	Storage      string `yaml:"storage"`
+	Fsync        string `yaml:"fsync"`
+}
+
+// unknownPeerPolicies are the UnknownPeerPolicy values which can be
+// configured; accepting authenticated peers needs code.
+var unknownPeerPolicies = map[string]UnknownPeerPolicy{
+	"accept":         AcceptUnknownPeers,
+	"reject":         RejectUnknownPeers,
+	"log-and-reject": LogAndRejectUnknownPeers,
+}
+
+// invariantModes are the configurable InvariantMode values.
+var invariantModes = map[string]InvariantMode{
+	"lenient": LenientInvariants,
+	"strict":  StrictInvariants,
+}
+
+// storageEngines are the configurable StorageEngine values.
+var storageEngines = map[string]StorageEngine{
+	"wal":  StorageWAL,
+	"bolt": StorageBolt,
+	"mmap": StorageMmap,
+}
+
+// resyncPolicies are the configurable ResyncPolicy values.
+var resyncPolicies = map[string]ResyncPolicy{
+	"suffix": ResyncSuffix,
+	"full":   ResyncFull,
+	"never":  ResyncNever,
+}
+
+type ArchiveConfig struct {
+	Endpoint string        `yaml:"endpoint"`
+	Bucket   string        `yaml:"bucket"`
+	Region   string        `yaml:"region"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+type GatewayConfig struct {
+	Listen string         `yaml:"listen"`
+	Peers  map[int]string `yaml:"peers"`
+}
+
+// LoadConfig reads and validates the YAML configuration file at path.
+func LoadConfig(path string) (Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	config, err := ParseConfig(data)
+	if err != nil {
+		return Config{}, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// ParseConfig parses and validates a YAML configuration.
+func ParseConfig(data []byte) (Config, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Config{}, fmt.Errorf("malformed configuration: %v", err)
+	}
+	names, err := resolveNames(&doc)
+	if err != nil {
+		return Config{}, err
+	}
+	if names != nil {
+		if data, err = yaml.Marshal(&doc); err != nil {
+			return Config{}, err
+		}
+	}
+
+	var config Config
+	config.ID = -1
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil {
+		return Config{}, fmt.Errorf("malformed configuration: %v", err)
+	}
+	config.Names = names
+	if err := config.validate(); err != nil {
+		return Config{}, err
+	}
+	return config, nil
+}
+
+// resolveNames replaces the replicas named by strings in the id, the peers
+// and the gateway peers of the configuration with their IDs, and returns
+// their names by ID, nil if there are none.
+func resolveNames(doc *yaml.Node) (map[int]string, error) {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	var nodes []*yaml.Node
+	addPeers := func(peers *yaml.Node) {
+		if peers.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i < len(peers.Content); i += 2 {
+			nodes = append(nodes, peers.Content[i])
+		}
+	}
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		switch key, value := root.Content[i].Value, root.Content[i+1]; key {
+		case "id":
+			nodes = append(nodes, value)
+		case "peers":
+			addPeers(value)
+		case "gateway":
+			for j := 0; value.Kind == yaml.MappingNode && j+1 < len(value.Content); j += 2 {
+				if value.Content[j].Value == "peers" {
+					addPeers(value.Content[j+1])
+				}
+			}
+		}
+	}
+
+	var named []*yaml.Node
+	var strs []string
+	for _, node := range nodes {
+		if _, err := strconv.Atoi(node.Value); node.Kind == yaml.ScalarNode && node.Tag != "!!null" && err != nil {
+			named = append(named, node)
+			strs = append(strs, node.Value)
+		}
+	}
+	if len(named) == 0 {
+		return nil, nil
+	}
+	IDs, err := nameIDs(strs)
+	if err != nil {
+		return nil, fmt.Errorf("id/peers: %v", err)
+	}
+	names := make(map[int]string, len(IDs))
+	for _, node := range named {
+		ID := IDs[node.Value]
+		names[ID] = node.Value
+		node.Value, node.Tag, node.Style = strconv.Itoa(ID), "!!int", 0
+	}
+	return names, nil
+}
+
+func (c Config) validate() error {
+	if c.ID < 0 {
+		return fmt.Errorf("id: required and must not be negative")
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("listen: required, e.g. \":7000\"")
+	}
+	if err := validateConfiguration(c.ID, c.Peers); err != nil {
+		return fmt.Errorf("peers: %v", err)
+	}
+	if c.DataDir != "" {
+		if info, err := os.Stat(c.DataDir); err != nil {
+			return fmt.Errorf("data_dir: %v", err)
+		} else if !info.IsDir() {
+			return fmt.Errorf("data_dir: %s is not a directory", c.DataDir)
+		}
+	}
+	for peerID := range c.Gateway.Peers {
+		if _, ok := c.Peers[peerID]; !ok && peerID != c.ID {
+			return fmt.Errorf("gateway.peers: replica %d is not in peers", peerID)
+		}
+	}
+
+	if a := c.Archive; a.Bucket != "" && (a.Endpoint == "" || a.Region == "") {
+		return fmt.Errorf("archive: endpoint and region are required with a bucket")
+	} else if a.Bucket == "" && (a.Endpoint != "" || a.Region != "" || a.Prefix != "" || a.Interval != 0) {
+		return fmt.Errorf("archive: bucket is required")
+	}
+
+	if _, ok := unknownPeerPolicies[c.Features.UnknownPeers]; !ok && c.Features.UnknownPeers != "" {
+		return fmt.Errorf("features.unknown_peers: %q is not one of accept, reject, log-and-reject", c.Features.UnknownPeers)
+	}
+
+	if _, ok := invariantModes[c.Features.Invariants]; !ok && c.Features.Invariants != "" {
+		return fmt.Errorf("features.invariants: %q is not one of lenient, strict", c.Features.Invariants)
+	}
+	if _, ok := resyncPolicies[c.Features.Resync]; !ok && c.Features.Resync != "" {
+		return fmt.Errorf("features.resync: %q is not one of suffix, full, never", c.Features.Resync)
+	}
+	if _, ok := storageEngines[c.Features.Storage]; !ok && c.Features.Storage != "" {
+		return fmt.Errorf("features.storage: %q is not one of wal, bolt, mmap", c.Features.Storage)
+	}
+	if c.Features.Fsync != "" {
+		if _, _, err := parseSyncPolicy(c.Features.Fsync); err != nil {
+			return fmt.Errorf("features.fsync: %v", err)
+		}
+	}
+
+	opts := c.Options()
+	if err := opts.validate(); err != nil {
+		return fmt.Errorf("timeouts/features: %v", err)
+	}
+	if opts.FailureThreshold > 0 {
+		if err := validateFailureThreshold(len(c.Peers)+1, opts.FailureThreshold); err != nil {
+			return fmt.Errorf("features.failure_threshold: %v", err)
+		}
+	}
+	return nil
+}
+
+// Options returns DefaultOptions overridden by the configuration.
+func (c Config) Options() Options {
+	opts := DefaultOptions()
+	opts.DataDir = c.DataDir
+	opts.AdvertiseAddr = c.Advertise
+	opts.ClusterEpoch = c.ClusterEpoch
+	if a := c.Archive; a.Bucket != "" {
+		opts.Archive = &S3Store{
+			Endpoint:        a.Endpoint,
+			Bucket:          a.Bucket,
+			Region:          a.Region,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		}
+		opts.ArchivePrefix = a.Prefix
+		if a.Interval != 0 {
+			opts.ArchiveInterval = a.Interval
+		}
+	}
+	if c.Timeouts.Heartbeat != 0 {
+		opts.HeartbeatInterval = c.Timeouts.Heartbeat
+	}
+	if c.Timeouts.ViewChange != 0 {
+		opts.ViewChangeTimeout = c.Timeouts.ViewChange
+	}
+	if c.Timeouts.MaxRestartHint != 0 {
+		opts.MaxRestartHint = c.Timeouts.MaxRestartHint
+	}
+
+	f := c.Features
+	if f.FailureThreshold != nil {
+		opts.FailureThreshold = *f.FailureThreshold
+	}
+	if f.CompressionThreshold != nil {
+		opts.CompressionThreshold = *f.CompressionThreshold
+	}
+	if f.PullThreshold != nil {
+		opts.PullThreshold = *f.PullThreshold
+	}
+	if f.ReorderWindow != nil {
+		opts.ReorderWindow = *f.ReorderWindow
+	}
+	if f.ReplayBufferSize != nil {
+		opts.ReplayBufferSize = *f.ReplayBufferSize
+	}
+	if f.StateTransferRate != nil {
+		opts.StateTransferRate = *f.StateTransferRate
+	}
+	if f.SnapshotInterval != nil {
+		opts.SnapshotInterval = *f.SnapshotInterval
+	}
+	if f.SnapshotBytes != nil {
+		opts.SnapshotBytes = *f.SnapshotBytes
+	}
+	if f.SnapshotChunkSize != nil {
+		opts.SnapshotChunkSize = *f.SnapshotChunkSize
+	}
+	if f.ShedHighWatermark != nil {
+		opts.ShedHighWatermark = *f.ShedHighWatermark
+	}
+	if f.ShedLowWatermark != nil {
+		opts.ShedLowWatermark = *f.ShedLowWatermark
+	}
+	if f.WALSegmentBytes != nil {
+		opts.WALSegments.MaxBytes = *f.WALSegmentBytes
+	}
+	if f.WALCompactBytes != nil {
+		opts.WALSegments.CompactBytes = *f.WALCompactBytes
+	}
+	if f.WALCompactEntries != nil {
+		opts.WALSegments.CompactEntries = *f.WALCompactEntries
+	}
+	if f.MaxInboundPerPeer != nil {
+		opts.MaxInboundPerPeer = *f.MaxInboundPerPeer
+	}
+	if f.MaxInboundQueuePerPeer != nil {
+		opts.MaxInboundQueuePerPeer = *f.MaxInboundQueuePerPeer
+	}
+	if policy, ok := unknownPeerPolicies[f.UnknownPeers]; ok {
+		opts.UnknownPeerPolicy = policy
+	}
+	if mode, ok := invariantModes[f.Invariants]; ok {
+		opts.InvariantMode = mode
+	}
+	if policy, ok := resyncPolicies[f.Resync]; ok {
+		opts.ResyncPolicy = policy
+	}
+	if engine, ok := storageEngines[f.Storage]; ok {
+		opts.StorageEngine = engine
+	}
+	if policy, interval, err := parseSyncPolicy(f.Fsync); err == nil {
+		opts.SyncPolicy, opts.SyncInterval = policy, interval
+	}
+	return opts
+}
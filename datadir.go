@@ -0,0 +1,216 @@
+package vrr
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The data directory of a replica, Options.DataDir, is laid out as:
+//
+//	LOCK        held by the process using the directory
+//	meta.json   version of the layout and ID of the replica owning it
+//	events.log  the event log, see EventLogFile
+//	log/        the segments of the write-ahead log of the state, see WAL,
+//	            its bbolt database, see BoltStorage, or its memory-mapped
+//	            log, see MmapStorage
+//	snapshots/  the snapshots of the state machine
+//
+// A replica locks the directory for as long as it runs, so that a second
+// process started with the same directory by mistake fails rather than
+// corrupting the files of the first one. The lock is an advisory flock,
+// released by the kernel if the process dies. A directory belongs to the
+// replica which created it: the others refuse it, since two replicas sharing
+// their state would count twice in the quorums.
+//
+// The layout version lets a later release migrate the directories written
+// by an older one, see dataDirMigrations; a directory written by a newer
+// release is refused.
+
+const (
+	dataDirLockFile     = "LOCK"
+	dataDirMetaFile     = "meta.json"
+	dataDirLogDir       = "log"
+	dataDirSnapshotsDir = "snapshots"
+
+	// DataDirLayoutVersion is the version of the layout written by this
+	// release.
+	DataDirLayoutVersion = 2
+)
+
+// ErrDataDirLocked is returned when opening a data directory which another
+// process, or another replica of this one, is using.
+var ErrDataDirLocked = errors.New("vrr: data directory is in use by another replica")
+
+// dataDirMigrations migrate a data directory of a layout version, by index,
+// to the next one. Version 0 is a directory with nothing but the event log,
+// which needs no migration.
+var dataDirMigrations = []func(dir string) error{
+	0: func(dir string) error { return nil },
+	// Version 1 kept the WAL in a single file, its first segment since.
+	1: func(dir string) error {
+		err := os.Rename(filepath.Join(dir, dataDirLogDir, "wal"), filepath.Join(dir, dataDirLogDir, walSegmentName(1)))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	},
+}
+
+// DataDirMeta is the content of the meta file of a data directory.
+type DataDirMeta struct {
+	LayoutVersion int       `json:"layout_version"`
+	ReplicaID     int       `json:"replica_id"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// DataDir is a data directory opened, and locked, by a replica.
+type DataDir struct {
+	path string
+	lock *os.File
+	meta DataDirMeta
+	// storage is the WAL, the BoltStorage or the MmapStorage opened in the
+	// directory.
+	storage io.Closer
+}
+
+// OpenDataDir opens the data directory of the replica, creating or migrating
+// its layout as needed, and locks it until Close.
+func OpenDataDir(path string, replicaID int) (*DataDir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(path, dataDirLockFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+	d := &DataDir{path: path, lock: lock}
+	if err := d.init(replicaID); err != nil {
+		d.Close()
+		return nil, fmt.Errorf("data directory %s: %v", path, err)
+	}
+	return d, nil
+}
+
+// init reads the meta file, or writes it in a new directory, migrates the
+// layout to the current version and creates its subdirectories.
+func (d *DataDir) init(replicaID int) error {
+	data, err := ioutil.ReadFile(filepath.Join(d.path, dataDirMetaFile))
+	switch {
+	case os.IsNotExist(err):
+		d.meta = DataDirMeta{ReplicaID: replicaID, CreatedAt: time.Now()}
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(data, &d.meta); err != nil {
+			return fmt.Errorf("%s: %v", dataDirMetaFile, err)
+		}
+	}
+
+	if d.meta.ReplicaID != replicaID {
+		return fmt.Errorf("belongs to replica %d, not %d", d.meta.ReplicaID, replicaID)
+	}
+	if d.meta.LayoutVersion > DataDirLayoutVersion {
+		return fmt.Errorf("layout version %d is newer than %d, written by a newer release", d.meta.LayoutVersion, DataDirLayoutVersion)
+	}
+	for d.meta.LayoutVersion < DataDirLayoutVersion {
+		if err := dataDirMigrations[d.meta.LayoutVersion](d.path); err != nil {
+			return fmt.Errorf("migrating layout version %d: %v", d.meta.LayoutVersion, err)
+		}
+		d.meta.LayoutVersion++
+	}
+
+	for _, dir := range []string{d.LogDir(), d.SnapshotsDir()} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	return d.writeMeta()
+}
+
+// writeMeta replaces the meta file atomically.
+func (d *DataDir) writeMeta() error {
+	data, err := json.MarshalIndent(d.meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(d.path, dataDirMetaFile+".tmp")
+	if err := ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(d.path, dataDirMetaFile))
+}
+
+// Path is the path of the data directory.
+func (d *DataDir) Path() string {
+	return d.path
+}
+
+// Meta returns the content of the meta file.
+func (d *DataDir) Meta() DataDirMeta {
+	return d.meta
+}
+
+// LogDir is the directory of the write-ahead log.
+func (d *DataDir) LogDir() string {
+	return filepath.Join(d.path, dataDirLogDir)
+}
+
+// SnapshotsDir is the directory of the snapshots of the state machine.
+func (d *DataDir) SnapshotsDir() string {
+	return filepath.Join(d.path, dataDirSnapshotsDir)
+}
+
+// OpenWAL opens the write-ahead log of the data directory, which Close
+// closes.
+func (d *DataDir) OpenWAL(policy SyncPolicy, interval time.Duration, segments WALSegments) (*WAL, error) {
+	wal, err := OpenWAL(d.LogDir(), policy, interval, segments)
+	if err != nil {
+		return nil, err
+	}
+	d.storage = wal
+	return wal, nil
+}
+
+// OpenBoltStorage opens the bbolt database of the data directory, which
+// Close closes.
+func (d *DataDir) OpenBoltStorage(policy SyncPolicy, interval time.Duration) (*BoltStorage, error) {
+	s, err := OpenBoltStorage(d.LogDir(), policy, interval)
+	if err != nil {
+		return nil, err
+	}
+	d.storage = s
+	return s, nil
+}
+
+// OpenMmapStorage opens the memory-mapped log of the data directory, which
+// Close closes.
+func (d *DataDir) OpenMmapStorage(policy SyncPolicy, interval time.Duration) (*MmapStorage, error) {
+	s, err := OpenMmapStorage(d.LogDir(), policy, interval)
+	if err != nil {
+		return nil, err
+	}
+	d.storage = s
+	return s, nil
+}
+
+// Close closes the write-ahead log or the database, if opened, and releases
+// the lock of the data directory.
+func (d *DataDir) Close() error {
+	if d.storage != nil {
+		if err := d.storage.Close(); err != nil {
+			d.lock.Close()
+			return err
+		}
+	}
+	return d.lock.Close()
+}
@@ -0,0 +1,73 @@
+package vrr
+
+import "time"
+
+// An external failure detector, e.g. a gossip membership or the API of an
+// orchestrator, often knows before the view change timer that the primary is
+// gone, or that it is merely slow. Its reports only tune the timing of the
+// view changes: a backup times out sooner on a primary reported dead, and
+// later on one reported alive, but never waits forever on a detector which is
+// wrong. A view change is safe whenever it happens, so a wrong detector only
+// costs the availability of a useless view change or of a longer timeout.
+
+// PeerHealth is what a FailureDetector knows of a peer.
+type PeerHealth int
+
+const (
+	PeerUnknown PeerHealth = iota
+	PeerAlive
+	PeerDead
+)
+
+func (h PeerHealth) String() string {
+	switch h {
+	case PeerUnknown:
+		return "Unknown"
+	case PeerAlive:
+		return "Alive"
+	case PeerDead:
+		return "Dead"
+	default:
+		panic("unreachable")
+	}
+}
+
+// FailureDetector is an external source of the health of the peers.
+// PeerHealth is called with the replica locked, so it must be cheap and must
+// not call the replica back, e.g. by reading a cache its detector updates.
+type FailureDetector interface {
+	PeerHealth(peerID int) PeerHealth
+}
+
+const (
+	// deadPrimaryTimeoutDivisor shortens the view change timeout on a
+	// primary the detector reports dead.
+	deadPrimaryTimeoutDivisor = 4
+
+	// alivePrimaryTimeoutFactor lengthens the view change timeout on a
+	// primary the detector reports alive, bounding how long a wrong detector
+	// delays the view change.
+	alivePrimaryTimeoutFactor = 3
+)
+
+// primaryHealth returns what the failure detector knows of the primary.
+// Expects r.mu to be locked.
+func (r *Replica) primaryHealth() PeerHealth {
+	if r.opts.FailureDetector == nil || r.primaryID == r.ID {
+		return PeerUnknown
+	}
+	return r.opts.FailureDetector.PeerHealth(r.primaryID)
+}
+
+// detectedTimeout adjusts the view change timeout to the health of the
+// primary. Expects r.mu to be locked.
+func (r *Replica) detectedTimeout(timeout time.Duration) time.Duration {
+	switch r.primaryHealth() {
+	case PeerDead:
+		return timeout / deadPrimaryTimeoutDivisor
+	case PeerAlive:
+		return timeout * alivePrimaryTimeoutFactor
+	default:
+		return timeout
+	}
+}
@@ -0,0 +1,179 @@
+package vrr
+
+import (
+	"bytes"
+	"log"
+)
+
+// The determinism checker catches state machines whose Apply isn't
+// deterministic, the most common bug of replicated state machines: every
+// Options.DeterminismCheckInterval operations, each replica hashes its state
+// machine, when it implements StateHasher, and sends the hash to its peers
+// with <STATE-HASH>; the primary and the backups also exchange the hash of
+// their latest checkpoint on <COMMIT>, so that a divergence is caught even
+// when a <STATE-HASH> is lost. A replica whose hash at the same opNum differs
+// from its own emits an EventNondeterminism, once per peer and checkpoint,
+// counts it in its StatsReply.Divergences and calls Options.OnDivergence. A
+// backup whose hash differs from the primary's resyncs, see ResyncPolicy.
+
+// StateHasher is implemented by the state machines able to hash their state,
+// for the determinism checker. Replicas which applied the same operations
+// must return the same hash.
+type StateHasher interface {
+	Hash() []byte
+}
+
+// stateHashCheckpoints is how many of the most recent checkpoints are kept,
+// waiting for the hashes of the peers to compare.
+const stateHashCheckpoints = 8
+
+// stateHashCheckpoint holds the hashes of the state machines once the
+// operation of a checkpoint is applied.
+type stateHashCheckpoint struct {
+	own   []byte
+	peers map[int][]byte
+
+	// diverged are the peers whose hash differed, reported once.
+	diverged map[int]bool
+}
+
+// NondeterminismEvidence is the evidence of an EventNondeterminism.
+type NondeterminismEvidence struct {
+	OpNum    int
+	PeerID   int
+	Hash     []byte
+	PeerHash []byte
+}
+
+// checkDeterminism hashes the state machine if the operation just applied is
+// a checkpoint, every interval operations, and sends the hash to the peers.
+// It runs outside r.mu, from commitChanSender, right after Apply.
+func (r *Replica) checkDeterminism(stateMachine StateMachine, interval int, opNum int) {
+	hasher, ok := stateMachine.(StateHasher)
+	if !ok || interval <= 0 || opNum%interval != 0 {
+		return
+	}
+	hash := hasher.Hash()
+
+	r.mu.Lock()
+	r.stateHashFor(opNum).own = hash
+	r.compareStateHashes(opNum)
+	args := StateHashArgs{
+		ReplicaID: r.ID,
+		OpNum:     opNum,
+		Hash:      hash,
+	}
+	r.mu.Unlock()
+
+	for peerID := range r.configuration {
+		go func(peerID int) {
+			var reply StateHashReply
+
+			r.dlog("sending <STATE-HASH> to %d: opNum=%d", peerID, args.OpNum)
+			if err := r.server.Call(peerID, "Replica.StateHash", args, &reply); err != nil {
+				log.Printf("failed sending <STATE-HASH>; err = %v", err.Error())
+			}
+		}(peerID)
+	}
+}
+
+// stateHashFor returns the checkpoint of opNum, forgetting the oldest one
+// when there are too many. Expects r.mu to be locked.
+func (r *Replica) stateHashFor(opNum int) *stateHashCheckpoint {
+	if r.stateHashes == nil {
+		r.stateHashes = make(map[int]*stateHashCheckpoint)
+	}
+	checkpoint, ok := r.stateHashes[opNum]
+	if ok {
+		return checkpoint
+	}
+	checkpoint = &stateHashCheckpoint{peers: make(map[int][]byte), diverged: make(map[int]bool)}
+	r.stateHashes[opNum] = checkpoint
+	if len(r.stateHashes) > stateHashCheckpoints {
+		oldest := opNum
+		for n := range r.stateHashes {
+			if n < oldest {
+				oldest = n
+			}
+		}
+		delete(r.stateHashes, oldest)
+	}
+	return checkpoint
+}
+
+// compareStateHashes compares the hash of the checkpoint with the ones of the
+// peers received so far, which are dropped once compared.
+// Expects r.mu to be locked.
+func (r *Replica) compareStateHashes(opNum int) {
+	checkpoint, ok := r.stateHashes[opNum]
+	if !ok || checkpoint.own == nil {
+		return
+	}
+	resync := false
+	for peerID, peerHash := range checkpoint.peers {
+		if !bytes.Equal(checkpoint.own, peerHash) && !checkpoint.diverged[peerID] {
+			checkpoint.diverged[peerID] = true
+			r.divergences++
+			evidence := NondeterminismEvidence{OpNum: opNum, PeerID: peerID, Hash: checkpoint.own, PeerHash: peerHash}
+			r.emit(EventNondeterminism, SeverityCritical, evidence,
+				"state machine hash at opNum=%d differs from replica %d's", opNum, peerID)
+			if r.opts.OnDivergence != nil {
+				go r.opts.OnDivergence(evidence)
+			}
+			resync = resync || (peerID == r.primaryID && r.primaryID != r.ID)
+		}
+		delete(checkpoint.peers, peerID)
+	}
+	if resync {
+		r.resyncStateMachine()
+	}
+}
+
+// latestStateHash returns the hash of the state machine at the latest
+// checkpoint the replica hashed, and its opNum; a nil hash if none.
+// Expects r.mu to be locked.
+func (r *Replica) latestStateHash() (int, []byte) {
+	latest, hash := 0, []byte(nil)
+	for opNum, checkpoint := range r.stateHashes {
+		if checkpoint.own != nil && opNum > latest {
+			latest, hash = opNum, checkpoint.own
+		}
+	}
+	return latest, hash
+}
+
+// receiveStateHash compares the hash of the peer's state machine at the
+// checkpoint of opNum with the replica's, as carried by <COMMIT> and its
+// reply. Expects r.mu to be locked.
+func (r *Replica) receiveStateHash(peerID int, opNum int, hash []byte) {
+	if hash == nil {
+		return
+	}
+	r.stateHashFor(opNum).peers[peerID] = hash
+	r.compareStateHashes(opNum)
+}
+
+type StateHashArgs struct {
+	ReplicaID int
+	OpNum     int
+	Hash      []byte
+}
+
+type StateHashReply struct {
+	IsReplied bool
+}
+
+func (r *Replica) StateHash(args StateHashArgs, reply *StateHashReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("StateHash: from=%d opNum=%d", args.ReplicaID, args.OpNum)
+
+	r.stateHashFor(args.OpNum).peers[args.ReplicaID] = args.Hash
+	r.compareStateHashes(args.OpNum)
+	reply.IsReplied = true
+	return nil
+}
@@ -0,0 +1,136 @@
+package vrr
+
+import (
+	"fmt"
+	"sync"
+)
+
+// EmbeddedGroup is a whole replication group running in a single process,
+// e.g. for tests or single-box durability. Its replicas talk to each other
+// through in-memory connections rather than TCP ports, and their commits
+// are delivered on a single channel tagged with the committing replica.
+type EmbeddedGroup struct {
+	servers []*Server
+	commits chan EmbeddedCommit
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// EmbeddedCommit is a commit of one of the replicas of an EmbeddedGroup.
+type EmbeddedCommit struct {
+	ReplicaID int
+	CommitEntry
+}
+
+// embeddedCommitsBufferSize is how many commits of all the replicas are
+// buffered before the replicas block on the consumer.
+const embeddedCommitsBufferSize = 64
+
+// NewEmbeddedGroup starts a group of n replicas with IDs 0 to n-1,
+// replica 0 being the first primary. Tolerating a single failure already
+// takes 2f+1 = 3 replicas.
+func NewEmbeddedGroup(n int, opts Options) (*EmbeddedGroup, error) {
+	if n < 3 {
+		return nil, fmt.Errorf("embedded group needs at least 3 replicas, got %d", n)
+	}
+
+	g := &EmbeddedGroup{
+		servers: make([]*Server, n),
+		commits: make(chan EmbeddedCommit, embeddedCommitsBufferSize),
+		quit:    make(chan struct{}),
+	}
+	ready := make(chan interface{})
+	commitChans := make([]chan CommitEntry, n)
+	for i := 0; i < n; i++ {
+		commitChans[i] = make(chan CommitEntry)
+		g.servers[i] = NewServer(ready, commitChans[i])
+	}
+
+	for i := 0; i < n; i++ {
+		configuration := make(map[int]string)
+		for j := 0; j < n; j++ {
+			if j != i {
+				configuration[j] = embeddedAddr(j)
+				g.servers[i].ConnectToLocalPeer(j, g.servers[j])
+			}
+		}
+		if err := g.servers[i].Configure(i, configuration, opts); err != nil {
+			g.shutdownServers()
+			return nil, fmt.Errorf("replica %d: %w", i, err)
+		}
+	}
+	close(ready)
+
+	for i := 0; i < n; i++ {
+		go func(replicaID int) {
+			for {
+				select {
+				case entry := <-commitChans[replicaID]:
+					select {
+					case g.commits <- EmbeddedCommit{ReplicaID: replicaID, CommitEntry: entry}:
+					case <-g.quit:
+						return
+					}
+				case <-g.quit:
+					return
+				}
+			}
+		}(i)
+	}
+	return g, nil
+}
+
+// embeddedAddr is the placeholder address of an embedded replica,
+// which is never dialed.
+func embeddedAddr(replicaID int) string {
+	return fmt.Sprintf("embedded-%d:0", replicaID)
+}
+
+// Replica returns the replica with the given ID.
+func (g *EmbeddedGroup) Replica(ID int) *Replica {
+	return g.servers[ID].Replica()
+}
+
+// Commits returns the commits of all the replicas of the group.
+// It must be consumed, or the replicas end up blocked on their commits.
+func (g *EmbeddedGroup) Commits() <-chan EmbeddedCommit {
+	return g.commits
+}
+
+// Submit submits the operation of the client to the current primary.
+func (g *EmbeddedGroup) Submit(namespace string, clientID int, reqNum int, op interface{}) error {
+	req := clientRequest{
+		namespace: namespace,
+		clientID:  clientID,
+		reqNum:    reqNum,
+		reqOp:     op,
+	}
+
+	err := ErrNotPrimary
+	for _, s := range g.servers {
+		if err = s.Replica().Submit(req); err != ErrNotPrimary {
+			return err
+		}
+	}
+	return err
+}
+
+// Shutdown stops all the replicas of the group.
+func (g *EmbeddedGroup) Shutdown() {
+	g.once.Do(func() {
+		close(g.quit)
+		g.shutdownServers()
+	})
+}
+
+func (g *EmbeddedGroup) shutdownServers() {
+	for _, s := range g.servers {
+		s.DisconnectAll()
+	}
+	for _, s := range g.servers {
+		if r := s.Replica(); r != nil {
+			r.Stop()
+		}
+		s.Shutdown()
+	}
+}
@@ -0,0 +1,109 @@
+package vrr
+
+import (
+	"errors"
+	"net/rpc"
+)
+
+// Errors returned by Submit when a request isn't accepted by the replica.
+var (
+	ErrNotPrimary       = errors.New("vrr: replica is not the primary")
+	ErrNotNormal        = errors.New("vrr: replica is not in Normal status")
+	ErrDuplicateRequest = errors.New("vrr: request number already seen for this client")
+	ErrRateLimited      = errors.New("vrr: namespace is over its rate limit")
+	ErrInvalidOperation = errors.New("vrr: operation rejected by the validator")
+	ErrOverloaded       = errors.New("vrr: primary is overloaded, the state machine is too far behind")
+	ErrOutOfOrder       = errors.New("vrr: request does not follow the previous request of the client")
+	ErrSequenceBroken   = errors.New("vrr: previous request of the client is not in the primary's log")
+)
+
+// ErrUnknownPeer is returned to the replicas which aren't in the configuration
+// when the UnknownPeerPolicy rejects their messages.
+var ErrUnknownPeer = errors.New("vrr: sender is not in the configuration")
+
+// ErrPeerIdentity is returned for the protocol messages whose sender isn't
+// the replica which identified itself in the handshake of the connection.
+var ErrPeerIdentity = errors.New("vrr: sender is not the replica identified by the connection handshake")
+
+// ErrFencedPeer is returned for the protocol messages of the replicas of
+// another ClusterEpoch, e.g. the members of a cluster replaced with
+// ForceNewCluster.
+var ErrFencedPeer = errors.New("vrr: sender belongs to another cluster epoch")
+
+// ErrPeerBusy is returned for the protocol messages of a peer which already
+// has too many of them in flight, see Options.MaxInboundPerPeer. The sender
+// backs off from the busy replica for a while.
+var ErrPeerBusy = errors.New("vrr: replica is busy with the messages of this peer")
+
+// ErrMessageDropped is returned for the protocol messages an inbound
+// interceptor dropped without handling them.
+var ErrMessageDropped = errors.New("vrr: message dropped by an inbound interceptor")
+
+// ErrNotCommitted is returned when reading log entries which aren't
+// committed yet, or no longer in the replica's log.
+var ErrNotCommitted = errors.New("vrr: log entries are not committed")
+
+// ErrCompacted is returned when reading log entries which were dropped from
+// the opLog once a snapshot held them.
+var ErrCompacted = errors.New("vrr: log entries were compacted into a snapshot")
+
+// ApplyError is the response recorded for an operation the StateMachine
+// failed to apply. The operation keeps its slot in the opLog and the
+// following ones are applied as usual; only the message of the error is kept,
+// so that the replicas applying it deterministically record the same outcome.
+type ApplyError struct {
+	Msg string
+}
+
+func (e ApplyError) Error() string {
+	return "vrr: operation failed: " + e.Msg
+}
+
+// ErrReplicaStopped is returned by the calls waiting on a replica which
+// gets stopped.
+var ErrReplicaStopped = errors.New("vrr: replica is stopped")
+
+// ErrNotConfigured is returned for the RPCs a Server receives before its
+// replica is created by Configure.
+var ErrNotConfigured = errors.New("vrr: server has no replica configured yet")
+
+// Errors returned by the handlers of the protocol messages the replica didn't
+// act upon, so that their sender can tell the outcomes apart.
+var (
+	// ErrStaleView is returned for a message of a view older than the
+	// replica's: its sender was superseded.
+	ErrStaleView = errors.New("vrr: message is of a view older than the replica's")
+
+	// ErrLogGap is returned for a <PREPARE> which doesn't follow the opLog
+	// of the replica, which fetches the operations it misses first.
+	ErrLogGap = errors.New("vrr: replica misses the operations before the message's")
+
+	// ErrReplicaDead is returned by a stopped replica.
+	ErrReplicaDead = errors.New("vrr: replica is dead")
+
+	// ErrWrongStatus is returned for a message the replica can't handle in
+	// its status, e.g. while it recovers.
+	ErrWrongStatus = errors.New("vrr: message can't be handled in the replica's status")
+)
+
+// remoteErrors are the errors of the handlers which Server.Call returns as
+// themselves, rather than as the rpc.ServerError carrying their message.
+var remoteErrors = []error{
+	ErrStaleView, ErrLogGap, ErrReplicaDead, ErrWrongStatus,
+	ErrUnknownPeer, ErrPeerIdentity, ErrFencedPeer, ErrPeerBusy, ErrMessageDropped, ErrNotConfigured,
+}
+
+// remoteError maps the error of a call back to the error the handler of the
+// peer returned, when it is one of remoteErrors.
+func remoteError(err error) error {
+	serverErr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	for _, remoteErr := range remoteErrors {
+		if string(serverErr) == remoteErr.Error() {
+			return remoteErr
+		}
+	}
+	return err
+}
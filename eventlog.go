@@ -0,0 +1,206 @@
+package vrr
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// The event log persists the most recent events of a replica in its data
+// directory, so that its last actions can be reconstructed after a crash
+// even if its standard output was lost.
+//
+// The file is a ring of eventLogSlots fixed-size slots, overwritten in turn:
+//
+//	crc32   uint32  IEEE checksum of the rest of the slot
+//	seq     uint64  sequence number of the event, 0 for an unused slot
+//	time    int64   Unix nanoseconds
+//	replica int32
+//	kind    uint8
+//	sev     uint8
+//	msglen  uint16
+//	msg     [msglen]byte, truncated to fit the slot
+//
+// Slots are written in place without fsync: the log survives the process
+// crashing, not the machine. A slot torn by a crash fails its checksum and
+// is skipped when reading.
+//
+// Events are written by a goroutine of their own, so that the replica
+// emitting them under r.mu never waits for the disk.
+const (
+	EventLogFile = "events.log"
+
+	eventLogSlots     = 4096
+	eventLogSlotSize  = 512
+	eventLogHeaderLen = 28
+	eventLogMaxMsgLen = eventLogSlotSize - eventLogHeaderLen
+
+	// eventLogPending is how many events can wait for the writer
+	// before new ones are dropped.
+	eventLogPending = 256
+)
+
+var errEventLogFull = errors.New("too many events waiting to be written, dropping the event")
+
+type eventLog struct {
+	f       *os.File
+	nextSeq uint64
+	buf     [eventLogSlotSize]byte
+
+	pending chan Event
+	done    chan struct{}
+}
+
+// openEventLog opens the event log of the data directory, creating it if
+// needed, and continues after the most recent event it holds.
+func openEventLog(dataDir string) (*eventLog, error) {
+	f, err := os.OpenFile(filepath.Join(dataDir, EventLogFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	records, err := readEventLogRecords(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	l := &eventLog{
+		f:       f,
+		nextSeq: 1,
+		pending: make(chan Event, eventLogPending),
+		done:    make(chan struct{}),
+	}
+	if len(records) > 0 {
+		l.nextSeq = records[len(records)-1].seq + 1
+	}
+	go l.run()
+	return l, nil
+}
+
+// append queues the event for the writer without blocking.
+func (l *eventLog) append(e Event) error {
+	select {
+	case l.pending <- e:
+		return nil
+	default:
+		return errEventLogFull
+	}
+}
+
+// run writes the queued events until the log is closed.
+func (l *eventLog) run() {
+	defer close(l.done)
+	for e := range l.pending {
+		if err := l.write(e); err != nil {
+			log.Printf("failed persisting event; err = %v", err)
+		}
+	}
+}
+
+func (l *eventLog) write(e Event) error {
+	seq := l.nextSeq
+	l.nextSeq++
+
+	msg := e.Message
+	if len(msg) > eventLogMaxMsgLen {
+		msg = msg[:eventLogMaxMsgLen]
+	}
+
+	b := l.buf[:]
+	for i := range b {
+		b[i] = 0
+	}
+	binary.BigEndian.PutUint64(b[4:], seq)
+	binary.BigEndian.PutUint64(b[12:], uint64(e.Time.UnixNano()))
+	binary.BigEndian.PutUint32(b[20:], uint32(int32(e.ReplicaID)))
+	b[24] = uint8(e.Kind)
+	b[25] = uint8(e.Severity)
+	binary.BigEndian.PutUint16(b[26:], uint16(len(msg)))
+	copy(b[eventLogHeaderLen:], msg)
+	binary.BigEndian.PutUint32(b[0:], crc32.ChecksumIEEE(b[4:]))
+
+	slot := int64((seq - 1) % eventLogSlots)
+	_, err := l.f.WriteAt(b, slot*eventLogSlotSize)
+	return err
+}
+
+// close waits for the queued events to be written and closes the file.
+// The log must not be appended to anymore.
+func (l *eventLog) close() error {
+	close(l.pending)
+	<-l.done
+	return l.f.Close()
+}
+
+type eventLogRecord struct {
+	seq   uint64
+	event Event
+}
+
+// ReadEventLog returns the events persisted in the event log of the data
+// directory, oldest first. Their Evidence isn't persisted, only their Message.
+func ReadEventLog(dataDir string) ([]Event, error) {
+	f, err := os.Open(filepath.Join(dataDir, EventLogFile))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	records, err := readEventLogRecords(f)
+	if err != nil {
+		return nil, err
+	}
+	events := make([]Event, len(records))
+	for i, record := range records {
+		events[i] = record.event
+	}
+	return events, nil
+}
+
+// readEventLogRecords returns the valid records of the event log sorted
+// by sequence number.
+func readEventLogRecords(f *os.File) ([]eventLogRecord, error) {
+	var records []eventLogRecord
+	var b [eventLogSlotSize]byte
+	for slot := int64(0); slot < eventLogSlots; slot++ {
+		_, err := f.ReadAt(b[:], slot*eventLogSlotSize)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record, ok := decodeEventLogSlot(b[:]); ok {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].seq < records[j].seq })
+	return records, nil
+}
+
+func decodeEventLogSlot(b []byte) (eventLogRecord, bool) {
+	seq := binary.BigEndian.Uint64(b[4:])
+	if seq == 0 || binary.BigEndian.Uint32(b[0:]) != crc32.ChecksumIEEE(b[4:]) {
+		return eventLogRecord{}, false
+	}
+	msgLen := int(binary.BigEndian.Uint16(b[26:]))
+	if msgLen > eventLogMaxMsgLen {
+		return eventLogRecord{}, false
+	}
+	return eventLogRecord{
+		seq: seq,
+		event: Event{
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(b[12:]))),
+			ReplicaID: int(int32(binary.BigEndian.Uint32(b[20:]))),
+			Kind:      EventKind(b[24]),
+			Severity:  EventSeverity(b[25]),
+			Message:   string(b[eventLogHeaderLen : eventLogHeaderLen+msgLen]),
+		},
+	}, true
+}
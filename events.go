@@ -0,0 +1,180 @@
+package vrr
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// eventsBufferSize is how many events are kept for a slow consumer
+// before new ones start being dropped.
+const eventsBufferSize = 256
+
+type EventKind int
+
+const (
+	// EventSplitBrain means two different primaries were observed active
+	// in the same view, which the protocol should make impossible.
+	EventSplitBrain EventKind = iota
+
+	// EventStatusChange is a transition of the replica's status,
+	// including the ones entering or leaving a view change.
+	EventStatusChange
+
+	// EventPrepareAcked means the replica sent <PREPARE-OK> for an operation.
+	EventPrepareAcked
+
+	// EventInvariantViolation means the replica detected an inconsistency
+	// of the protocol state, see InvariantMode.
+	EventInvariantViolation
+
+	// EventNondeterminism means the state machine of a peer had another
+	// state after applying the same operations, see StateHasher.
+	EventNondeterminism
+
+	// EventForcedNewCluster means the replica was made the seed of a new
+	// cluster with ForceNewCluster, for the audit of the restore.
+	EventForcedNewCluster
+
+	// EventAddressChanged means a peer announced its new address, which the
+	// replica redials, see Options.AdvertiseAddr.
+	EventAddressChanged
+
+	// EventViewChangeLivelock means the view changes of the replica keep
+	// being superseded by its peers', and no view starts.
+	EventViewChangeLivelock
+
+	// EventEpochStarted means the replica installed the configuration of
+	// a new epoch, see Reconfigure.
+	EventEpochStarted
+
+	// EventStorageFailed means the replica failed to write its state to
+	// its Storage, and stopped.
+	EventStorageFailed
+)
+
+func (ek EventKind) String() string {
+	switch ek {
+	case EventSplitBrain:
+		return "Split-Brain"
+	case EventStatusChange:
+		return "Status-Change"
+	case EventPrepareAcked:
+		return "Prepare-Acked"
+	case EventInvariantViolation:
+		return "Invariant-Violation"
+	case EventNondeterminism:
+		return "Nondeterminism"
+	case EventForcedNewCluster:
+		return "Forced-New-Cluster"
+	case EventAddressChanged:
+		return "Address-Changed"
+	case EventViewChangeLivelock:
+		return "View-Change-Livelock"
+	case EventEpochStarted:
+		return "Epoch-Started"
+	case EventStorageFailed:
+		return "Storage-Failed"
+	default:
+		panic("unreachable")
+	}
+}
+
+type EventSeverity int
+
+const (
+	SeverityInfo EventSeverity = iota
+	SeverityWarning
+	SeverityCritical
+)
+
+func (es EventSeverity) String() string {
+	switch es {
+	case SeverityInfo:
+		return "Info"
+	case SeverityWarning:
+		return "Warning"
+	case SeverityCritical:
+		return "Critical"
+	default:
+		panic("unreachable")
+	}
+}
+
+// Event is a notable protocol occurrence on a replica, meant for
+// operators and monitoring rather than for driving the protocol.
+type Event struct {
+	Time      time.Time
+	ReplicaID int
+	Kind      EventKind
+	Severity  EventSeverity
+	Message   string
+
+	// Evidence holds the kind-specific data backing the event.
+	Evidence interface{}
+}
+
+// Events returns the stream of events of the replica. Events are dropped
+// rather than blocking the protocol when nobody keeps up with the stream.
+func (r *Replica) Events() <-chan Event {
+	return r.events
+}
+
+// emit publishes an event without blocking. Expects r.mu to be locked.
+func (r *Replica) emit(kind EventKind, severity EventSeverity, evidence interface{}, format string, args ...interface{}) {
+	e := Event{
+		Time:      r.clock.Now(),
+		ReplicaID: r.ID,
+		Kind:      kind,
+		Severity:  severity,
+		Message:   fmt.Sprintf(format, args...),
+		Evidence:  evidence,
+	}
+	r.dlog("event %v (%v): %s", e.Kind, e.Severity, e.Message)
+
+	if r.eventLog != nil {
+		if err := r.eventLog.append(e); err != nil {
+			log.Printf("failed persisting event; err = %v", err)
+		}
+	}
+
+	select {
+	case r.events <- e:
+	default:
+		r.droppedEvents++
+	}
+}
+
+// StatusChangeEvidence is the evidence of an EventStatusChange.
+type StatusChangeEvidence struct {
+	From    ReplicaStatus
+	To      ReplicaStatus
+	ViewNum int
+}
+
+// setStatus changes the status of the replica, emitting the transition.
+// A Normal status also makes the current view the last normal one, even when
+// the replica was already Normal in an older view.
+// Expects r.mu to be locked.
+func (r *Replica) setStatus(status ReplicaStatus) {
+	if status == Normal {
+		r.lastNormalViewNum = r.viewNum
+		r.endViewChanges()
+	} else {
+		// Gaps in the opLog are only filled in the Normal status.
+		r.forgetGap()
+	}
+	// A deposed primary must not commit on the acks of its old view.
+	if status != Normal && status != Transitioning || r.primaryID != r.ID {
+		r.ackedOpNums = nil
+	}
+	// The view may have changed along with the status, or without it.
+	r.storeMeta()
+	if r.status == status {
+		return
+	}
+	evidence := StatusChangeEvidence{From: r.status, To: status, ViewNum: r.viewNum}
+	r.status = status
+	r.emit(EventStatusChange, SeverityInfo, evidence,
+		"status %v -> %v; viewNum=%d", evidence.From, evidence.To, evidence.ViewNum)
+}
@@ -0,0 +1,482 @@
+package vrr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// The export format holds the committed state of a replica so it can be
+// migrated to another vrr cluster or into other systems. All integers are
+// big endian, and "bytes" are a uint32 length followed by that many bytes.
+//
+//	magic     [4]byte  "VRRX"
+//	version   uint16   exportVersion
+//	metadata:
+//	  replicaID  int64
+//	  viewNum    int64
+//	  commitNum  int64
+//	  exportedAt int64  Unix nanoseconds
+//	snapshot  bytes    empty, or the snapshot the entries follow
+//	count     uint64   number of entries
+//	entries, count times:
+//	  opNum      int64
+//	  namespace  bytes
+//	  clientID   int64
+//	  reqNum     int64
+//	  op         value
+//	count     uint64   number of clients
+//	clients, count times:
+//	  namespace  bytes
+//	  clientID   int64
+//	  reqNum     int64  most recent committed request of the client
+//	  result     value  result of that request
+//	checksum  uint32   IEEE CRC-32 of everything above
+//
+// A "value" is a one byte tag followed by the value itself:
+//
+//	0  nil, nothing follows
+//	1  string, bytes
+//	2  []byte, bytes
+//	3  any other Go value, bytes holding its gob encoding as an interface{}
+//
+// Strings and byte slices are readable by any system, while the gob
+// encoding of other types is only meant for migrating between Go programs
+// that register the same types.
+//
+// Only committed entries are exported, in opNum order. The snapshot is
+// the one of a replica whose opLog was compacted, the gob encoding of a
+// snapshotState: the opNum of its last operation, which the entries follow,
+// the snapshot of the state machine, see Snapshotter, and the committed
+// clientTable entries.
+//
+// Version 1 reserved the snapshot field and always left it empty. A version
+// 1 export is read as the version 2 export with the same content, unless
+// its snapshot field isn't empty, which it rejects.
+const (
+	exportMagic   = "VRRX"
+	exportVersion = 2
+)
+
+var ErrBadExport = errors.New("vrr: malformed export")
+
+type ExportMetadata struct {
+	Version    int
+	ReplicaID  int
+	ViewNum    int
+	CommitNum  int
+	ExportedAt time.Time
+}
+
+type ExportedEntry struct {
+	OpNum     int
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Op        interface{}
+}
+
+// ExportedClient is the clientTable entry of a client, so the importing
+// replica keeps deduplicating its requests.
+type ExportedClient struct {
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Result    interface{}
+}
+
+type ExportedState struct {
+	Metadata ExportMetadata
+	// Snapshot is the snapshot the Entries follow, when the opLog of the
+	// replica was compacted, see Snapshotter.
+	Snapshot []byte
+	Entries  []ExportedEntry
+	Clients  []ExportedClient
+}
+
+// Tags of the values of the export format.
+const (
+	exportNil byte = iota
+	exportString
+	exportBytes
+	exportGob
+)
+
+// gobOp wraps an operation so that its dynamic type is kept by gob.
+type gobOp struct {
+	Op interface{}
+}
+
+// Export writes the committed prefix of the opLog in the export format,
+// following the latest snapshot if the opLog was compacted.
+func (r *Replica) Export(w io.Writer) error {
+	r.mu.Lock()
+	state := ExportedState{
+		Metadata: ExportMetadata{
+			Version:    exportVersion,
+			ReplicaID:  r.ID,
+			ViewNum:    r.viewNum,
+			CommitNum:  r.commitNum,
+			ExportedAt: time.Now(),
+		},
+	}
+	type clientKey struct {
+		namespace string
+		clientID  int
+	}
+	lastReqNums := make(map[clientKey]int)
+	start := 0
+	if r.logStart > 0 {
+		state.Snapshot = r.storedSnapshot()
+		start = r.snapshotNum
+	}
+	for opNum := start + 1; opNum <= r.commitNum && opNum <= r.opNum; opNum++ {
+		e := r.logEntry(opNum)
+		state.Entries = append(state.Entries, ExportedEntry{
+			OpNum:     opNum,
+			Namespace: e.namespace,
+			ClientID:  e.clientID,
+			ReqNum:    e.reqNum,
+			Op:        e.op(),
+		})
+		key := clientKey{e.namespace, e.clientID}
+		if _, ok := lastReqNums[key]; !ok {
+			state.Clients = append(state.Clients, ExportedClient{Namespace: e.namespace, ClientID: e.clientID})
+		}
+		lastReqNums[key] = e.reqNum
+	}
+	for i := range state.Clients {
+		c := &state.Clients[i]
+		c.ReqNum = lastReqNums[clientKey{c.Namespace, c.ClientID}]
+		// The clientTable may have moved on to a request that isn't
+		// committed yet, whose result isn't known.
+		if t, ok := r.tenants[c.Namespace]; ok {
+			if entry := t.clientTable[c.ClientID]; entry.reqNum == c.ReqNum && entry.committed && entry.replied {
+				c.Result = entry.resp
+			}
+		}
+	}
+	r.mu.Unlock()
+
+	return WriteExport(w, state)
+}
+
+// WriteExport writes the state in the export format.
+func WriteExport(w io.Writer, state ExportedState) error {
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	ew := &exportWriter{w: io.MultiWriter(bw, crc)}
+
+	ew.write([]byte(exportMagic))
+	ew.writeInt(uint16(exportVersion))
+	ew.writeInt(int64(state.Metadata.ReplicaID))
+	ew.writeInt(int64(state.Metadata.ViewNum))
+	ew.writeInt(int64(state.Metadata.CommitNum))
+	ew.writeInt(state.Metadata.ExportedAt.UnixNano())
+	ew.writeBytes(state.Snapshot)
+	ew.writeInt(uint64(len(state.Entries)))
+	for _, e := range state.Entries {
+		ew.writeInt(int64(e.OpNum))
+		ew.writeBytes([]byte(e.Namespace))
+		ew.writeInt(int64(e.ClientID))
+		ew.writeInt(int64(e.ReqNum))
+		if err := ew.writeValue(e.Op); err != nil {
+			return fmt.Errorf("failed encoding operation %d: %v", e.OpNum, err)
+		}
+	}
+	ew.writeInt(uint64(len(state.Clients)))
+	for _, c := range state.Clients {
+		ew.writeBytes([]byte(c.Namespace))
+		ew.writeInt(int64(c.ClientID))
+		ew.writeInt(int64(c.ReqNum))
+		if err := ew.writeValue(c.Result); err != nil {
+			return fmt.Errorf("failed encoding the result of client %d: %v", c.ClientID, err)
+		}
+	}
+	if ew.err != nil {
+		return ew.err
+	}
+
+	if err := binary.Write(bw, binary.BigEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// ReadExport reads a state written in the export format, checking its checksum.
+func ReadExport(rd io.Reader) (ExportedState, error) {
+	crc := crc32.NewIEEE()
+	er := &exportReader{r: io.TeeReader(bufio.NewReader(rd), crc)}
+	var state ExportedState
+
+	if magic := er.read(len(exportMagic)); er.err == nil && string(magic) != exportMagic {
+		return state, fmt.Errorf("%w: bad magic %q", ErrBadExport, magic)
+	}
+	var version uint16
+	er.readInt(&version)
+	if er.err == nil && version != 1 && version != exportVersion {
+		return state, fmt.Errorf("%w: unsupported version %d", ErrBadExport, version)
+	}
+	state.Metadata.Version = exportVersion
+
+	var replicaID, viewNum, commitNum, exportedAt int64
+	er.readInt(&replicaID)
+	er.readInt(&viewNum)
+	er.readInt(&commitNum)
+	er.readInt(&exportedAt)
+	state.Metadata.ReplicaID = int(replicaID)
+	state.Metadata.ViewNum = int(viewNum)
+	state.Metadata.CommitNum = int(commitNum)
+	state.Metadata.ExportedAt = time.Unix(0, exportedAt)
+	state.Snapshot = er.readBytes()
+	if er.err == nil && version == 1 && len(state.Snapshot) != 0 {
+		return state, fmt.Errorf("%w: version 1 with a snapshot", ErrBadExport)
+	}
+
+	var count uint64
+	er.readInt(&count)
+	for i := uint64(0); i < count && er.err == nil; i++ {
+		var opNum, clientID, reqNum int64
+		er.readInt(&opNum)
+		namespace := er.readBytes()
+		er.readInt(&clientID)
+		er.readInt(&reqNum)
+		op, err := er.readValue()
+		if err != nil {
+			return state, fmt.Errorf("%w: failed decoding operation %d: %v", ErrBadExport, opNum, err)
+		}
+		if er.err != nil {
+			break
+		}
+		state.Entries = append(state.Entries, ExportedEntry{
+			OpNum:     int(opNum),
+			Namespace: string(namespace),
+			ClientID:  int(clientID),
+			ReqNum:    int(reqNum),
+			Op:        op,
+		})
+	}
+	er.readInt(&count)
+	for i := uint64(0); i < count && er.err == nil; i++ {
+		var clientID, reqNum int64
+		namespace := er.readBytes()
+		er.readInt(&clientID)
+		er.readInt(&reqNum)
+		result, err := er.readValue()
+		if err != nil {
+			return state, fmt.Errorf("%w: failed decoding the result of client %d: %v", ErrBadExport, clientID, err)
+		}
+		if er.err != nil {
+			break
+		}
+		state.Clients = append(state.Clients, ExportedClient{
+			Namespace: string(namespace),
+			ClientID:  int(clientID),
+			ReqNum:    int(reqNum),
+			Result:    result,
+		})
+	}
+	if er.err != nil {
+		return state, fmt.Errorf("%w: %v", ErrBadExport, er.err)
+	}
+
+	sum := crc.Sum32()
+	var checksum uint32
+	if err := binary.Read(er.r, binary.BigEndian, &checksum); err != nil {
+		return state, fmt.Errorf("%w: missing checksum: %v", ErrBadExport, err)
+	}
+	if checksum != sum {
+		return state, fmt.Errorf("%w: checksum mismatch", ErrBadExport)
+	}
+	return state, nil
+}
+
+// Import installs an exported state into a replica that has not started
+// replicating anything yet, e.g. to seed the replicas of a new cluster
+// before they're ready.
+func (r *Replica) Import(rd io.Reader) error {
+	state, err := ReadExport(rd)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.importState(state)
+}
+
+// importState installs the exported state. Expects r.mu to be locked.
+func (r *Replica) importState(state ExportedState) error {
+	if r.opNum != 0 {
+		return fmt.Errorf("can't import into replica %d which already has %d operations", r.ID, r.opNum)
+	}
+	start := 0
+	if len(state.Snapshot) != 0 {
+		snapshot, err := decodeSnapshot(state.Snapshot)
+		if err != nil {
+			return fmt.Errorf("%w: snapshot: %v", ErrBadExport, err)
+		}
+		start = snapshot.OpNum
+	}
+	for i, e := range state.Entries {
+		if e.OpNum != start+i+1 {
+			return fmt.Errorf("%w: entry %d has opNum %d", ErrBadExport, i, e.OpNum)
+		}
+	}
+	if len(state.Snapshot) != 0 {
+		if err := r.installSnapshot(state.Snapshot); err != nil {
+			return err
+		}
+	}
+
+	opLog := make([]opLogEntry, 0, len(state.Entries))
+	for i, e := range state.Entries {
+		opLog = append(opLog, opLogEntry{
+			opID:      start + i,
+			namespace: e.Namespace,
+			clientID:  e.ClientID,
+			reqNum:    e.ReqNum,
+			operation: encodeOp(e.Op, r.opts.CompressionThreshold),
+		})
+	}
+	for _, e := range opLog {
+		r.tenantFor(e.namespace).clientTable[e.clientID] = clientTableEntry{
+			reqNum:    e.reqNum,
+			reqOp:     e.operation,
+			committed: true,
+		}
+	}
+	for _, c := range state.Clients {
+		t := r.tenantFor(c.Namespace)
+		if entry := t.clientTable[c.ClientID]; entry.reqNum == c.ReqNum {
+			// A nil result can't be told apart from a missing one.
+			entry.resp = c.Result
+			entry.replied = c.Result != nil
+			t.clientTable[c.ClientID] = entry
+		}
+	}
+	r.opLog = opLog
+	r.recountDecodedCache()
+	r.opNum = start + len(opLog)
+	r.commitNum = r.opNum
+	r.appliedNum = r.opNum
+	r.storeLog(1)
+	r.storeMeta()
+	r.forgetReplay()
+	r.forgetSessions()
+	now := r.clock.Now()
+	for i, e := range opLog {
+		r.indexSession(e, start+i+1, now)
+	}
+	r.dlog("imported %d operations exported by replica %d", len(opLog), state.Metadata.ReplicaID)
+	return nil
+}
+
+type exportWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (ew *exportWriter) write(b []byte) {
+	if ew.err == nil {
+		_, ew.err = ew.w.Write(b)
+	}
+}
+
+func (ew *exportWriter) writeInt(v interface{}) {
+	if ew.err == nil {
+		ew.err = binary.Write(ew.w, binary.BigEndian, v)
+	}
+}
+
+func (ew *exportWriter) writeBytes(b []byte) {
+	ew.writeInt(uint32(len(b)))
+	ew.write(b)
+}
+
+func (ew *exportWriter) writeValue(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		ew.write([]byte{exportNil})
+	case string:
+		ew.write([]byte{exportString})
+		ew.writeBytes([]byte(v))
+	case []byte:
+		ew.write([]byte{exportBytes})
+		ew.writeBytes(v)
+	default:
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(gobOp{Op: v}); err != nil {
+			return err
+		}
+		ew.write([]byte{exportGob})
+		ew.writeBytes(buf.Bytes())
+	}
+	return nil
+}
+
+// maxExportBytes bounds a single length-prefixed field, so a corrupted
+// length can't make the reader allocate an arbitrary amount of memory.
+const maxExportBytes = 1 << 30
+
+type exportReader struct {
+	r   io.Reader
+	err error
+}
+
+func (er *exportReader) read(n int) []byte {
+	if er.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, er.err = io.ReadFull(er.r, b)
+	return b
+}
+
+func (er *exportReader) readInt(v interface{}) {
+	if er.err == nil {
+		er.err = binary.Read(er.r, binary.BigEndian, v)
+	}
+}
+
+func (er *exportReader) readBytes() []byte {
+	var n uint32
+	er.readInt(&n)
+	if er.err == nil && n > maxExportBytes {
+		er.err = fmt.Errorf("field of %d bytes is too large", n)
+	}
+	return er.read(int(n))
+}
+
+func (er *exportReader) readValue() (interface{}, error) {
+	tag := er.read(1)
+	if er.err != nil {
+		return nil, nil
+	}
+	switch tag[0] {
+	case exportNil:
+		return nil, nil
+	case exportString:
+		return string(er.readBytes()), nil
+	case exportBytes:
+		return er.readBytes(), nil
+	case exportGob:
+		encoded := er.readBytes()
+		if er.err != nil {
+			return nil, nil
+		}
+		var op gobOp
+		if err := gob.NewDecoder(bytes.NewReader(encoded)).Decode(&op); err != nil {
+			return nil, err
+		}
+		return op.Op, nil
+	default:
+		return nil, fmt.Errorf("unknown value tag %d", tag[0])
+	}
+}
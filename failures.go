@@ -0,0 +1,108 @@
+package vrr
+
+import (
+	"fmt"
+	"time"
+)
+
+// Most of the work of a replica runs in the background, out of any call of
+// the application: the operations are applied, the snapshots taken and
+// installed, the state written to the storage and the peers called by
+// goroutines of their own. Their failures are logged, and also reported on
+// Errors, so that the application reacts to the persistent ones, e.g. alerts
+// on a full disk or restarts the replica its storage stopped, see Restart.
+// A call to a peer failing is only reported once the peer is deemed
+// unreachable, see unreachableAfterFailures, rather than for every message
+// of the protocol. Like Events, the failures are dropped rather than
+// blocking the replica when nobody keeps up with the stream.
+
+// failuresBufferSize is how many failures are kept for a slow consumer
+// before new ones start being dropped.
+const failuresBufferSize = 64
+
+// FailureKind is what failed in the background.
+type FailureKind int
+
+const (
+	// FailureStorage is a failure to read or write the state of the
+	// replica, which stops it when it is a write.
+	FailureStorage FailureKind = iota
+
+	// FailureSnapshot is a failure to take, restore or install a snapshot.
+	FailureSnapshot
+
+	// FailureApply is the state machine failing to apply an operation, see
+	// ApplyError.
+	FailureApply
+
+	// FailurePeer is a peer the calls no longer reach.
+	FailurePeer
+
+	// FailureArchive is a failure to upload the state to Options.Archive.
+	FailureArchive
+
+	// FailureInvariant is an invariant violation or a divergence the
+	// replica can't heal from, see InvariantMode.
+	FailureInvariant
+)
+
+func (k FailureKind) String() string {
+	switch k {
+	case FailureStorage:
+		return "Storage"
+	case FailureSnapshot:
+		return "Snapshot"
+	case FailureApply:
+		return "Apply"
+	case FailurePeer:
+		return "Peer"
+	case FailureArchive:
+		return "Archive"
+	case FailureInvariant:
+		return "Invariant"
+	default:
+		panic("unreachable")
+	}
+}
+
+// BackgroundError is a failure of the background work of a replica. OpNum
+// is the operation applied or snapshotted, if any, and PeerID the peer of a
+// FailurePeer.
+type BackgroundError struct {
+	Time      time.Time
+	ReplicaID int
+	Kind      FailureKind
+	OpNum     int
+	PeerID    int
+	Err       error
+}
+
+func (e BackgroundError) Error() string {
+	return fmt.Sprintf("vrr: replica %d: %v failure: %v", e.ReplicaID, e.Kind, e.Err)
+}
+
+func (e BackgroundError) Unwrap() error {
+	return e.Err
+}
+
+// Errors returns the stream of the failures of the background work of the
+// replica.
+func (r *Replica) Errors() <-chan BackgroundError {
+	return r.failures
+}
+
+// reportFailure publishes the failure without blocking. It doesn't need
+// r.mu.
+func (r *Replica) reportFailure(kind FailureKind, opNum int, peerID int, err error) {
+	select {
+	case r.failures <- BackgroundError{
+		Time:      r.clock.Now(),
+		ReplicaID: r.ID,
+		Kind:      kind,
+		OpNum:     opNum,
+		PeerID:    peerID,
+		Err:       err,
+	}:
+	default:
+	}
+}
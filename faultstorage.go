@@ -0,0 +1,149 @@
+package vrr
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// The recovery and persistence paths are tested on a FaultyStorage rather
+// than on a disk: a MemoryStorage whose writes can be slowed down, as if
+// synced to a slow disk, or fail, every one or a single AppendLog, and which
+// can crash. A crash stops the storage, so that the replica writing to it
+// stops too, and returns the state as left on the disk, torn in the middle
+// of the last AppendLog if it is the last write: the state the replica is
+// restarted with.
+
+// ErrStorageCrashed is returned by the writes of a crashed FaultyStorage.
+var ErrStorageCrashed = errors.New("vrr: storage crashed")
+
+// FaultyStorage is a MemoryStorage with injectable faults, for the tests.
+type FaultyStorage struct {
+	mu      sync.Mutex
+	state   *MemoryStorage
+	latency time.Duration
+	// writeErr fails every write, appendErr the AppendLog after
+	// appendsLeft more.
+	writeErr    error
+	appendErr   error
+	appendsLeft int
+	// lastAppend is the last write, if it is an AppendLog.
+	lastAppend *tornAppend
+	crashed    bool
+}
+
+// tornAppend is an AppendLog which a crash may tear.
+type tornAppend struct {
+	first   int
+	entries int
+}
+
+// NewFaultyStorage returns a FaultyStorage holding the state, a new
+// MemoryStorage if nil, which it writes to until it crashes.
+func NewFaultyStorage(state *MemoryStorage) *FaultyStorage {
+	if state == nil {
+		state = NewMemoryStorage()
+	}
+	return &FaultyStorage{state: state}
+}
+
+// SetLatency makes every write take at least d.
+func (s *FaultyStorage) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// FailWrites makes every write fail with err, until called with nil.
+func (s *FaultyStorage) FailWrites(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.writeErr = err
+}
+
+// FailAppend makes the AppendLog following the next after ones fail with
+// err, once.
+func (s *FaultyStorage) FailAppend(after int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appendErr, s.appendsLeft = err, after
+}
+
+// Crash makes the writes fail with ErrStorageCrashed from now on, and
+// returns the state the storage holds, as a new MemoryStorage. If the last
+// write is an AppendLog, only its first keep entries are in the state; a
+// negative keep keeps them all.
+func (s *FaultyStorage) Crash(keep int) *MemoryStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.crashed = true
+	state := s.state.clone()
+	if a := s.lastAppend; a != nil && keep >= 0 && keep < a.entries {
+		state.AppendLog(a.first+keep, nil)
+	}
+	return state
+}
+
+// write runs the write unless a fault fails it. torn is set for an
+// AppendLog, which the crash may tear.
+func (s *FaultyStorage) write(torn *tornAppend, write func() error) error {
+	s.mu.Lock()
+	latency := s.latency
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case s.crashed:
+		return ErrStorageCrashed
+	case s.writeErr != nil:
+		return s.writeErr
+	}
+	if torn != nil && s.appendErr != nil {
+		if s.appendsLeft == 0 {
+			err := s.appendErr
+			s.appendErr = nil
+			return err
+		}
+		s.appendsLeft--
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	s.lastAppend = torn
+	return nil
+}
+
+func (s *FaultyStorage) Get(key string) ([]byte, error) {
+	return s.state.Get(key)
+}
+
+func (s *FaultyStorage) Set(key string, value []byte) error {
+	return s.write(nil, func() error { return s.state.Set(key, value) })
+}
+
+func (s *FaultyStorage) SetBatch(values map[string][]byte) error {
+	return s.write(nil, func() error { return s.state.SetBatch(values) })
+}
+
+func (s *FaultyStorage) AppendLog(first int, entries []StoredEntry) error {
+	return s.write(&tornAppend{first: first, entries: len(entries)}, func() error {
+		return s.state.AppendLog(first, entries)
+	})
+}
+
+func (s *FaultyStorage) ReadLog(from int) ([]StoredEntry, error) {
+	return s.state.ReadLog(from)
+}
+
+func (s *FaultyStorage) CompactLog(upTo int) error {
+	return s.write(nil, func() error { return s.state.CompactLog(upTo) })
+}
+
+var (
+	_ Storage     = (*FaultyStorage)(nil)
+	_ BatchSetter = (*FaultyStorage)(nil)
+)
@@ -0,0 +1,12 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package vrr
+
+import "os"
+
+// lockFile doesn't lock the file on the platforms without flock: nothing
+// guards the data directory from a second process there.
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,311 @@
+package vrr
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Gateway runs alongside a Replica and translates JSON-over-HTTP calls into
+// client protocol requests, so that non-Go clients can submit operations and
+// read their results. The wire spec is:
+//
+//	POST /v1/sessions
+//	    Opens a session, replies 201 with {"session_id": <string>}.
+//	    A session is a client of the replication group, whose requests are
+//	    deduplicated by the primary's clientTable. The session ID is signed
+//	    with the session key of the gateway, so it can be used through any
+//	    gateway of the group sharing the key, e.g. the primary's one after a
+//	    redirection, and can't be made up to submit as another client.
+//
+//	POST /v1/sessions/{session_id}/ops
+//	    Body {"namespace": <string, optional>, "req_num": <int>,
+//	    "op": <any JSON value>}. The request numbers of a session start at 1
+//	    and grow with every new request; a request is retried with its own
+//	    number, so that it runs once however many times it is sent.
+//	    Replies 202 with {"req_num": <int>} once the primary has accepted the
+//	    operation, or accepted it already, 307 to the primary's gateway when
+//	    this replica isn't the primary, 400 for an invalid operation or
+//	    request number, 404 for a session the group didn't open, 409 when a
+//	    more recent request of the session was accepted, 429 when the
+//	    namespace is rate limited or the primary is overloaded, or 503 when
+//	    the request can't be accepted right now (e.g. view change in
+//	    progress).
+//
+//	GET /v1/sessions/{session_id}/ops/{req_num}?namespace=<string>
+//	    Replies 200 with {"req_num": <int>, "committed": <bool>, "result": <any>}
+//	    for the most recent request of the session, or 404 if it isn't known.
+//
+// Every reply carries the X-Vrr-Primary header with the ID of the primary
+// as known by this replica. Errors are replied as {"error": <string>}.
+type Gateway struct {
+	mu sync.Mutex
+
+	replica *Replica
+
+	// peerGateways maps replica IDs to the base URL (e.g. "http://host:8080")
+	// of the gateways running alongside them, used for primary redirection.
+	peerGateways map[int]string
+
+	sessions    map[int]*gatewaySession
+	idleTimeout time.Duration
+	sessionKey  []byte
+}
+
+type gatewaySession struct {
+	clientID int
+	lastSeen time.Time
+}
+
+// NewGateway returns a gateway for the replica. Sessions idle for longer than
+// idleTimeout are forgotten. The session IDs are signed with sessionKey,
+// which the gateways of the group share; an empty one is replaced by a
+// random key, so the sessions only work through this gateway.
+func NewGateway(replica *Replica, peerGateways map[int]string, idleTimeout time.Duration, sessionKey []byte) *Gateway {
+	if len(sessionKey) == 0 {
+		sessionKey = make([]byte, sha256.Size)
+		if _, err := crand.Read(sessionKey); err != nil {
+			panic(fmt.Sprintf("vrr: generating a gateway session key: %v", err))
+		}
+	}
+	return &Gateway{
+		replica:      replica,
+		peerGateways: peerGateways,
+		sessions:     make(map[int]*gatewaySession),
+		idleTimeout:  idleTimeout,
+		sessionKey:   sessionKey,
+	}
+}
+
+// ListenAndServe serves the gateway on the TCP address addr.
+func (g *Gateway) ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, g)
+}
+
+// gatewaySessionReply carries the session ID as a string, since it doesn't
+// fit in the integers JSON numbers can represent exactly.
+type gatewaySessionReply struct {
+	SessionID string `json:"session_id"`
+}
+
+type gatewaySubmitRequest struct {
+	Namespace string      `json:"namespace"`
+	ReqNum    int         `json:"req_num"`
+	Op        interface{} `json:"op"`
+}
+
+type gatewaySubmitReply struct {
+	ReqNum int `json:"req_num"`
+}
+
+type gatewayResultReply struct {
+	ReqNum    int         `json:"req_num"`
+	Committed bool        `json:"committed"`
+	Result    interface{} `json:"result"`
+}
+
+type gatewayErrorReply struct {
+	Error string `json:"error"`
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	_, primaryID, _ := g.primary()
+	w.Header().Set("X-Vrr-Primary", strconv.Itoa(primaryID))
+
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" || parts[1] != "sessions" {
+		g.replyError(w, http.StatusNotFound, "unknown path %s", req.URL.Path)
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && req.Method == http.MethodPost:
+		g.openSession(w)
+	case len(parts) == 4 && parts[3] == "ops" && req.Method == http.MethodPost:
+		g.submit(w, req, parts[2])
+	case len(parts) == 5 && parts[3] == "ops" && req.Method == http.MethodGet:
+		g.result(w, req, parts[2], parts[4])
+	default:
+		g.replyError(w, http.StatusNotFound, "unknown path %s %s", req.Method, req.URL.Path)
+	}
+}
+
+func (g *Gateway) openSession(w http.ResponseWriter) {
+	g.mu.Lock()
+	g.expireSessions()
+	clientID := rand.Int()
+	for _, ok := g.sessions[clientID]; ok; _, ok = g.sessions[clientID] {
+		clientID = rand.Int()
+	}
+	g.sessions[clientID] = &gatewaySession{clientID: clientID, lastSeen: time.Now()}
+	g.mu.Unlock()
+
+	g.reply(w, http.StatusCreated, gatewaySessionReply{SessionID: g.sessionID(clientID)})
+}
+
+func (g *Gateway) submit(w http.ResponseWriter, req *http.Request, sessionID string) {
+	if isPrimary, primaryID, ok := g.primary(); !isPrimary {
+		g.redirectToPrimary(w, req, primaryID, ok)
+		return
+	}
+
+	var body gatewaySubmitRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		g.replyError(w, http.StatusBadRequest, "malformed body: %v", err)
+		return
+	}
+	if body.ReqNum < 1 {
+		g.replyError(w, http.StatusBadRequest, "req_num must be at least 1, got %d", body.ReqNum)
+		return
+	}
+
+	g.mu.Lock()
+	session, ok := g.session(sessionID)
+	g.mu.Unlock()
+	if !ok {
+		g.replyError(w, http.StatusNotFound, "unknown session %s", sessionID)
+		return
+	}
+
+	clientReq := clientRequest{
+		namespace: body.Namespace,
+		clientID:  session.clientID,
+		reqNum:    body.ReqNum,
+		reqOp:     body.Op,
+	}
+	if err := g.replica.Submit(clientReq); err != nil {
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, ErrInvalidOperation) {
+			status = http.StatusBadRequest
+		} else if errors.Is(err, ErrDuplicateRequest) {
+			// A retry of the most recent request, whose reply was lost,
+			// was accepted already.
+			if last, _ := g.replica.clientTableEntry(body.Namespace, session.clientID); last.reqNum == body.ReqNum {
+				g.reply(w, http.StatusAccepted, gatewaySubmitReply{ReqNum: body.ReqNum})
+				return
+			}
+			status = http.StatusConflict
+		} else if errors.Is(err, ErrRateLimited) || errors.Is(err, ErrOverloaded) {
+			status = http.StatusTooManyRequests
+		}
+		g.replyError(w, status, "request %d was not accepted by the primary: %v", clientReq.reqNum, err)
+		return
+	}
+	g.reply(w, http.StatusAccepted, gatewaySubmitReply{ReqNum: clientReq.reqNum})
+}
+
+func (g *Gateway) result(w http.ResponseWriter, req *http.Request, sessionID string, reqNumStr string) {
+	reqNum, err := strconv.Atoi(reqNumStr)
+	if err != nil {
+		g.replyError(w, http.StatusBadRequest, "malformed request number %q", reqNumStr)
+		return
+	}
+
+	g.mu.Lock()
+	session, ok := g.session(sessionID)
+	g.mu.Unlock()
+	if !ok {
+		g.replyError(w, http.StatusNotFound, "unknown session %s", sessionID)
+		return
+	}
+
+	entry, ok := g.replica.clientTableEntry(req.URL.Query().Get("namespace"), session.clientID)
+	if !ok || entry.reqNum != reqNum {
+		g.replyError(w, http.StatusNotFound, "request %d of session %s is not the most recent one known", reqNum, sessionID)
+		return
+	}
+	g.reply(w, http.StatusOK, gatewayResultReply{
+		ReqNum:    entry.reqNum,
+		Committed: entry.committed,
+		Result:    entry.resp,
+	})
+}
+
+func (g *Gateway) redirectToPrimary(w http.ResponseWriter, req *http.Request, primaryID int, known bool) {
+	base, ok := g.peerGateways[primaryID]
+	if !known || !ok {
+		g.replyError(w, http.StatusServiceUnavailable, "this replica is not the primary and primary %d has no known gateway", primaryID)
+		return
+	}
+	http.Redirect(w, req, strings.TrimRight(base, "/")+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+}
+
+// primary tells whether the local replica is the primary, the ID of the
+// primary it knows about, and whether that knowledge is usable (i.e. the
+// replica isn't in the middle of a view change).
+func (g *Gateway) primary() (bool, int, bool) {
+	g.replica.mu.Lock()
+	defer g.replica.mu.Unlock()
+	return g.replica.ID == g.replica.primaryID, g.replica.primaryID, g.replica.status == Normal
+}
+
+// sessionID returns the ID of the session of the client: its client ID
+// followed by their MAC under the session key.
+func (g *Gateway) sessionID(clientID int) string {
+	return strconv.Itoa(clientID) + "." + hex.EncodeToString(g.sessionMAC(clientID))
+}
+
+func (g *Gateway) sessionMAC(clientID int) []byte {
+	mac := hmac.New(sha256.New, g.sessionKey)
+	mac.Write([]byte(strconv.Itoa(clientID)))
+	return mac.Sum(nil)
+}
+
+// session returns the session with the given ID, refreshing its idleness.
+// A session opened by another gateway of the group, whose ID is signed with
+// the same key, is adopted, since all of its state lives in the replicas.
+// Expects g.mu to be locked.
+func (g *Gateway) session(sessionID string) (*gatewaySession, bool) {
+	i := strings.IndexByte(sessionID, '.')
+	if i < 0 {
+		return nil, false
+	}
+	clientID, err := strconv.Atoi(sessionID[:i])
+	if err != nil || clientID < 0 {
+		return nil, false
+	}
+	mac, err := hex.DecodeString(sessionID[i+1:])
+	if err != nil || !hmac.Equal(mac, g.sessionMAC(clientID)) {
+		return nil, false
+	}
+	session, ok := g.sessions[clientID]
+	if !ok {
+		session = &gatewaySession{clientID: clientID}
+		g.sessions[clientID] = session
+	}
+	session.lastSeen = time.Now()
+	return session, true
+}
+
+// expireSessions forgets the sessions idle for longer than the timeout.
+// Expects g.mu to be locked.
+func (g *Gateway) expireSessions() {
+	if g.idleTimeout <= 0 {
+		return
+	}
+	for clientID, session := range g.sessions {
+		if time.Since(session.lastSeen) > g.idleTimeout {
+			delete(g.sessions, clientID)
+		}
+	}
+}
+
+func (g *Gateway) reply(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (g *Gateway) replyError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	g.reply(w, status, gatewayErrorReply{Error: fmt.Sprintf(format, args...)})
+}
@@ -1,3 +1,8 @@
 module github.com/joshuabezaleel/test-vrr
 
 go 1.13
+
+require (
+	go.etcd.io/bbolt v1.3.5
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,86 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// Replicas and clients may be named by strings, e.g. hostnames or UUIDs,
+// rather than by ints. The protocol still speaks int IDs: its messages,
+// clientTables and primary selection are unchanged, and a name stands for
+// the ID ParseID derives from it. A decimal name stands for that int, so the
+// deployments numbering their replicas keep their IDs, and their primaries,
+// whether they write them as ints or as names; any other name stands for a
+// hash of it, at or above NameIDBase, the same for every replica and client
+// without them coordinating. Two names of a configuration hashing to the
+// same ID are refused, see nameIDs; the IDs of the clients aren't checked,
+// the hash making a collision about as likely as two random UUIDs meeting.
+//
+// The primary of a view is picked among the IDs of the members, so the
+// replicas named by strings take turns in the order of their hashes rather
+// than of their names.
+
+// NameIDBase is the lowest ID a non-decimal name stands for. The IDs of the
+// replicas and clients numbered by ints should stay below it.
+const NameIDBase = 1 << (strconv.IntSize - 2)
+
+// ParseID returns the ID a replica or client name stands for: the int it
+// spells if it is decimal, a hash of it otherwise.
+func ParseID(name string) (int, error) {
+	if name == "" {
+		return 0, errors.New("vrr: empty name")
+	}
+	if ID, err := strconv.Atoi(name); err == nil {
+		if ID < 0 {
+			return 0, fmt.Errorf("vrr: negative ID %d", ID)
+		}
+		return ID, nil
+	}
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int(h.Sum64()%NameIDBase) + NameIDBase, nil
+}
+
+// nameIDs returns the IDs of the names, refusing the names which stand for
+// the same ID.
+func nameIDs(names []string) (map[string]int, error) {
+	IDs := make(map[string]int, len(names))
+	named := make(map[int]string, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		ID, err := ParseID(name)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := named[ID]; ok && other != name {
+			return nil, fmt.Errorf("vrr: %q and %q stand for the same ID %d", other, name, ID)
+		}
+		IDs[name], named[ID] = ID, name
+	}
+	return IDs, nil
+}
+
+// NewNamedClient returns a client named by a string for the replicas at the
+// addresses, keyed by replica name, see ParseID.
+func NewNamedClient(name string, namespace string, addresses map[string]string) (*Client, error) {
+	ID, err := ParseID(name)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(addresses))
+	for replicaName := range addresses {
+		names = append(names, replicaName)
+	}
+	IDs, err := nameIDs(names)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[int]string, len(addresses))
+	for replicaName, addr := range addresses {
+		byID[IDs[replicaName]] = addr
+	}
+	return NewClient(ID, namespace, byID)
+}
@@ -0,0 +1,103 @@
+package vrr
+
+import (
+	"log"
+	"time"
+)
+
+// Inbound limits protect a replica from a peer flooding it with protocol
+// messages, e.g. a misbehaving or compromised one, without starving the
+// others: each peer gets Options.MaxInboundPerPeer messages handled at once,
+// and Options.MaxInboundQueuePerPeer more waiting for their turn. Its other
+// messages fail with ErrPeerBusy, on which the sender stops sending it
+// anything for a backoff doubling with every busy reply.
+
+const (
+	minBusyBackoff = 10 * time.Millisecond
+	maxBusyBackoff = time.Second
+)
+
+// inboundLimiter bounds the inbound messages of a peer.
+type inboundLimiter struct {
+	slots  chan struct{}
+	queued int
+}
+
+// busyBackoff is until when a busy peer isn't sent anything.
+type busyBackoff struct {
+	until time.Time
+	delay time.Duration
+}
+
+// limitInbound returns the interceptor bounding the inbound messages of each
+// peer, which runs once the admission checked who the sender is.
+func (s *Server) limitInbound(maxInFlight int, maxQueued int) InboundInterceptor {
+	return func(next InboundHandler) InboundHandler {
+		return func(call InboundCall) error {
+			if maxInFlight <= 0 {
+				return next(call)
+			}
+
+			s.mu.Lock()
+			l, ok := s.inboundLimiters[call.SenderID]
+			if !ok {
+				l = &inboundLimiter{slots: make(chan struct{}, maxInFlight)}
+				s.inboundLimiters[call.SenderID] = l
+			}
+			select {
+			case l.slots <- struct{}{}:
+				s.mu.Unlock()
+			default:
+				if l.queued >= maxQueued {
+					s.mu.Unlock()
+					return ErrPeerBusy
+				}
+				l.queued++
+				s.mu.Unlock()
+
+				var err error
+				select {
+				case l.slots <- struct{}{}:
+				case <-s.quit:
+					err = ErrPeerBusy
+				}
+				s.mu.Lock()
+				l.queued--
+				s.mu.Unlock()
+				if err != nil {
+					return err
+				}
+			}
+			defer func() { <-l.slots }()
+
+			return next(call)
+		}
+	}
+}
+
+// noteBusy backs off from the peer if the call failed with ErrPeerBusy, and
+// stops backing off once a call succeeds.
+func (s *Server) noteBusy(peerID int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		delete(s.busyBackoffs, peerID)
+		return
+	}
+	// The error of the peer comes back as an rpc.ServerError.
+	if err.Error() != ErrPeerBusy.Error() {
+		return
+	}
+	b, ok := s.busyBackoffs[peerID]
+	if !ok {
+		b = &busyBackoff{delay: minBusyBackoff / 2}
+		s.busyBackoffs[peerID] = b
+	}
+	b.delay *= 2
+	if b.delay > maxBusyBackoff {
+		b.delay = maxBusyBackoff
+	}
+	b.until = time.Now().Add(b.delay)
+	log.Printf("replica %d is busy, backing off for %v", peerID, b.delay)
+}
@@ -0,0 +1,172 @@
+package vrr
+
+import (
+	"log"
+	"time"
+)
+
+// A replica missing operations the primary dropped from its opLog, see
+// compactLog, can't catch up from the opLog: when its <GET-STATE> asks for
+// them, the primary streams its latest snapshot instead, in chunks of
+// Options.SnapshotChunkSize bytes paced as the <NEW-STATE>s, see
+// SetStateTransferRate. The replica installs the snapshot once it has all of
+// it, staying in StateTransfer, and asks for the operations following it
+// with another <GET-STATE>, answered from the opLog.
+//
+// The replica keeps the chunks it received when the transfer fails, e.g. on
+// a broken connection or a change of primary with the same snapshot, and its
+// next <GET-STATE> tells the primary how far it got so that the transfer
+// resumes there. A primary whose snapshot is older or newer than the one
+// being received starts it over.
+
+// incomingSnapshot is a snapshot being received, as far as it got.
+type incomingSnapshot struct {
+	snapshotNum int
+	data        []byte
+}
+
+type InstallSnapshotArgs struct {
+	ViewNum   int
+	ReplicaID int
+	// SnapshotNum is the opNum of the snapshot, Data its bytes from Offset
+	// on, the last ones if Done.
+	SnapshotNum int
+	Offset      int
+	Data        []byte
+	Done        bool
+}
+
+type InstallSnapshotReply struct {
+	IsReplied bool
+	// NextOffset is how much of the snapshot the replica holds, where the
+	// transfer goes on.
+	NextOffset int
+}
+
+// streamSnapshot starts streaming the snapshot to the replica of the
+// <GET-STATE>, from where its previous transfer stopped, and tells whether
+// it did. Expects r.mu to be locked.
+func (r *Replica) streamSnapshot(args GetStateArgs) bool {
+	data := r.storedSnapshot()
+	if data == nil {
+		r.dlog("has no snapshot for the opLog before opNum=%d, drops message", r.logStart)
+		return false
+	}
+	offset := 0
+	if args.SnapshotNum == r.snapshotNum && args.SnapshotOffset <= len(data) {
+		offset = args.SnapshotOffset
+	}
+	if r.transferring == nil {
+		r.transferring = make(map[int]bool)
+	}
+	r.transferring[args.ReplicaID] = true
+	template := InstallSnapshotArgs{
+		ViewNum:     r.viewNum,
+		ReplicaID:   r.ID,
+		SnapshotNum: r.snapshotNum,
+	}
+	r.dlog("streams the snapshot at opNum=%d to %d from offset %d", r.snapshotNum, args.ReplicaID, offset)
+	go r.sendSnapshot(args.ReplicaID, template, data, offset)
+	return true
+}
+
+// sendSnapshot sends the snapshot to the peer in chunks, from offset on. It
+// follows the peer to the offset it holds once, and stops at the first chunk
+// it doesn't take otherwise; the peer asks for the rest again.
+func (r *Replica) sendSnapshot(peerID int, template InstallSnapshotArgs, data []byte, offset int) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.transferring, peerID)
+		r.mu.Unlock()
+	}()
+
+	resumed := false
+	for {
+		r.mu.Lock()
+		end := offset + r.opts.SnapshotChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		wait := time.Duration(0)
+		if pacer := r.transferPacerFor(peerID); pacer != nil {
+			wait = pacer.reserve(end-offset, r.clock.Now())
+		}
+		r.mu.Unlock()
+
+		if wait > 0 {
+			r.dlog("paces the snapshot to %d for %v", peerID, wait)
+			ticker := r.clock.NewTicker(wait)
+			<-ticker.C()
+			ticker.Stop()
+		}
+
+		var reply InstallSnapshotReply
+		args := template
+		args.Offset = offset
+		args.Data = data[offset:end]
+		args.Done = end == len(data)
+		r.dlog("sending <INSTALL-SNAPSHOT> to %d; offset=%d; bytes=%d; done=%v", peerID, offset, len(args.Data), args.Done)
+		if err := r.server.Call(peerID, "Replica.InstallSnapshot", args, &reply); err != nil {
+			log.Printf("failed sending <INSTALL-SNAPSHOT>; err = %v", err.Error())
+			return
+		}
+		if !reply.IsReplied {
+			if resumed || reply.NextOffset == offset || reply.NextOffset > len(data) {
+				return
+			}
+			offset, resumed = reply.NextOffset, true
+			continue
+		}
+		if args.Done {
+			return
+		}
+		offset, resumed = end, false
+	}
+}
+
+func (r *Replica) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("InstallSnapshot: view=%d snapshotNum=%d offset=%d bytes=%d done=%v [currentView=%d]", args.ViewNum, args.SnapshotNum, args.Offset, len(args.Data), args.Done, r.viewNum)
+
+	if r.status != StateTransfer || args.ViewNum != r.viewNum || args.SnapshotNum <= r.opNum {
+		r.dlog("not waiting for this INSTALL-SNAPSHOT, drops message")
+		return nil
+	}
+	s := r.incomingSnapshot
+	if s == nil || s.snapshotNum != args.SnapshotNum {
+		s = &incomingSnapshot{snapshotNum: args.SnapshotNum}
+		r.incomingSnapshot = s
+	}
+	reply.NextOffset = len(s.data)
+	if args.Offset != len(s.data) {
+		r.dlog("holds %d bytes of the snapshot, not %d, drops message", len(s.data), args.Offset)
+		return nil
+	}
+	reply.IsReplied = true
+
+	s.data = append(s.data, args.Data...)
+	reply.NextOffset = len(s.data)
+	r.viewChangeResetEvent = r.clock.Now()
+	// The next chunk is on its way, no need to ask for it.
+	r.nextStateRequestAt = r.clock.Now().Add(2 * r.opts.HeartbeatInterval)
+	if !args.Done {
+		return nil
+	}
+
+	r.incomingSnapshot = nil
+	if err := r.installSnapshot(s.data); err != nil {
+		log.Printf("failed installing the snapshot at opNum=%d; err = %v", args.SnapshotNum, err.Error())
+		r.reportFailure(FailureSnapshot, args.SnapshotNum, 0, err)
+		return nil
+	}
+	r.storeMeta()
+	// The operations following the snapshot come from the opLog.
+	r.nextStateRequestAt = r.clock.Now()
+	r.requestState()
+	return nil
+}
@@ -0,0 +1,99 @@
+package vrr
+
+// InboundCall is a protocol message received from a peer, as seen by the
+// inbound interceptors.
+type InboundCall struct {
+	// Method is the name of the handler, e.g. "Prepare".
+	Method string
+
+	// SenderID is the replica ID the message claims to come from.
+	SenderID int
+
+	// Peer is the identity handshaken on the connection the message came
+	// in on, nil if the peer hasn't identified itself.
+	Peer *PeerIdentity
+
+	// Args are the arguments of the handler, e.g. a PrepareArgs.
+	// They must not be modified.
+	Args interface{}
+}
+
+// InboundHandler handles an inbound protocol message.
+type InboundHandler func(call InboundCall) error
+
+// InboundInterceptor wraps the handlers of the protocol messages received
+// from peers, for authentication, metrics or fault injection. It may reject
+// the message by returning an error without calling next, drop it by
+// returning nil without calling next, in which case the sender gets
+// ErrMessageDropped, or delay it.
+//
+// The replica's admission of the peer runs first, then its inbound limits,
+// see Options.MaxInboundPerPeer, then the interceptors added to the Server
+// with AddInboundInterceptor, in the order they were added, then the ones of
+// Options.InboundInterceptors, first one outermost, then the capture of the
+// messages, see CaptureProtocol. Client requests and Stats aren't intercepted.
+type InboundInterceptor func(next InboundHandler) InboundHandler
+
+// AddInboundInterceptor wraps the protocol handlers of the server's replica
+// with the interceptor, e.g. to inject faults in tests.
+func (s *Server) AddInboundInterceptor(interceptor InboundInterceptor) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inboundInterceptors = append(s.inboundInterceptors, interceptor)
+}
+
+// admission is the replica's built-in interceptor: it rejects the messages
+// whose sender isn't the peer handshaken on the connection, then the ones of
+// the peers of another ClusterEpoch, then the ones the UnknownPeerPolicy
+// doesn't admit.
+func (r *Replica) admission(next InboundHandler) InboundHandler {
+	return func(call InboundCall) error {
+		if call.Peer == nil || call.Peer.ReplicaID != call.SenderID {
+			return ErrPeerIdentity
+		}
+		r.mu.Lock()
+		epoch := r.opts.ClusterEpoch
+		admitted := call.Peer.ClusterEpoch == epoch && r.admitPeer(*call.Peer, call.Method)
+		r.mu.Unlock()
+		if call.Peer.ClusterEpoch != epoch {
+			r.dlog("rejects %s from replica %d of cluster epoch %d", call.Method, call.SenderID, call.Peer.ClusterEpoch)
+			return ErrFencedPeer
+		}
+		if !admitted {
+			return ErrUnknownPeer
+		}
+		return next(call)
+	}
+}
+
+// intercept runs the handler of the inbound message through the replica's
+// admission, then the interceptors. A message an interceptor drops is
+// reported to the sender as ErrMessageDropped.
+func (rpp *RPCProxy) intercept(method string, senderID int, args interface{}, handle func(r *Replica) error) error {
+	r, err := rpp.replica()
+	if err != nil {
+		return err
+	}
+
+	rpp.s.mu.Lock()
+	interceptors := make([]InboundInterceptor, 0, 3+len(rpp.s.inboundInterceptors)+len(r.opts.InboundInterceptors))
+	interceptors = append(interceptors, r.admission, rpp.s.limitInbound(r.opts.MaxInboundPerPeer, r.opts.MaxInboundQueuePerPeer))
+	interceptors = append(interceptors, rpp.s.inboundInterceptors...)
+	rpp.s.mu.Unlock()
+	interceptors = append(interceptors, r.opts.InboundInterceptors...)
+	interceptors = append(interceptors, r.captureInbound)
+
+	handled := false
+	h := func(InboundCall) error {
+		handled = true
+		return handle(r)
+	}
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		h = interceptors[i](h)
+	}
+	err = h(InboundCall{Method: method, SenderID: senderID, Peer: rpp.peerIdentity(), Args: args})
+	if err == nil && !handled {
+		return ErrMessageDropped
+	}
+	return err
+}
@@ -0,0 +1,87 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+	"log"
+)
+
+// InvariantMode is how a replica reacts when it detects that the protocol
+// state it is asked to install contradicts its own, e.g. a regression of its
+// commitNum or viewNum, or an opLog diverging from the primary's.
+type InvariantMode int
+
+const (
+	// LenientInvariants drops the offending message and heals the replica
+	// by making it forget its state and recover it, see StartRecovery; a
+	// diverging opLog is healed as the ResyncPolicy of the replica says.
+	// Only a replica whose state machine is a StateResetter can be healed,
+	// the others are stopped.
+	LenientInvariants InvariantMode = iota
+
+	// StrictInvariants panics, so that the inconsistency is investigated
+	// rather than papered over.
+	StrictInvariants
+)
+
+func (m InvariantMode) String() string {
+	switch m {
+	case LenientInvariants:
+		return "Lenient"
+	case StrictInvariants:
+		return "Strict"
+	default:
+		panic("unreachable")
+	}
+}
+
+// InvariantViolationEvidence is the evidence of an EventInvariantViolation.
+type InvariantViolationEvidence struct {
+	// Invariant names the violated invariant, e.g. "commitNum regression".
+	Invariant string
+	Mode      InvariantMode
+	ViewNum   int
+	OpNum     int
+	CommitNum int
+}
+
+// errUnhealable is the failure reported for an invariant violation the
+// replica can't heal from, its state machine not being a StateResetter.
+var errUnhealable = errors.New("can't heal from an invariant violation: the state machine is not a StateResetter")
+
+// violateInvariant reports the violation of the invariant and handles it as
+// the InvariantMode of the replica says. The caller must drop the message
+// which revealed the violation. Expects r.mu to be locked.
+func (r *Replica) violateInvariant(invariant string, format string, args ...interface{}) {
+	r.reportViolation(invariant, format, args...)
+	if !r.resyncState() {
+		log.Printf("%v, stopping", errUnhealable)
+		go r.closeFiles(r.stop())
+	}
+}
+
+// divergeLog is violateInvariant for an opLog diverging from the primary's at
+// opNum, which is healed as the ResyncPolicy of the replica says.
+// Expects r.mu to be locked.
+func (r *Replica) divergeLog(opNum int, format string, args ...interface{}) {
+	r.reportViolation("log divergence", format, args...)
+	r.resyncLog(opNum)
+}
+
+// reportViolation emits the violation of the invariant, and panics in
+// StrictInvariants mode. Expects r.mu to be locked.
+func (r *Replica) reportViolation(invariant string, format string, args ...interface{}) {
+	evidence := InvariantViolationEvidence{
+		Invariant: invariant,
+		Mode:      r.opts.InvariantMode,
+		ViewNum:   r.viewNum,
+		OpNum:     r.opNum,
+		CommitNum: r.commitNum,
+	}
+	msg := fmt.Sprintf(format, args...)
+	r.emit(EventInvariantViolation, SeverityCritical, evidence, "%s: %s", invariant, msg)
+
+	if r.opts.InvariantMode == StrictInvariants {
+		panic(fmt.Sprintf("vrr: replica %d: %s: %s", r.ID, invariant, msg))
+	}
+}
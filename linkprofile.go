@@ -0,0 +1,55 @@
+package vrr
+
+import (
+	"math/rand"
+	"time"
+)
+
+// LinkProfile describes the emulated network conditions of the link
+// from a server to one of its peers.
+type LinkProfile struct {
+	Name string
+
+	// Every message is delayed by Latency plus a random jitter in [0, Jitter).
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Loss is the probability in [0, 1] that a message is dropped.
+	Loss float64
+}
+
+// Named presets for the usual deployment shapes, so test scenarios can be
+// expressed declaratively and compared across releases.
+var (
+	ProfileLAN         = LinkProfile{Name: "lan", Latency: 200 * time.Microsecond, Jitter: 300 * time.Microsecond}
+	ProfileSameRegion  = LinkProfile{Name: "same-region", Latency: 2 * time.Millisecond, Jitter: 2 * time.Millisecond, Loss: 0.0001}
+	ProfileCrossRegion = LinkProfile{Name: "cross-region", Latency: 70 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.001}
+	ProfileLossyMobile = LinkProfile{Name: "lossy-mobile", Latency: 120 * time.Millisecond, Jitter: 100 * time.Millisecond, Loss: 0.05}
+)
+
+var linkProfiles = map[string]LinkProfile{
+	ProfileLAN.Name:         ProfileLAN,
+	ProfileSameRegion.Name:  ProfileSameRegion,
+	ProfileCrossRegion.Name: ProfileCrossRegion,
+	ProfileLossyMobile.Name: ProfileLossyMobile,
+}
+
+// LinkProfileByName returns the preset with the given name.
+func LinkProfileByName(name string) (LinkProfile, bool) {
+	p, ok := linkProfiles[name]
+	return p, ok
+}
+
+// delay returns how long a message sent over the link should be held.
+func (p LinkProfile) delay() time.Duration {
+	d := p.Latency
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return d
+}
+
+// drop tells whether a message sent over the link should be lost.
+func (p LinkProfile) drop() bool {
+	return p.Loss > 0 && rand.Float64() < p.Loss
+}
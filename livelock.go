@@ -0,0 +1,83 @@
+package vrr
+
+import (
+	"math/rand"
+	"time"
+)
+
+// A view change which doesn't complete in time is followed by the next one,
+// with another primary, see primaryOfView. The timeout doubles with every view
+// change failing in a row, so that a group missing a quorum, or whose
+// candidates are down one after the other, doesn't storm the network. Two
+// replicas whose timers keep expiring about together may duel though: the
+// <START-VIEW-CHANGE> of each one supersedes the view change of the other
+// before it completes, and no view is ever started. The watchdog counts the
+// rounds a replica lost that way and surfaces an EventViewChangeLivelock once
+// they pile up. The replica which lost a round also waits a random extra
+// delay before starting the next view change, so that the other one likely
+// wins the next round.
+
+const (
+	// livelockRounds is how many view changes in a row the replica lets
+	// peers supersede before reporting a livelock.
+	livelockRounds = 3
+
+	// maxViewChangeBackoff bounds the view change timeout after failed
+	// view changes, before its jitter.
+	maxViewChangeBackoff = 10 * time.Second
+)
+
+// ViewChangeLivelockEvidence is the evidence of an EventViewChangeLivelock.
+type ViewChangeLivelockEvidence struct {
+	ViewNum int
+
+	// LostRounds is how many view changes in a row the replica initiated
+	// and saw superseded, the last one by RivalID's.
+	LostRounds int
+	RivalID    int
+
+	ViewChangeTimeout time.Duration
+}
+
+// viewChangeTimeout returns how long a view change timer waits, backing off
+// after failed view changes and randomized so that the replicas don't all
+// time out together. Expects r.mu to be locked.
+func (r *Replica) viewChangeTimeout() time.Duration {
+	timeout := r.opts.ViewChangeTimeout
+	for i := 0; i < r.failedViewChanges && timeout < maxViewChangeBackoff; i++ {
+		timeout *= 2
+	}
+	if timeout > maxViewChangeBackoff {
+		timeout = maxViewChangeBackoff
+	}
+	return timeout + time.Duration(rand.Int63n(int64(timeout))) + r.viewChangeExtraDelay
+}
+
+// loseViewChangeRound records that the view change the replica initiated was
+// superseded by the one of the rival, for the view viewNum.
+// Expects r.mu to be locked.
+func (r *Replica) loseViewChangeRound(rivalID int, viewNum int) {
+	r.lostViewChanges++
+	r.viewChangeExtraDelay = time.Duration(rand.Int63n(int64(r.opts.ViewChangeTimeout)))
+	r.dlog("view change of view %d superseded by replica %d's, %d in a row", r.viewNum, rivalID, r.lostViewChanges)
+
+	if r.lostViewChanges%livelockRounds == 0 {
+		evidence := ViewChangeLivelockEvidence{
+			ViewNum:           viewNum,
+			LostRounds:        r.lostViewChanges,
+			RivalID:           rivalID,
+			ViewChangeTimeout: r.opts.ViewChangeTimeout,
+		}
+		r.emit(EventViewChangeLivelock, SeverityWarning, evidence,
+			"%d view changes in a row superseded, the last one by replica %d's; consider increasing ViewChangeTimeout from %v",
+			evidence.LostRounds, rivalID, evidence.ViewChangeTimeout)
+	}
+}
+
+// endViewChanges forgets the view changes lost or failed once a view is
+// started. Expects r.mu to be locked.
+func (r *Replica) endViewChanges() {
+	r.lostViewChanges = 0
+	r.failedViewChanges = 0
+	r.viewChangeExtraDelay = 0
+}
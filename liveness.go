@@ -0,0 +1,85 @@
+package vrr
+
+import (
+	"net/rpc"
+	"time"
+)
+
+// The results of the calls to the peers tell which ones are reachable: a
+// peer whose last calls all failed to reach it is skipped when picking the
+// primary of a view, along with the ones the FailureDetector reports dead, so
+// that a view change doesn't stall on a dead candidate until the next one.
+// A peer which answered with an error, e.g. ErrStaleView, was reached.
+
+// unreachableAfterFailures is how many calls in a row must fail to reach a
+// peer for it to be deemed unreachable; a view change calls each peer twice,
+// with <PRE-VOTE> and <START-VIEW-CHANGE>, before picking the primary.
+const unreachableAfterFailures = 2
+
+// peerLiveness is what the results of the calls tell of a peer.
+type peerLiveness struct {
+	failures      int
+	lastReachedAt time.Time
+}
+
+// notePeerReached records whether the call reached the peer, and reports
+// the peer once it becomes unreachable.
+func (s *Server) notePeerReached(peerID int, err error) {
+	s.mu.Lock()
+	l, ok := s.peerLiveness[peerID]
+	if !ok {
+		l = &peerLiveness{}
+		s.peerLiveness[peerID] = l
+	}
+	lost := false
+	if reached(err) {
+		l.failures = 0
+		l.lastReachedAt = time.Now()
+	} else {
+		l.failures++
+		lost = l.failures == unreachableAfterFailures
+	}
+	replica := s.replica
+	s.mu.Unlock()
+
+	if lost && replica != nil {
+		replica.reportFailure(FailurePeer, 0, peerID, err)
+	}
+}
+
+// reached reports whether the peer handled the call, successfully or not.
+func reached(err error) bool {
+	if _, ok := err.(rpc.ServerError); ok || err == nil {
+		return true
+	}
+	for _, remoteErr := range remoteErrors {
+		if err == remoteErr {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnreachable reports whether the last calls to the peer all failed to
+// reach it.
+func (s *Server) isUnreachable(peerID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.peerLiveness[peerID]
+	return ok && l.failures >= unreachableAfterFailures
+}
+
+// peerHealth is what the failure detector knows of the peer, or else what the
+// results of the calls to it tell. Expects r.mu to be locked.
+func (r *Replica) peerHealth(peerID int) PeerHealth {
+	if r.opts.FailureDetector != nil {
+		if health := r.opts.FailureDetector.PeerHealth(peerID); health != PeerUnknown {
+			return health
+		}
+	}
+	if r.server != nil && r.server.isUnreachable(peerID) {
+		return PeerDead
+	}
+	return PeerUnknown
+}
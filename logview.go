@@ -0,0 +1,58 @@
+package vrr
+
+import "fmt"
+
+// LogEntry is a committed entry of the log, as exposed to the state
+// machines and embedders reading the log.
+type LogEntry struct {
+	OpNum     int
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Op        interface{}
+}
+
+// CommittedEntries returns the committed log entries with opNum from from to
+// to, inclusive. It never exposes uncommitted entries: it fails with
+// ErrNotCommitted if any of them isn't committed yet, and with ErrCompacted
+// if some were dropped for a snapshot.
+// The entries are copies and []byte operations are copied too, but
+// operations of other reference types must not be modified.
+func (r *Replica) CommittedEntries(from, to int) ([]LogEntry, error) {
+	if from < 1 || from > to {
+		return nil, fmt.Errorf("vrr: invalid log range [%d, %d]", from, to)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if to > r.commitNum || to > r.opNum {
+		return nil, fmt.Errorf("%w: asked up to %d, committed up to %d", ErrNotCommitted, to, r.commitNum)
+	}
+	if from <= r.logStart {
+		return nil, fmt.Errorf("%w: asked from %d, the opLog starts at %d", ErrCompacted, from, r.logStart+1)
+	}
+
+	entries := make([]LogEntry, 0, to-from+1)
+	for i, e := range r.logRange(from, to) {
+		op := e.op()
+		if b, ok := op.([]byte); ok {
+			op = append([]byte(nil), b...)
+		}
+		entries = append(entries, LogEntry{
+			OpNum:     from + i,
+			Namespace: e.namespace,
+			ClientID:  e.clientID,
+			ReqNum:    e.reqNum,
+			Op:        op,
+		})
+	}
+	return entries, nil
+}
+
+// CommitNum returns the opNum of the most recent committed log entry.
+func (r *Replica) CommitNum() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.commitNum
+}
@@ -0,0 +1,84 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The primary of a view is a pure function of the view number and of the
+// members of the replica group, their IDs in increasing order: the members
+// take turns, see nextPrimary. The replicas agree on it however their
+// configurations were built, and whatever the gaps between the IDs. So that
+// two replicas with different members, which would pick different primaries,
+// don't work together, the replicas of the same epoch compare their members
+// on the handshake of every connection, see checkMembership. Only the
+// messages of the members count towards the quorums, see isMember: the
+// replicas a reconfiguration removed may still be answering. IDs are
+// arbitrary non-negative ints, e.g. derived from the machine; -1 stands for
+// no replica.
+
+// ErrMembershipMismatch is returned by the handshake of a peer whose members
+// differ from the replica's in the same epoch.
+var ErrMembershipMismatch = errors.New("vrr: peer has other members in the same epoch")
+
+// membership is the members of the replica group in an epoch, as exchanged
+// on the handshake.
+type membership struct {
+	EpochNum int
+	Members  []int
+}
+
+// membersOf returns the IDs of the replica and of its peers, in increasing
+// order.
+func membersOf(ID int, configuration map[int]string) []int {
+	members := make([]int, 0, len(configuration)+1)
+	members = append(members, ID)
+	for peerID := range configuration {
+		members = append(members, peerID)
+	}
+	sort.Ints(members)
+	return members
+}
+
+// nextPrimary returns the primary of the view among the members, in
+// increasing order: the replicas take turns, so that a view change failing
+// because its primary is down is followed by one with another primary.
+func nextPrimary(viewNum int, members []int) int {
+	return members[viewNum%len(members)]
+}
+
+// isMember tells whether the replica of the ID is a member of the current
+// epoch, the replica itself included. Expects r.mu to be locked.
+func (r *Replica) isMember(ID int) bool {
+	if ID == r.ID {
+		return true
+	}
+	_, ok := r.configuration[ID]
+	return ok
+}
+
+// setConfiguration installs the configuration of the peers, and the
+// membership the handshakes are checked against. Expects r.mu to be locked.
+func (r *Replica) setConfiguration(configuration map[int]string) {
+	r.configuration = configuration
+	r.membership.Store(membership{EpochNum: r.epochNum, Members: membersOf(r.ID, configuration)})
+}
+
+// checkMembership checks the members of a peer of the epoch against the
+// replica's. The peers of other epochs are catching up with a
+// reconfiguration, or the replica is.
+func (r *Replica) checkMembership(epochNum int, members []int) error {
+	own, ok := r.membership.Load().(membership)
+	if !ok || members == nil || epochNum != own.EpochNum {
+		return nil
+	}
+	mismatch := len(members) != len(own.Members)
+	for i := 0; !mismatch && i < len(members); i++ {
+		mismatch = members[i] != own.Members[i]
+	}
+	if mismatch {
+		return fmt.Errorf("%w: %v in epoch %d, not %v", ErrMembershipMismatch, members, epochNum, own.Members)
+	}
+	return nil
+}
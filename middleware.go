@@ -0,0 +1,43 @@
+package vrr
+
+// SubmitRequest is a client request on its way to being admitted by the
+// primary, as seen by the submit middlewares.
+type SubmitRequest struct {
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Op        interface{}
+
+	// Annotations come with the request from the client and are only meant
+	// for the middlewares, e.g. to authenticate it; they aren't replicated.
+	Annotations map[string]string
+}
+
+func (sr SubmitRequest) clientRequest() clientRequest {
+	return clientRequest{
+		namespace: sr.Namespace,
+		clientID:  sr.ClientID,
+		reqNum:    sr.ReqNum,
+		reqOp:     sr.Op,
+	}
+}
+
+// SubmitFunc admits a request, returning nil once it is accepted for
+// replication or an error telling why it was dropped.
+type SubmitFunc func(req SubmitRequest) error
+
+// SubmitMiddleware wraps the admission of requests by the primary, so that
+// logging, authentication, validation, rate limiting or metrics can be
+// composed around it. A middleware may reject the request by returning an
+// error without calling next, or alter the request it passes to next.
+type SubmitMiddleware func(next SubmitFunc) SubmitFunc
+
+// chainSubmitMiddlewares wraps admit with the middlewares,
+// the first one being the outermost.
+func chainSubmitMiddlewares(middlewares []SubmitMiddleware, admit SubmitFunc) SubmitFunc {
+	h := admit
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+	return h
+}
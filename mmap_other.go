@@ -0,0 +1,24 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package vrr
+
+import (
+	"io"
+	"os"
+)
+
+// mmapFile reads the first size bytes of the file on the platforms without
+// mmap: the MmapStorage then reads the whole files when they grew.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	b := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(f, 0, size), b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// munmapFile releases what mmapFile read.
+func munmapFile(b []byte) error {
+	return nil
+}
@@ -0,0 +1,519 @@
+package vrr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A replica whose opLog holds millions of entries restores it slowly from the
+// WAL, which replays every record into memory, or from bbolt, which walks
+// its B+tree. An MmapStorage, see Options.StorageEngine, keeps the entries in
+// a log file, one length-prefixed gob encoding after the other, and their
+// offsets in an index file of 8 bytes per entry, both mapped in memory: the
+// entry of an opNum is found in constant time, at the offset of its slot of
+// the index, and only the entries read are decoded. The files are appended
+// to and truncated with plain writes, and mapped again when a read finds them
+// grown.
+//
+// The values of the Storage, and the opNums the index and the log start
+// after, are in a WAL of their own in the values/ directory. CompactLog only
+// moves the start of the log, until the dropped entries outnumber the live
+// ones: the live ones are then copied to the files of the next generation,
+// which the values switch to at once, and the older files removed. A crash
+// leaves at most a torn last entry, or an index slot past the end of the
+// log, which are dropped when the storage is opened.
+//
+// The SyncPolicy applies as for the WAL, the log file being synced before the
+// index, so that a synced slot points to a synced entry.
+
+const (
+	// mmapFilePrefix is the name of the files of the log and the index,
+	// before their generation and their extension.
+	mmapFilePrefix = "mmap-"
+	mmapValuesDir  = "values"
+	// mmapLogKey is the value holding the mmapLog.
+	mmapLogKey = "\x00mmapLog"
+)
+
+// mmapValuesSegments are the segments of the WAL of the values, which only
+// holds a few keys.
+var mmapValuesSegments = WALSegments{MaxBytes: 1 << 20, CompactBytes: 4 << 20}
+
+// mmapLog is where the log is, as stored in the values.
+type mmapLog struct {
+	// Generation numbers the files, Base is the opNum the index starts
+	// after, and Start the one the log does.
+	Generation int
+	Base       int
+	Start      int
+}
+
+// MmapStorage is a Storage whose log is in memory-mapped files.
+type MmapStorage struct {
+	mu     sync.Mutex
+	dir    string
+	policy SyncPolicy
+	values *WAL
+	meta   mmapLog
+
+	log, index         *os.File
+	logSize, indexSize int64
+	// logMap and indexMap map the files, as large as they were then.
+	logMap, indexMap []byte
+
+	dirty bool
+	done  chan struct{}
+}
+
+// OpenMmapStorage opens the storage in the directory, creating it if needed.
+func OpenMmapStorage(dir string, policy SyncPolicy, interval time.Duration) (*MmapStorage, error) {
+	valuesDir := filepath.Join(dir, mmapValuesDir)
+	if err := os.MkdirAll(valuesDir, 0755); err != nil {
+		return nil, err
+	}
+	values, err := OpenWAL(valuesDir, policy, interval, mmapValuesSegments)
+	if err != nil {
+		return nil, err
+	}
+	s := &MmapStorage{dir: dir, policy: policy, values: values, meta: mmapLog{Generation: 1}}
+	if data, err := values.Get(mmapLogKey); err != nil || data != nil {
+		if err == nil {
+			err = gob.NewDecoder(bytes.NewReader(data)).Decode(&s.meta)
+		}
+		if err != nil {
+			values.Close()
+			return nil, fmt.Errorf("%s: %v", valuesDir, err)
+		}
+	}
+	if err := s.openFiles(); err != nil {
+		values.Close()
+		return nil, err
+	}
+	if err := s.removeOtherGenerations(); err != nil {
+		s.closeFiles()
+		values.Close()
+		return nil, err
+	}
+	if policy == SyncInterval {
+		s.done = make(chan struct{})
+		go s.syncEvery(interval, s.done)
+	}
+	return s, nil
+}
+
+// path returns the path of the file of the generation with the
+// extension.
+func (s *MmapStorage) path(generation int, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%s%d.%s", mmapFilePrefix, generation, ext))
+}
+
+// openFiles opens the log and the index of the generation, dropping the
+// index slots whose entries a crash tore.
+func (s *MmapStorage) openFiles() error {
+	var err error
+	if s.log, err = os.OpenFile(s.path(s.meta.Generation, "log"), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return err
+	}
+	if s.index, err = os.OpenFile(s.path(s.meta.Generation, "idx"), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		s.log.Close()
+		return err
+	}
+	if err := s.repair(); err != nil {
+		s.closeFiles()
+		return fmt.Errorf("%s: %v", s.index.Name(), err)
+	}
+	return nil
+}
+
+// repair truncates the index after its last slot pointing to a whole entry,
+// and the log after that entry.
+func (s *MmapStorage) repair() error {
+	indexInfo, err := s.index.Stat()
+	if err != nil {
+		return err
+	}
+	logInfo, err := s.log.Stat()
+	if err != nil {
+		return err
+	}
+	slots := indexInfo.Size() / 8
+	var logSize int64
+	for ; slots > 0; slots-- {
+		offset, err := s.readOffset(slots - 1)
+		if err != nil {
+			return err
+		}
+		var length [4]byte
+		if offset+4 > logInfo.Size() {
+			continue
+		}
+		if _, err := s.log.ReadAt(length[:], offset); err != nil {
+			return err
+		}
+		if end := offset + 4 + int64(binary.BigEndian.Uint32(length[:])); end <= logInfo.Size() {
+			logSize = end
+			break
+		}
+	}
+	if err := s.index.Truncate(slots * 8); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(logSize); err != nil {
+		return err
+	}
+	s.indexSize, s.logSize = slots*8, logSize
+	return nil
+}
+
+// removeOtherGenerations removes the files of the generations a crash left
+// behind, before or after the current one.
+func (s *MmapStorage) removeOtherGenerations() error {
+	dir, err := os.Open(s.dir)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, mmapFilePrefix) {
+			continue
+		}
+		generation, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, mmapFilePrefix), ".log"), ".idx"))
+		if err != nil || generation == s.meta.Generation {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readOffset reads the offset of the index slot with a plain read.
+func (s *MmapStorage) readOffset(slot int64) (int64, error) {
+	var offset [8]byte
+	if _, err := s.index.ReadAt(offset[:], slot*8); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(offset[:])), nil
+}
+
+// end returns the opNum of the last entry of the log. Expects s.mu to be
+// locked.
+func (s *MmapStorage) end() int {
+	if end := s.meta.Base + int(s.indexSize/8); end > s.meta.Start {
+		return end
+	}
+	return s.meta.Start
+}
+
+// storeMeta writes where the log is to the values. Expects s.mu to be
+// locked.
+func (s *MmapStorage) storeMeta() error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(s.meta); err != nil {
+		return err
+	}
+	return s.values.Set(mmapLogKey, buf.Bytes())
+}
+
+// remap maps the files again if they changed size since they were mapped.
+// Expects s.mu to be locked.
+func (s *MmapStorage) remap() error {
+	if int64(len(s.logMap)) == s.logSize && int64(len(s.indexMap)) == s.indexSize {
+		return nil
+	}
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	var err error
+	if s.logMap, err = mmapFile(s.log, s.logSize); err != nil {
+		return err
+	}
+	s.indexMap, err = mmapFile(s.index, s.indexSize)
+	return err
+}
+
+// unmap unmaps the files, which must be done before they are truncated.
+// Expects s.mu to be locked.
+func (s *MmapStorage) unmap() error {
+	err := munmapFile(s.logMap)
+	if indexErr := munmapFile(s.indexMap); err == nil {
+		err = indexErr
+	}
+	s.logMap, s.indexMap = nil, nil
+	return err
+}
+
+// entry decodes the entry of the opNum from the mapped files. Expects s.mu
+// to be locked, and the files mapped.
+func (s *MmapStorage) entry(opNum int) (StoredEntry, error) {
+	var e StoredEntry
+	slot := int64(opNum-s.meta.Base-1) * 8
+	offset := int64(binary.BigEndian.Uint64(s.indexMap[slot:]))
+	length := int64(binary.BigEndian.Uint32(s.logMap[offset:]))
+	data := s.logMap[offset+4 : offset+4+length]
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil {
+		return e, fmt.Errorf("entry at opNum=%d: %v", opNum, err)
+	}
+	return e, nil
+}
+
+// sync syncs the log, then the index, if they were written to since the
+// last sync. Expects s.mu to be locked.
+func (s *MmapStorage) sync() error {
+	if !s.dirty {
+		return nil
+	}
+	if err := s.log.Sync(); err != nil {
+		return err
+	}
+	s.dirty = false
+	return s.index.Sync()
+}
+
+// syncEvery syncs the files every interval until the storage is closed.
+func (s *MmapStorage) syncEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.log != nil {
+				s.sync()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+func (s *MmapStorage) Get(key string) ([]byte, error) {
+	return s.values.Get(key)
+}
+
+func (s *MmapStorage) Set(key string, value []byte) error {
+	return s.values.Set(key, value)
+}
+
+func (s *MmapStorage) AppendLog(first int, entries []StoredEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if end := s.end(); first < 1 || first > end+1 {
+		return fmt.Errorf("vrr: can't append at opNum=%d to a log ending at opNum=%d", first, end)
+	}
+	if err := s.truncate(first); err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+	offsets := make([]byte, 8*len(entries))
+	for i, e := range entries {
+		start := data.Len()
+		binary.BigEndian.PutUint64(offsets[8*i:], uint64(s.logSize+int64(start)))
+		data.Write(make([]byte, 4))
+		if err := gob.NewEncoder(&data).Encode(e); err != nil {
+			return err
+		}
+		binary.BigEndian.PutUint32(data.Bytes()[start:], uint32(data.Len()-start-4))
+	}
+	if _, err := s.log.WriteAt(data.Bytes(), s.logSize); err != nil {
+		return err
+	}
+	s.logSize += int64(data.Len())
+	if s.policy == SyncAlways {
+		if err := s.log.Sync(); err != nil {
+			return err
+		}
+	}
+	if _, err := s.index.WriteAt(offsets, s.indexSize); err != nil {
+		return err
+	}
+	s.indexSize += int64(len(offsets))
+	if s.policy == SyncAlways {
+		return s.index.Sync()
+	}
+	s.dirty = true
+	return nil
+}
+
+// truncate drops the entries from opNum first on, starting the files over
+// if they don't hold the one before it. Expects s.mu to be locked.
+func (s *MmapStorage) truncate(first int) error {
+	slots := int64(first - s.meta.Base - 1)
+	if slots*8 == s.indexSize && first > s.meta.Start {
+		return nil
+	}
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	logSize := int64(0)
+	switch {
+	case slots < 0 || slots*8 > s.indexSize:
+		slots = 0
+		s.meta.Base = first - 1
+	case slots*8 < s.indexSize:
+		offset, err := s.readOffset(slots)
+		if err != nil {
+			return err
+		}
+		logSize = offset
+	default:
+		logSize = s.logSize
+	}
+	if err := s.index.Truncate(slots * 8); err != nil {
+		return err
+	}
+	if err := s.log.Truncate(logSize); err != nil {
+		return err
+	}
+	s.indexSize, s.logSize = slots*8, logSize
+	if first <= s.meta.Start {
+		s.meta.Start = first - 1
+	}
+	return s.storeMeta()
+}
+
+func (s *MmapStorage) ReadLog(from int) ([]StoredEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from <= s.meta.Start {
+		from = s.meta.Start + 1
+	}
+	last := s.meta.Base + int(s.indexSize/8)
+	if from > last {
+		return nil, nil
+	}
+	if err := s.remap(); err != nil {
+		return nil, err
+	}
+	entries := make([]StoredEntry, 0, last-from+1)
+	for opNum := from; opNum <= last; opNum++ {
+		e, err := s.entry(opNum)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func (s *MmapStorage) CompactLog(upTo int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if upTo <= s.meta.Start {
+		return nil
+	}
+	s.meta.Start = upTo
+	slots := int(s.indexSize / 8)
+	if dropped := upTo - s.meta.Base; dropped > slots-dropped {
+		return s.rewrite()
+	}
+	return s.storeMeta()
+}
+
+// rewrite copies the live entries to the files of the next generation, and
+// switches to them. Expects s.mu to be locked.
+func (s *MmapStorage) rewrite() error {
+	if err := s.remap(); err != nil {
+		return err
+	}
+	next := s.meta
+	next.Generation++
+	next.Base = s.meta.Start
+	var logData, indexData []byte
+	if live := int64(s.meta.Base) + s.indexSize/8 - int64(s.meta.Start); live > 0 {
+		from := int64(binary.BigEndian.Uint64(s.indexMap[(s.meta.Start-s.meta.Base)*8:]))
+		logData = s.logMap[from:]
+		indexData = make([]byte, live*8)
+		for i := int64(0); i < live; i++ {
+			offset := binary.BigEndian.Uint64(s.indexMap[(int64(s.meta.Start-s.meta.Base)+i)*8:])
+			binary.BigEndian.PutUint64(indexData[i*8:], offset-uint64(from))
+		}
+	}
+	for ext, data := range map[string][]byte{"log": logData, "idx": indexData} {
+		if err := writeSynced(s.path(next.Generation, ext), data); err != nil {
+			return err
+		}
+	}
+
+	if err := s.unmap(); err != nil {
+		return err
+	}
+	s.closeFiles()
+	previous := s.meta
+	s.meta = next
+	if err := s.storeMeta(); err != nil {
+		s.meta = previous
+		if openErr := s.openFiles(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := s.openFiles(); err != nil {
+		return err
+	}
+	return s.removeOtherGenerations()
+}
+
+// writeSynced writes the file, synced.
+func writeSynced(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// closeFiles closes the log and the index. Expects s.mu to be locked.
+func (s *MmapStorage) closeFiles() {
+	s.log.Close()
+	s.index.Close()
+	s.log, s.index = nil, nil
+}
+
+// Close syncs and closes the files and the values.
+func (s *MmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil
+	}
+	if s.done != nil {
+		close(s.done)
+		s.done = nil
+	}
+	s.dirty = true
+	err := s.sync()
+	if unmapErr := s.unmap(); err == nil {
+		err = unmapErr
+	}
+	s.closeFiles()
+	if valuesErr := s.values.Close(); err == nil {
+		err = valuesErr
+	}
+	return err
+}
+
+var _ Storage = (*MmapStorage)(nil)
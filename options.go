@@ -0,0 +1,322 @@
+package vrr
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// Options holds the tunables of a Replica. The zero value is not usable,
+// start from DefaultOptions and override what's needed.
+type Options struct {
+	// HeartbeatInterval is how often the primary sends <COMMIT> messages
+	// when there's no new request to <PREPARE>.
+	HeartbeatInterval time.Duration
+
+	// ViewChangeTimeout is the minimum time a backup waits without hearing
+	// from the primary before initiating a view change. The actual timeout
+	// is randomized between ViewChangeTimeout and 2*ViewChangeTimeout.
+	ViewChangeTimeout time.Duration
+
+	// MaxRestartHint bounds how long a replica announced as restarting
+	// through HintRestart is allowed to stay silent.
+	MaxRestartHint time.Duration
+
+	// FailureThreshold is the number f of faulty replicas the cluster must
+	// tolerate. Zero derives it from the cluster size as the largest f with
+	// 2f+1 replicas; a cluster can't be configured to tolerate more than that.
+	FailureThreshold int
+
+	// CompressionThreshold is the size in bytes above which []byte and string
+	// operations are stored compressed in the opLog. Zero disables compression.
+	CompressionThreshold int
+
+	// DecodedCacheBytes bounds the size of the compressed operations kept
+	// decoded too until they are applied, so that they are decompressed
+	// at most once. Zero disables the cache.
+	DecodedCacheBytes int
+
+	// ShedHighWatermark is the number of committed but not yet applied
+	// operations from which the primary sheds new requests with ErrOverloaded,
+	// until the lag goes back down to ShedLowWatermark. Zero disables shedding.
+	ShedHighWatermark int
+	ShedLowWatermark  int
+
+	// PullThreshold is how many committed operations a backup must be missing,
+	// as learnt from the primary's <COMMIT>, before it pulls them.
+	PullThreshold int
+
+	// AdvertiseAddr is the address the peers dial to reach the replica.
+	// When set, the replica checks once it starts that its peers have it,
+	// and announces it otherwise, e.g. after being moved to another host.
+	AdvertiseAddr string
+
+	// Storage keeps the state of the replica, which restores it when it is
+	// created, see Storage. Nil keeps it in the WAL of the DataDir, or in
+	// memory without one, see MemoryStorage.
+	Storage Storage
+
+	// SnapshotInterval makes a replica whose StateMachine is a Snapshotter
+	// checkpoint it every so many applied operations, and SnapshotBytes
+	// once the operations applied since the last snapshot add up to so many
+	// bytes; the operations the snapshot holds are then dropped from the
+	// opLog. Zero disables either.
+	SnapshotInterval int
+	SnapshotBytes    int
+
+	// SnapshotChunkSize is the size of the chunks a snapshot is sent to a
+	// replica behind the opLog of the primary in, see InstallSnapshot.
+	SnapshotChunkSize int
+
+	// StorageEngine is where a replica with a DataDir and no Storage keeps
+	// its state.
+	StorageEngine StorageEngine
+
+	// SyncPolicy is when the writes of the WAL are synced to the disk, every
+	// SyncInterval under SyncInterval.
+	SyncPolicy   SyncPolicy
+	SyncInterval time.Duration
+
+	// WALSegments is the size of the segment files of the WAL, and when
+	// the sealed ones are compacted.
+	WALSegments WALSegments
+
+	// Archive, if set, is where the sealed WAL segments and the snapshots
+	// of the replica are uploaded every ArchiveInterval, under
+	// ArchivePrefix, see ObjectStore.
+	Archive         ObjectStore
+	ArchivePrefix   string
+	ArchiveInterval time.Duration
+
+	// DataDir is the directory where the replica keeps its files, such as
+	// the event log, see OpenDataDir. Empty keeps nothing on disk.
+	DataDir string
+
+	// UnknownPeerPolicy is how messages from replicas which aren't in the
+	// configuration are treated. AuthenticatePeer decides which of them are
+	// accepted under AcceptAuthenticatedUnknownPeers, given the identity the
+	// sender declared in the handshake of its connection, e.g. to let in the
+	// replicas being added to the group.
+	UnknownPeerPolicy UnknownPeerPolicy
+	AuthenticatePeer  func(identity PeerIdentity) bool
+
+	// PeerCredentials are sent in the handshake of every connection the
+	// replica opens to a peer, for the peer's AuthenticatePeer.
+	PeerCredentials []byte
+
+	// ClusterEpoch is the incarnation of the cluster, sent in the handshake
+	// of every connection too: only the messages of the peers of the same
+	// epoch are processed, so that the members of a cluster replaced with
+	// ForceNewCluster are fenced off if they come back.
+	ClusterEpoch uint64
+
+	// SubmitMiddlewares wrap the admission of client requests by the primary,
+	// the first one being the outermost, see SubmitMiddleware.
+	SubmitMiddlewares []SubmitMiddleware
+
+	// InboundInterceptors wrap the handlers of the protocol messages
+	// received from peers, the first one being the outermost.
+	InboundInterceptors []InboundInterceptor
+
+	// ReorderWindow is how far ahead of its opLog a backup buffers the
+	// <PREPARE>s arriving out of order, waiting for the gap to be filled
+	// rather than starting a state transfer. The ones further ahead are
+	// pulled along with the gap. Zero disables the buffering.
+	ReorderWindow int
+
+	// ReplayBufferSize is how many of the most recently delivered committed
+	// operations are kept in memory for the subscribers resuming with
+	// SubscribeFrom. Older ones are replayed from the opLog, without their
+	// response. Zero disables the buffer.
+	ReplayBufferSize int
+
+	// StateTransferRate paces the state transfers to every peer to so many
+	// bytes per second, so that they don't starve the normal replication
+	// traffic, see SetStateTransferRate. Zero doesn't pace them.
+	StateTransferRate int
+
+	// MaxInboundPerPeer bounds the protocol messages of each peer handled at
+	// once, and MaxInboundQueuePerPeer how many more may wait for their turn;
+	// the others fail with ErrPeerBusy. Zero MaxInboundPerPeer is unbounded.
+	MaxInboundPerPeer      int
+	MaxInboundQueuePerPeer int
+
+	// InvariantMode is how the replica reacts to inconsistencies of the
+	// protocol state: healing through recovery, or panicking.
+	InvariantMode InvariantMode
+
+	// ResyncPolicy is how a backup heals once its opLog or its state machine
+	// diverged from the primary's.
+	ResyncPolicy ResyncPolicy
+
+	// Clock drives the timers of the replica; nil uses the real time.
+	// A ManualClock makes the replica timeout-free, e.g. for tests.
+	Clock Clock
+
+	// StateMachine, when set, applies the committed operations on every
+	// replica, in order, before they are delivered on the commit channel with
+	// its response, which is recorded for the client, see Client.Result.
+	// The commit channel may then be nil.
+	StateMachine StateMachine
+
+	// DeterminismCheckInterval is every how many operations the replicas
+	// compare the hashes of their state machines, when they implement
+	// StateHasher, to catch a nondeterministic Apply. Zero disables it.
+	DeterminismCheckInterval int
+
+	// OnDivergence, when set, is called in a goroutine of its own for every
+	// peer whose state machine hash differs from the replica's at a
+	// checkpoint, for the operators to act before the divergence spreads.
+	OnDivergence func(evidence NondeterminismEvidence)
+
+	// Validator, when set, is asked by the primary to validate every operation
+	// before appending it, so invalid requests never consume log space or
+	// replication bandwidth.
+	Validator Validator
+
+	// FailureDetector, when set, tunes how long the backups wait for the
+	// primary before starting a view change, see PeerHealth.
+	FailureDetector FailureDetector
+}
+
+// StateMachine is the replicated service. Apply executes a committed
+// operation and returns its response; it must be deterministic, since every
+// replica applies the same operations in the same order, errors included:
+// an error is recorded as the ApplyError response of the operation.
+type StateMachine interface {
+	Apply(op interface{}) (resp interface{}, err error)
+}
+
+// Validator is implemented by state machines able to cheaply reject
+// malformed operations or constraint violations before they are replicated.
+// Validate must not modify any state.
+type Validator interface {
+	Validate(op interface{}) error
+}
+
+func DefaultOptions() Options {
+	return Options{
+		HeartbeatInterval: 50 * time.Millisecond,
+		ViewChangeTimeout: 150 * time.Millisecond,
+		MaxRestartHint:    30 * time.Second,
+
+		CompressionThreshold: 4096,
+		DecodedCacheBytes:    16 << 20,
+		PullThreshold:        1,
+		ReorderWindow:        64,
+		ReplayBufferSize:     1024,
+		SnapshotChunkSize:    1 << 20,
+		WALSegments:          WALSegments{MaxBytes: 64 << 20, CompactBytes: 256 << 20},
+		ArchiveInterval:      time.Minute,
+
+		UnknownPeerPolicy: LogAndRejectUnknownPeers,
+	}
+}
+
+func (o Options) validate() error {
+	if o.HeartbeatInterval <= 0 {
+		return fmt.Errorf("heartbeat interval must be positive, got %v", o.HeartbeatInterval)
+	}
+	if o.ViewChangeTimeout <= 0 {
+		return fmt.Errorf("view change timeout must be positive, got %v", o.ViewChangeTimeout)
+	}
+	if o.MaxRestartHint < 0 {
+		return fmt.Errorf("max restart hint must not be negative, got %v", o.MaxRestartHint)
+	}
+	if o.CompressionThreshold < 0 {
+		return fmt.Errorf("compression threshold must not be negative, got %d", o.CompressionThreshold)
+	}
+	if o.DeterminismCheckInterval < 0 {
+		return fmt.Errorf("determinism check interval must not be negative, got %d", o.DeterminismCheckInterval)
+	}
+	if o.DecodedCacheBytes < 0 {
+		return fmt.Errorf("decoded cache bytes must not be negative, got %d", o.DecodedCacheBytes)
+	}
+	if o.ShedHighWatermark < 0 || o.ShedLowWatermark < 0 {
+		return fmt.Errorf("shedding watermarks must not be negative, got %d and %d", o.ShedHighWatermark, o.ShedLowWatermark)
+	}
+	if o.ShedHighWatermark > 0 && o.ShedLowWatermark >= o.ShedHighWatermark {
+		return fmt.Errorf("shedding low watermark (%d) must be smaller than the high one (%d)", o.ShedLowWatermark, o.ShedHighWatermark)
+	}
+	if o.UnknownPeerPolicy < AcceptUnknownPeers || o.UnknownPeerPolicy > AcceptAuthenticatedUnknownPeers {
+		return fmt.Errorf("unknown peer policy %d is not one of the UnknownPeerPolicy values", o.UnknownPeerPolicy)
+	}
+	if o.UnknownPeerPolicy == AcceptAuthenticatedUnknownPeers && o.AuthenticatePeer == nil {
+		return fmt.Errorf("unknown peer policy %v needs AuthenticatePeer", o.UnknownPeerPolicy)
+	}
+	if o.ReplayBufferSize < 0 {
+		return fmt.Errorf("replay buffer size must not be negative, got %d", o.ReplayBufferSize)
+	}
+	if o.StateTransferRate < 0 {
+		return fmt.Errorf("state transfer rate must not be negative, got %d", o.StateTransferRate)
+	}
+	if o.ReorderWindow < 0 {
+		return fmt.Errorf("reorder window must not be negative, got %d", o.ReorderWindow)
+	}
+	if o.MaxInboundPerPeer < 0 || o.MaxInboundQueuePerPeer < 0 {
+		return fmt.Errorf("inbound limits must not be negative, got %d and %d", o.MaxInboundPerPeer, o.MaxInboundQueuePerPeer)
+	}
+	if o.InvariantMode < LenientInvariants || o.InvariantMode > StrictInvariants {
+		return fmt.Errorf("invariant mode %d is not one of the InvariantMode values", o.InvariantMode)
+	}
+	if o.SnapshotChunkSize <= 0 {
+		return fmt.Errorf("snapshot chunk size must be positive, got %d", o.SnapshotChunkSize)
+	}
+	if o.SnapshotInterval < 0 || o.SnapshotBytes < 0 {
+		return fmt.Errorf("snapshot interval and bytes must not be negative, got %d and %d", o.SnapshotInterval, o.SnapshotBytes)
+	}
+	if o.StorageEngine < StorageWAL || o.StorageEngine > StorageMmap {
+		return fmt.Errorf("storage engine %d is not one of the StorageEngine values", o.StorageEngine)
+	}
+	if o.SyncPolicy < SyncAlways || o.SyncPolicy > SyncNever {
+		return fmt.Errorf("sync policy %d is not one of the SyncPolicy values", o.SyncPolicy)
+	}
+	if o.SyncPolicy == SyncInterval && o.SyncInterval <= 0 {
+		return fmt.Errorf("sync interval must be positive, got %v", o.SyncInterval)
+	}
+	if s := o.WALSegments; s.MaxBytes < 0 || s.CompactBytes < 0 || s.CompactEntries < 0 {
+		return fmt.Errorf("WAL segment size and compaction thresholds must not be negative, got %d, %d and %d", s.MaxBytes, s.CompactBytes, s.CompactEntries)
+	}
+	if o.Archive != nil && o.ArchiveInterval <= 0 {
+		return fmt.Errorf("archive interval must be positive, got %v", o.ArchiveInterval)
+	}
+	if o.ResyncPolicy < ResyncSuffix || o.ResyncPolicy > ResyncNever {
+		return fmt.Errorf("resync policy %d is not one of the ResyncPolicy values", o.ResyncPolicy)
+	}
+	if o.PullThreshold < 1 {
+		return fmt.Errorf("pull threshold must be at least 1, got %d", o.PullThreshold)
+	}
+	// Backups would keep on starting view changes against a perfectly healthy
+	// primary if its heartbeats can't arrive before they time out.
+	if o.HeartbeatInterval >= o.ViewChangeTimeout {
+		return fmt.Errorf("heartbeat interval (%v) must be smaller than the view change timeout (%v)", o.HeartbeatInterval, o.ViewChangeTimeout)
+	}
+	return nil
+}
+
+// validateConfiguration checks that a replica with the given ID can form
+// a quorum with the configuration. The configuration is a map of the IDs of
+// the *other* replicas to their addresses, so it must not contain ID itself.
+func validateConfiguration(ID int, configuration map[int]string) error {
+	if len(configuration) == 0 {
+		return fmt.Errorf("configuration of replica %d has no peers", ID)
+	}
+	if _, ok := configuration[ID]; ok {
+		return fmt.Errorf("configuration of replica %d must only contain its peers, not itself", ID)
+	}
+
+	owners := make(map[string]int)
+	for peerID, addr := range configuration {
+		if peerID < 0 {
+			return fmt.Errorf("replica ID must not be negative, got %d", peerID)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("address %q of replica %d is not parsable: %v", addr, peerID, err)
+		}
+		if otherID, ok := owners[addr]; ok {
+			return fmt.Errorf("replicas %d and %d share the same address %q", otherID, peerID, addr)
+		}
+		owners[addr] = peerID
+	}
+	return nil
+}
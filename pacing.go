@@ -0,0 +1,147 @@
+package vrr
+
+import (
+	"log"
+	"time"
+)
+
+// The <NEW-STATE> of a backup far behind, e.g. recovering a large opLog, can
+// saturate the primary's link and starve the <PREPARE>s of the normal case.
+// State transfers to a peer can be paced to Options.StateTransferRate bytes
+// per second, or to the rate set for the peer with SetStateTransferRate: the
+// primary then streams the operations in chunks of about a heartbeat interval
+// worth of bytes, each once the budget of the peer allows it, and the backup
+// stays in StateTransfer until the last one. The normal replication traffic
+// is never paced.
+
+// transferPacer is a token bucket of bytes refilled lazily, allowing bursts
+// of a second worth of bytes.
+type transferPacer struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTransferPacer(bytesPerSecond int, now time.Time) *transferPacer {
+	return &transferPacer{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   now,
+	}
+}
+
+// reserve takes n bytes from the bucket, going into debt if needed, and
+// returns how long to wait before sending them.
+func (p *transferPacer) reserve(n int, now time.Time) time.Duration {
+	p.tokens += now.Sub(p.last).Seconds() * p.rate
+	if p.tokens > p.rate {
+		p.tokens = p.rate
+	}
+	p.last = now
+
+	p.tokens -= float64(n)
+	if p.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-p.tokens / p.rate * float64(time.Second))
+}
+
+// SetStateTransferRate paces the state transfers to the peer to bytesPerSecond
+// rather than to Options.StateTransferRate. Zero doesn't pace them.
+func (r *Replica) SetStateTransferRate(peerID int, bytesPerSecond int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.transferRates == nil {
+		r.transferRates = make(map[int]int)
+	}
+	r.transferRates[peerID] = bytesPerSecond
+}
+
+// transferPacerFor returns the pacer of the state transfers to the peer, nil
+// if they aren't paced. Expects r.mu to be locked.
+func (r *Replica) transferPacerFor(peerID int) *transferPacer {
+	rate, ok := r.transferRates[peerID]
+	if !ok {
+		rate = r.opts.StateTransferRate
+	}
+	if rate <= 0 {
+		delete(r.transferPacers, peerID)
+		return nil
+	}
+	p, ok := r.transferPacers[peerID]
+	if !ok || p.rate != float64(rate) {
+		if r.transferPacers == nil {
+			r.transferPacers = make(map[int]*transferPacer)
+		}
+		p = newTransferPacer(rate, r.clock.Now())
+		r.transferPacers[peerID] = p
+	}
+	return p
+}
+
+// nextTransferChunk returns how many of the operations, at least one, fit in
+// a chunk of maxBytes, and their size on the wire.
+func nextTransferChunk(ops []opLogEntry, maxBytes int) (int, int) {
+	n, size := 0, 0
+	for n < len(ops) {
+		data, err := ops[n].GobEncode()
+		if err != nil {
+			log.Printf("failed sizing opID=%d of <NEW-STATE>; err = %v", ops[n].opID, err.Error())
+		}
+		if n > 0 && size+len(data) > maxBytes {
+			break
+		}
+		n++
+		size += len(data)
+	}
+	return n, size
+}
+
+// sendNewState sends the state to the peer, in chunks when its state
+// transfers are paced. It stops at the first chunk the peer doesn't take,
+// which asks for the state again if it still needs it.
+func (r *Replica) sendNewState(peerID int, newState NewStateArgs) {
+	defer func() {
+		r.mu.Lock()
+		delete(r.transferring, peerID)
+		r.mu.Unlock()
+	}()
+
+	ops := newState.OpLog
+	first := newState.OpNum - len(ops)
+	for sent := 0; ; {
+		r.mu.Lock()
+		chunk, wait := len(ops)-sent, time.Duration(0)
+		if pacer := r.transferPacerFor(peerID); pacer != nil {
+			maxBytes := int(pacer.rate * r.opts.HeartbeatInterval.Seconds())
+			var size int
+			chunk, size = nextTransferChunk(ops[sent:], maxBytes)
+			wait = pacer.reserve(size, r.clock.Now())
+		}
+		r.mu.Unlock()
+
+		if wait > 0 {
+			r.dlog("paces <NEW-STATE> to %d for %v", peerID, wait)
+			ticker := r.clock.NewTicker(wait)
+			<-ticker.C()
+			ticker.Stop()
+		}
+
+		var reply NewStateReply
+		args := newState
+		args.OpLog = ops[sent : sent+chunk]
+		args.OpNum = first + sent + chunk
+		args.More = sent+chunk < len(ops)
+		args.Checksums = checksums(args.OpLog)
+		r.dlog("sending <NEW-STATE> to %d; opNum=%d; entries=%d; more=%v", peerID, args.OpNum, len(args.OpLog), args.More)
+		if err := r.server.Call(peerID, "Replica.NewState", args, &reply); err != nil {
+			log.Printf("failed sending <NEW-STATE>; err = %v", err.Error())
+			return
+		}
+		sent += chunk
+		if !reply.IsReplied || sent == len(ops) {
+			return
+		}
+	}
+}
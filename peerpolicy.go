@@ -0,0 +1,82 @@
+package vrr
+
+import "log"
+
+// UnknownPeerPolicy is how a replica treats protocol messages sent by
+// replica IDs which aren't in its configuration.
+type UnknownPeerPolicy int
+
+const (
+	// AcceptUnknownPeers processes their messages like any other,
+	// e.g. for lab setups.
+	AcceptUnknownPeers UnknownPeerPolicy = iota
+
+	// RejectUnknownPeers fails their messages with ErrUnknownPeer.
+	RejectUnknownPeers
+
+	// LogAndRejectUnknownPeers is RejectUnknownPeers, logging every rejection.
+	LogAndRejectUnknownPeers
+
+	// AcceptAuthenticatedUnknownPeers only processes their messages when
+	// Options.AuthenticatePeer accepts the sender, rejecting them otherwise.
+	AcceptAuthenticatedUnknownPeers
+)
+
+func (p UnknownPeerPolicy) String() string {
+	switch p {
+	case AcceptUnknownPeers:
+		return "Accept"
+	case RejectUnknownPeers:
+		return "Reject"
+	case LogAndRejectUnknownPeers:
+		return "Log-And-Reject"
+	case AcceptAuthenticatedUnknownPeers:
+		return "Accept-If-Authenticated"
+	default:
+		panic("unreachable")
+	}
+}
+
+// PeerIdentity is who opened a connection to the replica, as declared in the
+// handshake of the connection: every protocol message received on it must be
+// sent by that replica.
+type PeerIdentity struct {
+	ReplicaID    int
+	RemoteAddr   string
+	Credentials  []byte
+	ClusterEpoch uint64
+}
+
+type HandshakeArgs struct {
+	ReplicaID    int
+	Credentials  []byte
+	ClusterEpoch uint64
+
+	// EpochNum and Members are the membership of the sender, see
+	// checkMembership.
+	EpochNum int
+	Members  []int
+}
+
+type HandshakeReply struct{}
+
+// admitPeer tells whether the message sent by the peer must be processed,
+// according to the UnknownPeerPolicy. Expects r.mu to be locked.
+func (r *Replica) admitPeer(peer PeerIdentity, method string) bool {
+	if _, ok := r.configuration[peer.ReplicaID]; ok || peer.ReplicaID == r.ID {
+		return true
+	}
+
+	switch r.opts.UnknownPeerPolicy {
+	case AcceptUnknownPeers:
+		return true
+	case AcceptAuthenticatedUnknownPeers:
+		if r.opts.AuthenticatePeer != nil && r.opts.AuthenticatePeer(peer) {
+			return true
+		}
+	case LogAndRejectUnknownPeers:
+		log.Printf("[%d] rejected %s from unknown replica %d at %s", r.ID, method, peer.ReplicaID, peer.RemoteAddr)
+	}
+	r.dlog("rejects %s from unknown replica %d", method, peer.ReplicaID)
+	return false
+}
@@ -0,0 +1,91 @@
+package vrr
+
+import "log"
+
+// A backup whose view change timer expires may just have a flaky link to the
+// primary, while the others still hear from it: starting a view change would
+// drag the whole group through it. The backup first probes its peers with
+// <PRE-VOTE>, and only starts the view change if a quorum, itself included,
+// also lost the primary. A probe doesn't change the state of the peers.
+
+type PreVoteArgs struct {
+	ViewNum   int
+	ReplicaID int
+}
+
+type PreVoteReply struct {
+	IsReplied bool
+	ReplicaID int
+
+	// Agree tells whether the peer lost the primary of the view too.
+	Agree bool
+}
+
+func (r *Replica) PreVote(args PreVoteArgs, reply *PreVoteReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("PreVote: %+v [currentView=%d]", args, r.viewNum)
+
+	reply.IsReplied = true
+	reply.ReplicaID = r.ID
+	switch {
+	case args.ViewNum < r.viewNum:
+		// The prober lags behind, the primary of the view will reach it.
+		reply.Agree = false
+	case r.leadsView():
+		reply.Agree = false
+	case r.primaryHealth() == PeerDead:
+		reply.Agree = true
+	case r.status == Normal && r.clock.Now().Sub(r.viewChangeResetEvent) < r.detectedTimeout(r.opts.ViewChangeTimeout):
+		reply.Agree = false
+	default:
+		reply.Agree = true
+	}
+	r.dlog("... PreVote replied: %+v", reply)
+	return nil
+}
+
+// probeViewChange asks the peers whether they lost the primary of the view
+// too, telling whether enough of them did to start a view change.
+func (r *Replica) probeViewChange() bool {
+	r.mu.Lock()
+	args := PreVoteArgs{
+		ViewNum:   r.viewNum,
+		ReplicaID: r.ID,
+	}
+	agreementsNeeded := r.startViewChangeAcksNeeded()
+	configuration := r.configuration
+	r.mu.Unlock()
+
+	if agreementsNeeded <= 0 {
+		return true
+	}
+	answers := make(chan bool, len(configuration))
+	for peerID := range configuration {
+		go func(peerID int) {
+			var reply PreVoteReply
+
+			r.dlog("sending <PRE-VOTE> to %d: %+v", peerID, args)
+			if err := r.server.Call(peerID, "Replica.PreVote", args, &reply); err != nil {
+				log.Printf("failed sending <PRE-VOTE>; err = %v", err.Error())
+			}
+			answers <- reply.IsReplied && reply.Agree
+		}(peerID)
+	}
+
+	agreements := 0
+	for range configuration {
+		if <-answers {
+			agreements++
+			if agreements >= agreementsNeeded {
+				return true
+			}
+		}
+	}
+	r.dlog("only %d peers lost the primary too, %d needed", agreements, agreementsNeeded)
+	return false
+}
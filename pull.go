@@ -0,0 +1,145 @@
+package vrr
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	minPullBackoff = 20 * time.Millisecond
+	maxPullBackoff = time.Second
+)
+
+// maybePullMissingOps makes the backup fetch from the primary the opLog
+// entries it lacks up to commitNum, unless a pull is already in flight or
+// the previous one failed too recently.
+// Expects r.mu to be locked.
+func (r *Replica) maybePullMissingOps(commitNum int) {
+	if r.pulling || r.clock.Now().Before(r.nextPullAt) {
+		return
+	}
+	r.pulling = true
+
+	args := GetMissingOpsArgs{
+		ViewNum:   r.viewNum,
+		ReplicaID: r.ID,
+		From:      r.opNum + 1,
+		To:        commitNum,
+	}
+	primaryID := r.primaryID
+	go r.pullMissingOps(primaryID, args)
+}
+
+func (r *Replica) pullMissingOps(primaryID int, args GetMissingOpsArgs) {
+	var reply GetMissingOpsReply
+
+	r.dlog("pulling missing ops [%d, %d] from primary %d", args.From, args.To, primaryID)
+	err := r.server.Call(primaryID, "Replica.GetMissingOps", args, &reply)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pulling = false
+
+	if reply.Compacted && r.viewNum == args.ViewNum && r.status == Normal {
+		r.dlog("primary dropped ops from opNum=%d, transferring its state", args.From)
+		r.startStateTransfer(r.viewNum, primaryID)
+		return
+	}
+	if err != nil || !reply.IsReplied {
+		if err != nil {
+			log.Printf("failed pulling missing ops; err = %v", err.Error())
+		}
+		r.backOffPull()
+		return
+	}
+
+	// Things may have moved on while the pull was in flight.
+	if r.viewNum != args.ViewNum || r.opNum != args.From-1 || r.status != Normal {
+		r.dlog("dropping pulled ops, replica moved on; viewNum=%d opNum=%d status=%v", r.viewNum, r.opNum, r.status)
+		return
+	}
+
+	r.appendOps(reply.Ops)
+	r.appendReordered()
+	r.pullBackoff = 0
+	r.dlog("installed %d pulled ops, opNum=%d", len(reply.Ops), r.opNum)
+	// The pulled ops may be uncommitted, when they fill the gap before
+	// buffered <PREPARE>s, and the primary waits for their <PREPARE-OK>.
+	if r.opNum > r.commitNum {
+		go r.sendPrepareOK(r.viewNum, r.opNum, r.primaryID)
+	}
+}
+
+// backOffPull doubles the delay before the next pull, up to maxPullBackoff.
+// Expects r.mu to be locked.
+func (r *Replica) backOffPull() {
+	if r.pullBackoff == 0 {
+		r.pullBackoff = minPullBackoff
+	} else if r.pullBackoff < maxPullBackoff {
+		r.pullBackoff *= 2
+		if r.pullBackoff > maxPullBackoff {
+			r.pullBackoff = maxPullBackoff
+		}
+	}
+	r.nextPullAt = r.clock.Now().Add(r.pullBackoff)
+}
+
+// appendOps appends entries fetched from the primary at the end of the opLog,
+// keeping the clientTable up to date. Expects r.mu to be locked.
+func (r *Replica) appendOps(ops []opLogEntry) {
+	for _, e := range ops {
+		e.opID = r.opNum
+		r.opLog = append(r.opLog, e)
+		r.opNum++
+		r.tenantFor(e.namespace).clientTable[e.clientID] = clientTableEntry{
+			reqNum: e.reqNum,
+			reqOp:  e.operation,
+		}
+	}
+	r.storeLog(r.opNum - len(ops) + 1)
+}
+
+type GetMissingOpsArgs struct {
+	ViewNum   int
+	ReplicaID int
+	// From and To are the first and last opNum wanted, inclusive.
+	From int
+	To   int
+}
+
+type GetMissingOpsReply struct {
+	IsReplied bool
+	Ops       []opLogEntry
+	// Compacted tells that the primary dropped the first ops wanted from
+	// its opLog, so that they take a state transfer.
+	Compacted bool
+}
+
+func (r *Replica) GetMissingOps(args GetMissingOpsArgs, reply *GetMissingOpsReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("GetMissingOps: %+v [currentView=%d]", args, r.viewNum)
+
+	if args.ViewNum != r.viewNum || r.status != Normal {
+		r.dlog("not in the view of the GetMissingOps request, drops message")
+		return nil
+	}
+	if args.From <= r.logStart {
+		r.dlog("dropped ops up to opNum=%d from the opLog, can't send [%d, %d]", r.logStart, args.From, args.To)
+		reply.Compacted = true
+		return nil
+	}
+	if args.From > args.To || args.To > r.opNum {
+		r.dlog("doesn't have ops [%d, %d], drops message", args.From, args.To)
+		return nil
+	}
+
+	reply.IsReplied = true
+	reply.Ops = make([]opLogEntry, args.To-args.From+1)
+	copy(reply.Ops, r.logRange(args.From, args.To))
+	return nil
+}
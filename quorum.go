@@ -0,0 +1,54 @@
+package vrr
+
+import "fmt"
+
+// derivedFailureThreshold is the number of failures f a cluster of
+// clusterSize replicas tolerates: the largest f with clusterSize >= 2f+1.
+func derivedFailureThreshold(clusterSize int) int {
+	return (clusterSize - 1) / 2
+}
+
+// quorumSize is the number of replicas (the local one included) that must
+// agree for a step of the protocol to be taken. For the paper's 2f+1 replicas
+// it's f+1; with an even number of replicas it stays a strict majority so
+// that any two quorums still intersect.
+func quorumSize(clusterSize int, f int) int {
+	return clusterSize - f
+}
+
+func validateFailureThreshold(clusterSize int, f int) error {
+	if f < 0 {
+		return fmt.Errorf("failure threshold must not be negative, got %d", f)
+	}
+	if clusterSize < 2*f+1 {
+		return fmt.Errorf("a cluster of %d replicas can't tolerate %d failures, it needs at least %d replicas", clusterSize, f, 2*f+1)
+	}
+	return nil
+}
+
+// clusterSize is the number of replicas including the local one.
+func (r *Replica) clusterSize() int {
+	return len(r.configuration) + 1
+}
+
+// failureThreshold is the configured f, or the one derived from the cluster size.
+func (r *Replica) failureThreshold() int {
+	if r.opts.FailureThreshold > 0 {
+		return r.opts.FailureThreshold
+	}
+	return derivedFailureThreshold(r.clusterSize())
+}
+
+// quorum is the quorumSize of the replica's cluster, which every step of the
+// protocol waits for: <PREPARE-OK>s to commit, <DO-VIEW-CHANGE>s to start a
+// view, and <RECOVERY-RESPONSE>s to recover, the local replica included.
+func (r *Replica) quorum() int {
+	return quorumSize(r.clusterSize(), r.failureThreshold())
+}
+
+// startViewChangeAcksNeeded is how many matching <START-VIEW-CHANGE> messages
+// from *other* replicas are needed before sending <DO-VIEW-CHANGE>: f of them
+// for 2f+1 replicas, so that with the local one they form a quorum.
+func (r *Replica) startViewChangeAcksNeeded() int {
+	return r.quorum() - 1
+}
@@ -0,0 +1,471 @@
+package vrr
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A service replicated with etcd's raft library is migrated to vrr from the
+// files of one of its members: ReadRaftWAL reads its write-ahead log and its
+// latest snapshot, in the formats of etcd's wal and snap packages, and
+// returns the committed state in the export format, which a replica of the
+// new cluster installs with Import or ForceNewCluster, see vrrd
+// -from-raft-wal.
+//
+// Only the application entries are kept: the empty entries of the new raft
+// leaders and the configuration changes have no vrr counterpart, so the
+// opNums count the application entries from the index of the snapshot on,
+// and differ from the raft indexes past the first one dropped. The raft
+// snapshot becomes the vrr snapshot at its index, restored by the
+// Snapshotter of the state machine, which must thus read the snapshots of the
+// raft service. The entries have no client: they are the requests of
+// RaftClientID, numbered by their opNums, so that a client of the new cluster
+// never collides with them.
+//
+// The files are checked as they are read: the chained CRCs of the WAL, the
+// CRC of the snapshot, the snapshot matching one the WAL recorded, and the
+// indexes of the entries following each other once those a new leader
+// overwrote are dropped. The state returned is then written in the export
+// format and read back, so that the operations which wouldn't survive the
+// migration are found before anything is installed.
+
+// RaftClientID is the client of the entries read from a raft WAL.
+const RaftClientID = -1
+
+// Record types of the WAL of etcd, see walpb.Record.
+const (
+	raftMetadataRecord = 1
+	raftEntryRecord    = 2
+	raftStateRecord    = 3
+	raftCRCRecord      = 4
+	raftSnapshotRecord = 5
+)
+
+// raftEntryNormal is the type of the application entries of raft, see
+// raftpb.EntryType.
+const raftEntryNormal = 0
+
+// raftCRCTable is the table of the CRCs of etcd's WAL and snapshots.
+var raftCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// ErrBadRaftWAL is returned for a raft WAL or snapshot which can't be read,
+// or fails its checks.
+var ErrBadRaftWAL = errors.New("vrr: malformed raft WAL")
+
+// RaftWALReport is what ReadRaftWAL read.
+type RaftWALReport struct {
+	// SnapshotIndex and SnapshotTerm are the raft snapshot the state
+	// starts from, zero without one.
+	SnapshotIndex uint64
+	SnapshotTerm  uint64
+
+	// CommitIndex and Term are the ones of the last hard state.
+	CommitIndex uint64
+	Term        uint64
+
+	// Entries are the committed application entries kept, Skipped the
+	// committed entries dropped, empty or configuration changes, and
+	// Overwritten the entries of the WAL a later leader replaced.
+	Entries     int
+	Skipped     int
+	Overwritten int
+
+	// Torn tells that the last record of the WAL was torn by a crash, and
+	// dropped.
+	Torn bool
+}
+
+// raftEntry is an entry of the raft log.
+type raftEntry struct {
+	term  uint64
+	index uint64
+	typ   uint64
+	data  []byte
+}
+
+// raftSnapshot is a snapshot of a raft node.
+type raftSnapshot struct {
+	index uint64
+	term  uint64
+	data  []byte
+}
+
+// ReadRaftWAL reads the WAL of an etcd raft member in walDir, and its
+// snapshots in snapDir, if not empty, and returns its committed application
+// entries, following its snapshot, as the state of a replica.
+func ReadRaftWAL(walDir, snapDir string) (ExportedState, RaftWALReport, error) {
+	var report RaftWALReport
+	wal, err := readRaftWALRecords(walDir, &report)
+	if err != nil {
+		return ExportedState{}, report, err
+	}
+
+	var snapshot raftSnapshot
+	if snapDir != "" {
+		if snapshot, err = readRaftSnapshot(snapDir, wal.snapshots); err != nil {
+			return ExportedState{}, report, err
+		}
+	}
+	if wal.commit < snapshot.index {
+		return ExportedState{}, report, fmt.Errorf("%w: commit index %d is before the snapshot at index %d", ErrBadRaftWAL, wal.commit, snapshot.index)
+	}
+	report.SnapshotIndex, report.SnapshotTerm = snapshot.index, snapshot.term
+	report.CommitIndex, report.Term = wal.commit, wal.term
+
+	state := ExportedState{
+		Metadata: ExportMetadata{
+			Version:    exportVersion,
+			ExportedAt: time.Now(),
+		},
+	}
+	opNum := int(snapshot.index)
+	if snapshot.index > 0 {
+		if state.Snapshot, err = encodeSnapshot(snapshotState{OpNum: opNum, State: snapshot.data}); err != nil {
+			return ExportedState{}, report, err
+		}
+	}
+	next := snapshot.index + 1
+	for _, e := range wal.entries {
+		if e.index <= snapshot.index || e.index > wal.commit {
+			continue
+		}
+		if e.index != next {
+			return ExportedState{}, report, fmt.Errorf("%w: entry at index %d missing after the snapshot at index %d", ErrBadRaftWAL, next, snapshot.index)
+		}
+		next++
+		if e.typ != raftEntryNormal || len(e.data) == 0 {
+			report.Skipped++
+			continue
+		}
+		opNum++
+		state.Entries = append(state.Entries, ExportedEntry{OpNum: opNum, ClientID: RaftClientID, ReqNum: opNum, Op: e.data})
+	}
+	if next <= wal.commit {
+		return ExportedState{}, report, fmt.Errorf("%w: committed entries from index %d on missing", ErrBadRaftWAL, next)
+	}
+	report.Entries = len(state.Entries)
+	if len(state.Entries) > 0 {
+		state.Clients = []ExportedClient{{ClientID: RaftClientID, ReqNum: opNum}}
+	}
+	state.Metadata.ViewNum = int(wal.term)
+	state.Metadata.CommitNum = opNum
+
+	if err := verifyExport(state); err != nil {
+		return ExportedState{}, report, err
+	}
+	return state, report, nil
+}
+
+// verifyExport checks that the state reads back the same from the export
+// format.
+func verifyExport(state ExportedState) error {
+	var buf bytes.Buffer
+	if err := WriteExport(&buf, state); err != nil {
+		return err
+	}
+	read, err := ReadExport(&buf)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(read.Snapshot, state.Snapshot) || len(read.Entries) != len(state.Entries) {
+		return fmt.Errorf("%w: the state doesn't read back from the export format", ErrBadExport)
+	}
+	for i, e := range read.Entries {
+		if !reflect.DeepEqual(e, state.Entries[i]) {
+			return fmt.Errorf("%w: entry %d reads back as %+v", ErrBadExport, state.Entries[i].OpNum, e)
+		}
+	}
+	return nil
+}
+
+// raftWAL is the content of the WAL of a raft member.
+type raftWAL struct {
+	// snapshots are the snapshots the WAL recorded.
+	snapshots []raftSnapshot
+	entries   []raftEntry
+	term      uint64
+	commit    uint64
+}
+
+// readRaftWALRecords reads the WAL files of the directory, in order.
+func readRaftWALRecords(dir string, report *RaftWALReport) (raftWAL, error) {
+	var wal raftWAL
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return wal, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".wal") {
+			names = append(names, file.Name())
+		}
+	}
+	if len(names) == 0 {
+		return wal, fmt.Errorf("%w: no .wal file in %q", ErrBadRaftWAL, dir)
+	}
+	sort.Strings(names)
+
+	var crc uint32
+	for i, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return wal, err
+		}
+		last := i == len(names)-1
+		if err := wal.readFile(data, &crc, last, report); err != nil {
+			return wal, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return wal, nil
+}
+
+// readFile reads the records of a WAL file, chaining their CRCs from crc.
+// Only the last file may end with a torn record.
+func (wal *raftWAL) readFile(data []byte, crc *uint32, last bool, report *RaftWALReport) error {
+	for offset := 0; offset+8 <= len(data); {
+		lenField := binary.LittleEndian.Uint64(data[offset:])
+		// The rest of the file is preallocated.
+		if lenField == 0 {
+			return nil
+		}
+		size := int(lenField & (1<<56 - 1))
+		var padding int
+		if lenField&(1<<63) != 0 {
+			padding = int(lenField >> 56 & 0x7)
+		}
+		if offset+8+size+padding > len(data) {
+			if last {
+				report.Torn = true
+				return nil
+			}
+			return fmt.Errorf("%w: torn record at offset %d", ErrBadRaftWAL, offset)
+		}
+		record := data[offset+8 : offset+8+size]
+		offset += 8 + size + padding
+
+		var typ, recordCRC uint64
+		var recordData []byte
+		err := readProto(record, func(field int, v uint64, b []byte) {
+			switch field {
+			case 1:
+				typ = v
+			case 2:
+				recordCRC = v
+			case 3:
+				recordData = b
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if typ == raftCRCRecord {
+			if *crc != 0 && uint32(recordCRC) != *crc {
+				return fmt.Errorf("%w: CRC record %08x doesn't chain with %08x", ErrBadRaftWAL, recordCRC, *crc)
+			}
+			*crc = uint32(recordCRC)
+			continue
+		}
+		*crc = crc32.Update(*crc, raftCRCTable, recordData)
+		if *crc != uint32(recordCRC) {
+			return fmt.Errorf("%w: record of type %d doesn't match its CRC", ErrBadRaftWAL, typ)
+		}
+		if err := wal.apply(typ, recordData, report); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply adds the record of the type to the WAL.
+func (wal *raftWAL) apply(typ uint64, data []byte, report *RaftWALReport) error {
+	switch typ {
+	case raftEntryRecord:
+		var e raftEntry
+		err := readProto(data, func(field int, v uint64, b []byte) {
+			switch field {
+			case 1:
+				e.typ = v
+			case 2:
+				e.term = v
+			case 3:
+				e.index = v
+			case 4:
+				e.data = b
+			}
+		})
+		if err != nil {
+			return err
+		}
+		// A new leader overwrites the entries the old one didn't commit.
+		for len(wal.entries) > 0 && wal.entries[len(wal.entries)-1].index >= e.index {
+			wal.entries = wal.entries[:len(wal.entries)-1]
+			report.Overwritten++
+		}
+		// The files before the first one may have been purged.
+		if n := len(wal.entries); n > 0 && e.index != wal.entries[n-1].index+1 {
+			return fmt.Errorf("%w: entry at index %d follows index %d", ErrBadRaftWAL, e.index, wal.entries[n-1].index)
+		}
+		wal.entries = append(wal.entries, e)
+	case raftStateRecord:
+		return readProto(data, func(field int, v uint64, b []byte) {
+			switch field {
+			case 1:
+				wal.term = v
+			case 3:
+				wal.commit = v
+			}
+		})
+	case raftSnapshotRecord:
+		var s raftSnapshot
+		err := readProto(data, func(field int, v uint64, b []byte) {
+			switch field {
+			case 1:
+				s.index = v
+			case 2:
+				s.term = v
+			}
+		})
+		if err != nil {
+			return err
+		}
+		wal.snapshots = append(wal.snapshots, s)
+	case raftMetadataRecord:
+	default:
+		return fmt.Errorf("%w: unknown record type %d", ErrBadRaftWAL, typ)
+	}
+	return nil
+}
+
+// readRaftSnapshot reads the latest snapshot of the directory which the WAL
+// recorded. Without any, the state starts from the first index.
+func readRaftSnapshot(dir string, recorded []raftSnapshot) (raftSnapshot, error) {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return raftSnapshot{}, nil
+	}
+	if err != nil {
+		return raftSnapshot{}, err
+	}
+	var names []string
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".snap") {
+			names = append(names, file.Name())
+		}
+	}
+	// The names are the term and index in hex, the latest is the last.
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	for _, name := range names {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return raftSnapshot{}, err
+		}
+		snapshot, err := decodeRaftSnapshot(data)
+		if err != nil {
+			return raftSnapshot{}, fmt.Errorf("%s: %w", name, err)
+		}
+		for _, s := range recorded {
+			if s.index == snapshot.index && s.term == snapshot.term {
+				return snapshot, nil
+			}
+		}
+	}
+	return raftSnapshot{}, nil
+}
+
+// decodeRaftSnapshot decodes a snapshot file, checking its CRC.
+func decodeRaftSnapshot(data []byte) (raftSnapshot, error) {
+	var crc uint64
+	var snapshotData []byte
+	err := readProto(data, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			crc = v
+		case 2:
+			snapshotData = b
+		}
+	})
+	if err != nil {
+		return raftSnapshot{}, err
+	}
+	if crc32.Checksum(snapshotData, raftCRCTable) != uint32(crc) {
+		return raftSnapshot{}, fmt.Errorf("%w: snapshot doesn't match its CRC", ErrBadRaftWAL)
+	}
+
+	var s raftSnapshot
+	var metadata []byte
+	err = readProto(snapshotData, func(field int, v uint64, b []byte) {
+		switch field {
+		case 1:
+			s.data = b
+		case 2:
+			metadata = b
+		}
+	})
+	if err != nil {
+		return raftSnapshot{}, err
+	}
+	err = readProto(metadata, func(field int, v uint64, b []byte) {
+		switch field {
+		case 2:
+			s.index = v
+		case 3:
+			s.term = v
+		}
+	})
+	return s, err
+}
+
+// readProto calls field with the number and the value of each field of the
+// protobuf message: v for the numbers, b for the bytes and the messages.
+func readProto(data []byte, field func(num int, v uint64, b []byte)) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return fmt.Errorf("%w: bad protobuf key", ErrBadRaftWAL)
+		}
+		data = data[n:]
+		num := int(key >> 3)
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return fmt.Errorf("%w: bad varint of field %d", ErrBadRaftWAL, num)
+			}
+			data = data[n:]
+			field(num, v, nil)
+		case 1:
+			if len(data) < 8 {
+				return fmt.Errorf("%w: %v in field %d", ErrBadRaftWAL, io.ErrUnexpectedEOF, num)
+			}
+			field(num, binary.LittleEndian.Uint64(data), nil)
+			data = data[8:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return fmt.Errorf("%w: bad length of field %d", ErrBadRaftWAL, num)
+			}
+			field(num, 0, data[n:n+int(length)])
+			data = data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return fmt.Errorf("%w: %v in field %d", ErrBadRaftWAL, io.ErrUnexpectedEOF, num)
+			}
+			field(num, uint64(binary.LittleEndian.Uint32(data)), nil)
+			data = data[4:]
+		default:
+			return fmt.Errorf("%w: unsupported wire type %d of field %d", ErrBadRaftWAL, key&7, num)
+		}
+	}
+	return nil
+}
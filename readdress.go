@@ -0,0 +1,194 @@
+package vrr
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// A replica whose address changed, e.g. because its container was rescheduled,
+// is still dialed by its peers at the old one. With Options.AdvertiseAddr, the
+// replica asks its peers which address they have for it once it starts and,
+// when it is stale, announces the new one to the primary with
+// <ANNOUNCE-ADDRESS>. The primary replicates the announcement as an internal
+// operation, so that every replica updates its configuration and redials the
+// replica once it is committed, in the same order as the other operations,
+// without a membership change. Internal operations aren't delivered to the
+// state machine nor to the commit channel.
+
+// internalNamespace is the namespace of the internal operations, the
+// announcing replica being their client.
+const internalNamespace = "vrr.internal"
+
+const (
+	minAnnounceBackoff = 50 * time.Millisecond
+
+	// maxAnnounceAttempts is how many times the replica checks its address
+	// with its peers, and announces it while they have a stale one.
+	maxAnnounceAttempts = 8
+)
+
+// addressChange is the internal operation moving a replica to a new address.
+type addressChange struct {
+	ReplicaID int
+	Addr      string
+}
+
+// AddressChangedEvidence is the evidence of an EventAddressChanged.
+type AddressChangedEvidence struct {
+	ReplicaID int
+	OldAddr   string
+	Addr      string
+}
+
+// runAddressCheck announces the advertised address of the replica until its
+// peers have it, backing off between the attempts.
+func (r *Replica) runAddressCheck() {
+	backoff := minAnnounceBackoff
+	for attempt := 0; attempt < maxAnnounceAttempts; attempt++ {
+		stale, answered := r.checkAddress()
+		if answered > 0 && stale == 0 {
+			return
+		}
+		if stale > 0 {
+			if err := r.announceAddress(); err != nil {
+				log.Printf("failed announcing the address; err = %v", err.Error())
+			}
+		}
+
+		ticker := r.clock.NewTicker(backoff)
+		<-ticker.C()
+		ticker.Stop()
+		backoff *= 2
+	}
+	r.dlog("peers may still have a stale address after %d attempts", maxAnnounceAttempts)
+}
+
+// checkAddress greets the peers, counting the ones which answered and the
+// ones among them which have another address than the advertised one.
+func (r *Replica) checkAddress() (stale int, answered int) {
+	r.mu.Lock()
+	if r.status == Dead {
+		r.mu.Unlock()
+		return 0, 1
+	}
+	args := HelloArgs{ID: r.ID}
+	addr := r.opts.AdvertiseAddr
+	configuration := r.configuration
+	r.mu.Unlock()
+
+	for peerID := range configuration {
+		var reply HelloReply
+		if err := r.server.Call(peerID, "Replica.Hello", args, &reply); err != nil {
+			log.Printf("failed sending <HELLO>; err = %v", err.Error())
+			continue
+		}
+		answered++
+		if reply.Addr != addr {
+			r.dlog("replica %d has address %s, advertised %s", peerID, reply.Addr, addr)
+			stale++
+		}
+	}
+	return stale, answered
+}
+
+type AnnounceAddressArgs struct {
+	ViewNum   int
+	ReplicaID int
+	Addr      string
+}
+
+type AnnounceAddressReply struct {
+	IsReplied bool
+}
+
+// announceAddress makes the primary replicate the advertised address.
+func (r *Replica) announceAddress() error {
+	r.mu.Lock()
+	args := AnnounceAddressArgs{
+		ViewNum:   r.viewNum,
+		ReplicaID: r.ID,
+		Addr:      r.opts.AdvertiseAddr,
+	}
+	primaryID := r.primaryID
+	r.mu.Unlock()
+
+	if primaryID == r.ID {
+		return r.admitAddressChange(args)
+	}
+	var reply AnnounceAddressReply
+	r.dlog("sending <ANNOUNCE-ADDRESS> to %d: %+v", primaryID, args)
+	if err := r.server.Call(primaryID, "Replica.AnnounceAddress", args, &reply); err != nil {
+		return err
+	}
+	if !reply.IsReplied {
+		return fmt.Errorf("primary %d dropped the announcement", primaryID)
+	}
+	return nil
+}
+
+func (r *Replica) AnnounceAddress(args AnnounceAddressArgs, reply *AnnounceAddressReply) error {
+	r.mu.Lock()
+	if r.status == Dead {
+		r.mu.Unlock()
+		return nil
+	}
+	r.dlog("AnnounceAddress: %+v [currentView=%d]", args, r.viewNum)
+	if args.ViewNum != r.viewNum {
+		r.dlog("not in the view of the ANNOUNCE-ADDRESS, drops message")
+		r.mu.Unlock()
+		return nil
+	}
+	r.mu.Unlock()
+
+	if err := r.admitAddressChange(args); err != nil {
+		r.dlog("drops ANNOUNCE-ADDRESS; err = %v", err)
+		return nil
+	}
+	reply.IsReplied = true
+	return nil
+}
+
+// admitAddressChange makes the primary accept the internal operation of the
+// announcement. The announcing replica is its client, whose next request it
+// is.
+func (r *Replica) admitAddressChange(args AnnounceAddressArgs) error {
+	r.mu.Lock()
+	reqNum := r.tenantFor(internalNamespace).clientTable[args.ReplicaID].reqNum + 1
+	r.mu.Unlock()
+
+	req := clientRequest{
+		namespace: internalNamespace,
+		clientID:  args.ReplicaID,
+		reqNum:    reqNum,
+		reqOp:     addressChange{ReplicaID: args.ReplicaID, Addr: args.Addr},
+	}
+	_, err := r.admit(req, nil, r.clock.Now())
+	return err
+}
+
+// applyAddressChange moves the peer to its new address once the operation is
+// committed, and redials it there.
+func (r *Replica) applyAddressChange(change addressChange) {
+	r.mu.Lock()
+	oldAddr, ok := r.configuration[change.ReplicaID]
+	if !ok || oldAddr == change.Addr {
+		r.mu.Unlock()
+		return
+	}
+	// The configuration is copied rather than updated in place, since it is
+	// ranged over out of the lock.
+	configuration := make(map[int]string, len(r.configuration))
+	for peerID, addr := range r.configuration {
+		configuration[peerID] = addr
+	}
+	configuration[change.ReplicaID] = change.Addr
+	r.setConfiguration(configuration)
+
+	evidence := AddressChangedEvidence{ReplicaID: change.ReplicaID, OldAddr: oldAddr, Addr: change.Addr}
+	r.emit(EventAddressChanged, SeverityInfo, evidence,
+		"replica %d moved from %s to %s", change.ReplicaID, oldAddr, change.Addr)
+	r.mu.Unlock()
+
+	go r.server.redial(change.ReplicaID, change.Addr)
+}
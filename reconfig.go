@@ -0,0 +1,154 @@
+package vrr
+
+import (
+	"fmt"
+	"log"
+	"sort"
+)
+
+// Reconfiguration changes the members of the replica group, epoch by epoch.
+// The primary admits an internal epochChange operation carrying the members
+// of the next epoch, and is Transitioning until it commits it: it refuses
+// the client requests while the operations of the old epoch still in flight
+// are committed. Every replica installs the configuration of the new epoch
+// once it commits the epochChange, and the primary is Normal again. The
+// replicas joining are started with the configuration of the new epoch and
+// catch up with the primary like lagging backups; the ones leaving stop once
+// they commit the epochChange too, which the primary tells them with a last
+// <COMMIT>.
+
+// epochChange is the internal operation starting the epoch EpochNum, whose
+// members are all the replicas, by ID, with their addresses.
+type epochChange struct {
+	EpochNum int
+	Members  map[int]string
+}
+
+// EpochStartedEvidence is the evidence of an EventEpochStarted.
+type EpochStartedEvidence struct {
+	EpochNum int
+	OpNum    int
+	Added    []int
+	Removed  []int
+}
+
+// validateMembers checks the members of a new epoch.
+func validateMembers(members map[int]string, f int) error {
+	for id := range members {
+		if id < 0 {
+			return fmt.Errorf("vrr: replica ID must not be negative, got %d", id)
+		}
+	}
+	if f > 0 {
+		return validateFailureThreshold(len(members), f)
+	}
+	return nil
+}
+
+// Reconfigure makes the primary start a new epoch whose members are the given
+// replicas, itself included. It returns once the epochChange is accepted; the
+// primary is Transitioning until it is committed.
+func (r *Replica) Reconfigure(members map[int]string) error {
+	r.mu.Lock()
+	if _, ok := members[r.ID]; !ok {
+		r.mu.Unlock()
+		return fmt.Errorf("vrr: primary %d can't leave the replica group, transfer the primaryship first", r.ID)
+	}
+	if err := validateMembers(members, r.opts.FailureThreshold); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	change := epochChange{EpochNum: r.epochNum + 1, Members: make(map[int]string, len(members))}
+	for id, addr := range members {
+		change.Members[id] = addr
+	}
+	req := clientRequest{
+		namespace: internalNamespace,
+		clientID:  r.ID,
+		reqNum:    r.tenantFor(internalNamespace).clientTable[r.ID].reqNum + 1,
+		reqOp:     change,
+	}
+	r.mu.Unlock()
+
+	token, err := r.admit(req, nil, r.clock.Now())
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// The epoch may have started already.
+	if r.commitNum < token.OpNum && r.status == Normal && r.viewNum == token.ViewNum && r.primaryID == r.ID {
+		r.dlog("transitions to epoch %d at opNum=%d", change.EpochNum, token.OpNum)
+		r.setStatus(Transitioning)
+	}
+	return nil
+}
+
+// leadsView reports whether the replica is the primary of a started view,
+// which it still is while Transitioning to a new epoch.
+// Expects r.mu to be locked.
+func (r *Replica) leadsView() bool {
+	return r.primaryID == r.ID && (r.status == Normal || r.status == Transitioning)
+}
+
+// startEpoch installs the configuration of the epochChange the replica just
+// committed at opNum. Expects r.mu to be locked.
+func (r *Replica) startEpoch(change epochChange, opNum int) {
+	// A replica recovering commits the epochs it already started again.
+	if change.EpochNum <= r.epochNum {
+		return
+	}
+
+	evidence := EpochStartedEvidence{EpochNum: change.EpochNum, OpNum: opNum}
+	configuration := make(map[int]string)
+	for id, addr := range change.Members {
+		if id == r.ID {
+			continue
+		}
+		configuration[id] = addr
+		if oldAddr, ok := r.configuration[id]; !ok || oldAddr != addr {
+			if !ok {
+				evidence.Added = append(evidence.Added, id)
+			}
+			go r.server.redial(id, addr)
+		}
+	}
+	for id := range r.configuration {
+		if _, ok := change.Members[id]; !ok {
+			evidence.Removed = append(evidence.Removed, id)
+			if r.primaryID == r.ID {
+				go r.sendLastCommit(id, CommitArgs{ViewNum: r.viewNum, CommitNum: opNum, PrimaryID: r.ID})
+			}
+		}
+	}
+	sort.Ints(evidence.Added)
+	sort.Ints(evidence.Removed)
+
+	r.epochNum = change.EpochNum
+	r.setConfiguration(configuration)
+	r.emit(EventEpochStarted, SeverityInfo, evidence,
+		"started epoch %d of %d replicas at opNum=%d; added=%v removed=%v",
+		change.EpochNum, len(change.Members), opNum, evidence.Added, evidence.Removed)
+
+	if _, ok := change.Members[r.ID]; !ok {
+		r.dlog("is not a member of epoch %d, stops", change.EpochNum)
+		go r.Stop()
+		return
+	}
+	if r.status == Transitioning {
+		r.setStatus(Normal)
+	}
+}
+
+// sendLastCommit tells a replica which left the group with the new epoch
+// that the epochChange is committed, since the primary doesn't send it its
+// heartbeats anymore.
+func (r *Replica) sendLastCommit(peerID int, args CommitArgs) {
+	var reply CommitReply
+
+	r.dlog("sending the last <COMMIT> to %d: %+v", peerID, args)
+	if err := r.server.Call(peerID, "Replica.Commit", args, &reply); err != nil {
+		log.Printf("failed sending the last <COMMIT>; err = %v", err.Error())
+	}
+}
@@ -0,0 +1,258 @@
+package vrr
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"log"
+)
+
+// Recovery brings back a replica which crashed and lost its state. It sends
+// <RECOVERY> with a fresh nonce to all the replicas; those in Normal status
+// answer with a <RECOVERY-RESPONSE> carrying the nonce, and the primary adds
+// its opLog, opNum and commitNum, and its snapshot if its opLog doesn't
+// start from the first operation. Once it has a quorum of responses matching
+// the nonce, including one from the primary of the latest view among them,
+// the replica installs the primary's state and becomes Normal again.
+// Until then it takes no part in the protocol.
+
+// StartRecovery makes the replica forget its state and recover it from the
+// other replicas. It is meant for a replica restarted after a crash.
+func (r *Replica) StartRecovery() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.startRecovery()
+}
+
+// startRecovery is StartRecovery. Expects r.mu to be locked.
+func (r *Replica) startRecovery() {
+	if r.status == Dead || r.isRecovering() {
+		return
+	}
+
+	r.opLog = nil
+	r.decodedCacheBytes = 0
+	r.stateHashes = nil
+	r.logStart = 0
+	r.snapshotNum = 0
+	r.compactNum = 0
+	r.pendingSnapshot = nil
+	r.incomingSnapshot = nil
+	r.opNum = 0
+	r.commitNum = 0
+	r.appliedNum = 0
+	r.storeLog(1)
+	if err := r.storage.Set(storageSnapshot, nil); err != nil {
+		r.failStorage(err)
+	}
+	r.storeMeta()
+	r.forgetReplay()
+	r.forgetSessions()
+	for _, t := range r.tenants {
+		t.clientTable = make(map[int]clientTableEntry)
+		t.replies = nil
+	}
+
+	r.recoveryNonce = newRecoveryNonce()
+	r.recoveryResponses = make(map[int]RecoveryResponseArgs)
+	r.setStatus(Recovery)
+	r.dlog("starts recovery; nonce=%x", r.recoveryNonce)
+
+	go r.runRecovery(r.recoveryNonce)
+}
+
+// isRecovering tells whether the replica is running the recovery protocol.
+// Expects r.mu to be locked.
+func (r *Replica) isRecovering() bool {
+	return r.recoveryNonce != 0
+}
+
+func newRecoveryNonce() uint64 {
+	var b [8]byte
+	for {
+		if _, err := rand.Read(b[:]); err != nil {
+			log.Fatalf("failed generating a recovery nonce; err = %v", err)
+		}
+		// Zero means no recovery in progress.
+		if nonce := binary.BigEndian.Uint64(b[:]); nonce != 0 {
+			return nonce
+		}
+	}
+}
+
+// runRecovery sends <RECOVERY> until the recovery with the nonce completes,
+// since the messages or their responses may be lost.
+func (r *Replica) runRecovery(nonce uint64) {
+	ticker := r.clock.NewTicker(2 * r.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		r.blastRecovery(nonce)
+		<-ticker.C()
+
+		r.mu.Lock()
+		done := r.status == Dead || r.recoveryNonce != nonce
+		r.mu.Unlock()
+		if done {
+			return
+		}
+	}
+}
+
+func (r *Replica) blastRecovery(nonce uint64) {
+	for peerID := range r.configuration {
+		args := RecoveryArgs{
+			ReplicaID: r.ID,
+			Nonce:     nonce,
+		}
+		go func(peerID int) {
+			var reply RecoveryReply
+
+			r.dlog("sending <RECOVERY> to %d: %+v", peerID, args)
+			if err := r.server.Call(peerID, "Replica.Recovery", args, &reply); err != nil {
+				log.Printf("failed sending <RECOVERY>; err = %v", err.Error())
+			}
+		}(peerID)
+	}
+}
+
+type RecoveryArgs struct {
+	ReplicaID int
+	Nonce     uint64
+}
+
+type RecoveryReply struct {
+	IsReplied bool
+}
+
+func (r *Replica) Recovery(args RecoveryArgs, reply *RecoveryReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("Recovery: %+v [currentView=%d]", args, r.viewNum)
+
+	if r.status != Normal {
+		r.dlog("is not Normal, drops RECOVERY")
+		return nil
+	}
+	reply.IsReplied = true
+
+	response := RecoveryResponseArgs{
+		ViewNum:   r.viewNum,
+		Nonce:     args.Nonce,
+		ReplicaID: r.ID,
+		PrimaryID: r.primaryID,
+	}
+	if r.primaryID == r.ID {
+		// The recovering replica starts from the snapshot.
+		if r.snapshotNum > 0 {
+			response.Snapshot = r.storedSnapshot()
+		}
+		response.OpLog = make([]opLogEntry, r.opNum-r.snapshotNum)
+		copy(response.OpLog, r.logRange(r.snapshotNum+1, r.opNum))
+		response.OpNum = r.opNum
+		response.CommitNum = r.commitNum
+	}
+	go func() {
+		var reply RecoveryResponseReply
+
+		r.dlog("sending <RECOVERY-RESPONSE> to %d; viewNum=%d", args.ReplicaID, response.ViewNum)
+		if err := r.server.Call(args.ReplicaID, "Replica.RecoveryResponse", response, &reply); err != nil {
+			log.Printf("failed sending <RECOVERY-RESPONSE>; err = %v", err.Error())
+		}
+	}()
+	return nil
+}
+
+type RecoveryResponseArgs struct {
+	ViewNum   int
+	Nonce     uint64
+	ReplicaID int
+	PrimaryID int
+
+	// Only set by the primary. OpLog holds the entries following the
+	// Snapshot, if any, up to OpNum.
+	Snapshot  []byte
+	OpLog     []opLogEntry
+	OpNum     int
+	CommitNum int
+}
+
+type RecoveryResponseReply struct {
+	IsReplied bool
+}
+
+func (r *Replica) RecoveryResponse(args RecoveryResponseArgs, reply *RecoveryResponseReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("RecoveryResponse: view=%d from=%d primary=%d entries=%d", args.ViewNum, args.ReplicaID, args.PrimaryID, len(args.OpLog))
+
+	if !r.isRecovering() || args.Nonce != r.recoveryNonce {
+		r.dlog("not waiting for this RECOVERY-RESPONSE, drops message")
+		return nil
+	}
+	reply.IsReplied = true
+	if !r.isMember(args.ReplicaID) {
+		r.dlog("%d isn't a member, drops its RECOVERY-RESPONSE", args.ReplicaID)
+		return nil
+	}
+
+	r.recoveryResponses[args.ReplicaID] = args
+	if len(r.recoveryResponses) < r.quorum() {
+		return nil
+	}
+
+	latest := -1
+	for _, response := range r.recoveryResponses {
+		if response.ViewNum > latest {
+			latest = response.ViewNum
+		}
+	}
+	var primary RecoveryResponseArgs
+	found := false
+	for _, response := range r.recoveryResponses {
+		if response.ViewNum == latest && response.ReplicaID == response.PrimaryID {
+			primary, found = response, true
+		}
+	}
+	if !found {
+		r.dlog("no RECOVERY-RESPONSE from the primary of view %d yet", latest)
+		return nil
+	}
+
+	r.opLog = nil
+	r.decodedCacheBytes = 0
+	r.opNum = 0
+	if len(primary.Snapshot) > 0 {
+		if err := r.installSnapshot(primary.Snapshot); err != nil {
+			log.Printf("failed installing the snapshot of <RECOVERY-RESPONSE>; err = %v", err.Error())
+			r.reportFailure(FailureSnapshot, 0, 0, err)
+			return nil
+		}
+	}
+	r.appendOps(primary.OpLog)
+	r.viewNum = primary.ViewNum
+	r.primaryID = primary.PrimaryID
+	r.recoveryNonce = 0
+	r.recoveryResponses = nil
+	r.viewChangeResetEvent = r.clock.Now()
+	r.setStatus(Normal)
+	r.viewStartedAt = r.clock.Now()
+	r.viewStartCommitNum = 0
+
+	// The state machine was lost with the rest of the state,
+	// all the committed operations are delivered again.
+	r.commitUpTo(primary.CommitNum)
+	r.dlog("recovered; viewNum=%d opNum=%d commitNum=%d", r.viewNum, r.opNum, r.commitNum)
+
+	// The view change timer stopped while recovering.
+	go r.runViewChangeTimer()
+
+	return nil
+}
@@ -0,0 +1,108 @@
+package vrr
+
+import "time"
+
+// A backup buffers the <PREPARE>s arriving ahead of a gap in its opLog, e.g.
+// reordered by the network while the primary has several requests in flight,
+// and fetches the missing operations from the primary right away with
+// <GET-MISSING-OPS>. It appends the buffered ones once the gap is filled, by
+// the pull, the missing <PREPARE>s or their retransmissions. The <PREPARE>s
+// more than Options.ReorderWindow operations ahead aren't buffered but pulled
+// along with the gap. It only starts a state transfer when the gap is wider
+// than maxPulledGap, or when it outlives reorderGapTimeout.
+
+const (
+	// reorderGapTimeout is how long a gap in the opLog may last before the
+	// backup starts a state transfer.
+	reorderGapTimeout = 100 * time.Millisecond
+
+	// maxPulledGap is how many missing operations the backup pulls at most,
+	// a wider gap is filled by a state transfer.
+	maxPulledGap = 1024
+)
+
+// fillGap handles the <PREPARE> following a gap in the opLog, telling whether
+// it could: the replica must start a state transfer otherwise.
+// Expects r.mu to be locked.
+func (r *Replica) fillGap(args PrepareArgs) bool {
+	now := r.clock.Now()
+	if args.OpNum-r.opNum > maxPulledGap {
+		return false
+	}
+	if r.gapSince.IsZero() {
+		r.gapSince = now
+	} else if now.Sub(r.gapSince) >= reorderGapTimeout {
+		r.dlog("gap at opNum=%d persisted for %v", r.opNum+1, now.Sub(r.gapSince))
+		return false
+	}
+
+	if args.OpNum-r.opNum > r.opts.ReorderWindow {
+		r.dlog("PREPARE of opNum=%d is beyond the reorder window, pulls it", args.OpNum)
+		r.maybePullMissingOps(args.OpNum)
+		return true
+	}
+	// A duplicated <PREPARE> of a buffered operation is buffered once.
+	if buffered, ok := r.reordered[args.OpNum]; ok && buffered.ViewNum == args.ViewNum {
+		b, req := buffered.ClientMessage, args.ClientMessage
+		if b.namespace != req.namespace || b.clientID != req.clientID || b.reqNum != req.reqNum {
+			r.divergeLog(args.OpNum, "opNum=%d is request %d of client %d in the buffered PREPARE but request %d of client %d in this one",
+				args.OpNum, b.reqNum, b.clientID, req.reqNum, req.clientID)
+			return true
+		}
+		r.dlog("already buffers PREPARE of opNum=%d", args.OpNum)
+		return true
+	}
+	if r.reordered == nil {
+		r.reordered = make(map[int]PrepareArgs)
+	}
+	r.reordered[args.OpNum] = args
+	r.dlog("buffers PREPARE of opNum=%d, waiting for opNum=%d", args.OpNum, r.opNum+1)
+	r.maybePullMissingOps(args.OpNum - 1)
+	return true
+}
+
+// forgetGap drops the buffered <PREPARE>s, e.g. when the gap is to be filled
+// by a state transfer. Expects r.mu to be locked.
+func (r *Replica) forgetGap() {
+	r.reordered = nil
+	r.gapSince = time.Time{}
+}
+
+// appendPrepared appends the operation of a <PREPARE> to the opLog, keeping
+// the clientTable up to date. Expects r.mu to be locked.
+func (r *Replica) appendPrepared(req clientRequest) {
+	entry := r.newOpLogEntry(req)
+	r.opLog = append(r.opLog, entry)
+	r.opNum++
+	r.storeLog(r.opNum)
+	r.tenantFor(req.namespace).clientTable[req.clientID] = clientTableEntry{
+		reqNum: req.reqNum,
+		reqOp:  entry.operation,
+	}
+}
+
+// appendReordered appends the buffered <PREPARE>s which follow the opLog now
+// that the gap before them is filled, and forgets the ones of other views or
+// already in the opLog. Expects r.mu to be locked.
+func (r *Replica) appendReordered() {
+	for {
+		args, ok := r.reordered[r.opNum+1]
+		if !ok || args.ViewNum != r.viewNum {
+			break
+		}
+		delete(r.reordered, args.OpNum)
+		r.appendPrepared(args.ClientMessage)
+		r.dlog("appends buffered PREPARE of opNum=%d", args.OpNum)
+	}
+	for opNum, args := range r.reordered {
+		if opNum <= r.opNum || args.ViewNum != r.viewNum {
+			delete(r.reordered, opNum)
+		}
+	}
+	if len(r.reordered) == 0 {
+		r.gapSince = time.Time{}
+	} else {
+		// Another gap remains before the other ones.
+		r.gapSince = r.clock.Now()
+	}
+}
@@ -0,0 +1,125 @@
+package vrr
+
+import "sort"
+
+// A subscriber which disconnects briefly resumes with SubscribeFrom rather
+// than reading what it missed back from the log. The replica keeps the most
+// recently delivered committed operations, Options.ReplayBufferSize of them,
+// in a replay buffer; a subscriber resuming further back is replayed the
+// older ones from the opLog instead, which stands for the storage layer.
+//
+// The replay is done by commitChanSender, between two deliveries, so that the
+// subscriber receives every operation once and in order.
+
+// recordReplay keeps the committed operation just delivered in the replay
+// buffer, forgetting the oldest one when it is full. Expects r.mu to be locked.
+func (r *Replica) recordReplay(entry CommitEntry) {
+	size := r.opts.ReplayBufferSize
+	if size <= 0 {
+		return
+	}
+	r.replay = append(r.replay, entry)
+	if len(r.replay) > size {
+		// Copy rather than reslice, so that the forgotten responses are
+		// garbage collected.
+		r.replay = append([]CommitEntry(nil), r.replay[len(r.replay)-size:]...)
+	}
+}
+
+// forgetReplay empties the replay buffer, when the applied operations are
+// reset. Expects r.mu to be locked.
+func (r *Replica) forgetReplay() {
+	r.replay = nil
+}
+
+// replayEntries returns the committed operations delivered from opNum from
+// on, from the replay buffer when it holds them all, from the opLog with no
+// response otherwise. Expects r.mu to be locked.
+func (r *Replica) replayEntries(from int) []CommitEntry {
+	if from < 1 {
+		from = 1
+	}
+	if from > r.appliedNum {
+		return nil
+	}
+	if len(r.replay) > 0 && r.replay[0].OpNum <= from {
+		// The buffer has gaps where the internal operations were.
+		i := sort.Search(len(r.replay), func(i int) bool { return r.replay[i].OpNum >= from })
+		return append([]CommitEntry(nil), r.replay[i:]...)
+	}
+
+	// The operations dropped from the opLog are only in the snapshot.
+	if from <= r.logStart {
+		from = r.logStart + 1
+	}
+	r.dlog("replays opNum=%d..%d from the opLog", from, r.appliedNum)
+	entries := make([]CommitEntry, 0, r.appliedNum-from+1)
+	for opNum := from; opNum <= r.appliedNum; opNum++ {
+		e := r.logEntry(opNum)
+		if e.namespace == internalNamespace {
+			continue
+		}
+		entry := CommitEntry{
+			ViewStamp: e.viewStamp(),
+			CommitNum: opNum,
+			Namespace: e.namespace,
+			ClientReq: clientRequest{
+				namespace: e.namespace,
+				clientID:  e.clientID,
+				reqNum:    e.reqNum,
+				reqOp:     e.op(),
+			},
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// pendingReplay is the replay of a resuming subscriber.
+type pendingReplay struct {
+	s       *commitSubscription
+	entries []CommitEntry
+}
+
+// takeReplays returns the replays of the subscribers which resumed since the
+// last delivery. Expects r.mu to be locked.
+func (r *Replica) takeReplays() []pendingReplay {
+	var replays []pendingReplay
+	for i := 0; i < len(r.subscriptions); i++ {
+		s := r.subscriptions[i]
+		if s.replayFrom == 0 {
+			continue
+		}
+		if s.strict && !r.canReplay(s.replayFrom) {
+			// No delivery is in progress, the channel can be closed.
+			r.dlog("can't replay opNum=%d, dropped from the opLog; ends the subscription", s.replayFrom)
+			r.subscriptions = append(r.subscriptions[:i:i], r.subscriptions[i+1:]...)
+			close(s.entries)
+			i--
+			continue
+		}
+		replays = append(replays, pendingReplay{s: s, entries: r.replayEntries(s.replayFrom)})
+		s.replayFrom = 0
+	}
+	return replays
+}
+
+// canReplay tells whether the committed operations delivered from opNum from
+// on can all be replayed, rather than only those left in the opLog. Expects
+// r.mu to be locked.
+func (r *Replica) canReplay(from int) bool {
+	if from > r.logStart || from > r.appliedNum {
+		return true
+	}
+	return len(r.replay) > 0 && r.replay[0].OpNum <= from
+}
+
+// SubscribeFrom is Subscribe, resuming from opNum from: the subscriber first
+// receives the committed operations already delivered from there on, then
+// the new ones. The operations older than the replay buffer have no response.
+func (r *Replica) SubscribeFrom(filter CommitFilter, buffer int, from int) (<-chan CommitEntry, func()) {
+	if from < 1 {
+		from = 1
+	}
+	return r.subscribe(filter, buffer, from)
+}
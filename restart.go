@@ -0,0 +1,84 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A replica stopped, by Stop or by a failure of its storage, is brought back
+// by Restart, with the same ID, on the state it persisted: the Server creates
+// a replica in its place, with the configuration and Options of the stopped
+// one, which restores its state like a replica created on a DataDir after a
+// crash of the process, see restore; without a DataDir, from the storage of
+// the stopped replica, e.g. the MemoryStorage it kept. The restored state is
+// only trusted if every write reached it: a replica whose writes weren't all
+// synced, see SyncPolicy, may have acknowledged operations it forgot, and one
+// which restored nothing may have lost its storage altogether. Either runs
+// the recovery protocol to get its state back from the others, see
+// StartRecovery, while the others take up from their restored view and catch
+// up with the primary through state transfer.
+//
+// The state machine applies the committed operations again from the
+// snapshot or from the start, so it must start over too: it is reset, and a
+// state machine which isn't a StateResetter can't be restarted.
+
+// ErrNotStopped is returned by Restart while the replica is running.
+var ErrNotStopped = errors.New("vrr: replica is not stopped")
+
+// Restart replaces the stopped replica of the server with a new one, created
+// on the state it persisted, which rejoins the cluster.
+func (s *Server) Restart() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stopped := s.replica
+	if stopped == nil {
+		return errors.New("vrr: no replica to restart, see Configure")
+	}
+	stopped.mu.Lock()
+	status, storage := stopped.status, stopped.storage
+	configuration := make(map[int]string, len(stopped.configuration))
+	for peerID, addr := range stopped.configuration {
+		configuration[peerID] = addr
+	}
+	opts := stopped.opts
+	stopped.mu.Unlock()
+	if status != Dead {
+		return ErrNotStopped
+	}
+	if opts.StateMachine != nil {
+		resetter, ok := opts.StateMachine.(StateResetter)
+		if !ok {
+			return fmt.Errorf("vrr: can't restart replica %d, its state machine isn't a StateResetter", stopped.ID)
+		}
+		resetter.Reset()
+	}
+	// Without a DataDir, the storage of the stopped replica holds the state
+	// to restore, whether the Options gave it or it kept it in memory.
+	if opts.DataDir == "" {
+		opts.Storage = storage
+	}
+
+	replica, err := NewReplica(stopped.ID, configuration, s, s.ready, s.commitChan, opts)
+	if err != nil {
+		return err
+	}
+	replica.mu.Lock()
+	if !replica.trustsRestoredState() {
+		replica.startRecovery()
+	}
+	replica.dlog("restarted as %v; viewNum=%d opNum=%d commitNum=%d", replica.status, replica.viewNum, replica.opNum, replica.commitNum)
+	replica.mu.Unlock()
+	s.configuration = configuration
+	s.replica = replica
+	return nil
+}
+
+// trustsRestoredState tells whether the replica restored a state holding
+// every write it made. Expects r.mu to be locked.
+func (r *Replica) trustsRestoredState() bool {
+	if r.opNum == 0 && r.viewNum == 0 && r.snapshotNum == 0 {
+		return false
+	}
+	return r.opts.Storage != nil || r.dataDir == nil || r.opts.SyncPolicy == SyncAlways
+}
@@ -0,0 +1,85 @@
+package vrr
+
+import (
+	"log"
+	"time"
+)
+
+// HintRestart tells this replica and all of its peers that the replica with
+// the given ID is restarting intentionally (e.g. during a rolling deploy) and
+// will be silent for up to d. While the hint holds, its silence isn't treated
+// as a failure, so no view change is started because of it. The window is
+// capped by Options.MaxRestartHint, after which the replica is treated as
+// failed like any other silent replica.
+func (r *Replica) HintRestart(replicaID int, d time.Duration) {
+	r.mu.Lock()
+	r.recordRestartHint(replicaID, d)
+	r.mu.Unlock()
+
+	for peerID := range r.configuration {
+		// The duration rather than the deadline is sent,
+		// so the hint doesn't depend on the clocks being in sync.
+		args := RestartHintArgs{
+			SenderID:  r.ID,
+			ReplicaID: replicaID,
+			Duration:  d,
+		}
+		go func(peerID int) {
+			var reply RestartHintReply
+
+			r.dlog("sending restart hint to %d: %+v", peerID, args)
+			if err := r.server.Call(peerID, "Replica.RestartHint", args, &reply); err != nil {
+				log.Printf("failed sending restart hint; err = %v", err.Error())
+			}
+		}(peerID)
+	}
+}
+
+// recordRestartHint bounds the hint and saves it.
+// Expects r.mu to be locked.
+func (r *Replica) recordRestartHint(replicaID int, d time.Duration) {
+	if d > r.opts.MaxRestartHint {
+		d = r.opts.MaxRestartHint
+	}
+	until := r.clock.Now().Add(d)
+	r.restartHints[replicaID] = until
+	r.dlog("replica %d is restarting intentionally until %v", replicaID, until)
+}
+
+// isRestarting tells whether the replica is within a restart hint window.
+// Expects r.mu to be locked.
+func (r *Replica) isRestarting(replicaID int) bool {
+	until, ok := r.restartHints[replicaID]
+	if !ok {
+		return false
+	}
+	if r.clock.Now().After(until) {
+		delete(r.restartHints, replicaID)
+		return false
+	}
+	return true
+}
+
+type RestartHintArgs struct {
+	SenderID  int
+	ReplicaID int
+	Duration  time.Duration
+}
+
+type RestartHintReply struct {
+	IsReplied bool
+}
+
+func (r *Replica) RestartHint(args RestartHintArgs, reply *RestartHintReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("RestartHint: %+v", args)
+
+	r.recordRestartHint(args.ReplicaID, args.Duration)
+	reply.IsReplied = true
+	return nil
+}
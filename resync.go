@@ -0,0 +1,102 @@
+package vrr
+
+// A backup which finds that its opLog or its state machine diverged from the
+// primary's, e.g. because of a corrupted log, heals itself rather than going
+// on acking <PREPARE>s on top of it. How aggressively is its ResyncPolicy: it
+// drops the suspect suffix of its opLog and transfers it again from the
+// primary, or forgets its whole state and recovers it, see StartRecovery.
+// Only the state machines implementing StateResetter can recover the whole
+// state, which the others would apply a second time: their divergence is
+// reported as a FailureInvariant instead, see also
+// Options.DeterminismCheckInterval.
+
+// ResyncPolicy is how a backup heals from a divergence with the primary.
+type ResyncPolicy int
+
+const (
+	// ResyncSuffix drops the operations of the opLog from the first diverging
+	// one on and transfers them again from the primary. A divergence of the
+	// committed operations or of the state machine, which were applied
+	// already, is healed as with ResyncFull.
+	ResyncSuffix ResyncPolicy = iota
+
+	// ResyncFull makes the replica forget its whole state and recover it.
+	ResyncFull
+
+	// ResyncNever only reports the divergence, dropping the message which
+	// revealed it.
+	ResyncNever
+)
+
+func (p ResyncPolicy) String() string {
+	switch p {
+	case ResyncSuffix:
+		return "Suffix"
+	case ResyncFull:
+		return "Full"
+	case ResyncNever:
+		return "Never"
+	default:
+		panic("unreachable")
+	}
+}
+
+// StateResetter is implemented by the state machines which can be emptied,
+// so that a replica whose state machine diverged applies all the operations
+// again from the start once it recovered them.
+type StateResetter interface {
+	Reset()
+}
+
+// resyncLog heals the replica whose opLog diverged from the primary's at
+// opNum, as its ResyncPolicy says. Expects r.mu to be locked.
+func (r *Replica) resyncLog(opNum int) {
+	switch {
+	case r.opts.ResyncPolicy == ResyncNever:
+		r.dlog("keeps its opLog diverging at opNum=%d", opNum)
+	case r.opts.ResyncPolicy == ResyncSuffix && opNum > r.commitNum:
+		r.resyncs++
+		r.dlog("drops its opLog from opNum=%d and transfers it again", opNum)
+		if opNum <= r.opNum {
+			r.opLog = r.opLog[:opNum-r.logStart-1]
+			r.recountDecodedCache()
+			r.opNum = opNum - 1
+			r.storeLog(opNum)
+		}
+		r.forgetGap()
+		r.startStateTransfer(r.viewNum, r.primaryID)
+	default:
+		r.resyncState()
+	}
+}
+
+// resyncStateMachine heals the backup whose state machine hash differs from
+// the primary's, as its ResyncPolicy says. Expects r.mu to be locked.
+func (r *Replica) resyncStateMachine() {
+	if r.opts.ResyncPolicy == ResyncNever {
+		return
+	}
+	r.resyncState()
+}
+
+// resyncState makes the replica forget its whole state, its state machine
+// included, and recover it. A state machine which isn't a StateResetter
+// would apply the recovered operations a second time, so the replica keeps
+// its state and reports the failure instead. It tells whether the replica
+// heals. Expects r.mu to be locked.
+func (r *Replica) resyncState() bool {
+	if r.status == Dead || r.isRecovering() {
+		return true
+	}
+	if _, ok := r.opts.StateMachine.(StateResetter); !ok {
+		r.dlog("can't reset its state machine, keeps its state")
+		r.reportFailure(FailureInvariant, r.commitNum, 0, errUnhealable)
+		return false
+	}
+	r.resyncs++
+	// commitChanSender resets the state machine before it applies the
+	// recovered operations, so that it doesn't race with Apply.
+	r.resetStateMachine = true
+	r.startRecovery()
+	return true
+}
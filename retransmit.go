@@ -0,0 +1,111 @@
+package vrr
+
+import (
+	"log"
+	"time"
+)
+
+// The primary retransmits the <PREPARE>s a backup missed, e.g. because the
+// call failed, rather than leaving it to find out about the gap. The
+// retransmissions to a backup go one at a time from the first operation it
+// didn't acknowledge, backing off while the calls keep failing, until it
+// acknowledged the whole opLog or it is declared behind: it then catches up by
+// itself, pulling the missing operations or through state transfer.
+
+const (
+	minRetransmitBackoff = 10 * time.Millisecond
+	maxRetransmitBackoff = time.Second
+
+	// maxRetransmitFailures is how many retransmissions in a row may fail
+	// before the backup is declared behind.
+	maxRetransmitFailures = 8
+)
+
+// retransmitPrepares makes the primary retransmit to the backup the
+// <PREPARE>s it didn't acknowledge, unless it is already doing so.
+// Expects r.mu to be locked.
+func (r *Replica) retransmitPrepares(peerID int) {
+	if r.retransmitting == nil {
+		r.retransmitting = make(map[int]bool)
+	}
+	if r.retransmitting[peerID] {
+		return
+	}
+	r.retransmitting[peerID] = true
+	go r.runRetransmissions(peerID, r.viewNum)
+}
+
+func (r *Replica) runRetransmissions(peerID int, viewNum int) {
+	backoff := minRetransmitBackoff
+	failures := 0
+	for {
+		if backoff > 0 {
+			ticker := r.clock.NewTicker(backoff)
+			<-ticker.C()
+			ticker.Stop()
+		}
+
+		r.mu.Lock()
+		if !r.leadsView() || r.viewNum != viewNum || r.ackedOpNums[peerID] >= r.opNum {
+			delete(r.retransmitting, peerID)
+			r.mu.Unlock()
+			return
+		}
+		if failures >= maxRetransmitFailures {
+			r.dlog("backup %d is behind, stops retransmitting <PREPARE>s", peerID)
+			delete(r.retransmitting, peerID)
+			r.mu.Unlock()
+			return
+		}
+		opNum := r.ackedOpNums[peerID] + 1
+		if opNum <= r.logStart {
+			r.dlog("backup %d is behind the opLog, stops retransmitting <PREPARE>s", peerID)
+			delete(r.retransmitting, peerID)
+			r.mu.Unlock()
+			return
+		}
+		e := r.logEntry(opNum)
+		args := PrepareArgs{
+			PrimaryID: r.ID,
+			ViewNum:   viewNum,
+			OpNum:     opNum,
+			CommitNum: r.commitNum,
+			ClientMessage: clientRequest{
+				namespace: e.namespace,
+				clientID:  e.clientID,
+				reqNum:    e.reqNum,
+				reqOp:     e.op(),
+			},
+		}
+		r.mu.Unlock()
+
+		var reply PrepareOKReply
+		r.dlog("retransmitting <PREPARE> to %d: opNum=%d", peerID, opNum)
+		err := r.server.Call(peerID, "Replica.Prepare", args, &reply)
+		if err != nil {
+			log.Printf("failed retransmitting <PREPARE>; err = %v", err.Error())
+		}
+
+		r.mu.Lock()
+		if err == ErrStaleView || err == ErrReplicaDead {
+			r.dlog("backup %d refused <PREPARE>, stops retransmitting", peerID)
+			delete(r.retransmitting, peerID)
+			r.mu.Unlock()
+			return
+		}
+		if err == nil && reply.IsReplied && reply.ViewNum == viewNum {
+			r.ackPrepare(peerID, reply.OpNum)
+			backoff = 0
+			failures = 0
+		} else {
+			failures++
+			backoff *= 2
+			if backoff < minRetransmitBackoff {
+				backoff = minRetransmitBackoff
+			} else if backoff > maxRetransmitBackoff {
+				backoff = maxRetransmitBackoff
+			}
+		}
+		r.mu.Unlock()
+	}
+}
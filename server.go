@@ -3,7 +3,6 @@ package vrr
 import (
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/rpc"
 	"sync"
@@ -17,14 +16,39 @@ type Server struct {
 	configuration map[int]string
 
 	replica  *Replica
-	rpcProxy *RPCProxy
-
-	rpcServer *rpc.Server
-	listener  net.Listener
+	listener net.Listener
 
 	commitChan  chan<- CommitEntry
 	peerClients map[int]*rpc.Client
 
+	// handshaken holds the peer clients which identified this server's
+	// replica to the peer, see PeerIdentity.
+	handshaken map[int]*rpc.Client
+
+	// dataSlots bounds the in-flight data-plane messages per peer. Control-plane
+	// messages don't take a slot, so they are never queued behind a saturated
+	// stream of <PREPARE>s.
+	dataSlots map[int]chan struct{}
+
+	// linkProfiles emulates the network conditions of the outbound link
+	// to each peer. Peers without a profile are reached directly.
+	linkProfiles map[int]LinkProfile
+
+	// inboundInterceptors wrap the protocol handlers, outside of the
+	// replica's Options.InboundInterceptors.
+	inboundInterceptors []InboundInterceptor
+
+	// inboundLimiters bound the inbound messages of each peer, and
+	// busyBackoffs the outbound ones to the peers which replied ErrPeerBusy.
+	inboundLimiters map[int]*inboundLimiter
+	busyBackoffs    map[int]*busyBackoff
+
+	// peerLiveness tells which peers the outbound calls reach.
+	peerLiveness map[int]*peerLiveness
+
+	// messagesSent counts the outbound calls per service method.
+	messagesSent map[string]int
+
 	ready <-chan interface{}
 	quit  chan interface{}
 	wg    sync.WaitGroup
@@ -33,6 +57,13 @@ type Server struct {
 func NewServer(ready <-chan interface{}, commitChan chan<- CommitEntry) *Server {
 	s := new(Server)
 	s.peerClients = make(map[int]*rpc.Client)
+	s.handshaken = make(map[int]*rpc.Client)
+	s.linkProfiles = make(map[int]LinkProfile)
+	s.dataSlots = make(map[int]chan struct{})
+	s.messagesSent = make(map[string]int)
+	s.inboundLimiters = make(map[int]*inboundLimiter)
+	s.busyBackoffs = make(map[int]*busyBackoff)
+	s.peerLiveness = make(map[int]*peerLiveness)
 	s.ready = ready
 	s.commitChan = commitChan
 	s.quit = make(chan interface{})
@@ -40,16 +71,17 @@ func NewServer(ready <-chan interface{}, commitChan chan<- CommitEntry) *Server
 	return s
 }
 
+// Serve starts listening for incoming RPCs. The replica itself is only created
+// by Configure, once the addresses of all the peers are known.
 func (s *Server) Serve() {
-	s.mu.Lock()
-	s.replica = NewReplica(s.serverID, s.configuration, s, s.ready, s.commitChan)
-
-	s.rpcServer = rpc.NewServer()
-	s.rpcProxy = &RPCProxy{r: s.replica}
-	s.rpcServer.RegisterName("Replica", s.rpcProxy)
+	s.ServeOn(":0")
+}
 
+// ServeOn is like Serve but listens at addr.
+func (s *Server) ServeOn(addr string) {
+	s.mu.Lock()
 	var err error
-	s.listener, err = net.Listen("tcp", ":0")
+	s.listener, err = net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -72,13 +104,56 @@ func (s *Server) Serve() {
 			}
 			s.wg.Add(1)
 			go func() {
-				s.rpcServer.ServeConn(conn)
+				s.serveConn(conn)
 				s.wg.Done()
 			}()
 		}
 	}()
 }
 
+// Configure creates the replica served by this server with the given ID,
+// configuration of its peers, and options.
+func (s *Server) Configure(ID int, configuration map[int]string, opts Options) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replica, err := NewReplica(ID, configuration, s, s.ready, s.commitChan, opts)
+	if err != nil {
+		return err
+	}
+	s.serverID = ID
+	s.configuration = configuration
+	s.replica = replica
+	return nil
+}
+
+// MessagesSent returns how many messages were sent to peers so far,
+// per service method, whether they were delivered or not.
+func (s *Server) MessagesSent() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sent := make(map[string]int, len(s.messagesSent))
+	for method, n := range s.messagesSent {
+		sent[method] = n
+	}
+	return sent
+}
+
+// serveConn serves the RPCs received on the connection. Each connection has
+// an RPCProxy of its own, holding the identity of the peer which opened it.
+func (s *Server) serveConn(conn net.Conn) {
+	rpcServer := rpc.NewServer()
+	rpcServer.RegisterName("Replica", &RPCProxy{s: s, remoteAddr: conn.RemoteAddr().String()})
+	rpcServer.ServeConn(conn)
+}
+
+// Replica returns the replica created by Configure.
+func (s *Server) Replica() *Replica {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.replica
+}
+
 func (s *Server) DisconnectAll() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -93,7 +168,9 @@ func (s *Server) DisconnectAll() {
 func (s *Server) Shutdown() {
 	// s.replica.Stop()
 	close(s.quit)
-	s.listener.Close()
+	if s.listener != nil {
+		s.listener.Close()
+	}
 	s.wg.Wait()
 }
 
@@ -116,6 +193,49 @@ func (s *Server) ConnectToPeer(peerID int, addr net.Addr) error {
 	return nil
 }
 
+// redialInterval is how long the server waits before dialing again a peer
+// which moved, see redial.
+const redialInterval = 100 * time.Millisecond
+
+// redial replaces the connection to the peer by one to its new address,
+// trying again until it succeeds or the server shuts down.
+func (s *Server) redial(peerID int, addr string) {
+	for {
+		client, err := rpc.Dial("tcp", addr)
+		if err == nil {
+			s.mu.Lock()
+			if old := s.peerClients[peerID]; old != nil {
+				old.Close()
+			}
+			s.peerClients[peerID] = client
+			s.mu.Unlock()
+			return
+		}
+		log.Printf("failed redialing replica %d at %s; err = %v", peerID, addr, err.Error())
+		select {
+		case <-time.After(redialInterval):
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// ConnectToLocalPeer connects to the server of the peer running in the same
+// process through an in-memory connection.
+func (s *Server) ConnectToLocalPeer(peerID int, peer *Server) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peerClients[peerID] == nil {
+		clientConn, serverConn := net.Pipe()
+		peer.wg.Add(1)
+		go func() {
+			defer peer.wg.Done()
+			peer.serveConn(serverConn)
+		}()
+		s.peerClients[peerID] = rpc.NewClient(clientConn)
+	}
+}
+
 func (s *Server) DisconnectPeer(peerID int) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -127,54 +247,297 @@ func (s *Server) DisconnectPeer(peerID int) error {
 	return nil
 }
 
+// SetLinkProfile emulates the network conditions of the profile on every
+// message sent from this server to the peer.
+func (s *Server) SetLinkProfile(peerID int, profile LinkProfile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.linkProfiles[peerID] = profile
+}
+
+// ClearLinkProfile removes any emulated network conditions towards the peer.
+func (s *Server) ClearLinkProfile(peerID int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.linkProfiles, peerID)
+}
+
 func (s *Server) Call(ID int, serviceMethod string, args interface{}, reply interface{}) error {
 	s.mu.Lock()
+	if b, ok := s.busyBackoffs[ID]; ok && time.Now().Before(b.until) {
+		s.mu.Unlock()
+		return fmt.Errorf("%w: backing off from replica %d", ErrPeerBusy, ID)
+	}
 	peer := s.peerClients[ID]
+	profile, emulated := s.linkProfiles[ID]
+	slots, ok := s.dataSlots[ID]
+	if !ok {
+		slots = make(chan struct{}, maxInFlightDataMessages)
+		s.dataSlots[ID] = slots
+	}
+	s.messagesSent[serviceMethod]++
 	s.mu.Unlock()
 
 	if peer == nil {
-		return fmt.Errorf("call client %d after it is closed", ID)
-	} else {
-		return peer.Call(serviceMethod, args, reply)
+		err := fmt.Errorf("call client %d after it is closed", ID)
+		s.notePeerReached(ID, err)
+		return err
+	}
+	if err := s.handshake(ID, peer); err != nil {
+		s.notePeerReached(ID, err)
+		return err
+	}
+
+	if classOf(serviceMethod) == dataPlane {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-s.quit:
+			return fmt.Errorf("call client %d after the server is shut down", ID)
+		}
 	}
+
+	if emulated {
+		time.Sleep(profile.delay())
+		if profile.drop() {
+			err := fmt.Errorf("message %s to %d dropped by %q link profile", serviceMethod, ID, profile.Name)
+			s.notePeerReached(ID, err)
+			return err
+		}
+	}
+	err := remoteError(peer.Call(serviceMethod, args, reply))
+	s.noteBusy(ID, err)
+	s.notePeerReached(ID, err)
+	return err
 }
 
+// handshake identifies the replica of this server on the connection of the
+// peer client, once per connection.
+func (s *Server) handshake(peerID int, peer *rpc.Client) error {
+	s.mu.Lock()
+	done := s.handshaken[peerID] == peer
+	args := HandshakeArgs{ReplicaID: s.serverID}
+	if s.replica != nil {
+		args.Credentials = s.replica.opts.PeerCredentials
+		args.ClusterEpoch = s.replica.opts.ClusterEpoch
+		if m, ok := s.replica.membership.Load().(membership); ok {
+			args.EpochNum = m.EpochNum
+			args.Members = m.Members
+		}
+	}
+	s.mu.Unlock()
+	if done {
+		return nil
+	}
+
+	var reply HandshakeReply
+	if err := peer.Call("Replica.Handshake", args, &reply); err != nil {
+		return fmt.Errorf("handshake with %d failed: %v", peerID, err)
+	}
+	s.mu.Lock()
+	s.handshaken[peerID] = peer
+	s.mu.Unlock()
+	return nil
+}
+
+// maxInFlightDataMessages is the capacity reserved per peer to data-plane
+// messages, the rest of the link is left to control-plane messages.
+const maxInFlightDataMessages = 32
+
+type messageClass int
+
+const (
+	// controlPlane messages drive view changes and membership,
+	// they must go through even when the primary is saturated.
+	// <COMMIT> is one of them: it is the primary's heartbeat, and the
+	// backups would start a view change if it queued behind <PREPARE>s.
+	controlPlane messageClass = iota
+	// dataPlane messages replicate client requests.
+	dataPlane
+)
+
+func classOf(serviceMethod string) messageClass {
+	switch serviceMethod {
+	case "Replica.Prepare":
+		return dataPlane
+	default:
+		return controlPlane
+	}
+}
+
+// RPCProxy serves the RPCs of a single connection to the server.
 type RPCProxy struct {
-	r *Replica
+	s          *Server
+	remoteAddr string
+
+	mu sync.Mutex
+	// identity is the peer which opened the connection, set by its handshake.
+	identity *PeerIdentity
+}
+
+// Handshake binds the identity of the peer to the connection. It can't be
+// changed to another replica afterwards.
+func (rpp *RPCProxy) Handshake(args HandshakeArgs, reply *HandshakeReply) error {
+	if r, err := rpp.replica(); err == nil {
+		if err := r.checkMembership(args.EpochNum, args.Members); err != nil {
+			return err
+		}
+	}
+
+	rpp.mu.Lock()
+	defer rpp.mu.Unlock()
+	if rpp.identity != nil && rpp.identity.ReplicaID != args.ReplicaID {
+		return fmt.Errorf("connection already identified as replica %d", rpp.identity.ReplicaID)
+	}
+	rpp.identity = &PeerIdentity{
+		ReplicaID:    args.ReplicaID,
+		RemoteAddr:   rpp.remoteAddr,
+		Credentials:  args.Credentials,
+		ClusterEpoch: args.ClusterEpoch,
+	}
+	return nil
+}
+
+// peerIdentity returns the identity of the peer, nil before its handshake.
+func (rpp *RPCProxy) peerIdentity() *PeerIdentity {
+	rpp.mu.Lock()
+	defer rpp.mu.Unlock()
+	return rpp.identity
+}
+
+// replica returns the replica of the server, or ErrNotConfigured when
+// Configure wasn't called yet: the server already accepts connections then.
+func (rpp *RPCProxy) replica() (*Replica, error) {
+	rpp.s.mu.Lock()
+	defer rpp.s.mu.Unlock()
+	if rpp.s.replica == nil {
+		return nil, ErrNotConfigured
+	}
+	return rpp.s.replica, nil
 }
 
 func (rpp *RPCProxy) Hello(args HelloArgs, reply *HelloReply) error {
-	time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+	return rpp.intercept("Hello", args.ID, args, func(r *Replica) error {
+		return r.Hello(args, reply)
+	})
+}
 
-	return rpp.r.Hello(args, reply)
+func (rpp *RPCProxy) PreVote(args PreVoteArgs, reply *PreVoteReply) error {
+	return rpp.intercept("PreVote", args.ReplicaID, args, func(r *Replica) error {
+		return r.PreVote(args, reply)
+	})
 }
 
 func (rpp *RPCProxy) StartViewChange(args StartViewChangeArgs, reply *StartViewChangeReply) error {
-	time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
-
-	return rpp.r.StartViewChange(args, reply)
+	return rpp.intercept("StartViewChange", args.ReplicaID, args, func(r *Replica) error {
+		return r.StartViewChange(args, reply)
+	})
 }
 
 func (rpp *RPCProxy) DoViewChange(args DoViewChangeArgs, reply *DoViewChangeReply) error {
-	time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
-
-	return rpp.r.DoViewChange(args, reply)
+	return rpp.intercept("DoViewChange", args.ReplicaID, args, func(r *Replica) error {
+		return r.DoViewChange(args, reply)
+	})
 }
 
 func (rpp *RPCProxy) StartView(args StartViewArgs, reply *StartViewReply) error {
-	time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
-
-	return rpp.r.StartView(args, reply)
+	return rpp.intercept("StartView", args.PrimaryID, args, func(r *Replica) error {
+		return r.StartView(args, reply)
+	})
 }
 
 func (rpp *RPCProxy) Prepare(args PrepareArgs, reply *PrepareOKReply) error {
-	time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+	return rpp.intercept("Prepare", args.PrimaryID, args, func(r *Replica) error {
+		return r.Prepare(args, reply)
+	})
+}
 
-	return rpp.r.Prepare(args, reply)
+func (rpp *RPCProxy) PrepareOK(args PrepareOKArgs, reply *PrepareOKAckReply) error {
+	return rpp.intercept("PrepareOK", args.ReplicaID, args, func(r *Replica) error {
+		return r.PrepareOK(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) AnnounceAddress(args AnnounceAddressArgs, reply *AnnounceAddressReply) error {
+	return rpp.intercept("AnnounceAddress", args.ReplicaID, args, func(r *Replica) error {
+		return r.AnnounceAddress(args, reply)
+	})
 }
 
 func (rpp *RPCProxy) Commit(args CommitArgs, reply *CommitReply) error {
-	time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+	return rpp.intercept("Commit", args.PrimaryID, args, func(r *Replica) error {
+		return r.Commit(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) RestartHint(args RestartHintArgs, reply *RestartHintReply) error {
+	return rpp.intercept("RestartHint", args.SenderID, args, func(r *Replica) error {
+		return r.RestartHint(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) StateHash(args StateHashArgs, reply *StateHashReply) error {
+	return rpp.intercept("StateHash", args.ReplicaID, args, func(r *Replica) error {
+		return r.StateHash(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) Request(args RequestArgs, reply *RequestReply) error {
+	r, err := rpp.replica()
+	if err != nil {
+		return err
+	}
+	return r.Request(args, reply)
+}
+
+func (rpp *RPCProxy) GetMissingOps(args GetMissingOpsArgs, reply *GetMissingOpsReply) error {
+	return rpp.intercept("GetMissingOps", args.ReplicaID, args, func(r *Replica) error {
+		return r.GetMissingOps(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) GetState(args GetStateArgs, reply *GetStateReply) error {
+	return rpp.intercept("GetState", args.ReplicaID, args, func(r *Replica) error {
+		return r.GetState(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) NewState(args NewStateArgs, reply *NewStateReply) error {
+	return rpp.intercept("NewState", args.ReplicaID, args, func(r *Replica) error {
+		return r.NewState(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) InstallSnapshot(args InstallSnapshotArgs, reply *InstallSnapshotReply) error {
+	return rpp.intercept("InstallSnapshot", args.ReplicaID, args, func(r *Replica) error {
+		return r.InstallSnapshot(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) Recovery(args RecoveryArgs, reply *RecoveryReply) error {
+	return rpp.intercept("Recovery", args.ReplicaID, args, func(r *Replica) error {
+		return r.Recovery(args, reply)
+	})
+}
+
+func (rpp *RPCProxy) RecoveryResponse(args RecoveryResponseArgs, reply *RecoveryResponseReply) error {
+	return rpp.intercept("RecoveryResponse", args.ReplicaID, args, func(r *Replica) error {
+		return r.RecoveryResponse(args, reply)
+	})
+}
 
-	return rpp.r.Commit(args, reply)
+func (rpp *RPCProxy) WaitForCommit(args WaitForCommitArgs, reply *WaitForCommitReply) error {
+	r, err := rpp.replica()
+	if err != nil {
+		return err
+	}
+	return r.waitForCommitRequest(args, reply)
+}
+
+func (rpp *RPCProxy) Stats(args StatsArgs, reply *StatsReply) error {
+	r, err := rpp.replica()
+	if err != nil {
+		return err
+	}
+	return r.Stats(args, reply)
 }
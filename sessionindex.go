@@ -0,0 +1,69 @@
+package vrr
+
+import (
+	"sort"
+	"time"
+)
+
+// The session index records, for every committed operation, its position in
+// the session of its client: the request number and when the replica
+// committed it. It answers "what did client X do between T1 and T2" without
+// scanning the log, see SessionHistory; the operations themselves are read
+// with CommittedEntries.
+
+// SessionPosition is a committed operation of a client session.
+type SessionPosition struct {
+	OpNum       int
+	ReqNum      int
+	CommittedAt time.Time
+}
+
+// sessionKey identifies a client session, client IDs being per tenant.
+type sessionKey struct {
+	namespace string
+	clientID  int
+}
+
+// indexSession records the position of the operation of opNum just committed
+// in the session of its client. Expects r.mu to be locked.
+func (r *Replica) indexSession(e opLogEntry, opNum int, committedAt time.Time) {
+	if e.namespace == internalNamespace {
+		return
+	}
+	if r.sessions == nil {
+		r.sessions = make(map[sessionKey][]SessionPosition)
+	}
+	key := sessionKey{namespace: e.namespace, clientID: e.clientID}
+	r.sessions[key] = append(r.sessions[key], SessionPosition{
+		OpNum:       opNum,
+		ReqNum:      e.reqNum,
+		CommittedAt: committedAt,
+	})
+}
+
+// forgetSessions empties the session index, when the committed operations
+// are reset. Expects r.mu to be locked.
+func (r *Replica) forgetSessions() {
+	r.sessions = nil
+}
+
+// SessionHistory returns the operations of the client of the namespace which
+// this replica committed between since and until, inclusive, in order. A zero
+// until has no upper bound. The times are the ones of this replica, which
+// commits the operations it imported or recovered when it gets them.
+func (r *Replica) SessionHistory(namespace string, clientID int, since, until time.Time) []SessionPosition {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	positions := r.sessions[sessionKey{namespace: namespace, clientID: clientID}]
+	// The positions are in commit order, hence of time.
+	first := sort.Search(len(positions), func(i int) bool { return !positions[i].CommittedAt.Before(since) })
+	last := len(positions)
+	if !until.IsZero() {
+		last = sort.Search(len(positions), func(i int) bool { return positions[i].CommittedAt.After(until) })
+	}
+	if first >= last {
+		return nil
+	}
+	return append([]SessionPosition(nil), positions[first:last]...)
+}
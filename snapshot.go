@@ -0,0 +1,261 @@
+package vrr
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"log"
+)
+
+// The opLog would grow without bound, so a replica whose state machine is a
+// Snapshotter checkpoints it every Options.SnapshotInterval applied
+// operations, or Options.SnapshotBytes of them, and drops the operations the
+// snapshot holds from its opLog: the opLog then starts after logStart, the
+// opNums keep counting from the start. The snapshot holds the committed
+// entries of the clientTable too, and is written to the storage, from which
+// a restarted replica restores it before applying the rest of the opLog.
+//
+// A replica only drops the operations every member of the group holds, as
+// the primary learns from their <PREPARE-OK>s and tells with its <COMMIT>s,
+// see compactNum: a view change or a lagging backup thus finds the
+// operations it needs in the opLog of another replica. A member which is
+// down holds the truncation back until it comes back. A replica missing the
+// operations before the log of another, e.g. recovering, installs its
+// snapshot, see installSnapshot.
+
+// Snapshotter is implemented by the state machines which can be
+// checkpointed. Snapshot returns the state after the operations applied so
+// far, and Restore replaces the state with a snapshot; neither is called
+// while an operation is applied.
+type Snapshotter interface {
+	Snapshot() ([]byte, error)
+	Restore(snapshot []byte) error
+}
+
+const storageSnapshot = "snapshot"
+
+// snapshotState is a snapshot of the replica after the operation OpNum.
+type snapshotState struct {
+	OpNum   int
+	State   []byte
+	Clients []snapshotClient
+}
+
+// snapshotClient is a committed entry of a clientTable.
+type snapshotClient struct {
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Resp      interface{}
+	Replied   bool
+}
+
+func encodeSnapshot(snapshot snapshotState) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(snapshot); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSnapshot(data []byte) (snapshotState, error) {
+	var snapshot snapshotState
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&snapshot)
+	return snapshot, err
+}
+
+// logEntry returns the entry of the opLog with the opNum, which must be past
+// logStart. Expects r.mu to be locked.
+func (r *Replica) logEntry(opNum int) *opLogEntry {
+	return &r.opLog[opNum-r.logStart-1]
+}
+
+// logRange returns the entries of the opLog with opNums from from to to,
+// inclusive, from past logStart. Expects r.mu to be locked.
+func (r *Replica) logRange(from, to int) []opLogEntry {
+	return r.opLog[from-r.logStart-1 : to-r.logStart]
+}
+
+// snapshotDue tells whether the state machine should be checkpointed after
+// the operation just applied. Expects r.mu to be locked.
+func (r *Replica) snapshotDue() bool {
+	if _, ok := r.opts.StateMachine.(Snapshotter); !ok {
+		return false
+	}
+	if n := r.opts.SnapshotInterval; n > 0 && r.appliedNum-r.snapshotNum >= n {
+		return true
+	}
+	return r.opts.SnapshotBytes > 0 && r.appliedBytes >= r.opts.SnapshotBytes
+}
+
+// takeSnapshot checkpoints the state machine after the operation opNum, the
+// last one applied, and drops the operations it holds from the opLog. It is
+// called by commitChanSender between two operations.
+func (r *Replica) takeSnapshot(snapshotter Snapshotter, opNum int) {
+	state, err := snapshotter.Snapshot()
+	if err != nil {
+		log.Printf("failed taking a snapshot at opNum=%d; err = %v", opNum, err.Error())
+		r.reportFailure(FailureSnapshot, opNum, 0, err)
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// Recovery may have reset the state machine meanwhile.
+	if r.appliedNum != opNum || r.status == Dead {
+		return
+	}
+	snapshot := snapshotState{OpNum: opNum, State: state}
+	for namespace, t := range r.tenants {
+		for clientID, e := range t.clientTable {
+			if e.committed {
+				snapshot.Clients = append(snapshot.Clients, snapshotClient{
+					Namespace: namespace,
+					ClientID:  clientID,
+					ReqNum:    e.reqNum,
+					Resp:      e.resp,
+					Replied:   e.replied,
+				})
+			}
+		}
+	}
+	data, err := encodeSnapshot(snapshot)
+	if err != nil {
+		log.Printf("failed encoding the snapshot at opNum=%d; err = %v", opNum, err.Error())
+		r.reportFailure(FailureSnapshot, opNum, 0, err)
+		return
+	}
+	if err := r.storage.Set(storageSnapshot, data); err != nil {
+		r.failStorage(err)
+		return
+	}
+	r.snapshotNum = opNum
+	r.appliedBytes = 0
+	r.dlog("took a snapshot of %d bytes at opNum=%d", len(state), opNum)
+	r.compactLog()
+}
+
+// updateCompactNum is called on the <PREPARE-OK>s of the primary: the
+// operations every member acknowledged, and committed, can be dropped from
+// the opLogs. Expects r.mu to be locked.
+func (r *Replica) updateCompactNum() {
+	compactNum := r.commitNum
+	for peerID := range r.configuration {
+		if acked := r.ackedOpNums[peerID]; acked < compactNum {
+			compactNum = acked
+		}
+	}
+	if compactNum > r.compactNum {
+		r.compactNum = compactNum
+		r.compactLog()
+	}
+}
+
+// compactLog drops from the opLog the operations both the latest snapshot
+// and every member hold. Expects r.mu to be locked.
+func (r *Replica) compactLog() {
+	upTo := r.snapshotNum
+	if r.compactNum < upTo {
+		upTo = r.compactNum
+	}
+	if upTo <= r.logStart {
+		return
+	}
+	// Copy rather than reslice, so that the dropped operations are garbage
+	// collected.
+	r.opLog = append([]opLogEntry(nil), r.opLog[upTo-r.logStart:]...)
+	r.logStart = upTo
+	r.recountDecodedCache()
+	if err := r.storage.CompactLog(upTo); err != nil {
+		r.failStorage(err)
+		return
+	}
+	r.dlog("dropped the opLog up to opNum=%d", upTo)
+}
+
+// storedSnapshot returns the latest snapshot of the replica as stored, nil
+// if it has none. Expects r.mu to be locked.
+func (r *Replica) storedSnapshot() []byte {
+	if r.snapshotNum == 0 {
+		return nil
+	}
+	data, err := r.storage.Get(storageSnapshot)
+	if err != nil {
+		log.Printf("failed reading the snapshot; err = %v", err.Error())
+		r.reportFailure(FailureStorage, r.snapshotNum, 0, err)
+		return nil
+	}
+	return data
+}
+
+// installSnapshot makes the snapshot sent by another replica the state of
+// the replica, whose opLog then starts after it: commitChanSender restores
+// the state machine before it applies the next operation.
+// Expects r.mu to be locked.
+func (r *Replica) installSnapshot(data []byte) error {
+	snapshot, err := decodeSnapshot(data)
+	if err != nil {
+		return fmt.Errorf("vrr: malformed snapshot: %v", err)
+	}
+	if err := r.storage.Set(storageSnapshot, data); err != nil {
+		return err
+	}
+	if err := r.storage.CompactLog(snapshot.OpNum); err != nil {
+		return err
+	}
+
+	r.useSnapshot(snapshot)
+	r.dlog("installed the snapshot at opNum=%d", snapshot.OpNum)
+	return nil
+}
+
+// useSnapshot makes the snapshot the state of the replica, with an empty
+// opLog following it. Expects r.mu to be locked.
+func (r *Replica) useSnapshot(snapshot snapshotState) {
+	r.opLog = nil
+	r.decodedCacheBytes = 0
+	r.logStart = snapshot.OpNum
+	r.snapshotNum = snapshot.OpNum
+	r.opNum = snapshot.OpNum
+	r.commitNum = snapshot.OpNum
+	r.appliedNum = snapshot.OpNum
+	r.appliedBytes = 0
+	r.pendingSnapshot = snapshot.State
+	r.resetStateMachine = false
+	r.forgetReplay()
+	for _, t := range r.tenants {
+		t.clientTable = make(map[int]clientTableEntry)
+	}
+	for _, c := range snapshot.Clients {
+		r.tenantFor(c.Namespace).clientTable[c.ClientID] = clientTableEntry{
+			reqNum:    c.ReqNum,
+			committed: true,
+			resp:      c.Resp,
+			replied:   c.Replied,
+		}
+	}
+}
+
+// installLog replaces the opLog with the entries following opNum start, up
+// to opNum, as sent by another replica whose opLog starts after start. The
+// operations up to start are committed, so the replica keeps its own when
+// its opLog starts earlier. It tells whether the replica has the operations
+// up to start, which it needs a snapshot for otherwise.
+// Expects r.mu to be locked.
+func (r *Replica) installLog(start int, entries []opLogEntry, opNum int) bool {
+	switch {
+	case opNum < r.logStart:
+		return false
+	case start <= r.logStart:
+		r.opLog = entries[r.logStart-start:]
+	case start <= r.opNum:
+		opLog := make([]opLogEntry, 0, opNum-r.logStart)
+		opLog = append(opLog, r.logRange(r.logStart+1, start)...)
+		r.opLog = append(opLog, entries...)
+	default:
+		return false
+	}
+	r.opNum = opNum
+	r.recountDecodedCache()
+	return true
+}
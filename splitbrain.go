@@ -0,0 +1,86 @@
+package vrr
+
+import (
+	"sort"
+	"time"
+)
+
+// primarySighting is the most recent evidence of a replica acting
+// as the primary of a view.
+type primarySighting struct {
+	ViewNum    int
+	PrimaryID  int
+	ReportedBy int
+	SeenAt     time.Time
+}
+
+// SplitBrainEvidence is attached to EventSplitBrain events: two different
+// primaries were seen active within overlapping periods, either in the same
+// view, or the primary of an older view after the one of a newer view.
+// ViewNum is the view of the Second sighting, which raised the event.
+type SplitBrainEvidence struct {
+	ViewNum int
+	First   primarySighting
+	Second  primarySighting
+}
+
+// observePrimary records that reportedBy has seen (or acknowledged) primaryID
+// acting as the primary of viewNum, raising a critical event if another
+// primary was seen active recently in the same view or in a newer one: the
+// primary of an older view still serving is as much a split brain as two
+// primaries of the same view.
+// Expects r.mu to be locked.
+func (r *Replica) observePrimary(viewNum int, primaryID int, reportedBy int) {
+	now := r.clock.Now()
+	sighting := primarySighting{ViewNum: viewNum, PrimaryID: primaryID, ReportedBy: reportedBy, SeenAt: now}
+
+	views := make([]int, 0, len(r.primarySightings))
+	for v := range r.primarySightings {
+		views = append(views, v)
+	}
+	sort.Ints(views)
+	latest := viewNum
+	for _, v := range views {
+		if v > latest {
+			latest = v
+		}
+		previous := r.primarySightings[v]
+		if v < viewNum || previous.PrimaryID == primaryID || now.Sub(previous.SeenAt) > r.splitBrainWindow() {
+			continue
+		}
+		// A backup lagging behind still acknowledges the primary of its
+		// view, only a message of that primary proves it's still serving.
+		if v > viewNum && reportedBy != primaryID {
+			continue
+		}
+		evidence := SplitBrainEvidence{
+			ViewNum: viewNum,
+			First:   previous,
+			Second:  sighting,
+		}
+		if v == viewNum {
+			r.emit(EventSplitBrain, SeverityCritical, evidence,
+				"primaries %d (reported by %d) and %d (reported by %d) are both active in view %d",
+				previous.PrimaryID, previous.ReportedBy, primaryID, reportedBy, viewNum)
+		} else {
+			r.emit(EventSplitBrain, SeverityCritical, evidence,
+				"primary %d of view %d (reported by %d) is still active after primary %d of view %d (reported by %d)",
+				primaryID, viewNum, reportedBy, previous.PrimaryID, v, previous.ReportedBy)
+		}
+	}
+	r.primarySightings[viewNum] = sighting
+
+	// Only the sightings of the recent views are worth keeping.
+	for v := range r.primarySightings {
+		if v < latest-1 {
+			delete(r.primarySightings, v)
+		}
+	}
+}
+
+// splitBrainWindow is how long a primary is considered active after
+// having been seen, i.e. how long a backup would wait for it before
+// starting a view change.
+func (r *Replica) splitBrainWindow() time.Duration {
+	return 2 * r.opts.ViewChangeTimeout
+}
@@ -0,0 +1,194 @@
+package vrr
+
+import (
+	"fmt"
+	"log"
+)
+
+// State transfer brings up to date a replica which learnt that it is missing
+// operations, from a gap in the <PREPARE>s or from a message of a later view:
+// it sends <GET-STATE> to the primary, which answers with a <NEW-STATE>
+// holding the part of its opLog the replica lacks. The replica stays in
+// StateTransfer, ignoring <PREPARE>s, until it installs the <NEW-STATE>.
+// Crash recovery, see StartRecovery, takes over a state transfer in progress.
+// A replica missing operations the primary dropped from its opLog gets its
+// snapshot first, see InstallSnapshot.
+
+// startStateTransfer makes the replica catch up with the primary of viewNum.
+// Expects r.mu to be locked.
+func (r *Replica) startStateTransfer(viewNum int, primaryID int) {
+	// A replica still changing views missed the <START-VIEW> of viewNum.
+	if viewNum > r.viewNum || r.status == ViewChange || r.status == DoViewChange {
+		// The operations which weren't committed may have been replaced
+		// by the view change, only the committed ones are known to hold.
+		if r.commitNum < r.opNum {
+			r.opLog = r.opLog[:r.commitNum-r.logStart]
+			r.recountDecodedCache()
+			r.opNum = r.commitNum
+			r.storeLog(r.commitNum + 1)
+		}
+		r.viewNum = viewNum
+	}
+	// The timer of a view change stops with it, the one of a backup keeps
+	// watching the primary.
+	changingViews := r.status == ViewChange || r.status == DoViewChange || r.status == StartView
+	r.primaryID = primaryID
+	r.setStatus(StateTransfer)
+	r.nextStateRequestAt = r.clock.Now()
+	r.requestState()
+	if changingViews {
+		go r.runViewChangeTimer()
+	}
+}
+
+// requestState sends <GET-STATE> to the primary, unless one was sent too
+// recently for its <NEW-STATE> to be back. Expects r.mu to be locked.
+func (r *Replica) requestState() {
+	now := r.clock.Now()
+	if now.Before(r.nextStateRequestAt) {
+		return
+	}
+	r.nextStateRequestAt = now.Add(2 * r.opts.HeartbeatInterval)
+
+	args := GetStateArgs{
+		ViewNum:   r.viewNum,
+		OpNum:     r.opNum,
+		ReplicaID: r.ID,
+	}
+	if s := r.incomingSnapshot; s != nil {
+		args.SnapshotNum, args.SnapshotOffset = s.snapshotNum, len(s.data)
+	}
+	primaryID := r.primaryID
+	go func() {
+		var reply GetStateReply
+
+		r.dlog("sending <GET-STATE> to primary %d: %+v", primaryID, args)
+		if err := r.server.Call(primaryID, "Replica.GetState", args, &reply); err != nil {
+			log.Printf("failed sending <GET-STATE>; err = %v", err.Error())
+		}
+	}()
+}
+
+type GetStateArgs struct {
+	ViewNum   int
+	OpNum     int
+	ReplicaID int
+	// SnapshotNum and SnapshotOffset are the snapshot being received and
+	// how much of it, so that its transfer resumes there.
+	SnapshotNum    int
+	SnapshotOffset int
+}
+
+type GetStateReply struct {
+	IsReplied bool
+}
+
+func (r *Replica) GetState(args GetStateArgs, reply *GetStateReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("GetState: %+v [currentView=%d]", args, r.viewNum)
+
+	if args.ViewNum != r.viewNum || r.status != Normal {
+		r.dlog("not in the view of the GET-STATE, drops message")
+		return nil
+	}
+	if args.OpNum > r.opNum {
+		r.dlog("doesn't have the state after opNum=%d, drops message", args.OpNum)
+		return nil
+	}
+	if r.transferring[args.ReplicaID] {
+		r.dlog("already streams NEW-STATE to %d, drops message", args.ReplicaID)
+		return nil
+	}
+	if args.OpNum < r.logStart {
+		reply.IsReplied = r.streamSnapshot(args)
+		return nil
+	}
+	reply.IsReplied = true
+
+	newState := NewStateArgs{
+		ViewNum:   r.viewNum,
+		ReplicaID: r.ID,
+		OpLog:     make([]opLogEntry, r.opNum-args.OpNum),
+		OpNum:     r.opNum,
+		CommitNum: r.commitNum,
+	}
+	copy(newState.OpLog, r.logRange(args.OpNum+1, r.opNum))
+	if r.transferPacerFor(args.ReplicaID) != nil {
+		if r.transferring == nil {
+			r.transferring = make(map[int]bool)
+		}
+		r.transferring[args.ReplicaID] = true
+	}
+	go r.sendNewState(args.ReplicaID, newState)
+	return nil
+}
+
+type NewStateArgs struct {
+	ViewNum   int
+	ReplicaID int
+	// OpLog holds the entries following the opNum of the <GET-STATE>,
+	// up to OpNum.
+	OpLog     []opLogEntry
+	OpNum     int
+	CommitNum int
+	// Checksums are the CRCs of the entries of OpLog, see checksums.
+	Checksums []uint32
+	// More tells that the state is paced and more of it follows, see
+	// SetStateTransferRate.
+	More bool
+}
+
+type NewStateReply struct {
+	IsReplied bool
+}
+
+func (r *Replica) NewState(args NewStateArgs, reply *NewStateReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+	r.dlog("NewState: view=%d opNum=%d commitNum=%d entries=%d [currentView=%d]", args.ViewNum, args.OpNum, args.CommitNum, len(args.OpLog), r.viewNum)
+
+	if r.status != StateTransfer || args.ViewNum != r.viewNum {
+		r.dlog("not waiting for this NEW-STATE, drops message")
+		return nil
+	}
+	// It answers an earlier <GET-STATE>, the state doesn't fit anymore.
+	if args.OpNum-len(args.OpLog) != r.opNum {
+		r.dlog("NEW-STATE starts after opNum=%d, not %d, drops message", args.OpNum-len(args.OpLog), r.opNum)
+		return nil
+	}
+	if i := firstCorrupt(args.OpLog, args.Checksums); i >= 0 {
+		opNum := args.OpNum - len(args.OpLog) + i + 1
+		r.dlog("NEW-STATE entry at opNum=%d doesn't match its CRC, recovers instead", opNum)
+		r.reportFailure(FailureStorage, opNum, args.ReplicaID, fmt.Errorf("vrr: corrupt entry from replica %d at opNum=%d", args.ReplicaID, opNum))
+		r.startRecovery()
+		return nil
+	}
+	reply.IsReplied = true
+
+	r.appendOps(args.OpLog)
+	r.viewChangeResetEvent = r.clock.Now()
+	if args.More {
+		// The next chunk is on its way, no need to ask for it.
+		r.nextStateRequestAt = r.clock.Now().Add(2 * r.opts.HeartbeatInterval)
+		r.dlog("installed NEW-STATE up to opNum=%d, waiting for more", r.opNum)
+		r.commitUpTo(args.CommitNum)
+		return nil
+	}
+	r.setStatus(Normal)
+	r.incomingSnapshot = nil
+	r.viewStartedAt = r.clock.Now()
+	r.viewStartCommitNum = r.commitNum
+	r.dlog("installed NEW-STATE, back to Normal; opNum=%d", r.opNum)
+
+	r.commitUpTo(args.CommitNum)
+	return nil
+}
@@ -0,0 +1,193 @@
+package vrr
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// statsWindowSize is the number of most recent samples kept
+	// for the rolling statistics.
+	statsWindowSize = 256
+
+	// statsRateWindow is the window over which the submit
+	// and commit rates are computed, counted in statsRateBuckets buckets.
+	statsRateWindow  = time.Second
+	statsRateBuckets = 10
+)
+
+// durationWindow keeps the last statsWindowSize durations in a ring buffer.
+type durationWindow struct {
+	samples [statsWindowSize]time.Duration
+	next    int
+	full    bool
+}
+
+func (w *durationWindow) add(d time.Duration) {
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % statsWindowSize
+	if w.next == 0 {
+		w.full = true
+	}
+}
+
+// percentile returns the p-th percentile (0 < p <= 100) of the samples
+// in the window, or zero when there's none.
+func (w *durationWindow) percentile(p float64) time.Duration {
+	n := w.next
+	if w.full {
+		n = statsWindowSize
+	}
+	if n == 0 {
+		return 0
+	}
+
+	sorted := make([]time.Duration, n)
+	copy(sorted, w.samples[:n])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := int(float64(n)*p/100+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= n {
+		idx = n - 1
+	}
+	return sorted[idx]
+}
+
+// rateCounter counts events in time buckets spanning statsRateWindow, so that
+// unlike a window of samples it doesn't cap the rate it can report. The rate
+// is as precise as a bucket, a tenth of the window.
+type rateCounter struct {
+	counts [statsRateBuckets]int
+	starts [statsRateBuckets]time.Time
+}
+
+const statsRateBucketWidth = statsRateWindow / statsRateBuckets
+
+func (c *rateCounter) add(t time.Time) {
+	start := t.Truncate(statsRateBucketWidth)
+	i := int(start.UnixNano()/int64(statsRateBucketWidth)) % statsRateBuckets
+	if !c.starts[i].Equal(start) {
+		c.starts[i] = start
+		c.counts[i] = 0
+	}
+	c.counts[i]++
+}
+
+// rate returns the number of events per second over the last window.
+func (c *rateCounter) rate(now time.Time) float64 {
+	count := 0
+	for i, start := range c.starts {
+		if c.counts[i] > 0 && now.Sub(start) < statsRateWindow {
+			count += c.counts[i]
+		}
+	}
+	return float64(count) / statsRateWindow.Seconds()
+}
+
+type StatsArgs struct{}
+
+// StatsReply is a cheap snapshot of the rolling protocol statistics of a replica,
+// meant for smart clients adapting their batching and read routing.
+type StatsReply struct {
+	ReplicaID int
+	PrimaryID int
+	ViewNum   int
+	Status    ReplicaStatus
+
+	// Commit latency on the primary, from Submit to reaching a quorum.
+	// Only the accepted requests are counted, as for SubmitRate.
+	CommitLatencyP50 time.Duration
+	CommitLatencyP99 time.Duration
+
+	// ViewStableFor is how long the replica has been Normal in the current view.
+	ViewStableFor time.Duration
+
+	// Primary load: operations not yet committed, and requests
+	// submitted per second over the last second.
+	InFlightOps int
+	SubmitRate  float64
+
+	// Progress: operations committed since the current view started, and
+	// committed per second over the last second.
+	CommittedInView int
+	CommitRate      float64
+
+	// How long ago the replica last committed an operation, and last received
+	// a <COMMIT> heartbeat from a primary; zero when it never did.
+	SinceLastCommit    time.Duration
+	SinceLastHeartbeat time.Duration
+
+	// DecodeCacheHitRate is the fraction of the compressed operations applied
+	// without decompressing them again, see Options.DecodedCacheBytes.
+	DecodeCacheHitRate float64
+
+	// Divergences counts the peers whose state machine hash differed from
+	// the replica's at a checkpoint, see Options.DeterminismCheckInterval.
+	Divergences int
+
+	// Resyncs counts how many times the replica healed from a divergence
+	// with the primary, see Options.ResyncPolicy.
+	Resyncs int
+
+	// SnapshotOpNum is the opNum of the latest snapshot, and LogStart the
+	// opNum of the last operation dropped from the opLog since, see
+	// Options.SnapshotInterval.
+	SnapshotOpNum int
+	LogStart      int
+}
+
+// recordCommit updates the statistics with a newly committed operation.
+// Expects r.mu to be locked.
+func (r *Replica) recordCommit() {
+	r.lastCommitAt = r.clock.Now()
+	r.commitTimes.add(r.lastCommitAt)
+}
+
+// LocalStats returns the statistics of the replica, as replied by the Stats
+// RPC, for the applications embedding it, e.g. to build health checks.
+func (r *Replica) LocalStats() StatsReply {
+	var reply StatsReply
+	r.Stats(StatsArgs{}, &reply)
+	return reply
+}
+
+func (r *Replica) Stats(args StatsArgs, reply *StatsReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
+	}
+
+	now := r.clock.Now()
+	reply.ReplicaID = r.ID
+	reply.PrimaryID = r.primaryID
+	reply.ViewNum = r.viewNum
+	reply.Status = r.status
+	reply.CommitLatencyP50 = r.commitLatencies.percentile(50)
+	reply.CommitLatencyP99 = r.commitLatencies.percentile(99)
+	if r.status == Normal && !r.viewStartedAt.IsZero() {
+		reply.ViewStableFor = now.Sub(r.viewStartedAt)
+	}
+	reply.InFlightOps = r.opNum - r.commitNum
+	reply.SubmitRate = r.submitTimes.rate(now)
+	reply.CommittedInView = r.commitNum - r.viewStartCommitNum
+	reply.CommitRate = r.commitTimes.rate(now)
+	if !r.lastCommitAt.IsZero() {
+		reply.SinceLastCommit = now.Sub(r.lastCommitAt)
+	}
+	if !r.lastHeartbeatAt.IsZero() {
+		reply.SinceLastHeartbeat = now.Sub(r.lastHeartbeatAt)
+	}
+	if decoded := r.decodeCacheHits + r.decodeCacheMisses; decoded > 0 {
+		reply.DecodeCacheHitRate = float64(r.decodeCacheHits) / float64(decoded)
+	}
+	reply.Divergences = r.divergences
+	reply.Resyncs = r.resyncs
+	reply.SnapshotOpNum = r.snapshotNum
+	reply.LogStart = r.logStart
+	return nil
+}
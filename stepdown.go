@@ -0,0 +1,42 @@
+package vrr
+
+import "time"
+
+// A primary cut off from a quorum can't commit anything, while the other side
+// of the partition may already have started a new view. Rather than going on
+// sending its heartbeats and accepting requests it will never commit, the
+// primary steps down by starting a view change once it hasn't heard from a
+// quorum for a view change timeout: the backups time out on it after as long.
+
+// hearFrom records that the backup replied to the primary.
+// Expects r.mu to be locked.
+func (r *Replica) hearFrom(peerID int) {
+	if r.heardFrom == nil {
+		r.heardFrom = make(map[int]time.Time)
+	}
+	r.heardFrom[peerID] = r.clock.Now()
+}
+
+// resetHeardFrom gives the backups a whole timeout to reply to the primary,
+// as its view starts. Expects r.mu to be locked.
+func (r *Replica) resetHeardFrom() {
+	r.heardFrom = make(map[int]time.Time)
+	now := r.clock.Now()
+	for peerID := range r.configuration {
+		r.heardFrom[peerID] = now
+	}
+}
+
+// lostQuorum tells whether fewer than a quorum of replicas, the primary
+// included, were heard from within the view change timeout.
+// Expects r.mu to be locked.
+func (r *Replica) lostQuorum() bool {
+	now := r.clock.Now()
+	heard := 1
+	for _, at := range r.heardFrom {
+		if now.Sub(at) < r.opts.ViewChangeTimeout {
+			heard++
+		}
+	}
+	return heard < r.quorum()
+}
@@ -0,0 +1,367 @@
+package vrr
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+)
+
+// The state a replica must not forget when it crashes is written through
+// its Storage: the opLog, as it is appended to, its suffix replaced or its
+// prefix dropped for a snapshot, the viewNum, the last normal view and the
+// commitNum, as they change, along with the primary of the view, and the
+// latest snapshot, see takeSnapshot. A
+// replica created on a storage which holds a state restores it rather than
+// starting empty, see restore. The clientTable isn't stored: it is rebuilt
+// from the snapshot and the opLog, and its responses as the committed
+// operations are applied again. A replica which fails to write to its storage stops, rather than
+// acknowledging what it may forget.
+//
+// The default storage, MemoryStorage, keeps the state in memory: it doesn't
+// survive the process, only the replica.
+
+// Storage keeps the state of a replica. The entries of the log are numbered
+// by opNum, from 1 or from after the last entry dropped by CompactLog.
+type Storage interface {
+	// Get returns the value of the key, nil if it isn't set.
+	Get(key string) ([]byte, error)
+	// Set sets the value of the key.
+	Set(key string, value []byte) error
+	// AppendLog writes the entries to the log from opNum first on, dropping
+	// the entries it held from there on. first is at most one past the
+	// last entry; the log starts at first if it is before its start.
+	AppendLog(first int, entries []StoredEntry) error
+	// ReadLog returns the entries of the log from opNum from on, or from
+	// its start.
+	ReadLog(from int) ([]StoredEntry, error)
+	// CompactLog drops the entries of the log up to opNum upTo, inclusive.
+	// The log starts after upTo even if it ends before.
+	CompactLog(upTo int) error
+}
+
+// StoredEntry is an operation of the opLog as kept by a Storage. Op is the
+// operation as replicated, compressed as Options.CompressionThreshold says;
+// the storages which encode it with gob get its dynamic type back. CRC is
+// the checksum of the entry, checked when it is restored.
+type StoredEntry struct {
+	OpNum     int
+	ViewNum   int
+	Namespace string
+	ClientID  int
+	ReqNum    int
+	Op        interface{}
+	CRC       uint32
+}
+
+// Keys of the state a replica keeps in its storage.
+const (
+	storageViewNum           = "viewNum"
+	storageLastNormalViewNum = "lastNormalViewNum"
+	storageCommitNum         = "commitNum"
+	storagePrimaryID         = "primaryID"
+)
+
+// MemoryStorage is a Storage in memory.
+type MemoryStorage struct {
+	mu     sync.Mutex
+	values map[string][]byte
+	// entries are the log after opNum start.
+	start   int
+	entries []StoredEntry
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{values: make(map[string][]byte)}
+}
+
+func (s *MemoryStorage) Get(key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.values[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *MemoryStorage) Set(key string, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (s *MemoryStorage) SetBatch(values map[string][]byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, value := range values {
+		s.values[key] = append([]byte(nil), value...)
+	}
+	return nil
+}
+
+func (s *MemoryStorage) AppendLog(first int, entries []StoredEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if first < 1 || first > s.start+len(s.entries)+1 {
+		return fmt.Errorf("vrr: can't append at opNum=%d to a log ending at opNum=%d", first, s.start+len(s.entries))
+	}
+	if first <= s.start {
+		s.start = first - 1
+		s.entries = nil
+	}
+	n := first - s.start - 1
+	// Appending in place would overwrite the entries ReadLog returned.
+	s.entries = append(s.entries[:n:n], entries...)
+	return nil
+}
+
+// clone returns a copy of the storage.
+func (s *MemoryStorage) clone() *MemoryStorage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &MemoryStorage{values: make(map[string][]byte, len(s.values)), start: s.start}
+	for key, value := range s.values {
+		c.values[key] = value
+	}
+	c.entries = append([]StoredEntry(nil), s.entries...)
+	return c
+}
+
+// reset replaces the state with the values and the log after opNum start.
+func (s *MemoryStorage) reset(values map[string][]byte, start int, entries []StoredEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if values == nil {
+		values = make(map[string][]byte)
+	}
+	s.values, s.start, s.entries = values, start, entries
+}
+
+// logLen returns the number of entries of the log.
+func (s *MemoryStorage) logLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.entries)
+}
+
+// logEnd returns the opNum of the last entry of the log.
+func (s *MemoryStorage) logEnd() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.start + len(s.entries)
+}
+
+func (s *MemoryStorage) ReadLog(from int) ([]StoredEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if from <= s.start {
+		from = s.start + 1
+	}
+	if from > s.start+len(s.entries) {
+		return nil, nil
+	}
+	return append([]StoredEntry(nil), s.entries[from-s.start-1:]...), nil
+}
+
+func (s *MemoryStorage) CompactLog(upTo int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case upTo <= s.start:
+	case upTo >= s.start+len(s.entries):
+		s.start, s.entries = upTo, nil
+	default:
+		s.entries = append([]StoredEntry(nil), s.entries[upTo-s.start:]...)
+		s.start = upTo
+	}
+	return nil
+}
+
+// storeLog writes the opLog from opNum from on to the storage, replacing
+// what it held from there on. Expects r.mu to be locked.
+func (r *Replica) storeLog(from int) {
+	if from > r.opNum+1 {
+		from = r.opNum + 1
+	}
+	if from <= r.logStart {
+		from = r.logStart + 1
+	}
+	entries := make([]StoredEntry, 0, r.opNum-from+1)
+	for i, e := range r.logRange(from, r.opNum) {
+		entries = append(entries, StoredEntry{
+			OpNum:     from + i,
+			ViewNum:   e.viewNum,
+			Namespace: e.namespace,
+			ClientID:  e.clientID,
+			ReqNum:    e.reqNum,
+			Op:        e.operation,
+			CRC:       e.checksum(),
+		})
+	}
+	if err := r.storage.AppendLog(from, entries); err != nil {
+		r.failStorage(err)
+	}
+}
+
+// storeMeta writes the view and commit numbers and the primary ID to the
+// storage, when they changed, at once if it is a BatchSetter.
+// Expects r.mu to be locked.
+func (r *Replica) storeMeta() {
+	batcher, ok := r.storage.(BatchSetter)
+	if !ok {
+		r.storeNum(storageViewNum, r.viewNum, &r.storedViewNum)
+		r.storeNum(storageLastNormalViewNum, r.lastNormalViewNum, &r.storedLastNormalViewNum)
+		r.storeNum(storageCommitNum, r.commitNum, &r.storedCommitNum)
+		r.storeNum(storagePrimaryID, r.primaryID, &r.storedPrimaryID)
+		return
+	}
+	if r.status == Dead {
+		return
+	}
+	values := make(map[string][]byte)
+	for _, n := range []struct {
+		key    string
+		value  int
+		stored int
+	}{
+		{storageViewNum, r.viewNum, r.storedViewNum},
+		{storageLastNormalViewNum, r.lastNormalViewNum, r.storedLastNormalViewNum},
+		{storageCommitNum, r.commitNum, r.storedCommitNum},
+		{storagePrimaryID, r.primaryID, r.storedPrimaryID},
+	} {
+		if n.value != n.stored {
+			values[n.key] = []byte(strconv.Itoa(n.value))
+		}
+	}
+	if len(values) == 0 {
+		return
+	}
+	if err := batcher.SetBatch(values); err != nil {
+		r.failStorage(err)
+		return
+	}
+	r.storedViewNum, r.storedLastNormalViewNum, r.storedCommitNum = r.viewNum, r.lastNormalViewNum, r.commitNum
+	r.storedPrimaryID = r.primaryID
+}
+
+// storeNum writes the number under the key, unless it is the one stored.
+// Expects r.mu to be locked.
+func (r *Replica) storeNum(key string, value int, stored *int) {
+	if value == *stored || r.status == Dead {
+		return
+	}
+	if err := r.storage.Set(key, []byte(strconv.Itoa(value))); err != nil {
+		r.failStorage(err)
+		return
+	}
+	*stored = value
+}
+
+// failStorage stops the replica which failed to write to its storage.
+// Expects r.mu to be locked.
+func (r *Replica) failStorage(err error) {
+	if r.status == Dead {
+		return
+	}
+	log.Printf("failed writing to the storage, stopping; err = %v", err.Error())
+	r.emit(EventStorageFailed, SeverityCritical, nil, "failed writing to the storage: %v", err)
+	r.reportFailure(FailureStorage, 0, 0, err)
+	go r.closeFiles(r.stop())
+}
+
+// restore installs the state held by the storage, if any, as the state of
+// the replica being created: the snapshot is restored and the committed
+// operations following it are committed again, and the replica takes up the
+// view change it was in, or its view as a backup. A replica which was the
+// primary of its view may have been deposed while it was down, which only a
+// quorum can tell, so it starts the next view change rather than accepting
+// requests it may never commit.
+func (r *Replica) restore() error {
+	entries, err := r.storage.ReadLog(1)
+	if err != nil {
+		return err
+	}
+	// The primary ID is unset in the storages written before it was stored,
+	// and in the new ones, which the next storeMeta writes it to.
+	nums := [4]int{0, 0, 0, -1}
+	for i, key := range []string{storageViewNum, storageLastNormalViewNum, storageCommitNum, storagePrimaryID} {
+		value, err := r.storage.Get(key)
+		if err != nil {
+			return err
+		}
+		if value == nil {
+			continue
+		}
+		if nums[i], err = strconv.Atoi(string(value)); err != nil {
+			return fmt.Errorf("vrr: stored %s: %v", key, err)
+		}
+	}
+	r.storedViewNum, r.storedLastNormalViewNum, r.storedCommitNum = nums[0], nums[1], nums[2]
+	r.storedPrimaryID = nums[3]
+	data, err := r.storage.Get(storageSnapshot)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 && r.storedViewNum == 0 && len(data) == 0 {
+		return nil
+	}
+
+	if len(data) > 0 {
+		snapshot, err := decodeSnapshot(data)
+		if err != nil {
+			return fmt.Errorf("vrr: stored snapshot: %v", err)
+		}
+		r.useSnapshot(snapshot)
+	}
+	// The opLog may start before the snapshot, see compactLog.
+	if len(entries) > 0 {
+		if start := entries[0].OpNum - 1; start > r.logStart {
+			return fmt.Errorf("vrr: the stored opLog starts at opNum=%d, after the snapshot at opNum=%d", start+1, r.logStart)
+		}
+		r.logStart = entries[0].OpNum - 1
+	}
+	corrupt := false
+	for _, e := range entries {
+		entry := opLogEntry{
+			opID:      e.OpNum - 1,
+			viewNum:   e.ViewNum,
+			namespace: e.Namespace,
+			clientID:  e.ClientID,
+			reqNum:    e.ReqNum,
+			operation: e.Op,
+		}
+		if e.CRC != 0 && e.CRC != entry.checksum() {
+			r.dlog("stored entry at opNum=%d doesn't match its CRC, drops the opLog from there", e.OpNum)
+			r.reportFailure(FailureStorage, e.OpNum, -1, fmt.Errorf("%v at opNum=%d", errCorruptLog, e.OpNum))
+			corrupt = true
+			break
+		}
+		r.opLog = append(r.opLog, entry)
+	}
+	r.opNum = r.logStart + len(r.opLog)
+	r.viewNum = r.storedViewNum
+	r.lastNormalViewNum = r.storedLastNormalViewNum
+	// The primary of the view may not be its first candidate, see
+	// primaryOfView.
+	r.primaryID = r.storedPrimaryID
+	if r.primaryID < 0 {
+		r.primaryID = nextPrimary(r.viewNum, membersOf(r.ID, r.configuration))
+	}
+	if r.viewNum != r.lastNormalViewNum {
+		r.status = ViewChange
+	} else if r.primaryID == r.ID {
+		r.viewNum++
+		r.initiatedViewNum = r.viewNum
+		r.status = ViewChange
+	}
+	// Nothing is committed from a corrupt opLog, which is recovered.
+	if corrupt {
+		return errCorruptLog
+	}
+	r.rebuildClientTables(nil)
+	r.commitUpTo(r.storedCommitNum)
+	r.dlog("restored viewNum=%d opNum=%d commitNum=%d from the storage", r.viewNum, r.opNum, r.commitNum)
+	return nil
+}
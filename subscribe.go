@@ -0,0 +1,122 @@
+package vrr
+
+import "reflect"
+
+// CommitFilter selects the committed operations a subscriber receives, see
+// Subscribe. An operation must match every non-empty field; the zero
+// CommitFilter matches all of them.
+type CommitFilter struct {
+	// Namespaces are the tenants whose operations are received.
+	Namespaces []string
+
+	// OpTypes are values of the operation types received, e.g. Put{} so
+	// that an indexer doesn't receive the reads. Only the types matter.
+	OpTypes []interface{}
+
+	// Predicate, if set, is called with the operations matching the other
+	// fields, and selects those it returns true for. It is called as the
+	// operations are delivered, which waits for it, and must not lock the
+	// replica.
+	Predicate func(CommitEntry) bool
+}
+
+// commitSubscription is a subscriber of the committed operations. Its filter
+// is compiled to sets so that it is cheap to evaluate for every operation.
+type commitSubscription struct {
+	namespaces map[string]bool
+	opTypes    map[reflect.Type]bool
+	predicate  func(CommitEntry) bool
+	entries    chan CommitEntry
+	done       chan struct{}
+
+	// replayFrom is the opNum a resuming subscriber is replayed from by
+	// commitChanSender, zero once replayed, see SubscribeFrom.
+	replayFrom int
+
+	// strict subscribers aren't replayed from past the operations dropped
+	// from the opLog: their channel is closed instead, see Watch.
+	strict bool
+}
+
+func newCommitSubscription(filter CommitFilter, buffer int) *commitSubscription {
+	s := &commitSubscription{
+		predicate: filter.Predicate,
+		entries:   make(chan CommitEntry, buffer),
+		done:      make(chan struct{}),
+	}
+	if len(filter.Namespaces) > 0 {
+		s.namespaces = make(map[string]bool)
+		for _, namespace := range filter.Namespaces {
+			s.namespaces[namespace] = true
+		}
+	}
+	if len(filter.OpTypes) > 0 {
+		s.opTypes = make(map[reflect.Type]bool)
+		for _, op := range filter.OpTypes {
+			s.opTypes[reflect.TypeOf(op)] = true
+		}
+	}
+	return s
+}
+
+func (s *commitSubscription) matches(entry CommitEntry) bool {
+	if s.namespaces != nil && !s.namespaces[entry.Namespace] {
+		return false
+	}
+	if s.opTypes != nil && !s.opTypes[reflect.TypeOf(entry.ClientReq.reqOp)] {
+		return false
+	}
+	if s.predicate != nil && !s.predicate(entry) {
+		return false
+	}
+	return true
+}
+
+// deliver hands the entry to the subscriber, unless it unsubscribes first.
+func (s *commitSubscription) deliver(entry CommitEntry) {
+	select {
+	case s.entries <- entry:
+	case <-s.done:
+	}
+}
+
+// Subscribe returns a channel receiving the committed operations which match
+// the filter, in order, along with the function cancelling the subscription.
+// The operations delivered before the call aren't received. Like the commit
+// channel of the replica, a subscriber must keep up: the delivery waits for it
+// once its buffer is full. The channel isn't closed by the cancellation.
+func (r *Replica) Subscribe(filter CommitFilter, buffer int) (<-chan CommitEntry, func()) {
+	return r.subscribe(filter, buffer, 0)
+}
+
+// subscribe registers the subscription, to be replayed from opNum replayFrom
+// unless it is zero.
+func (r *Replica) subscribe(filter CommitFilter, buffer int, replayFrom int) (<-chan CommitEntry, func()) {
+	s := newCommitSubscription(filter, buffer)
+	s.replayFrom = replayFrom
+
+	r.mu.Lock()
+	r.subscriptions = append(r.subscriptions, s)
+	if replayFrom > 0 {
+		r.notifyCommitReady()
+	}
+	r.mu.Unlock()
+
+	return s.entries, r.unsubscriber(s)
+}
+
+// unsubscriber returns the function cancelling the subscription.
+func (r *Replica) unsubscriber(s *commitSubscription) func() {
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+
+		for i, other := range r.subscriptions {
+			if other == s {
+				r.subscriptions = append(r.subscriptions[:i:i], r.subscriptions[i+1:]...)
+				close(s.done)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package vrr
+
+import (
+	"time"
+)
+
+// DefaultNamespace is the namespace used by requests that don't specify one,
+// so a replication group serving a single application doesn't need to care
+// about tenants at all.
+const DefaultNamespace = ""
+
+// TenantMetrics is a snapshot of the per-namespace counters kept by a Replica.
+type TenantMetrics struct {
+	Submitted    uint64
+	Deduplicated uint64
+	RateLimited  uint64
+	Invalid      uint64
+	Shed         uint64
+	Committed    uint64
+}
+
+// tenant holds everything that must not leak between namespaces sharing
+// the same replication group: the clientTable used for dedup, the metrics,
+// the optional rate limiter and the responses kept for coalescing.
+type tenant struct {
+	clientTable map[int]clientTableEntry
+	metrics     TenantMetrics
+	limiter     *rateLimiter
+
+	// replies are the latest responses to each client, see recordReply.
+	replies map[int][]ClientReply
+}
+
+func newTenant() *tenant {
+	return &tenant{
+		clientTable: make(map[int]clientTableEntry),
+	}
+}
+
+// rateLimiter is a simple token bucket refilled lazily on every take.
+type rateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(opsPerSecond float64, burst int, now time.Time) *rateLimiter {
+	return &rateLimiter{
+		rate:   opsPerSecond,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (rl *rateLimiter) allow(now time.Time) bool {
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+
+	if rl.tokens < 1 {
+		return false
+	}
+	rl.tokens--
+	return true
+}
+
+// tenantFor returns the tenant of the given namespace, creating it on first use.
+// Expects r.mu to be locked.
+func (r *Replica) tenantFor(namespace string) *tenant {
+	t, ok := r.tenants[namespace]
+	if !ok {
+		t = newTenant()
+		r.tenants[namespace] = t
+	}
+	return t
+}
+
+// SetTenantRateLimit limits the rate of requests the primary accepts for the
+// namespace to opsPerSecond, allowing bursts of up to burst requests.
+// A non-positive opsPerSecond removes the limit.
+func (r *Replica) SetTenantRateLimit(namespace string, opsPerSecond float64, burst int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t := r.tenantFor(namespace)
+	if opsPerSecond <= 0 {
+		t.limiter = nil
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	t.limiter = newRateLimiter(opsPerSecond, burst, r.clock.Now())
+}
+
+// TenantMetrics returns the counters of the namespace and whether the
+// replica has seen the namespace at all.
+func (r *Replica) TenantMetrics(namespace string) (TenantMetrics, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tenants[namespace]
+	if !ok {
+		return TenantMetrics{}, false
+	}
+	return t.metrics, true
+}
+
+// Namespaces returns all the namespaces known by the replica.
+func (r *Replica) Namespaces() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	namespaces := make([]string, 0, len(r.tenants))
+	for ns := range r.tenants {
+		namespaces = append(namespaces, ns)
+	}
+	return namespaces
+}
@@ -3,6 +3,7 @@ package vrr
 import (
 	"log"
 	"math/rand"
+	"reflect"
 	"sort"
 	"sync"
 	"testing"
@@ -20,6 +21,10 @@ type Harness struct {
 	commitChans []chan CommitEntry
 	commits     [][]CommitEntry
 
+	// commitsPaused holds, for the replicas whose commits aren't taken,
+	// the channel closed when they are taken again.
+	commitsPaused []chan struct{}
+
 	cluster []*Server
 
 	connected []bool
@@ -38,16 +43,16 @@ func NewHarness(t *testing.T, n int) *Harness {
 	for i := 0; i < n; i++ {
 		commitChans[i] = make(chan CommitEntry)
 		ns[i] = NewServer(ready, commitChans[i])
+		ns[i].AddInboundInterceptor(networkJitter)
 		ns[i].Serve()
 	}
 
-	sort.SliceStable(ns, func(i, j int) bool {
-		return ns[i].GetListenAddr().String() < ns[j].GetListenAddr().String()
-	})
+	// The servers are sorted along with their commit channels,
+	// so that commitChans[i] keeps being the one of replica i.
+	sort.Sort(byListenAddr{ns, commitChans})
 
 	for i := 0; i < n; i++ {
-		ns[i].serverID = i
-		log.Printf("[id:%d] server listens at %s", ns[i].serverID, ns[i].GetListenAddr())
+		log.Printf("[id:%d] server listens at %s", i, ns[i].GetListenAddr())
 
 		// configuration will be a map of ReplicaID and TCP address
 		// of other peer replicas.
@@ -63,23 +68,22 @@ func NewHarness(t *testing.T, n int) *Harness {
 				log.Fatalf("%d failed to connect with %d :(", i, j)
 			}
 		}
-		ns[i].configuration = configuration
-
-		ns[i].replica.ID = i
-		ns[i].replica.configuration = configuration
-		ns[i].replica.primaryID = 0
+		if err := ns[i].Configure(i, configuration, DefaultOptions()); err != nil {
+			log.Fatalf("failed to configure replica %d: %v", i, err)
+		}
 
 		connected[i] = true
 	}
 	close(ready)
 
 	h := &Harness{
-		commitChans: commitChans,
-		commits:     commits,
-		cluster:     ns,
-		connected:   connected,
-		n:           n,
-		t:           t,
+		commitChans:   commitChans,
+		commits:       commits,
+		commitsPaused: make([]chan struct{}, n),
+		cluster:       ns,
+		connected:     connected,
+		n:             n,
+		t:             t,
 	}
 
 	for i := 0; i < n; i++ {
@@ -126,13 +130,206 @@ func (h *Harness) ReconnectPeer(ID int) {
 	h.connected[ID] = true
 }
 
-// CheckSinglePrimary returns primary's ID and viewNum.
+// SetLinkProfile applies the profile to the link from replica `from` to replica `to`.
+func (h *Harness) SetLinkProfile(from, to int, profile LinkProfile) {
+	tlog("Link %d -> %d uses %q profile", from, to, profile.Name)
+	h.cluster[from].SetLinkProfile(to, profile)
+}
+
+// SetLinkProfileBetween applies the profile to both directions of the link
+// between replicas a and b.
+func (h *Harness) SetLinkProfileBetween(a, b int, profile LinkProfile) {
+	h.SetLinkProfile(a, b, profile)
+	h.SetLinkProfile(b, a, profile)
+}
+
+// SetAllLinksProfile applies the profile to every link of the cluster.
+func (h *Harness) SetAllLinksProfile(profile LinkProfile) {
+	for i := 0; i < h.n; i++ {
+		for j := 0; j < h.n; j++ {
+			if i != j {
+				h.SetLinkProfile(i, j, profile)
+			}
+		}
+	}
+}
+
+// CrashPeer stops the replica and cuts it off the rest of the cluster.
+func (h *Harness) CrashPeer(ID int) {
+	tlog("Crash %d", ID)
+	h.DisconnectPeer(ID)
+	h.cluster[ID].replica.Stop()
+}
+
+// RestartPeer restarts the crashed replica and connects it back to the rest
+// of the cluster. Its commits are collected again from the first one, which
+// it delivers again.
+func (h *Harness) RestartPeer(ID int) {
+	tlog("Restart %d", ID)
+	h.mu.Lock()
+	h.commits[ID] = nil
+	h.mu.Unlock()
+	if err := h.cluster[ID].Restart(); err != nil {
+		h.t.Fatal(err)
+	}
+	h.ReconnectPeer(ID)
+}
+
+// CheckSinglePrimary checks that a single connected replica is the primary
+// in Normal status and returns primary's ID and viewNum.
 func (h *Harness) CheckSinglePrimary() (int, int) {
-	return 0, 0
+	for attempt := 0; attempt < 10; attempt++ {
+		primaryID, primaryViewNum := -1, -1
+		for i := 0; i < h.n; i++ {
+			if !h.connected[i] {
+				continue
+			}
+			_, viewNum, isPrimary, status := h.cluster[i].replica.Report()
+			if isPrimary && status == Normal {
+				if primaryID >= 0 {
+					h.t.Fatalf("both %d and %d think they're primaries", primaryID, i)
+				}
+				primaryID, primaryViewNum = i, viewNum
+			}
+		}
+		if primaryID >= 0 {
+			return primaryID, primaryViewNum
+		}
+		sleepMs(150)
+	}
+
+	h.t.Fatalf("primary not found")
+	return -1, -1
 }
 
+// CheckNoPrimary checks that no connected replica is the primary in Normal status.
 func (h *Harness) CheckNoPrimary() {
+	for i := 0; i < h.n; i++ {
+		if !h.connected[i] {
+			continue
+		}
+		_, _, isPrimary, status := h.cluster[i].replica.Report()
+		if isPrimary && status == Normal {
+			h.t.Fatalf("replica %d is primary, expected none", i)
+		}
+	}
+}
 
+// SubmitToReplica submits the operation of the client to the replica
+// and returns whether it was accepted.
+func (h *Harness) SubmitToReplica(ID int, clientID int, reqNum int, op interface{}) bool {
+	err := h.cluster[ID].replica.Submit(clientRequest{
+		clientID: clientID,
+		reqNum:   reqNum,
+		reqOp:    op,
+	})
+	return err == nil
+}
+
+// NewClient returns a client connected to all the replicas of the cluster.
+func (h *Harness) NewClient(clientID int) *Client {
+	addresses := make(map[int]string)
+	for i := 0; i < h.n; i++ {
+		addresses[i] = h.cluster[i].GetListenAddr().String()
+	}
+	c, err := NewClient(clientID, DefaultNamespace, addresses)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return c
+}
+
+// CheckCommittedN checks that every connected replica has committed exactly
+// n operations and returns them as seen by the first connected replica.
+func (h *Harness) CheckCommittedN(n int) []CommitEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var committed []CommitEntry
+	for i := 0; i < h.n; i++ {
+		if !h.connected[i] {
+			continue
+		}
+		if len(h.commits[i]) != n {
+			h.t.Fatalf("replica %d committed %d operations, want %d", i, len(h.commits[i]), n)
+		}
+		if committed == nil {
+			committed = h.commits[i]
+			continue
+		}
+		for j := range committed {
+			got, want := h.commits[i][j], committed[j]
+			if got.OpNum != want.OpNum || got.CommitNum != want.CommitNum || got.ClientReq.reqOp != want.ClientReq.reqOp || !reflect.DeepEqual(got.Resp, want.Resp) {
+				h.t.Fatalf("replica %d committed %+v at %d, want %+v", i, got, j, want)
+			}
+		}
+	}
+	return committed
+}
+
+// PauseCommits stops taking the commits of the replica, like a stalled state
+// machine, until ResumeCommits. A commit already being taken still is.
+func (h *Harness) PauseCommits(ID int) {
+	tlog("Pause commits of %d", ID)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.commitsPaused[ID] == nil {
+		h.commitsPaused[ID] = make(chan struct{})
+	}
+}
+
+// ResumeCommits takes the commits of the replica again, see PauseCommits.
+func (h *Harness) ResumeCommits(ID int) {
+	tlog("Resume commits of %d", ID)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.commitsPaused[ID] != nil {
+		close(h.commitsPaused[ID])
+		h.commitsPaused[ID] = nil
+	}
+}
+
+// networkJitter delays the protocol messages by 1 to 5ms, so that the
+// messages of the harness' replicas interleave as they would over a network.
+func networkJitter(next InboundHandler) InboundHandler {
+	return func(call InboundCall) error {
+		time.Sleep(time.Duration(1+rand.Intn(5)) * time.Millisecond)
+		return next(call)
+	}
+}
+
+// InterceptInbound adds the interceptor to the protocol handlers of the
+// replica, e.g. to drop or delay the messages it receives.
+func (h *Harness) InterceptInbound(ID int, interceptor InboundInterceptor) {
+	h.cluster[ID].AddInboundInterceptor(interceptor)
+}
+
+// MessagesSent returns the messages sent by all the replicas of the cluster
+// so far, per service method.
+func (h *Harness) MessagesSent() map[string]int {
+	sent := make(map[string]int)
+	for i := 0; i < h.n; i++ {
+		for method, n := range h.cluster[i].MessagesSent() {
+			sent[method] += n
+		}
+	}
+	return sent
+}
+
+type byListenAddr struct {
+	servers     []*Server
+	commitChans []chan CommitEntry
+}
+
+func (s byListenAddr) Len() int { return len(s.servers) }
+
+func (s byListenAddr) Less(i, j int) bool {
+	return s.servers[i].GetListenAddr().String() < s.servers[j].GetListenAddr().String()
+}
+
+func (s byListenAddr) Swap(i, j int) {
+	s.servers[i], s.servers[j] = s.servers[j], s.servers[i]
+	s.commitChans[i], s.commitChans[j] = s.commitChans[j], s.commitChans[i]
 }
 
 func tlog(format string, a ...interface{}) {
@@ -145,7 +342,18 @@ func sleepMs(n int) {
 }
 
 func (h *Harness) collectCommits(i int) {
-	for c := range h.commitChans[i] {
+	for {
+		h.mu.Lock()
+		paused := h.commitsPaused[i]
+		h.mu.Unlock()
+		if paused != nil {
+			<-paused
+		}
+
+		c, ok := <-h.commitChans[i]
+		if !ok {
+			return
+		}
 		h.mu.Lock()
 		tlog("collectCommits(%d) got %+v", i, c)
 		h.commits[i] = append(h.commits[i], c)
@@ -0,0 +1,67 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A committed operation is identified by its viewstamp, the view its primary
+// assigned its opNum in along with the opNum, as in the paper: the same on
+// every replica, since a view change keeps the entries of the opLog as they
+// were prepared, and ordered like the operations, since a later view only
+// appends after the operations the earlier ones committed. The applications
+// get it in every CommitEntry, and with every accepted request, see
+// SeqToken.ViewStamp, and wait for it with WaitForCommit, which also tells
+// them when a view change dropped the operation they submitted in its place.
+//
+// The operations imported, see Import, or stored before the viewstamps, have
+// a zero ViewNum, as if prepared in the first view.
+
+// ErrViewStampSuperseded is returned by WaitForCommit when the operation
+// committed at the opNum of the viewstamp was prepared in another view: the
+// one of the viewstamp was dropped by a view change.
+var ErrViewStampSuperseded = errors.New("vrr: operation dropped by a view change")
+
+// ViewStamp identifies an operation of the opLog.
+type ViewStamp struct {
+	ViewNum int
+	OpNum   int
+}
+
+// Compare returns -1, 0 or 1 as v is before, the same as or after w.
+func (v ViewStamp) Compare(w ViewStamp) int {
+	if v.ViewNum != w.ViewNum {
+		return compareInts(v.ViewNum, w.ViewNum)
+	}
+	return compareInts(v.OpNum, w.OpNum)
+}
+
+// Less tells whether v is before w.
+func (v ViewStamp) Less(w ViewStamp) bool {
+	return v.Compare(w) < 0
+}
+
+func (v ViewStamp) String() string {
+	return fmt.Sprintf("%d.%d", v.ViewNum, v.OpNum)
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// ViewStamp returns the viewstamp of the request of the token.
+func (t SeqToken) ViewStamp() ViewStamp {
+	return ViewStamp{ViewNum: t.ViewNum, OpNum: t.OpNum}
+}
+
+// viewStamp returns the viewstamp of the entry of the opLog.
+func (e opLogEntry) viewStamp() ViewStamp {
+	return ViewStamp{ViewNum: e.viewNum, OpNum: e.opID + 1}
+}
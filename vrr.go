@@ -1,21 +1,33 @@
 package vrr
 
 import (
+	"context"
 	"fmt"
 	"log"
-	"math/rand"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// CommitEntry is a committed operation, as delivered on the commit channel.
+// Every replica delivers the same entries in the same order.
 type CommitEntry struct {
-	ViewNum   int
-	OpNum     int
+	// ViewStamp identifies the operation: its OpNum is the position of the
+	// operation in the opLog, and CommitNum the replica's commitNum once
+	// the operation is committed: as the operations are committed in
+	// order, both are the same.
+	ViewStamp
 	CommitNum int
 
+	// Namespace is the tenant the committed operation belongs to.
+	Namespace string
+
 	ClientReq clientRequest
-	Resp      interface{}
+
+	// Resp is the response of Options.StateMachine to the operation,
+	// an ApplyError if it failed, nil without a state machine.
+	Resp interface{}
 }
 
 type ReplicaStatus int
@@ -28,6 +40,9 @@ const (
 	Dead
 	DoViewChange
 	StartView
+	// StateTransfer is a replica catching up with the primary, which unlike
+	// one in Recovery didn't lose its state.
+	StateTransfer
 )
 
 func (rs ReplicaStatus) String() string {
@@ -46,14 +61,59 @@ func (rs ReplicaStatus) String() string {
 		return "DoViewChange"
 	case StartView:
 		return "StartView"
+	case StateTransfer:
+		return "State-Transfer"
 	default:
-		panic("unreachable")
+		return fmt.Sprintf("Unknown(%d)", int(rs))
+	}
+}
+
+// replicaStatuses are all the ReplicaStatus values, for ParseReplicaStatus.
+var replicaStatuses = []ReplicaStatus{Normal, Recovery, ViewChange, Transitioning, Dead, DoViewChange, StartView, StateTransfer}
+
+// ParseReplicaStatus returns the status whose String is s.
+func ParseReplicaStatus(s string) (ReplicaStatus, error) {
+	for _, rs := range replicaStatuses {
+		if rs.String() == s {
+			return rs, nil
+		}
+	}
+	return 0, fmt.Errorf("vrr: unknown replica status %q", s)
+}
+
+// MarshalText encodes the status as its String, e.g. in JSON. An unknown
+// status can't be encoded, as it couldn't be decoded back.
+func (rs ReplicaStatus) MarshalText() ([]byte, error) {
+	if rs < Normal || rs > StateTransfer {
+		return nil, fmt.Errorf("vrr: can't encode the unknown replica status %d", int(rs))
 	}
+	return []byte(rs.String()), nil
+}
+
+// UnmarshalText decodes the status from its String, see ParseReplicaStatus.
+func (rs *ReplicaStatus) UnmarshalText(text []byte) error {
+	parsed, err := ParseReplicaStatus(string(text))
+	if err != nil {
+		return err
+	}
+	*rs = parsed
+	return nil
 }
 
 type opLogEntry struct {
 	opID      int
+	namespace string
+	clientID  int
+	reqNum    int
 	operation interface{}
+
+	// viewNum is the view the primary assigned the opNum in, see
+	// ViewStamp.
+	viewNum int
+
+	// decoded is the original operation of a compressed one, when cached,
+	// see cacheDecoded. It stays local to the replica.
+	decoded interface{}
 }
 
 type Replica struct {
@@ -63,70 +123,327 @@ type Replica struct {
 
 	server *Server
 
+	// commitChan receives the committed operations from commitChanSender,
+	// which is woken up through newCommitReadyChan.
 	commitChan         chan<- CommitEntry
 	newCommitReadyChan chan struct{}
 
-	oldViewNum int
-	viewNum    int
-	commitNum  int
-	opNum      int
+	// lastNormalViewNum is the last view in which the status was Normal,
+	// whose opLog a view change can trust, see considerDoViewChange.
+	lastNormalViewNum int
+	viewNum           int
+	commitNum         int
+	opNum             int
+	// appliedNum is the number of committed operations handed over to the
+	// state machine, it lags behind commitNum when the state machine is slow.
+	appliedNum int
+	shedding   bool
 	opLog      []opLogEntry
 	primaryID  int
 
+	// logStart is the opNum of the last operation dropped from the opLog,
+	// which holds the operations after it, see compactLog. snapshotNum is the
+	// opNum of the latest snapshot, and appliedBytes the size of the
+	// operations applied since. compactNum is the highest opNum every member
+	// holds, as told by the primary. pendingSnapshot is the state
+	// commitChanSender restores the state machine to, see installSnapshot.
+	logStart        int
+	snapshotNum     int
+	appliedBytes    int
+	compactNum      int
+	pendingSnapshot []byte
+
+	// decodedCacheBytes is the size of the decoded operations cached in the
+	// opLog, and the counters of the applied compressed operations found in
+	// the cache or not.
+	decodedCacheBytes int
+	decodeCacheHits   uint64
+	decodeCacheMisses uint64
+
 	// These are used for saving data when the replica is the next designated primary
-	// and are sorting out data from other backup replicas.
+	// and are sorting out data from other backup replicas: the senders of the
+	// <DO-VIEW-CHANGE>s of the view, and the log selected among them with
+	// the last normal view it comes from, see considerDoViewChange.
 	doViewChangeCount int
-	tempViewNum       int
+	doViewChangeFrom  map[int]bool
+	tempOldViewNum    int
+	tempLogStart      int
 	tempOpLog         []opLogEntry
 	tempOpNum         int
 	tempCommitNum     int
+	tempResponses     []clientResponse
+
+	// preparedAt is, for the primary, when the operations of its view
+	// waiting for a quorum were submitted, by opNum.
+	preparedAt map[int]time.Time
+
+	// commitAdvanced is closed once commitNum advances, waking up the
+	// WaitForCommit calls, see notifyCommitWaiters.
+	commitAdvanced chan struct{}
+
+	// ackedOpNums is, for the primary, the highest opNum each backup
+	// acknowledged in the view, like Raft's matchIndex.
+	ackedOpNums map[int]int
+
+	// retransmitting are the backups the primary retransmits <PREPARE>s to.
+	retransmitting map[int]bool
+
+	// heardFrom is, for the primary, when each backup last replied in the
+	// view, see lostQuorum.
+	heardFrom map[int]time.Time
 
 	status        ReplicaStatus
 	configuration map[int]string
+	opts          Options
 
-	// clientTable map is owned by every Replica and is a map
+	// tenants map is owned by every Replica and is a map of the namespace
+	// to its own clientTable, metrics and rate limiter. Each clientTable is a map
 	// of the clientID to its request number, request operation, and response.
-	clientTable map[int]clientTableEntry
+	tenants map[string]*tenant
 
 	viewChangeResetEvent time.Time
+
+	// initiatedViewNum is the last view change the replica initiated,
+	// lostViewChanges how many of them in a row peers superseded, and
+	// viewChangeExtraDelay the random delay it adds to its view change
+	// timer since, see loseViewChangeRound.
+	initiatedViewNum     int
+	lostViewChanges      int
+	viewChangeExtraDelay time.Duration
+
+	// failedViewChanges is how many view changes in a row didn't complete
+	// in time, see viewChangeTimeout.
+	failedViewChanges int
+
+	// primarySightings maps a view to the most recent evidence of a
+	// replica acting as its primary, used to detect split brains.
+	primarySightings map[int]primarySighting
+
+	clock Clock
+
+	events        chan Event
+	failures      chan BackgroundError
+	droppedEvents int
+	eventLog      *eventLog
+	// dataDir is the data directory the replica locked, see OpenDataDir.
+	dataDir *DataDir
+	// stopArchive cancels the uploads of the archiver once the replica
+	// stops, see runArchiver.
+	stopArchive context.CancelFunc
+	// membership is the membership of the current epoch, read by the
+	// handshakes without r.mu, see setConfiguration.
+	membership atomic.Value
+
+	// storage keeps the state of the replica, which last wrote the view
+	// and commit numbers and the primary ID stored*, see storeMeta.
+	storage                 Storage
+	storedViewNum           int
+	storedLastNormalViewNum int
+	storedCommitNum         int
+	storedPrimaryID         int
+
+	// State of the backup pulling missing committed ops from the primary.
+	pulling     bool
+	pullBackoff time.Duration
+	nextPullAt  time.Time
+
+	// State of the replica catching up with the primary through state transfer.
+	nextStateRequestAt time.Time
+
+	// State of the replica recovering from a crash, see StartRecovery.
+	recoveryNonce     uint64
+	recoveryResponses map[int]RecoveryResponseArgs
+
+	// subscriptions receive the committed operations matching their
+	// filter, after commitChan, see Subscribe.
+	subscriptions []*commitSubscription
+	// replay are the most recently delivered committed operations, for
+	// the subscribers resuming with SubscribeFrom.
+	replay []CommitEntry
+	// divergences counts the peers whose state machine hash differed,
+	// see compareStateHashes.
+	divergences int
+	// resyncs counts how many times the replica healed from a divergence,
+	// and resetStateMachine tells commitChanSender to reset the state
+	// machine before it applies the next operation, see ResyncPolicy.
+	resyncs           int
+	resetStateMachine bool
+	// transferRates are the rates of the state transfers set per peer,
+	// paced by transferPacers; transferring are the peers a paced
+	// <NEW-STATE> or a snapshot is streamed to.
+	transferRates  map[int]int
+	transferPacers map[int]*transferPacer
+	transferring   map[int]bool
+	// incomingSnapshot is the snapshot being received in StateTransfer,
+	// see InstallSnapshot.
+	incomingSnapshot *incomingSnapshot
+
+	// capture is the *protocolCapture recording the protocol messages
+	// while capturing, see CaptureProtocol. It is read by captureInbound
+	// without r.mu.
+	capture   atomic.Value
+	capturing bool
+
+	// epochNum is the reconfiguration epoch whose configuration the
+	// replica has, see Reconfigure.
+	epochNum int
+
+	// sessions index the committed operations by client session, see
+	// SessionHistory.
+	sessions map[sessionKey][]SessionPosition
+
+	// reordered are the <PREPARE>s the backup received ahead of a gap in
+	// its opLog, by opNum, buffered since gapSince, see bufferPrepare.
+	reordered map[int]PrepareArgs
+	gapSince  time.Time
+
+	// stateHashes are the most recent checkpoints of the determinism
+	// checker, by opNum.
+	stateHashes map[int]*stateHashCheckpoint
+
+	// restartHints maps the ID of a replica restarting intentionally
+	// to until when its silence must not be treated as a failure.
+	restartHints map[int]time.Time
+
+	// Rolling statistics exposed through the Stats RPC.
+	commitLatencies durationWindow
+	submitTimes     rateCounter
+	commitTimes     rateCounter
+	viewStartedAt   time.Time
+	lastCommitAt    time.Time
+	lastHeartbeatAt time.Time
+
+	// viewStartCommitNum is the commitNum when the current view started.
+	viewStartCommitNum int
 }
 
 type clientRequest struct {
-	clientID int
-	reqNum   int
-	reqOp    interface{}
+	namespace string
+	clientID  int
+	reqNum    int
+	reqOp     interface{}
 }
 
+// clientTableEntry is the most recent request of a client. Its reqOp is
+// stored the way the opLog stores it, see encodeOp.
 type clientTableEntry struct {
-	reqNum int
-	reqOp  interface{}
-	resp   interface{}
+	reqNum    int
+	reqOp     interface{}
+	resp      interface{}
+	committed bool
+
+	// replied tells whether resp was recorded by Reply.
+	replied bool
 }
 
-func NewReplica(ID int, configuration map[int]string, server *Server, ready <-chan interface{}, commitChan chan<- CommitEntry) *Replica {
+// clientTableEntry returns the most recent request of the client in the namespace.
+func (r *Replica) clientTableEntry(namespace string, clientID int) (clientTableEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tenants[namespace]
+	if !ok {
+		return clientTableEntry{}, false
+	}
+	entry, ok := t.clientTable[clientID]
+	return entry, ok
+}
+
+func NewReplica(ID int, configuration map[int]string, server *Server, ready <-chan interface{}, commitChan chan<- CommitEntry, opts Options) (*Replica, error) {
+	if err := validateConfiguration(ID, configuration); err != nil {
+		return nil, err
+	}
+	if err := opts.validate(); err != nil {
+		return nil, err
+	}
+	if opts.FailureThreshold > 0 {
+		if err := validateFailureThreshold(len(configuration)+1, opts.FailureThreshold); err != nil {
+			return nil, err
+		}
+	}
+
 	r := new(Replica)
 	r.ID = ID
-	r.configuration = configuration
+	r.setConfiguration(configuration)
+	r.primaryID = nextPrimary(0, membersOf(ID, configuration))
+	r.opts = opts
+	r.clock = opts.Clock
+	if r.clock == nil {
+		r.clock = realClock{}
+	}
 	r.server = server
 	r.commitChan = commitChan
 	r.newCommitReadyChan = make(chan struct{}, 16)
-	r.oldViewNum = -1
 	r.doViewChangeCount = 0
-	r.clientTable = make(map[int]clientTableEntry)
+	r.tenants = make(map[string]*tenant)
+	r.restartHints = make(map[int]time.Time)
+	r.primarySightings = make(map[int]primarySighting)
+	r.events = make(chan Event, eventsBufferSize)
+	r.failures = make(chan BackgroundError, failuresBufferSize)
+	if opts.DataDir != "" {
+		dataDir, err := OpenDataDir(opts.DataDir, ID)
+		if err != nil {
+			return nil, err
+		}
+		eventLog, err := openEventLog(dataDir.Path())
+		if err != nil {
+			dataDir.Close()
+			return nil, err
+		}
+		r.dataDir = dataDir
+		r.eventLog = eventLog
+	}
 
 	r.status = Normal
+	r.storage = opts.Storage
+	if r.storage == nil && r.dataDir != nil {
+		var err error
+		switch opts.StorageEngine {
+		case StorageBolt:
+			r.storage, err = r.dataDir.OpenBoltStorage(opts.SyncPolicy, opts.SyncInterval)
+		case StorageMmap:
+			r.storage, err = r.dataDir.OpenMmapStorage(opts.SyncPolicy, opts.SyncInterval)
+		default:
+			r.storage, err = r.dataDir.OpenWAL(opts.SyncPolicy, opts.SyncInterval, opts.WALSegments)
+		}
+		if err != nil {
+			r.storage = nil
+			r.closeFiles(r.dataDir, r.eventLog)
+			return nil, err
+		}
+	}
+	if r.storage == nil {
+		r.storage = NewMemoryStorage()
+	}
+	if err := r.restore(); err == errCorruptLog {
+		r.startRecovery()
+	} else if err != nil {
+		r.closeFiles(r.dataDir, r.eventLog)
+		return nil, err
+	}
 
 	go func() {
 		<-ready
 		r.mu.Lock()
-		r.viewChangeResetEvent = time.Now()
+		r.viewChangeResetEvent = r.clock.Now()
+		r.viewStartedAt = r.viewChangeResetEvent
+		r.viewStartCommitNum = r.commitNum
+		checkAddress := r.opts.AdvertiseAddr != ""
 		r.mu.Unlock()
+		if checkAddress {
+			go r.runAddressCheck()
+		}
 		r.runViewChangeTimer()
 	}()
 
-	// go replica.commitChanSender()
+	go r.commitChanSender()
+	if opts.Archive != nil {
+		ctx, cancel := context.WithCancel(context.Background())
+		r.stopArchive = cancel
+		go r.runArchiver(ctx, newArchiver(opts.Archive, opts.ArchivePrefix, ID))
+	}
 
-	return r
+	return r, nil
 }
 
 func (r *Replica) Report() (int, int, bool, ReplicaStatus) {
@@ -137,52 +454,225 @@ func (r *Replica) Report() (int, int, bool, ReplicaStatus) {
 
 func (r *Replica) Stop() {
 	r.mu.Lock()
-	defer r.mu.Unlock()
-	r.status = Dead
+	if r.status == Dead {
+		r.mu.Unlock()
+		return
+	}
+	dataDir, eventLog := r.stop()
+	r.mu.Unlock()
+	r.closeFiles(dataDir, eventLog)
+}
+
+// stop makes the replica Dead, and returns its files for closeFiles to close
+// out of the lock. Expects r.mu to be locked.
+func (r *Replica) stop() (*DataDir, *eventLog) {
+	r.setStatus(Dead)
 	r.dlog("becomes Dead")
 	close(r.newCommitReadyChan)
+	r.notifyCommitWaiters()
+	if r.stopArchive != nil {
+		r.stopArchive()
+	}
+	eventLog := r.eventLog
+	r.eventLog = nil
+	dataDir := r.dataDir
+	r.dataDir = nil
+	return dataDir, eventLog
 }
 
-func (r *Replica) Submit(req clientRequest) bool {
+// closeFiles closes the files of the stopped replica.
+func (r *Replica) closeFiles(dataDir *DataDir, eventLog *eventLog) {
+	// The last events are written out of the lock too.
+	if eventLog != nil {
+		eventLog.close()
+	}
+	// Another replica may use the data directory once it is stopped.
+	if dataDir != nil {
+		dataDir.Close()
+	}
+}
+
+// Submit makes the primary accept the client request and start replicating it.
+// It returns nil once the request is accepted, or one of the Err* errors
+// telling why it was dropped.
+func (r *Replica) Submit(req clientRequest) error {
+	_, err := r.submit(req, nil, nil)
+	return err
+}
+
+// submit runs the client request with its annotations through the submit
+// middlewares, down to admit. It returns the token of the accepted request,
+// or the one admit returns along with ErrDuplicateRequest.
+func (r *Replica) submit(req clientRequest, annotations map[string]string, token *SeqToken) (SeqToken, error) {
+	submittedAt := r.clock.Now()
+	var accepted SeqToken
+	admit := func(sr SubmitRequest) error {
+		var err error
+		accepted, err = r.admit(sr.clientRequest(), token, submittedAt)
+		return err
+	}
+
+	sr := SubmitRequest{
+		Namespace:   req.namespace,
+		ClientID:    req.clientID,
+		ReqNum:      req.reqNum,
+		Op:          req.reqOp,
+		Annotations: annotations,
+	}
+	if err := chainSubmitMiddlewares(r.opts.SubmitMiddlewares, admit)(sr); err != nil {
+		return accepted, err
+	}
+	return accepted, nil
+}
+
+// admit accepts the client request, verifying first that it follows the
+// previous request of the client when a sequencing token is given. It returns
+// the token of the accepted request. When the most recent request of the
+// client is submitted again with a token, the reply accepting it was likely
+// lost, so its token is returned along with ErrDuplicateRequest. submittedAt
+// is when the request was submitted, before the middlewares, to measure the
+// commit latency.
+func (r *Replica) admit(req clientRequest, token *SeqToken, submittedAt time.Time) (SeqToken, error) {
+	// The Validator is code of the application, which may be slow or call
+	// the replica: it runs out of the lock, and its verdict is only acted on
+	// once the request passed the checks before it.
+	r.mu.Lock()
+	validator := r.opts.Validator
+	r.mu.Unlock()
+	var invalid error
+	if validator != nil && req.namespace != internalNamespace {
+		invalid = validator.Validate(req.reqOp)
+	}
+
 	r.mu.Lock()
 
 	r.dlog("Submit received by %v: %v", r.status, req.reqOp)
 	if r.ID != r.primaryID {
 		r.dlog("is not a primary, dropping the request")
 		r.mu.Unlock()
-		return false
+		return SeqToken{}, ErrNotPrimary
 	}
 
 	if r.status != Normal {
 		r.dlog("is a primary but not in a Normal status, dropping the request")
 		r.mu.Unlock()
-		return false
+		return SeqToken{}, ErrNotNormal
 	}
 
-	if req.reqNum <= r.clientTable[req.clientID].reqNum {
+	t := r.tenantFor(req.namespace)
+	t.metrics.Submitted++
+
+	// Every ingress path goes through admit, and the request is appended
+	// in the same critical section, so that a request arriving twice at
+	// once is appended once.
+	if req.reqNum <= t.clientTable[req.clientID].reqNum {
+		// The most recent response goes back to the client along with
+		// the error, see Request.
 		r.dlog("reqNum in clientTable is greater than the incoming request, drops the request and resend the most recent response")
-		// TODO
-		// Resend the most recent response for the
-		// corresponding clientID
+		t.metrics.Deduplicated++
 
+		var duplicate SeqToken
+		if token != nil && req.reqNum == t.clientTable[req.clientID].reqNum {
+			duplicate = r.duplicateToken(req)
+		}
 		r.mu.Unlock()
-		return false
+		return duplicate, ErrDuplicateRequest
+	}
+
+	if token != nil {
+		if err := r.verifySeqToken(t, req, *token); err != nil {
+			r.dlog("request %d of client %d is out of sequence with token %+v; err = %v", req.reqNum, req.clientID, *token, err)
+			r.mu.Unlock()
+			return SeqToken{}, err
+		}
+	}
+
+	if t.limiter != nil && !t.limiter.allow(r.clock.Now()) {
+		r.dlog("namespace %q is over its rate limit, dropping the request", req.namespace)
+		t.metrics.RateLimited++
+		r.mu.Unlock()
+		return SeqToken{}, ErrRateLimited
 	}
 
-	r.opLog = append(r.opLog, opLogEntry{opID: len(r.opLog), operation: req.reqOp})
+	if r.isOverloaded() {
+		r.dlog("state machine is %d operations behind, shedding the request", r.commitNum-r.appliedNum)
+		t.metrics.Shed++
+		r.mu.Unlock()
+		return SeqToken{}, ErrOverloaded
+	}
+
+	if invalid != nil {
+		r.dlog("operation %v is invalid, dropping the request; err = %v", req.reqOp, invalid)
+		t.metrics.Invalid++
+		r.mu.Unlock()
+		return SeqToken{}, fmt.Errorf("%w: %v", ErrInvalidOperation, invalid)
+	}
+
+	entry := r.newOpLogEntry(req)
+	r.opLog = append(r.opLog, entry)
 	r.opNum++
+	r.storeLog(r.opNum)
 	ctEntry := clientTableEntry{
 		reqNum: req.reqNum,
-		reqOp:  req.reqOp,
+		reqOp:  entry.operation,
 	}
-	r.clientTable[req.clientID] = ctEntry
+	t.clientTable[req.clientID] = ctEntry
+	r.submitTimes.add(r.clock.Now())
 	r.dlog("... log=%v", r.opLog)
+	newToken := SeqToken{ReqNum: req.reqNum, ViewNum: r.viewNum, OpNum: r.opNum}
+	if r.preparedAt == nil {
+		r.preparedAt = make(map[int]time.Time)
+	}
+	r.preparedAt[r.opNum] = submittedAt
+	args := PrepareArgs{
+		PrimaryID:     r.ID,
+		ViewNum:       r.viewNum,
+		OpNum:         r.opNum,
+		CommitNum:     r.commitNum,
+		ClientMessage: req,
+	}
 
 	r.mu.Unlock()
 
-	r.primaryBlastPrepare(req)
+	r.primaryBlastPrepare(args)
+
+	return newToken, nil
+}
+
+// newOpLogEntry returns the opLog entry of the client request,
+// to be appended at the end of the opLog. Expects r.mu to be locked.
+func (r *Replica) newOpLogEntry(req clientRequest) opLogEntry {
+	e := opLogEntry{
+		opID:      r.opNum,
+		viewNum:   r.viewNum,
+		namespace: req.namespace,
+		clientID:  req.clientID,
+		reqNum:    req.reqNum,
+		operation: encodeOp(req.reqOp, r.opts.CompressionThreshold),
+	}
+	r.cacheDecoded(&e, req.reqOp)
+	return e
+}
+
+// isOverloaded tells whether the primary should shed new requests because
+// the state machine is too far behind the commits. Shedding starts once the
+// lag reaches the high watermark and only stops when it is back to the low
+// one, so it doesn't flap around a single threshold.
+// Expects r.mu to be locked.
+func (r *Replica) isOverloaded() bool {
+	if r.opts.ShedHighWatermark <= 0 {
+		return false
+	}
 
-	return true
+	lag := r.commitNum - r.appliedNum
+	if r.shedding && lag <= r.opts.ShedLowWatermark {
+		r.dlog("apply lag is back to %d, stops shedding requests", lag)
+		r.shedding = false
+	} else if !r.shedding && lag >= r.opts.ShedHighWatermark {
+		r.dlog("apply lag reached %d, starts shedding requests", lag)
+		r.shedding = true
+	}
+	return r.shedding
 }
 
 func (r *Replica) dlog(format string, args ...interface{}) {
@@ -191,19 +681,48 @@ func (r *Replica) dlog(format string, args ...interface{}) {
 }
 
 func (r *Replica) runViewChangeTimer() {
-	timeoutDuration := time.Duration(150+rand.Intn(150)) * time.Millisecond
 	r.mu.Lock()
+	timeoutDuration := r.viewChangeTimeout()
 	viewStarted := r.viewNum
 	r.mu.Unlock()
 	r.dlog("view change timer started (%v), view=%d", timeoutDuration, viewStarted)
 
-	ticker := time.NewTicker(5 * time.Millisecond)
+	// The step of the view change the timer drives, once its messages are
+	// sent: the next view change starts if it doesn't complete in time.
+	driving := false
+	var drivenStatus ReplicaStatus
+	drivenViewNum := -1
+
+	ticker := r.clock.NewTicker(5 * time.Millisecond)
 	defer ticker.Stop()
 	for {
-		<-ticker.C
+		<-ticker.C()
 
 		r.mu.Lock()
 
+		if r.status == Dead || r.isRecovering() {
+			r.mu.Unlock()
+			return
+		}
+
+		// The next steps of the view change start timers of their own,
+		// except for a higher view change superseding this one.
+		if driving && r.status != drivenStatus && r.status != ViewChange {
+			r.mu.Unlock()
+			return
+		}
+		if driving && r.viewNum == drivenViewNum && r.status == drivenStatus {
+			if r.clock.Now().Sub(r.viewChangeResetEvent) >= timeoutDuration {
+				r.dlog("view change of view %d didn't complete in %v, starts the next one", r.viewNum, timeoutDuration)
+				r.failedViewChanges++
+				r.initiateViewChange()
+				r.mu.Unlock()
+				return
+			}
+			r.mu.Unlock()
+			continue
+		}
+
 		// Replica is the primary
 		if r.status == Normal && r.primaryID == r.ID {
 			// TODO
@@ -216,25 +735,58 @@ func (r *Replica) runViewChangeTimer() {
 
 		if r.status == ViewChange {
 			r.dlog("status become View-Change, blast <START-VIEW-CHANGE> to all replicas")
+			driving, drivenStatus, drivenViewNum = true, ViewChange, r.viewNum
+			timeoutDuration = r.viewChangeTimeout()
 			r.mu.Unlock()
 			r.blastStartViewChange()
-			return
+			continue
 		}
 
 		if r.status == DoViewChange {
+			driving, drivenStatus, drivenViewNum = true, DoViewChange, r.viewNum
+			timeoutDuration = r.viewChangeTimeout()
 			r.sendDoViewChange()
 			r.mu.Unlock()
-			return
+			continue
 		}
 
 		if r.status == StartView {
 			r.dlog("status become Start-View as new designated primary, blast <START-VIEW> to all replicas for updated state.")
 			r.mu.Unlock()
 			r.primaryBlastStartView()
+
+			// The view is started, the primary sends its heartbeats.
+			r.mu.Lock()
+			if r.status == StartView {
+				r.setStatus(Normal)
+				r.primarySendPeriodicCommits()
+			}
+			r.mu.Unlock()
 			return
 		}
 
-		if elapsed := time.Since(r.viewChangeResetEvent); elapsed >= timeoutDuration {
+		if elapsed := r.clock.Now().Sub(r.viewChangeResetEvent); elapsed >= r.detectedTimeout(timeoutDuration) {
+			if r.isRestarting(r.primaryID) {
+				r.mu.Unlock()
+				continue
+			}
+			status, lastReset := r.status, r.viewChangeResetEvent
+			r.mu.Unlock()
+
+			agreed := r.probeViewChange()
+
+			r.mu.Lock()
+			// Unless the primary was heard from during the probe.
+			if r.status != status || r.viewChangeResetEvent != lastReset {
+				r.mu.Unlock()
+				continue
+			}
+			if !agreed {
+				r.dlog("peers still hear from primary %d, doesn't start a view change", r.primaryID)
+				r.viewChangeResetEvent = r.clock.Now()
+				r.mu.Unlock()
+				continue
+			}
 			r.initiateViewChange()
 			r.mu.Unlock()
 			return
@@ -243,86 +795,85 @@ func (r *Replica) runViewChangeTimer() {
 	}
 }
 
-func (r *Replica) primaryBlastPrepare(newRequest clientRequest) {
-	r.mu.Lock()
-	savedViewNum := r.viewNum
-	savedOpNum := r.opNum
-	savedCommitNum := r.commitNum
-	var prepareOKsReceived int32 = 1
-	var commitedAlready bool = false
-	r.mu.Unlock()
+// ackPrepare records the <PREPARE-OK> of the backup, acknowledging the
+// operations of the view up to opNum since its opLog has no gap, and commits
+// the operations a quorum acknowledged. Acks may thus be lost or reordered.
+// Expects r.mu to be locked.
+func (r *Replica) ackPrepare(replicaID int, opNum int) {
+	if r.ackedOpNums == nil {
+		r.ackedOpNums = make(map[int]int)
+	}
+	if opNum > r.ackedOpNums[replicaID] {
+		r.ackedOpNums[replicaID] = opNum
+	}
+	r.hearFrom(replicaID)
+	r.commitAcked()
+	r.updateCompactNum()
+}
 
+// primaryBlastPrepare sends the <PREPARE> to the backups, and records their
+// <PREPARE-OK>s. Several operations can be in flight, see ackPrepare.
+func (r *Replica) primaryBlastPrepare(args PrepareArgs) {
 	for peerID := range r.configuration {
-		args := PrepareArgs{
-			ViewNum:       savedViewNum,
-			OpNum:         savedOpNum,
-			CommitNum:     savedCommitNum,
-			ClientMessage: newRequest,
-		}
 		go func(peerID int) {
 			var reply PrepareOKReply
 
-			r.dlog("incoming new request (%+v), sending <PREPARE> to %d; viewNum=%v, opNum=%v, commitNum=%v", args.ClientMessage, peerID, savedViewNum, savedOpNum, savedCommitNum)
+			r.dlog("incoming new request (%+v), sending <PREPARE> to %d; viewNum=%v, opNum=%v, commitNum=%v", args.ClientMessage, peerID, args.ViewNum, args.OpNum, args.CommitNum)
 			err := r.server.Call(peerID, "Replica.Prepare", args, &reply)
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			// The backup got the <PREPARE> but didn't take it: it is
+			// catching up on its own, or the primary was superseded.
+			if err == ErrLogGap || err == ErrWrongStatus || err == ErrStaleView || err == ErrReplicaDead {
+				r.dlog("backup %d didn't take <PREPARE>; err = %v", peerID, err)
+				return
+			}
 			if err != nil {
 				log.Printf("failed sending <PREPARE> messages; err = %v", err.Error())
+				r.retransmitPrepares(peerID)
+				return
 			}
-			if err == nil {
-				r.mu.Lock()
-				defer r.mu.Unlock()
-				r.dlog("receved <PREPARE-OK> reply %+v", reply)
-
-				if reply.IsReplied && !commitedAlready {
-					replies := int(atomic.AddInt32(&prepareOKsReceived, 1))
-					if replies*2 > len(r.configuration)+1 {
-						r.dlog("quorum agrees on incoming request, ready to be committed")
-
-						// TODO
-						// 1. Primary executes the operation by making an up-call to the service code
-						// (v) 2. increments its own commitNum
-						// 3. send <REPLY> message to Client with viewNum, reqNum, resp,
-						// 4. and updates its clientTable with the result
-						r.commitNum++
-
-						commitedAlready = true
-
-						if r.commitNum != savedCommitNum {
-							newReqCommitEntry := CommitEntry{
-								ViewNum:   savedViewNum,
-								OpNum:     savedOpNum,
-								CommitNum: savedCommitNum,
-								ClientReq: newRequest,
-								Resp:      nil,
-							}
-							r.dlog("primary increments commitNum=%d; sending commitEntry=%v", r.commitNum, newReqCommitEntry)
-							r.commitChan <- newReqCommitEntry
-							r.dlog("commitChan send done")
-						}
-
-						return
-					}
-				}
-			}
+			r.dlog("receved <PREPARE-OK> reply %+v", reply)
+			r.prepareReplied(peerID, args, reply)
 		}(peerID)
 	}
 }
 
+// prepareReplied records the <PREPARE-OK> the backup replied to the
+// <PREPARE>, unless the replica no longer leads the view it was sent in.
+// Expects r.mu to be locked.
+func (r *Replica) prepareReplied(peerID int, args PrepareArgs, reply PrepareOKReply) {
+	if reply.IsReplied && reply.ViewNum == args.ViewNum && r.leadsView() && r.viewNum == args.ViewNum {
+		r.ackPrepare(peerID, reply.OpNum)
+	}
+}
+
+// primarySendPeriodicCommits starts the heartbeats of the primary, until it
+// isn't the primary anymore or it steps down, see lostQuorum.
+// Expects r.mu to be locked.
 func (r *Replica) primarySendPeriodicCommits() {
 	// Primary's heartbeat can be in the form of
 	// <PREPARE> when there's new request from clients or
 	// <COMMIT> can be sent when there's no new requests but this particular
 	// method is used only for <COMMIT> since <PREPARE> will
 	// immediately be issued when the new request is submitted.
+	r.resetHeardFrom()
 	go func() {
-		ticker := time.NewTicker(50 * time.Millisecond)
+		ticker := r.clock.NewTicker(r.opts.HeartbeatInterval)
 		defer ticker.Stop()
 
 		for {
 			r.primarySendCommit()
-			<-ticker.C
+			<-ticker.C()
 
 			r.mu.Lock()
-			if r.primaryID != r.ID || r.status != Normal {
+			if !r.leadsView() {
+				r.mu.Unlock()
+				return
+			}
+			if r.lostQuorum() {
+				r.dlog("hasn't heard from a quorum for %v, steps down", r.opts.ViewChangeTimeout)
+				r.initiateViewChange()
 				r.mu.Unlock()
 				return
 			}
@@ -336,12 +887,18 @@ func (r *Replica) primarySendCommit() {
 	savedViewNum := r.viewNum
 	// commitNum should be equal to opNum
 	savedCommitNum := r.commitNum
+	savedCompactNum := r.compactNum
+	stateHashOpNum, stateHash := r.latestStateHash()
 	r.mu.Unlock()
 
 	for peerID := range r.configuration {
 		args := CommitArgs{
-			ViewNum:   savedViewNum,
-			CommitNum: savedCommitNum,
+			ViewNum:        savedViewNum,
+			CommitNum:      savedCommitNum,
+			PrimaryID:      r.ID,
+			StateHashOpNum: stateHashOpNum,
+			StateHash:      stateHash,
+			CompactNum:     savedCompactNum,
 		}
 		go func(peerID int) {
 			var reply CommitReply
@@ -356,6 +913,19 @@ func (r *Replica) primarySendCommit() {
 				defer r.mu.Unlock()
 				r.dlog("receved <COMMIT> reply %+v", reply)
 
+				// A backup which moved to another view doesn't count
+				// towards the quorum of the primary.
+				if reply.IsReplied && reply.AckedViewNum == args.ViewNum {
+					r.hearFrom(peerID)
+				}
+				// The backup gossips back which primary it acknowledges
+				// for the view, allowing to spot a split brain.
+				if reply.IsReplied && reply.AckedPrimaryID >= 0 {
+					r.observePrimary(reply.AckedViewNum, reply.AckedPrimaryID, reply.ReplicaID)
+				}
+				if reply.IsReplied {
+					r.receiveStateHash(reply.ReplicaID, reply.StateHashOpNum, reply.StateHash)
+				}
 				return
 			}
 
@@ -364,8 +934,12 @@ func (r *Replica) primarySendCommit() {
 }
 
 func (r *Replica) blastStartViewChange() {
+	r.mu.Lock()
 	savedCurrentViewNum := r.viewNum
-	var repliesReceived int32 = 1
+	acksNeeded := r.startViewChangeAcksNeeded()
+	r.mu.Unlock()
+	// Only the other replicas are counted, the local one is implied.
+	var repliesReceived int32 = 0
 	var sendStartViewChangeAlready bool = false
 
 	for peerID := range r.configuration {
@@ -386,9 +960,9 @@ func (r *Replica) blastStartViewChange() {
 				defer r.mu.Unlock()
 				r.dlog("received <START-VIEW-CHANGE> reply %+v", reply)
 
-				if reply.IsReplied && !sendStartViewChangeAlready {
+				if reply.IsReplied && reply.ViewNum == savedCurrentViewNum && !sendStartViewChangeAlready {
 					replies := int(atomic.AddInt32(&repliesReceived, 1))
-					if replies*2 > len(r.configuration)+1 {
+					if replies >= acksNeeded {
 						r.dlog("acknowledge that quorum agrees on a view change. Sending <DO-VIEW-CHANGE> to new designated primary")
 						r.initiateDoViewChange()
 						sendStartViewChangeAlready = true
@@ -401,54 +975,69 @@ func (r *Replica) blastStartViewChange() {
 }
 
 func (r *Replica) initiateStartView() {
-	r.status = StartView
+	r.setStatus(StartView)
 	savedCurrentViewNum := r.viewNum
-	r.viewChangeResetEvent = time.Now()
+	r.viewChangeResetEvent = r.clock.Now()
 	r.dlog("initiates START VIEW; view=%d", savedCurrentViewNum)
 
 	go r.runViewChangeTimer()
 }
 
 func (r *Replica) initiateDoViewChange() {
-	r.status = DoViewChange
+	r.setStatus(DoViewChange)
 	savedCurrentViewNum := r.viewNum
-	r.viewChangeResetEvent = time.Now()
+	r.viewChangeResetEvent = r.clock.Now()
 	r.dlog("initiates DO VIEW CHANGE; view=%d", savedCurrentViewNum)
 
 	go r.runViewChangeTimer()
 }
 
+// sendDoViewChange sends the <DO-VIEW-CHANGE> of the replica to the primary
+// of its view, or counts it if it is the one. Expects r.mu to be locked.
 func (r *Replica) sendDoViewChange() {
-	nextPrimaryID := nextPrimary(r.primaryID, r.configuration)
-
-	if nextPrimaryID == r.ID {
-		r.doViewChangeCount++
-		return
-	}
+	nextPrimaryID := r.primaryOfView(r.viewNum)
 
 	args := DoViewChangeArgs{
+		ReplicaID:  r.ID,
 		ViewNum:    r.viewNum,
-		OldViewNum: r.oldViewNum,
+		OldViewNum: r.lastNormalViewNum,
 		CommitNum:  r.commitNum,
 		OpNum:      r.opNum,
+		LogStart:   r.logStart,
 		OpLog:      r.opLog,
+		Responses:  r.clientResponses(),
 	}
-	var reply DoViewChangeReply
 
-	r.dlog("sending <DO-VIEW-CHANGE> to the next primary %d: %+v", nextPrimaryID, args)
-	err := r.server.Call(nextPrimaryID, "Replica.DoViewChange", args, &reply)
-	if err == nil {
-		r.dlog("received <DO-VIEW-CHANGE> reply %+v", reply)
+	if nextPrimaryID == r.ID {
+		// Its own log is a candidate like the others', whose
+		// <DO-VIEW-CHANGE>s may have arrived first.
+		r.considerDoViewChange(args)
+		r.startViewOnQuorum()
 		return
 	}
+
+	// Sent out of the lock: the next primary may be waiting for the
+	// replica's lock itself, sending a <DO-VIEW-CHANGE> of another view.
+	go func() {
+		var reply DoViewChangeReply
+
+		r.dlog("sending <DO-VIEW-CHANGE> to the next primary %d: %+v", nextPrimaryID, args)
+		err := r.server.Call(nextPrimaryID, "Replica.DoViewChange", args, &reply)
+		if err != nil {
+			r.dlog("next primary %d didn't take <DO-VIEW-CHANGE>; err = %v", nextPrimaryID, err)
+			return
+		}
+		r.dlog("received <DO-VIEW-CHANGE> reply %+v", reply)
+	}()
 }
 
 func (r *Replica) initiateViewChange() {
-	r.status = ViewChange
-	r.doViewChangeCount = 0
+	r.resetDoViewChanges()
 	r.viewNum += 1
+	r.initiatedViewNum = r.viewNum
+	r.setStatus(ViewChange)
 	savedCurrentViewNum := r.viewNum
-	r.viewChangeResetEvent = time.Now()
+	r.viewChangeResetEvent = r.clock.Now()
 	r.dlog("initiates VIEW CHANGE; view=%d; log=<ADDED LATER>", savedCurrentViewNum)
 
 	go r.runViewChangeTimer()
@@ -457,17 +1046,23 @@ func (r *Replica) initiateViewChange() {
 func (r *Replica) primaryBlastStartView() {
 	r.mu.Lock()
 	savedViewNum := r.viewNum
+	savedLogStart := r.logStart
 	savedOpLog := r.opLog
 	savedOpNum := r.opNum
+	savedCommitNum := r.commitNum
 	savedPrimaryID := r.ID
+	savedResponses := r.clientResponses()
 	r.mu.Unlock()
 
 	for peerID := range r.configuration {
 		args := StartViewArgs{
 			ViewNum:   savedViewNum,
+			LogStart:  savedLogStart,
 			OpLog:     savedOpLog,
 			OpNum:     savedOpNum,
+			CommitNum: savedCommitNum,
 			PrimaryID: savedPrimaryID,
+			Responses: savedResponses,
 		}
 		go func(peerID int) {
 			var reply StartViewReply
@@ -488,6 +1083,7 @@ func (r *Replica) primaryBlastStartView() {
 }
 
 type PrepareArgs struct {
+	PrimaryID     int
 	ViewNum       int
 	OpNum         int
 	CommitNum     int
@@ -497,6 +1093,8 @@ type PrepareArgs struct {
 type PrepareOKReply struct {
 	IsReplied bool
 	ViewNum   int
+	// OpNum is the highest opNum of the backup, which has all the
+	// operations before it.
 	OpNum     int
 	ReplicaID int
 	Status    ReplicaStatus
@@ -507,46 +1105,77 @@ func (r *Replica) Prepare(args PrepareArgs, reply *PrepareOKReply) error {
 	defer r.mu.Unlock()
 
 	if r.status == Dead {
-		return nil
+		return ErrReplicaDead
+	}
+	if r.isRecovering() {
+		r.dlog("is recovering, drops PREPARE")
+		return ErrWrongStatus
 	}
 	r.dlog("Prepare: %+v [currentView=%d]", args, r.viewNum)
 
-	// TODO
-	// This Replica is behind others, changing status to Recovery and
-	// initiate state transfer from the new primary.
+	// This Replica is behind others, it initiates state transfer
+	// from the new primary.
 	if r.viewNum < args.ViewNum {
-		r.status = Recovery
-		r.dlog("is behind PREPARE's viewNum, changing status to Recovery and initiate state transfer from Primary")
+		r.dlog("is behind PREPARE's viewNum, initiates state transfer from Primary")
+		r.startStateTransfer(args.ViewNum, args.PrimaryID)
+		return ErrLogGap
+	}
 
-		// TODO
-		// Initiate a state transfer from the Primary.
-		// NOTE: Will probably need to run timer here.
+	// The missing operations, including this one, come with the <NEW-STATE>.
+	if r.viewNum == args.ViewNum && r.status == StateTransfer {
+		r.viewChangeResetEvent = r.clock.Now()
+		r.dlog("is transferring state, drops PREPARE")
+		return ErrLogGap
 	}
 
 	if r.viewNum == args.ViewNum {
+		// A retransmitted or duplicated <PREPARE> of an operation which is
+		// already in the opLog isn't a gap: the operation is kept as is and
+		// <PREPARE-OK> is sent again, since the previous one may have been lost.
+		if args.OpNum <= r.opNum {
+			r.viewChangeResetEvent = r.clock.Now()
+			// In a view, an opNum is assigned to a single request.
+			if args.OpNum > r.logStart {
+				e, req := *r.logEntry(args.OpNum), args.ClientMessage
+				if e.namespace != req.namespace || e.clientID != req.clientID || e.reqNum != req.reqNum {
+					r.divergeLog(args.OpNum, "opNum=%d is request %d of client %d in the opLog but request %d of client %d in the PREPARE",
+						args.OpNum, e.reqNum, e.clientID, req.reqNum, req.clientID)
+					return nil
+				}
+			}
+			r.dlog("already has opNum=%d of PREPARE, re-sending PREPARE-OK", args.OpNum)
+
+			reply.IsReplied = true
+			reply.ReplicaID = r.ID
+			reply.Status = r.status
+			reply.ViewNum = r.viewNum
+			reply.OpNum = r.opNum
+			return nil
+		}
+
 		// Not only the viewNum should be the same,
 		// but also the opNum should be strictly consecutive.
-		// If not, replica drops the message and initiates recovery with state transfer
+		// If not, replica pulls the missing operations and buffers the message
+		// until the gap is filled, or initiates recovery with state transfer
+		// if the gap is too wide or persists.
 		if r.opNum != args.OpNum-1 {
-			r.status = Recovery
-			r.dlog("viewNum is the same but different opNum with PREPARE's, changing status to Recovery and initiate state transfer from Primary")
-
-			// TODO
-			// Initiate recovery with state transfer.
-			// Note: Will probably need to run timer here.
-
-			return nil
+			r.viewChangeResetEvent = r.clock.Now()
+			if r.fillGap(args) {
+				return ErrLogGap
+			}
+			r.dlog("viewNum is the same but different opNum with PREPARE's, initiates state transfer from Primary")
+			r.startStateTransfer(args.ViewNum, args.PrimaryID)
+			return ErrLogGap
 		}
-		r.viewChangeResetEvent = time.Now()
+		r.viewChangeResetEvent = r.clock.Now()
 		r.dlog("state = %v;time = %v", r.status, r.viewChangeResetEvent)
 
-		r.opNum++
-		r.opLog = append(r.opLog, opLogEntry{opID: len(r.opLog), operation: args.ClientMessage.reqOp})
-		ctEntry := clientTableEntry{
-			reqNum: args.ClientMessage.reqNum,
-			reqOp:  args.ClientMessage.reqOp,
+		r.appendPrepared(args.ClientMessage)
+		r.appendReordered()
+		// The operations it failed to store can't be acknowledged.
+		if r.status == Dead {
+			return ErrReplicaDead
 		}
-		r.clientTable[args.ClientMessage.clientID] = ctEntry
 
 		reply.IsReplied = true
 		reply.ReplicaID = r.ID
@@ -555,35 +1184,121 @@ func (r *Replica) Prepare(args PrepareArgs, reply *PrepareOKReply) error {
 		reply.OpNum = r.opNum
 
 		r.dlog("... PREPARE-OK replied: %+v", reply)
+		r.emit(EventPrepareAcked, SeverityInfo, nil, "acked PREPARE; viewNum=%d opNum=%d", r.viewNum, r.opNum)
 	}
 
-	// This also returns nil when this Replica's viewNum is greater (>)
-	// than the incoming argument's viewNum (r.viewNum > args.ViewNum)
-	// which means this replica drops the incoming message.
+	// This Replica's viewNum is greater (>) than the incoming argument's
+	// viewNum (r.viewNum > args.ViewNum) which means this replica drops the
+	// incoming message of a superseded primary.
 	if r.viewNum > args.ViewNum {
 		r.dlog("viewNum is bigger than PREPARE's, drops message")
+		return ErrStaleView
 	}
 
 	// Replica learns that Primary already advances its commitNum meaning that
 	// its safe for Replica to commit its opLog and advance its own commitNum
-	if args.CommitNum > r.commitNum {
-		// TODO
-		// Replica commits operations in its opLog which is in between
-		// its own commitNum and the PREPARE args' commitNum.
+	if args.CommitNum > r.commitNum && r.status == Normal && r.viewNum == args.ViewNum && r.ID != args.PrimaryID {
+		r.commitUpTo(args.CommitNum)
+	}
 
+	return nil
+}
+
+// PrepareOKArgs is a <PREPARE-OK> sent on its own rather than as the reply
+// to a <PREPARE>, by a backup once a view started. As the backup has the
+// whole opLog of the view, it acknowledges all the operations up to OpNum.
+type PrepareOKArgs struct {
+	ViewNum   int
+	OpNum     int
+	ReplicaID int
+}
+
+type PrepareOKAckReply struct {
+	IsReplied bool
+}
+
+// sendPrepareOK acknowledges the operations up to opNum to the primary of
+// the view.
+func (r *Replica) sendPrepareOK(viewNum int, opNum int, primaryID int) {
+	args := PrepareOKArgs{
+		ViewNum:   viewNum,
+		OpNum:     opNum,
+		ReplicaID: r.ID,
+	}
+	var reply PrepareOKAckReply
+
+	r.dlog("sending <PREPARE-OK> to %d: %+v", primaryID, args)
+	if err := r.server.Call(primaryID, "Replica.PrepareOK", args, &reply); err != nil {
+		log.Printf("failed sending <PREPARE-OK>; err = %v", err.Error())
+	}
+}
+
+func (r *Replica) PrepareOK(args PrepareOKArgs, reply *PrepareOKAckReply) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.status == Dead {
+		return nil
 	}
+	r.dlog("PrepareOK: %+v [currentView=%d]", args, r.viewNum)
 
+	// The primary may still be sending the <START-VIEW>s.
+	if args.ViewNum != r.viewNum || r.primaryID != r.ID || (r.status != Normal && r.status != Transitioning && r.status != StartView) {
+		r.dlog("isn't the primary of view %d, drops PREPARE-OK", args.ViewNum)
+		return nil
+	}
+	reply.IsReplied = true
+	r.ackPrepare(args.ReplicaID, args.OpNum)
 	return nil
 }
 
+// commitAcked commits the operations a quorum acknowledged, the primary
+// included. Expects r.mu to be locked.
+func (r *Replica) commitAcked() {
+	acked := []int{r.opNum}
+	for replicaID, opNum := range r.ackedOpNums {
+		if r.isMember(replicaID) {
+			acked = append(acked, opNum)
+		}
+	}
+	if len(acked) < r.quorum() {
+		return
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(acked)))
+	if opNum := acked[r.quorum()-1]; opNum > r.commitNum {
+		r.dlog("a quorum acknowledged up to opNum=%d, primary commits", opNum)
+		r.commitUpTo(opNum)
+	}
+}
+
 type CommitArgs struct {
 	ViewNum   int
 	CommitNum int
+	PrimaryID int
+
+	// The hash of the state machine of the primary at its latest
+	// checkpoint, see Options.DeterminismCheckInterval, nil if none.
+	StateHashOpNum int
+	StateHash      []byte
+
+	// CompactNum is the highest opNum every member holds, which the
+	// replicas can drop from their opLogs once they have a snapshot.
+	CompactNum int
 }
 
 type CommitReply struct {
 	IsReplied bool
 	ReplicaID int
+
+	// The highest (view, primary) acknowledged by the replica,
+	// AckedPrimaryID is -1 when it is not in a Normal view.
+	AckedViewNum   int
+	AckedPrimaryID int
+
+	// The hash of the state machine of the replica at its latest
+	// checkpoint, for the primary to compare with its own.
+	StateHashOpNum int
+	StateHash      []byte
 }
 
 func (r *Replica) Commit(args CommitArgs, reply *CommitReply) error {
@@ -591,27 +1306,246 @@ func (r *Replica) Commit(args CommitArgs, reply *CommitReply) error {
 	defer r.mu.Unlock()
 
 	if r.status == Dead {
-		return nil
+		return ErrReplicaDead
+	}
+	if r.isRecovering() {
+		r.dlog("is recovering, drops COMMIT")
+		return ErrWrongStatus
 	}
 	r.dlog("Commit: %+v [currentView=%d]", args, r.viewNum)
 
-	r.viewChangeResetEvent = time.Now()
+	r.viewChangeResetEvent = r.clock.Now()
+	r.lastHeartbeatAt = r.viewChangeResetEvent
 	r.dlog("state = %v;time = %v", r.status, r.viewChangeResetEvent)
 
-	// TODO
+	r.observePrimary(args.ViewNum, args.PrimaryID, args.PrimaryID)
+	if r.status == Normal && r.viewNum == args.ViewNum {
+		r.observePrimary(r.viewNum, r.primaryID, r.ID)
+	}
+
+	reply.IsReplied = true
+	reply.ReplicaID = r.ID
+	reply.AckedViewNum = r.viewNum
+	reply.AckedPrimaryID = -1
+	if r.status == Normal {
+		reply.AckedPrimaryID = r.primaryID
+	}
+	r.receiveStateHash(args.PrimaryID, args.StateHashOpNum, args.StateHash)
+	reply.StateHashOpNum, reply.StateHash = r.latestStateHash()
+
+	// The primary committed operations this backup never received,
+	// instead of waiting for a gap in <PREPARE>s it proactively fetches them.
+	if r.status == Normal && args.ViewNum == r.viewNum && r.ID != args.PrimaryID &&
+		args.CommitNum-r.opNum >= r.opts.PullThreshold {
+		r.maybePullMissingOps(args.CommitNum)
+	}
+
+	// A backup left behind by a view change catches up with the new primary,
+	// and one whose <NEW-STATE> got lost asks for it again.
+	if r.ID != args.PrimaryID {
+		if args.ViewNum > r.viewNum {
+			r.startStateTransfer(args.ViewNum, args.PrimaryID)
+		} else if args.ViewNum == r.viewNum && (r.status == ViewChange || r.status == DoViewChange) {
+			// The view started without it, its <START-VIEW> got lost.
+			r.startStateTransfer(args.ViewNum, args.PrimaryID)
+		} else if args.ViewNum == r.viewNum && r.status == StateTransfer {
+			r.requestState()
+		}
+	}
+
 	// Replica receiving COMMIT message
 	// executes all operation in their opLog between their commitNum and
 	// args' commitNum following the order of the operations
 	// and also advance its commitNum
+	if r.status == Normal && args.ViewNum == r.viewNum && r.ID != args.PrimaryID {
+		r.commitUpTo(args.CommitNum)
+		if args.CompactNum > r.compactNum {
+			r.compactNum = args.CompactNum
+			r.compactLog()
+		}
+	}
 
 	return nil
 }
 
+// commitUpTo commits, in order, the operations of the opLog up to
+// commitNum, or up to its opNum if it doesn't have them all yet, and
+// delivers them on the commit channel. The service code executes them once
+// commitChanSender delivers them and records the responses with Reply, which
+// the clients get by resending their requests, see Client.Result.
+// Expects r.mu to be locked.
+func (r *Replica) commitUpTo(commitNum int) {
+	for r.commitNum < commitNum && r.commitNum < r.opNum {
+		e := *r.logEntry(r.commitNum + 1)
+		r.commitNum++
+
+		t := r.tenantFor(e.namespace)
+		t.metrics.Committed++
+		if entry := t.clientTable[e.clientID]; entry.reqNum == e.reqNum {
+			entry.committed = true
+			t.clientTable[e.clientID] = entry
+		}
+		if submittedAt, ok := r.preparedAt[r.commitNum]; ok && r.primaryID == r.ID {
+			r.commitLatencies.add(r.clock.Now().Sub(submittedAt))
+			delete(r.preparedAt, r.commitNum)
+		}
+		r.recordCommit()
+		r.indexSession(e, r.commitNum, r.clock.Now())
+		if e.namespace == internalNamespace {
+			if change, ok := e.op().(epochChange); ok {
+				r.startEpoch(change, r.commitNum)
+			}
+		}
+		r.dlog("commits opNum=%d", r.commitNum)
+	}
+	r.storeMeta()
+	r.notifyCommitWaiters()
+	r.notifyCommitReady()
+}
+
+// notifyCommitReady wakes commitChanSender up to deliver the operations
+// committed since. Expects r.mu to be locked.
+func (r *Replica) notifyCommitReady() {
+	// Stop closed the channel.
+	if r.status == Dead {
+		return
+	}
+	select {
+	case r.newCommitReadyChan <- struct{}{}:
+	default:
+		// A wake-up is already pending, it will see these commits too.
+	}
+}
+
+// commitChanSender delivers the committed operations on commitChan, in the
+// order of the opLog, without holding r.mu while the consumer takes them so
+// that a slow state machine doesn't hold the protocol up. appliedNum counts
+// the operations the consumer took. It returns once the replica is stopped.
+func (r *Replica) commitChanSender() {
+	for range r.newCommitReadyChan {
+		for {
+			r.mu.Lock()
+			if r.pendingSnapshot != nil {
+				snapshot := r.pendingSnapshot
+				r.pendingSnapshot = nil
+				snapshotter, _ := r.opts.StateMachine.(Snapshotter)
+				r.mu.Unlock()
+				if snapshotter != nil {
+					r.dlog("restores its state machine from the snapshot")
+					if err := snapshotter.Restore(snapshot); err != nil {
+						log.Printf("failed restoring the snapshot; err = %v", err.Error())
+						r.reportFailure(FailureSnapshot, 0, 0, err)
+					}
+				}
+				continue
+			}
+			if r.resetStateMachine {
+				r.resetStateMachine = false
+				resetter, _ := r.opts.StateMachine.(StateResetter)
+				r.mu.Unlock()
+				if resetter != nil {
+					r.dlog("resets its state machine")
+					resetter.Reset()
+				}
+				continue
+			}
+			if replays := r.takeReplays(); len(replays) > 0 {
+				r.mu.Unlock()
+				for _, replay := range replays {
+					for _, entry := range replay.entries {
+						if replay.s.matches(entry) {
+							replay.s.deliver(entry)
+						}
+					}
+				}
+				continue
+			}
+			if r.appliedNum >= r.commitNum || r.appliedNum >= r.opNum {
+				r.mu.Unlock()
+				break
+			}
+			appliedNum := r.appliedNum
+			e := *r.logEntry(appliedNum + 1)
+			commitEntry := CommitEntry{
+				ViewStamp: e.viewStamp(),
+				CommitNum: appliedNum + 1,
+				Namespace: e.namespace,
+				ClientReq: clientRequest{
+					namespace: e.namespace,
+					clientID:  e.clientID,
+					reqNum:    e.reqNum,
+					reqOp:     r.applyingOp(appliedNum + 1),
+				},
+			}
+			stateMachine := r.opts.StateMachine
+			checkInterval := r.opts.DeterminismCheckInterval
+			subscriptions := r.subscriptions
+			r.mu.Unlock()
+
+			// The internal operations aren't delivered; an epochChange
+			// was installed as it was committed.
+			if commitEntry.Namespace == internalNamespace {
+				if change, ok := commitEntry.ClientReq.reqOp.(addressChange); ok {
+					r.applyAddressChange(change)
+				}
+			} else {
+				if stateMachine != nil {
+					resp, err := stateMachine.Apply(commitEntry.ClientReq.reqOp)
+					if err != nil {
+						r.dlog("failed applying opNum=%d; err = %v", commitEntry.OpNum, err)
+						r.reportFailure(FailureApply, commitEntry.OpNum, 0, err)
+						resp = ApplyError{Msg: err.Error()}
+					}
+					commitEntry.Resp = resp
+					r.checkDeterminism(stateMachine, checkInterval, commitEntry.OpNum)
+				}
+				if r.commitChan != nil {
+					r.dlog("sending commitEntry=%v", commitEntry)
+					r.commitChan <- commitEntry
+				}
+				for _, s := range subscriptions {
+					if s.matches(commitEntry) {
+						s.deliver(commitEntry)
+					}
+				}
+			}
+
+			r.mu.Lock()
+			// Recovery may have reset the state machine meanwhile,
+			// it gets the operations again from the start.
+			snapshotter, _ := stateMachine.(Snapshotter)
+			snapshotDue := false
+			if r.appliedNum == appliedNum {
+				r.appliedNum++
+				r.appliedBytes += storedSize(e.operation)
+				if stateMachine != nil {
+					r.recordResponse(commitEntry.ClientReq, commitEntry.Resp)
+				}
+				if commitEntry.Namespace != internalNamespace {
+					r.recordReplay(commitEntry)
+				}
+				snapshotDue = r.snapshotDue()
+			}
+			r.mu.Unlock()
+
+			if snapshotDue {
+				r.takeSnapshot(snapshotter, appliedNum+1)
+			}
+		}
+	}
+}
+
 type StartViewArgs struct {
-	ViewNum   int
+	ViewNum int
+	// OpLog holds the entries following LogStart, up to OpNum.
+	LogStart  int
 	OpLog     []opLogEntry
 	OpNum     int
+	CommitNum int
 	PrimaryID int
+	// Responses are the responses of the clientTables of the primary, see
+	// rebuildClientTables.
+	Responses []clientResponse
 }
 
 type StartViewReply struct {
@@ -626,33 +1560,70 @@ func (r *Replica) StartView(args StartViewArgs, reply *StartViewReply) error {
 	if r.status == Dead {
 		return nil
 	}
+	if r.isRecovering() {
+		r.dlog("is recovering, drops START-VIEW")
+		return nil
+	}
 	r.dlog("StartView: %+v [currentView=%d]", args, r.viewNum)
 
+	// A START-VIEW of an older view was delayed past the next view change.
+	if args.ViewNum < r.viewNum {
+		r.dlog("START-VIEW of view %d is stale, drops message", args.ViewNum)
+		return nil
+	}
+	if args.OpNum < r.commitNum {
+		r.violateInvariant("commitNum regression", "START-VIEW has opNum=%d but commitNum=%d is committed", args.OpNum, r.commitNum)
+		return nil
+	}
+
 	reply.IsReplied = true
 	reply.ReplicaID = r.ID
-	// var oldOpNum = r.opNum
+	// A backup which was already Normal still runs its view change timer,
+	// a primary doesn't.
+	timerRunning := r.status == Normal && !r.leadsView()
 
-	r.opLog = args.OpLog
-	r.opNum = args.OpNum
+	if !r.installLog(args.LogStart, args.OpLog, args.OpNum) {
+		r.violateInvariant("log gap", "START-VIEW opLog starts after opNum=%d but ends at opNum=%d", args.LogStart, r.opNum)
+		return nil
+	}
+	// The committed operations are the same in every view.
+	r.storeLog(r.commitNum + 1)
 	r.viewNum = args.ViewNum
 	r.primaryID = args.PrimaryID
+	r.rebuildClientTables(args.Responses)
+
+	r.setStatus(Normal)
+	r.viewStartedAt = r.clock.Now()
+	r.viewStartCommitNum = r.commitNum
+	r.viewChangeResetEvent = r.viewStartedAt
+
+	// The replica executes the operations committed up to the new commitNum,
+	// and acknowledges the uncommitted ones so that the new primary can
+	// commit them.
+	r.commitUpTo(args.CommitNum)
+	if r.opNum > r.commitNum && r.status != Dead {
+		go r.sendPrepareOK(r.viewNum, r.opNum, r.primaryID)
+	}
 
-	r.status = Normal
-	// TODO
-	// 1. Replica executes all operation from the old commitNum to the new commitNum.
-	// 2. Send <PREPARE-OK> for all operations in opLog which have not been commited yet.
-
-	// go r.runViewChangeTimer()
+	if !timerRunning {
+		go r.runViewChangeTimer()
+	}
 
 	return nil
 }
 
 type DoViewChangeArgs struct {
+	ReplicaID  int
 	ViewNum    int
 	OldViewNum int
 	CommitNum  int
 	OpNum      int
-	OpLog      []opLogEntry
+	// OpLog holds the entries following LogStart, up to OpNum.
+	LogStart int
+	OpLog    []opLogEntry
+	// Responses are the responses of the clientTables of the sender, see
+	// rebuildClientTables.
+	Responses []clientResponse
 }
 
 type DoViewChangeReply struct {
@@ -664,51 +1635,105 @@ func (r *Replica) DoViewChange(args DoViewChangeArgs, reply *DoViewChangeReply)
 	r.mu.Lock()
 
 	if r.status == Dead {
-		return nil
+		r.mu.Unlock()
+		return ErrReplicaDead
+	}
+	if r.isRecovering() {
+		r.dlog("is recovering, drops DO-VIEW-CHANGE")
+		r.mu.Unlock()
+		return ErrWrongStatus
 	}
 	r.dlog("DoViewChange: %+v [currentView=%d]", args, r.viewNum)
 
+	if args.ViewNum < r.viewNum {
+		r.dlog("viewNum is bigger than DO-VIEW-CHANGE's, drops message")
+		r.mu.Unlock()
+		return ErrStaleView
+	}
+
 	if args.ViewNum == r.viewNum {
-		r.doViewChangeCount++
-		r.dlog("DoViewChange messages received: %d", r.doViewChangeCount)
-
-		if args.OldViewNum >= r.oldViewNum {
-			if args.OpNum > r.opNum {
-				r.tempViewNum = args.ViewNum
-				r.tempOpNum = len(args.OpLog)
-				r.tempOpLog = args.OpLog
-			}
-		}
+		r.considerDoViewChange(args)
+	}
 
-		if args.CommitNum >= r.commitNum {
-			r.tempCommitNum = args.CommitNum
-		}
+	r.startViewOnQuorum()
+	r.mu.Unlock()
+	return nil
+}
+
+// resetDoViewChanges forgets the <DO-VIEW-CHANGE>s of the previous view
+// change. Expects r.mu to be locked.
+func (r *Replica) resetDoViewChanges() {
+	r.doViewChangeCount = 0
+	r.doViewChangeFrom = make(map[int]bool)
+	r.tempOldViewNum = -1
+	r.tempLogStart = 0
+	r.tempOpLog = nil
+	r.tempOpNum = 0
+	r.tempCommitNum = 0
+	r.tempResponses = nil
+}
+
+// considerDoViewChange counts the <DO-VIEW-CHANGE> of the current view, once
+// per member, and keeps the log the new view starts from as in the paper: the
+// one of the largest last normal view, then of the largest opNum; and the
+// largest commitNum. Expects r.mu to be locked.
+func (r *Replica) considerDoViewChange(args DoViewChangeArgs) {
+	if r.doViewChangeFrom == nil {
+		r.resetDoViewChanges()
+	}
+	if r.doViewChangeFrom[args.ReplicaID] {
+		r.dlog("already has the DO-VIEW-CHANGE of %d", args.ReplicaID)
+		return
+	}
+	if !r.isMember(args.ReplicaID) {
+		r.dlog("%d isn't a member, drops its DO-VIEW-CHANGE", args.ReplicaID)
+		return
+	}
+	r.doViewChangeFrom[args.ReplicaID] = true
+	r.doViewChangeCount++
+	r.dlog("DoViewChange messages received: %d", r.doViewChangeCount)
+
+	if args.OldViewNum > r.tempOldViewNum || (args.OldViewNum == r.tempOldViewNum && args.OpNum > r.tempOpNum) {
+		r.tempOldViewNum = args.OldViewNum
+		r.tempOpNum = args.OpNum
+		r.tempLogStart = args.LogStart
+		r.tempOpLog = args.OpLog
+	}
+	if args.CommitNum > r.tempCommitNum {
+		r.tempCommitNum = args.CommitNum
 	}
+	r.tempResponses = append(r.tempResponses, args.Responses...)
+}
 
-	if r.doViewChangeCount > (len(r.configuration)/2)+1 && r.status != StartView {
+// startViewOnQuorum makes the replica the primary of the new view once it
+// has a quorum of <DO-VIEW-CHANGE>s, its own included.
+// Expects r.mu to be locked.
+func (r *Replica) startViewOnQuorum() {
+	if r.doViewChangeCount >= r.quorum() && r.status != StartView {
 		// WORKING
 		// Comparing messages to other replicas' data and taking the most updated/recent state.
-		// Primary is back to normal and informs other replicas of the completion of the View-Change
-		r.viewNum = r.tempViewNum
-		r.opNum = r.tempOpNum
-		r.opLog = r.tempOpLog
-
-		// TODO
-		// Execute all commited operations in the operation log between
-		// the old commitNum and the new commitNum (r.tempCommitNum)
-
-		r.commitNum = r.tempCommitNum
-		r.status = Normal
+		// Primary is back to normal and informs other replicas of the completion of the View-Change.
+		// The <DO-VIEW-CHANGE>s were all for its viewNum, which it keeps.
+		if !r.installLog(r.tempLogStart, r.tempOpLog, r.tempOpNum) {
+			r.violateInvariant("log gap", "the opLog of the new view starts after opNum=%d but ends at opNum=%d", r.tempLogStart, r.opNum)
+			return
+		}
+		r.storeLog(r.commitNum + 1)
+		r.rebuildClientTables(r.tempResponses)
+		r.commitUpTo(r.tempCommitNum)
+		// The backups acknowledge the uncommitted operations once they
+		// install the new view.
+		r.ackedOpNums = make(map[int]int)
+		r.preparedAt = make(map[int]time.Time)
+		// The late <DO-VIEW-CHANGE>s must not start the view again.
+		r.resetDoViewChanges()
+		r.setStatus(Normal)
+		r.viewStartedAt = r.clock.Now()
+		r.viewStartCommitNum = r.commitNum
 		r.primaryID = r.ID
 		r.dlog("as Primary is back to Normal; viewNum = %v; opNum = %v; commitNum = %v; ", r.viewNum, r.opNum, r.commitNum)
 		r.initiateStartView()
-		r.mu.Unlock()
-
-		return nil
 	}
-
-	r.mu.Unlock()
-	return nil
 }
 
 type StartViewChangeArgs struct {
@@ -719,6 +1744,7 @@ type StartViewChangeArgs struct {
 type StartViewChangeReply struct {
 	IsReplied bool
 	ReplicaID int
+	ViewNum   int
 }
 
 func (r *Replica) StartViewChange(args StartViewChangeArgs, reply *StartViewChangeReply) error {
@@ -728,6 +1754,10 @@ func (r *Replica) StartViewChange(args StartViewChangeArgs, reply *StartViewChan
 	if r.status == Dead {
 		return nil
 	}
+	if r.isRecovering() {
+		r.dlog("is recovering, drops START-VIEW-CHANGE")
+		return nil
+	}
 	r.dlog("StartViewChange: %+v [currentView=%d]", args, r.viewNum)
 
 	// If the incoming <START-VIEW-CHANGE> message got a bigger `view-num`
@@ -737,14 +1767,24 @@ func (r *Replica) StartViewChange(args StartViewChangeArgs, reply *StartViewChan
 		// and reply with <START-VIEW-CHANGE> to all replicas.
 		reply.IsReplied = true
 		reply.ReplicaID = r.ID
-		r.status = ViewChange
-		r.oldViewNum = r.viewNum
+		if (r.status == ViewChange || r.status == DoViewChange) && r.initiatedViewNum == r.viewNum {
+			r.loseViewChangeRound(args.ReplicaID, args.ViewNum)
+		}
+		// The backups and the replicas changing views run their view
+		// change timer already, which drives this view change.
+		leading := r.leadsView()
 		r.viewNum = args.ViewNum
-		r.viewChangeResetEvent = time.Now()
+		r.resetDoViewChanges()
+		r.setStatus(ViewChange)
+		r.viewChangeResetEvent = r.clock.Now()
+		if leading {
+			go r.runViewChangeTimer()
+		}
 	} else if args.ViewNum == r.viewNum {
 		reply.IsReplied = true
 		reply.ReplicaID = r.ID
 	}
+	reply.ViewNum = r.viewNum
 	r.dlog("... StartViewChange replied: %+v", reply)
 	return nil
 }
@@ -755,6 +1795,9 @@ type HelloArgs struct {
 
 type HelloReply struct {
 	ID int
+
+	// Addr is the address the replica dials the greeting one at.
+	Addr string
 }
 
 func (r *Replica) Hello(args HelloArgs, reply *HelloReply) error {
@@ -765,6 +1808,7 @@ func (r *Replica) Hello(args HelloArgs, reply *HelloReply) error {
 	}
 	r.dlog("%d receive the greetings from %d! :)", reply.ID, args.ID)
 	reply.ID = r.ID
+	reply.Addr = r.configuration[args.ID]
 	return nil
 }
 
@@ -787,11 +1831,19 @@ func (r *Replica) greetOthers() {
 	}
 }
 
-func nextPrimary(primaryID int, config map[int]string) int {
-	nextPrimaryID := primaryID + 1
-	if nextPrimaryID == len(config)+1 {
-		nextPrimaryID = 0
+// primaryOfView returns the replica the <DO-VIEW-CHANGE>s of the view go to,
+// skipping the candidates which are dead, as the failure detector reports or
+// as the calls to them fail, see peerHealth. Replicas which disagree on the
+// candidates may pick different ones, which is safe: each replica
+// sends a single <DO-VIEW-CHANGE> per view, so that only one candidate can
+// gather a quorum of them. Expects r.mu to be locked.
+func (r *Replica) primaryOfView(viewNum int) int {
+	members := membersOf(r.ID, r.configuration)
+	for i := 0; i < len(members); i++ {
+		candidate := nextPrimary(viewNum+i, members)
+		if candidate == r.ID || r.peerHealth(candidate) != PeerDead {
+			return candidate
+		}
 	}
-
-	return nextPrimaryID
+	return nextPrimary(viewNum, members)
 }
@@ -1,6 +1,25 @@
 package vrr
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,3 +34,4165 @@ func TestHarnessBasic(t *testing.T) {
 
 	time.Sleep(7 * time.Second)
 }
+
+// TestReplicatedCounterFailover drives a replicated counter through 3 replicas,
+// crashing the primary mid-stream. No increment may be lost or applied twice,
+// and every surviving replica must end up with the same counter.
+func TestReplicatedCounterFailover(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	const clientID = 1
+	reqNum := 0
+	submitIncrements := func(n int) {
+		for i := 0; i < n; i++ {
+			primaryID, _ := h.CheckSinglePrimary()
+			reqNum++
+			for !h.SubmitToReplica(primaryID, clientID, reqNum, "incr") {
+				sleepMs(50)
+				primaryID, _ = h.CheckSinglePrimary()
+			}
+			sleepMs(20)
+		}
+	}
+
+	submitIncrements(5)
+	sleepMs(250)
+	primaryID, _ := h.CheckSinglePrimary()
+	h.CrashPeer(primaryID)
+
+	submitIncrements(5)
+	sleepMs(500)
+
+	counter := 0
+	for _, c := range h.CheckCommittedN(10) {
+		if c.ClientReq.reqOp == "incr" {
+			counter++
+		}
+	}
+	if counter != 10 {
+		t.Errorf("counter = %d, want 10", counter)
+	}
+}
+
+// newLonePrimary returns a replica without peers that considers itself the
+// primary, which is enough to exercise the Submit path without a cluster.
+func newLonePrimary() *Replica {
+	r := new(Replica)
+	r.clock = realClock{}
+	r.server = NewServer(nil, nil)
+	r.configuration = make(map[int]string)
+	r.tenants = make(map[string]*tenant)
+	r.storage = NewMemoryStorage()
+	r.status = Normal
+	return r
+}
+
+// newTestBackup returns replica 1, a backup of replica 0 in a group of three,
+// keeping its state in the storage, or in memory if nil, and applying the
+// committed operations to the state machine, if any. Its commits aren't
+// delivered until commitChanSender runs.
+func newTestBackup(storage Storage, sm StateMachine) *Replica {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.opts.StateMachine = sm
+	r.configuration = map[int]string{0: "127.0.0.1:7000", 2: "127.0.0.1:7002"}
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	r.primarySightings = make(map[int]primarySighting)
+	r.events = make(chan Event, eventsBufferSize)
+	if storage != nil {
+		r.storage = storage
+	}
+	return r
+}
+
+func TestReplicaStatusRoundTrip(t *testing.T) {
+	for _, status := range replicaStatuses {
+		parsed, err := ParseReplicaStatus(status.String())
+		if err != nil || parsed != status {
+			t.Errorf("ParseReplicaStatus(%q) = %v, %v", status.String(), parsed, err)
+		}
+
+		b, err := json.Marshal(StatsReply{Status: status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var reply StatsReply
+		if err := json.Unmarshal(b, &reply); err != nil || reply.Status != status {
+			t.Errorf("%v through JSON = %v, %v", status, reply.Status, err)
+		}
+	}
+
+	if _, err := ParseReplicaStatus("Sleeping"); err == nil {
+		t.Error("unknown status parsed")
+	}
+	if s := ReplicaStatus(42).String(); s != "Unknown(42)" {
+		t.Errorf("String() of an unknown status = %q", s)
+	}
+	if _, err := json.Marshal(ReplicaStatus(42)); err == nil {
+		t.Error("unknown status encoded")
+	}
+}
+
+func TestTenantDedupIsolation(t *testing.T) {
+	r := newLonePrimary()
+
+	if err := r.Submit(clientRequest{namespace: "a", clientID: 1, reqNum: 1, reqOp: "x"}); err != nil {
+		t.Fatalf("first request of tenant a rejected: %v", err)
+	}
+	if err := r.Submit(clientRequest{namespace: "b", clientID: 1, reqNum: 1, reqOp: "x"}); err != nil {
+		t.Fatalf("same clientID and reqNum of tenant b rejected as a duplicate of tenant a: %v", err)
+	}
+	if err := r.Submit(clientRequest{namespace: "a", clientID: 1, reqNum: 1, reqOp: "x"}); err != ErrDuplicateRequest {
+		t.Fatalf("duplicate request of tenant a: err = %v", err)
+	}
+
+	r.SetTenantRateLimit("b", 0.001, 1)
+	if err := r.Submit(clientRequest{namespace: "b", clientID: 1, reqNum: 2, reqOp: "x"}); err != nil {
+		t.Fatalf("request within the burst of tenant b rejected: %v", err)
+	}
+	if err := r.Submit(clientRequest{namespace: "b", clientID: 1, reqNum: 3, reqOp: "x"}); err != ErrRateLimited {
+		t.Fatalf("request over the rate limit of tenant b: err = %v", err)
+	}
+
+	ma, _ := r.TenantMetrics("a")
+	mb, _ := r.TenantMetrics("b")
+	if ma.Submitted != 2 || ma.Deduplicated != 1 {
+		t.Errorf("tenant a metrics = %+v", ma)
+	}
+	if mb.Submitted != 3 || mb.RateLimited != 1 || mb.Deduplicated != 0 {
+		t.Errorf("tenant b metrics = %+v", mb)
+	}
+}
+
+func TestNewReplicaValidation(t *testing.T) {
+	tooSlowHeartbeat := DefaultOptions()
+	tooSlowHeartbeat.HeartbeatInterval = tooSlowHeartbeat.ViewChangeTimeout
+
+	tests := []struct {
+		name          string
+		configuration map[int]string
+		opts          Options
+		wantErr       bool
+	}{
+		{"valid", map[int]string{1: "localhost:7001", 2: "localhost:7002"}, DefaultOptions(), false},
+		{"no peers", map[int]string{}, DefaultOptions(), true},
+		{"contains self", map[int]string{0: "localhost:7000", 1: "localhost:7001"}, DefaultOptions(), true},
+		{"shared address", map[int]string{1: "localhost:7001", 2: "localhost:7001"}, DefaultOptions(), true},
+		{"unparsable address", map[int]string{1: "localhost"}, DefaultOptions(), true},
+		{"heartbeat not below timeout", map[int]string{1: "localhost:7001"}, tooSlowHeartbeat, true},
+		{"zero options", map[int]string{1: "localhost:7001"}, Options{}, true},
+	}
+
+	for _, tt := range tests {
+		_, err := NewReplica(0, tt.configuration, nil, make(chan interface{}), nil, tt.opts)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: NewReplica() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestServerRejectsCallsBeforeConfigure(t *testing.T) {
+	s := NewServer(make(chan interface{}), nil)
+	s.Serve()
+	defer s.Shutdown()
+
+	client, err := rpc.Dial("tcp", s.GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	var prepareReply PrepareOKReply
+	if err := client.Call("Replica.Prepare", PrepareArgs{OpNum: 1}, &prepareReply); err == nil || err.Error() != ErrNotConfigured.Error() {
+		t.Errorf("Prepare before Configure: err = %v", err)
+	}
+	var statsReply StatsReply
+	if err := client.Call("Replica.Stats", StatsArgs{}, &statsReply); err == nil || err.Error() != ErrNotConfigured.Error() {
+		t.Errorf("Stats before Configure: err = %v", err)
+	}
+}
+
+func TestPeerIdentityIsBoundToConnection(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Replica 1 identified itself on its connection to 2, so it can't
+	// pass for the primary there.
+	commit := CommitArgs{ViewNum: 0, PrimaryID: 0}
+	if err := h.cluster[1].Call(2, "Replica.Commit", commit, &CommitReply{}); err == nil || err.Error() != ErrPeerIdentity.Error() {
+		t.Errorf("<COMMIT> claiming to come from 0 sent by 1: err = %v", err)
+	}
+	if err := h.cluster[0].Call(2, "Replica.Commit", commit, &CommitReply{}); err != nil {
+		t.Errorf("<COMMIT> sent by 0: err = %v", err)
+	}
+
+	// Nor can a connection without a handshake.
+	client, err := rpc.Dial("tcp", h.cluster[2].GetListenAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Call("Replica.Commit", commit, &CommitReply{}); err == nil || err.Error() != ErrPeerIdentity.Error() {
+		t.Errorf("<COMMIT> without a handshake: err = %v", err)
+	}
+	var reply HandshakeReply
+	if err := client.Call("Replica.Handshake", HandshakeArgs{ReplicaID: 0}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("Replica.Handshake", HandshakeArgs{ReplicaID: 1}, &reply); err == nil {
+		t.Error("connection identified as another replica after its handshake")
+	}
+}
+
+func TestRestartHint(t *testing.T) {
+	r := newLonePrimary()
+	clock := NewManualClock(time.Unix(0, 0))
+	r.clock = clock
+	r.restartHints = make(map[int]time.Time)
+	r.opts.MaxRestartHint = time.Second
+
+	r.recordRestartHint(1, time.Hour)
+	clock.Step(999 * time.Millisecond)
+	if !r.isRestarting(1) {
+		t.Error("replica not restarting within its hint")
+	}
+	clock.Step(2 * time.Millisecond)
+	if r.isRestarting(1) {
+		t.Error("hint not capped by MaxRestartHint")
+	}
+
+	// The backups don't start a view change while the primary restarts.
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	h.cluster[0].replica.HintRestart(0, time.Second)
+	sleepMs(50)
+	h.DisconnectPeer(0)
+	sleepMs(600)
+	for i := 1; i < 3; i++ {
+		if _, viewNum, _, status := h.cluster[i].replica.Report(); viewNum != 0 || status != Normal {
+			t.Errorf("replica %d went to view %d with status %v while the primary restarts", i, viewNum, status)
+		}
+	}
+}
+
+func TestGatewaySubmitAndRedirect(t *testing.T) {
+	r := newLonePrimary()
+	r.opts.SubmitMiddlewares = []SubmitMiddleware{func(next SubmitFunc) SubmitFunc {
+		return func(req SubmitRequest) error {
+			if req.Op == "reject" {
+				return errors.New("rejected")
+			}
+			return next(req)
+		}
+	}}
+	key := []byte("group session key")
+	srv := httptest.NewServer(NewGateway(r, map[int]string{1: "http://primary.example:8080"}, time.Minute, key))
+	defer srv.Close()
+	other := httptest.NewServer(NewGateway(r, nil, time.Minute, key))
+	defer other.Close()
+	stranger := httptest.NewServer(NewGateway(r, nil, time.Minute, nil))
+	defer stranger.Close()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+	post := func(url string, body string, v interface{}) int {
+		resp, err := noRedirect.Post(url, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatalf("POST %s: malformed reply: %v", url, err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	var session gatewaySessionReply
+	if status := post(srv.URL+"/v1/sessions", "", &session); status != http.StatusCreated {
+		t.Fatalf("open session status = %d", status)
+	}
+
+	opsURL := srv.URL + "/v1/sessions/" + session.SessionID + "/ops"
+	var submitted gatewaySubmitReply
+	if status := post(opsURL, `{"req_num": 1, "op": {"incr": 1}}`, &submitted); status != http.StatusAccepted || submitted.ReqNum != 1 {
+		t.Fatalf("submit status = %d, reqNum = %d", status, submitted.ReqNum)
+	}
+	// A retry whose reply was lost is accepted again, but runs once.
+	if status := post(opsURL, `{"req_num": 1, "op": {"incr": 1}}`, &submitted); status != http.StatusAccepted || r.opNum != 1 {
+		t.Fatalf("retried submit status = %d, opNum = %d", status, r.opNum)
+	}
+	if status := post(opsURL, `{"op": 1}`, nil); status != http.StatusBadRequest {
+		t.Fatalf("submit without a request number status = %d", status)
+	}
+
+	resp, err := http.Get(opsURL + "/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result gatewayResultReply
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || result.ReqNum != 1 {
+		t.Fatalf("result status = %d, reply = %+v; err = %v", resp.StatusCode, result, err)
+	}
+
+	// A rejected request doesn't use up its number, and the session
+	// keeps its numbering through another gateway of the group.
+	if status := post(opsURL, `{"req_num": 2, "op": "reject"}`, nil); status != http.StatusServiceUnavailable {
+		t.Fatalf("rejected submit status = %d", status)
+	}
+	otherOpsURL := other.URL + "/v1/sessions/" + session.SessionID + "/ops"
+	if status := post(otherOpsURL, `{"req_num": 2, "op": 2}`, &submitted); status != http.StatusAccepted || submitted.ReqNum != 2 {
+		t.Fatalf("submit through another gateway status = %d, reqNum = %d", status, submitted.ReqNum)
+	}
+	if status := post(otherOpsURL, `{"req_num": 1, "op": 3}`, nil); status != http.StatusConflict {
+		t.Fatalf("submit of an older request status = %d", status)
+	}
+
+	// A session ID the group didn't sign isn't accepted.
+	clientID := session.SessionID[:strings.IndexByte(session.SessionID, '.')]
+	for _, url := range []string{
+		srv.URL + "/v1/sessions/" + clientID + "/ops",
+		srv.URL + "/v1/sessions/" + strconv.Itoa(r.ID+7) + session.SessionID[len(clientID):] + "/ops",
+		stranger.URL + "/v1/sessions/" + session.SessionID + "/ops",
+	} {
+		if status := post(url, `{"req_num": 3, "op": 3}`, nil); status != http.StatusNotFound {
+			t.Errorf("submit to %s status = %d, want 404", url, status)
+		}
+	}
+
+	r.mu.Lock()
+	r.primaryID = 1
+	r.mu.Unlock()
+	resp, err = noRedirect.Post(opsURL, "application/json", strings.NewReader(`{"op": 1}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTemporaryRedirect || resp.Header.Get("Location") != "http://primary.example:8080/v1/sessions/"+session.SessionID+"/ops" {
+		t.Fatalf("non-primary submit status = %d, location = %q", resp.StatusCode, resp.Header.Get("Location"))
+	}
+}
+
+func TestLinkProfiles(t *testing.T) {
+	for _, name := range []string{"lan", "same-region", "cross-region", "lossy-mobile"} {
+		if p, ok := LinkProfileByName(name); !ok || p.Name != name {
+			t.Errorf("LinkProfileByName(%q) = %+v, %v", name, p, ok)
+		}
+	}
+	if _, ok := LinkProfileByName("moon"); ok {
+		t.Error("unknown profile found")
+	}
+
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	stats := func(from, to int) (time.Duration, error) {
+		var reply StatsReply
+		start := time.Now()
+		err := h.cluster[from].Call(to, "Replica.Stats", StatsArgs{}, &reply)
+		return time.Since(start), err
+	}
+
+	h.SetLinkProfile(0, 1, LinkProfile{Name: "slow", Latency: 30 * time.Millisecond})
+	if d, err := stats(0, 1); err != nil || d < 30*time.Millisecond {
+		t.Errorf("call over the slow link took %v; err = %v", d, err)
+	}
+	if d, err := stats(1, 0); err != nil || d >= 30*time.Millisecond {
+		t.Errorf("the profile applies to the reverse link: took %v; err = %v", d, err)
+	}
+
+	h.SetLinkProfile(0, 2, LinkProfile{Name: "cut", Loss: 1})
+	if _, err := stats(0, 2); err == nil {
+		t.Error("call over a link losing every message succeeded")
+	}
+	h.cluster[0].ClearLinkProfile(2)
+	if _, err := stats(0, 2); err != nil {
+		t.Errorf("call after clearing the profile: err = %v", err)
+	}
+}
+
+func TestPreVoteKeepsFlakyBackupOut(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	sleepMs(100)
+
+	// Backup 2 stops hearing from the primary, backup 1 doesn't.
+	h.SetLinkProfile(0, 2, LinkProfile{Name: "cut", Loss: 1})
+	sleepMs(500)
+
+	for i := 0; i < 3; i++ {
+		_, viewNum, isPrimary, status := h.cluster[i].Replica().Report()
+		if viewNum != 0 || status != Normal || isPrimary != (i == 0) {
+			t.Errorf("replica %d: viewNum=%d status=%v primary=%v, want the view 0 of primary 0 kept", i, viewNum, status, isPrimary)
+		}
+	}
+}
+
+type staticDetector map[int]PeerHealth
+
+func (d staticDetector) PeerHealth(peerID int) PeerHealth {
+	return d[peerID]
+}
+
+func TestFailureDetector(t *testing.T) {
+	r := newLonePrimary()
+	r.ID, r.primaryID = 1, 0
+	r.opts = DefaultOptions()
+	detector := staticDetector{}
+	r.opts.FailureDetector = detector
+	r.viewChangeResetEvent = r.clock.Now()
+
+	agrees := func() bool {
+		var reply PreVoteReply
+		if err := r.PreVote(PreVoteArgs{ViewNum: 0, ReplicaID: 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply.Agree
+	}
+
+	timeout := r.opts.ViewChangeTimeout
+	if agrees() || r.detectedTimeout(timeout) != timeout {
+		t.Fatal("backup which just heard from the primary agrees to a view change")
+	}
+	detector[0] = PeerDead
+	if !agrees() || r.detectedTimeout(timeout) >= timeout {
+		t.Error("backup doesn't act on the primary reported dead")
+	}
+	detector[0] = PeerAlive
+	r.viewChangeResetEvent = r.clock.Now().Add(-2 * timeout)
+	if agrees() || r.detectedTimeout(timeout) <= timeout {
+		t.Error("backup doesn't wait longer on the primary reported alive")
+	}
+	r.viewChangeResetEvent = r.clock.Now().Add(-alivePrimaryTimeoutFactor * timeout)
+	if !agrees() {
+		t.Error("backup waits forever on the primary reported alive")
+	}
+}
+
+func TestViewChangeBackoff(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 2
+	r.configuration = map[int]string{0: "", 1: "", 3: ""}
+	r.opts = DefaultOptions()
+	base := r.opts.ViewChangeTimeout
+
+	r.failedViewChanges = 3
+	if timeout := r.viewChangeTimeout(); timeout < 8*base || timeout >= 16*base {
+		t.Errorf("timeout after 3 failed view changes = %v, want within [%v, %v)", timeout, 8*base, 16*base)
+	}
+	r.failedViewChanges = 100
+	if timeout := r.viewChangeTimeout(); timeout >= 2*maxViewChangeBackoff {
+		t.Errorf("timeout = %v beyond the backoff bound", timeout)
+	}
+
+	// Candidates take turns, skipping the ones reported dead.
+	if primaryID := r.primaryOfView(5); primaryID != 1 {
+		t.Errorf("primary of view 5 = %d, want 1", primaryID)
+	}
+	r.opts.FailureDetector = staticDetector{1: PeerDead, 2: PeerDead}
+	if primaryID := r.primaryOfView(5); primaryID != 2 {
+		t.Errorf("primary of view 5 with replica 1 dead = %d, want 2", primaryID)
+	}
+}
+
+func TestPrimaryOfNonContiguousIDs(t *testing.T) {
+	// The replicas 3, 7 and 12 agree on the primaries, whatever their
+	// configurations.
+	configurations := map[int]map[int]string{
+		3:  {12: "127.0.0.1:7012", 7: "127.0.0.1:7007"},
+		7:  {3: "127.0.0.1:7003", 12: "127.0.0.1:7012"},
+		12: {7: "127.0.0.1:7007", 3: "127.0.0.1:7003"},
+	}
+	for id, configuration := range configurations {
+		r := newLonePrimary()
+		r.ID = id
+		r.opts = DefaultOptions()
+		r.setConfiguration(configuration)
+		for viewNum, want := range []int{3, 7, 12, 3, 7} {
+			if primaryID := r.primaryOfView(viewNum); primaryID != want {
+				t.Errorf("replica %d: primary of view %d = %d, want %d", id, viewNum, primaryID, want)
+			}
+		}
+
+		// A peer of the epoch with other members is refused on the
+		// handshake, one of another epoch isn't.
+		if err := r.checkMembership(0, []int{3, 7, 12}); err != nil {
+			t.Errorf("replica %d refused the same members: %v", id, err)
+		}
+		if err := r.checkMembership(0, []int{0, 1, 2}); !errors.Is(err, ErrMembershipMismatch) {
+			t.Errorf("replica %d: other members: err = %v", id, err)
+		}
+		if err := r.checkMembership(1, []int{3, 7}); err != nil {
+			t.Errorf("replica %d refused a member of another epoch: %v", id, err)
+		}
+	}
+}
+
+func TestQuorumCountsMembersOnly(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 3
+	r.opts = DefaultOptions()
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	r.setConfiguration(map[int]string{7: "127.0.0.1:7007", 12: "127.0.0.1:7012"})
+	r.opLog = []opLogEntry{{opID: 0, clientID: 1, reqNum: 1, operation: "a"}}
+	r.opNum = 1
+
+	// A replica a reconfiguration removed doesn't complete the quorum.
+	r.ackPrepare(40, 1)
+	if r.commitNum != 0 {
+		t.Fatalf("committed on the ack of a non-member; commitNum = %d", r.commitNum)
+	}
+	r.ackPrepare(12, 1)
+	if r.commitNum != 1 {
+		t.Errorf("commitNum = %d after the ack of a member, want 1", r.commitNum)
+	}
+}
+
+func TestUnreachableCandidateSkipped(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 2
+	r.opts = DefaultOptions()
+	r.configuration = map[int]string{0: "127.0.0.1:7000", 1: "127.0.0.1:7001"}
+
+	r.server.notePeerReached(1, errors.New("connection refused"))
+	if primaryID := r.primaryOfView(1); primaryID != 1 {
+		t.Errorf("primary of view 1 after a failed call to 1 = %d, want 1", primaryID)
+	}
+	r.server.notePeerReached(1, errors.New("connection refused"))
+	if primaryID := r.primaryOfView(1); primaryID != 2 {
+		t.Errorf("primary of view 1 with 1 unreachable = %d, want 2", primaryID)
+	}
+
+	// A peer replying with an error is reachable, and the failure detector
+	// has the last word.
+	r.server.notePeerReached(1, ErrStaleView)
+	if primaryID := r.primaryOfView(1); primaryID != 1 {
+		t.Errorf("primary of view 1 once 1 replied = %d, want 1", primaryID)
+	}
+	r.server.notePeerReached(1, errors.New("connection refused"))
+	r.server.notePeerReached(1, errors.New("connection refused"))
+	r.opts.FailureDetector = staticDetector{1: PeerAlive}
+	if primaryID := r.primaryOfView(1); primaryID != 1 {
+		t.Errorf("primary of view 1 reported alive = %d, want 1", primaryID)
+	}
+}
+
+func TestPartitionedPrimaryStepsDown(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	sleepMs(100)
+
+	h.DisconnectPeer(0)
+	sleepMs(400)
+
+	r := h.cluster[0].Replica()
+	if err := r.Submit(clientRequest{clientID: 1, reqNum: 1, reqOp: "x"}); err != ErrNotNormal {
+		t.Errorf("partitioned primary accepted a request: err = %v", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == Normal || r.viewNum == 0 {
+		t.Errorf("partitioned primary still status=%v in view %d", r.status, r.viewNum)
+	}
+}
+
+func TestViewChangeLivelock(t *testing.T) {
+	r := newLonePrimary()
+	r.opts = DefaultOptions()
+	r.opts.ViewChangeTimeout = time.Minute
+	r.events = make(chan Event, 32)
+	defer func() {
+		r.mu.Lock()
+		r.status = Dead
+		r.mu.Unlock()
+	}()
+
+	// Replica 2 supersedes every view change of the replica.
+	for round := 1; round <= livelockRounds; round++ {
+		r.mu.Lock()
+		r.initiateViewChange()
+		viewNum := r.viewNum
+		r.mu.Unlock()
+		if err := r.StartViewChange(StartViewChangeArgs{ViewNum: viewNum + 1, ReplicaID: 2}, &StartViewChangeReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var livelock *ViewChangeLivelockEvidence
+	for len(r.events) > 0 {
+		if e := <-r.Events(); e.Kind == EventViewChangeLivelock {
+			evidence := e.Evidence.(ViewChangeLivelockEvidence)
+			livelock = &evidence
+		}
+	}
+	if livelock == nil || livelock.LostRounds != livelockRounds || livelock.RivalID != 2 || livelock.ViewNum != 2*livelockRounds {
+		t.Fatalf("livelock evidence = %+v", livelock)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.viewChangeExtraDelay <= 0 {
+		t.Error("no extra delay after losing the view changes")
+	}
+	r.setStatus(Normal)
+	if r.lostViewChanges != 0 || r.viewChangeExtraDelay != 0 {
+		t.Errorf("lost rounds = %d, extra delay = %v once the view started", r.lostViewChanges, r.viewChangeExtraDelay)
+	}
+}
+
+func TestSplitBrainDetection(t *testing.T) {
+	r := newLonePrimary()
+	r.opts = DefaultOptions()
+	r.primarySightings = make(map[int]primarySighting)
+	r.events = make(chan Event, 2)
+
+	r.observePrimary(3, 1, 1)
+	r.observePrimary(3, 1, 2)
+	r.observePrimary(4, 2, 2)
+	// A backup lagging in view 3 doesn't make its primary active.
+	r.observePrimary(3, 1, 0)
+	select {
+	case e := <-r.Events():
+		t.Fatalf("unexpected event %+v", e)
+	default:
+	}
+
+	nextSplitBrain := func() SplitBrainEvidence {
+		select {
+		case e := <-r.Events():
+			if e.Kind != EventSplitBrain {
+				t.Fatalf("unexpected event %+v", e)
+			}
+			return e.Evidence.(SplitBrainEvidence)
+		default:
+			t.Fatal("split brain not detected")
+			return SplitBrainEvidence{}
+		}
+	}
+
+	// Primary 0 of view 3 is active at once with primary 1 of the same view,
+	// and after primary 2 of view 4 took over.
+	r.observePrimary(3, 0, 0)
+	if evidence := nextSplitBrain(); evidence.ViewNum != 3 || evidence.First.PrimaryID != 1 || evidence.Second.PrimaryID != 0 {
+		t.Fatalf("unexpected evidence %+v", evidence)
+	}
+	if evidence := nextSplitBrain(); evidence.ViewNum != 3 || evidence.First.ViewNum != 4 || evidence.First.PrimaryID != 2 || evidence.Second.PrimaryID != 0 {
+		t.Fatalf("unexpected evidence %+v", evidence)
+	}
+}
+
+func TestHeartbeatsBypassSaturatedDataPlane(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	s := h.cluster[0]
+	slots := make(chan struct{}, maxInFlightDataMessages)
+	for i := 0; i < maxInFlightDataMessages; i++ {
+		slots <- struct{}{}
+	}
+	s.mu.Lock()
+	s.dataSlots[1] = slots
+	s.mu.Unlock()
+
+	call := func(method string, args interface{}, reply interface{}) <-chan error {
+		done := make(chan error, 1)
+		go func() { done <- s.Call(1, method, args, reply) }()
+		return done
+	}
+
+	select {
+	case err := <-call("Replica.Commit", CommitArgs{PrimaryID: 0}, &CommitReply{}):
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("<COMMIT> queued behind the saturated data plane")
+	}
+
+	prepared := call("Replica.Prepare", PrepareArgs{PrimaryID: 0, OpNum: 1, ClientMessage: clientRequest{clientID: 1, reqNum: 1}}, &PrepareOKReply{})
+	select {
+	case <-prepared:
+		t.Fatal("<PREPARE> sent over the saturated data plane")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-slots
+	if err := <-prepared; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStartViewChangeAcksNeeded(t *testing.T) {
+	tests := []struct {
+		clusterSize int
+		f           int
+		wantF       int
+		wantAcks    int
+		wantErr     bool
+	}{
+		{clusterSize: 3, wantF: 1, wantAcks: 1},
+		{clusterSize: 5, wantF: 2, wantAcks: 2},
+		{clusterSize: 7, wantF: 3, wantAcks: 3},
+		// Even clusters still need a strict majority.
+		{clusterSize: 4, wantF: 1, wantAcks: 2},
+		// Tolerating less failures than possible needs more acks.
+		{clusterSize: 7, f: 1, wantF: 1, wantAcks: 5},
+		{clusterSize: 5, f: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		configuration := make(map[int]string)
+		for i := 1; i < tt.clusterSize; i++ {
+			configuration[i] = "localhost:" + strconv.Itoa(7000+i)
+		}
+		opts := DefaultOptions()
+		opts.FailureThreshold = tt.f
+
+		r, err := NewReplica(0, configuration, nil, make(chan interface{}), nil, opts)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("n=%d f=%d: expected an error", tt.clusterSize, tt.f)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("n=%d f=%d: %v", tt.clusterSize, tt.f, err)
+		}
+		if got := r.failureThreshold(); got != tt.wantF {
+			t.Errorf("n=%d f=%d: failureThreshold() = %d, want %d", tt.clusterSize, tt.f, got, tt.wantF)
+		}
+		if got := r.startViewChangeAcksNeeded(); got != tt.wantAcks {
+			t.Errorf("n=%d f=%d: startViewChangeAcksNeeded() = %d, want %d", tt.clusterSize, tt.f, got, tt.wantAcks)
+		}
+	}
+}
+
+func TestConfiguredFailureThresholdQuorums(t *testing.T) {
+	// With f=1, a group of 5 replicas needs 4 of them to take any step,
+	// where the derived f=2 only needs 3.
+	newGroup := func(f int) *EmbeddedGroup {
+		opts := DefaultOptions()
+		opts.FailureThreshold = f
+		g, err := NewEmbeddedGroup(5, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for range g.Commits() {
+			}
+		}()
+		return g
+	}
+	cut := LinkProfile{Name: "cut", Loss: 1}
+	isolate := func(g *EmbeddedGroup, ID int) {
+		for j := range g.servers {
+			if j != ID {
+				g.servers[ID].SetLinkProfile(j, cut)
+				g.servers[j].SetLinkProfile(ID, cut)
+			}
+		}
+	}
+
+	for _, tt := range []struct {
+		f          int
+		wantCommit bool
+	}{{f: 0, wantCommit: true}, {f: 1, wantCommit: false}} {
+		g := newGroup(tt.f)
+		g.servers[0].SetLinkProfile(3, cut)
+		g.servers[0].SetLinkProfile(4, cut)
+		if err := g.Submit(DefaultNamespace, 1, 1, "op"); err != nil {
+			t.Fatal(err)
+		}
+		sleepMs(50)
+		if committed := g.Replica(0).CommitNum() == 1; committed != tt.wantCommit {
+			t.Errorf("f=%d: committed with 3 replicas = %v", tt.f, committed)
+		}
+		g.Shutdown()
+	}
+
+	for _, tt := range []struct {
+		f              int
+		wantViewChange bool
+	}{{f: 0, wantViewChange: true}, {f: 1, wantViewChange: false}} {
+		g := newGroup(tt.f)
+		isolate(g, 0)
+		isolate(g, 4)
+		// A replica starts a new view once it has a quorum of
+		// <DO-VIEW-CHANGE>s: replica 1, or the next ones should its view
+		// change take too long.
+		viewChanged := false
+		deadline := time.Now().Add(time.Second)
+		for !viewChanged && time.Now().Before(deadline) {
+			for i := 1; i <= 3; i++ {
+				if _, viewNum, isPrimary, status := g.Replica(i).Report(); isPrimary && viewNum > 0 && status == Normal {
+					viewChanged = true
+				}
+			}
+			sleepMs(10)
+		}
+		if viewChanged != tt.wantViewChange {
+			t.Errorf("f=%d: view changed with 3 replicas = %v", tt.f, viewChanged)
+		}
+		g.Shutdown()
+	}
+}
+
+func TestOperationCompression(t *testing.T) {
+	large := strings.Repeat("vrr", 1000)
+
+	stored := encodeOp(large, 1024)
+	if _, ok := stored.(compressedOp); !ok {
+		t.Fatalf("large string stored as %T, want compressed", stored)
+	}
+	if got := (opLogEntry{operation: stored}).op(); got != large {
+		t.Fatalf("decoded operation differs from the original one")
+	}
+
+	if stored := encodeOp("small", 1024); stored != "small" {
+		t.Fatalf("small string stored as %v", stored)
+	}
+	if stored := encodeOp(large, 0); stored != large {
+		t.Fatalf("operation compressed with compression disabled")
+	}
+
+	r := newLonePrimary()
+	r.opts.CompressionThreshold = 1024
+	if err := r.Submit(clientRequest{clientID: 1, reqNum: 1, reqOp: large}); err != nil {
+		t.Fatal(err)
+	}
+	entry, _ := r.clientTableEntry(DefaultNamespace, 1)
+	if _, ok := entry.reqOp.(compressedOp); !ok {
+		t.Fatalf("large string kept in the clientTable as %T, want compressed", entry.reqOp)
+	}
+}
+
+// counter is a StateMachine adding up the int operations.
+type counter struct {
+	sum int
+}
+
+func (c *counter) Apply(op interface{}) (interface{}, error) {
+	c.sum += op.(int)
+	return c.sum, nil
+}
+
+func TestStateMachineApply(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	sm := &counter{}
+	r.opts.StateMachine = sm
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	go r.commitChanSender()
+	defer r.Stop()
+
+	// There's no commit channel, the state machine is enough.
+	for opNum := 1; opNum <= 4; opNum++ {
+		var reply PrepareOKReply
+		args := PrepareArgs{OpNum: opNum, CommitNum: opNum - 1, ClientMessage: clientRequest{clientID: opNum % 2, reqNum: (opNum + 1) / 2, reqOp: opNum}}
+		if err := r.Prepare(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sleepMs(10)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sm.sum != 6 || r.appliedNum != 3 {
+		t.Fatalf("sum=%d appliedNum=%d, want 6 and 3", sm.sum, r.appliedNum)
+	}
+	// Client 1 sent operations 1 and 3, client 0 operations 2 and 4.
+	if entry := r.tenantFor(DefaultNamespace).clientTable[1]; !entry.replied || entry.resp != 6 {
+		t.Errorf("clientTable entry of client 1 = %+v", entry)
+	}
+	if entry := r.tenantFor(DefaultNamespace).clientTable[0]; entry.replied {
+		t.Errorf("response recorded for the uncommitted request of client 0: %+v", entry)
+	}
+}
+
+// snapshottingCounter is a counter which can be checkpointed.
+type snapshottingCounter struct {
+	counter
+}
+
+func (c *snapshottingCounter) Snapshot() ([]byte, error) {
+	return []byte(strconv.Itoa(c.sum)), nil
+}
+
+func (c *snapshottingCounter) Restore(snapshot []byte) error {
+	sum, err := strconv.Atoi(string(snapshot))
+	c.sum = sum
+	return err
+}
+
+func TestSnapshotCompaction(t *testing.T) {
+	storage := NewMemoryStorage()
+	newBackup := func(sm StateMachine) *Replica {
+		r := newTestBackup(storage, sm)
+		r.opts.SnapshotInterval = 2
+		go r.commitChanSender()
+		return r
+	}
+	r := newBackup(&snapshottingCounter{})
+	for opNum := 1; opNum <= 6; opNum++ {
+		args := PrepareArgs{OpNum: opNum, CommitNum: opNum - 1, ClientMessage: clientRequest{clientID: 1, reqNum: opNum, reqOp: opNum}}
+		if err := r.Prepare(args, &PrepareOKReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sleepMs(10)
+
+	// The opLog is only compacted up to what every member holds.
+	if err := r.Commit(CommitArgs{CommitNum: 5, CompactNum: 3}, &CommitReply{}); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	if r.snapshotNum != 4 || r.logStart != 3 || len(r.opLog) != 3 {
+		t.Errorf("snapshotNum=%d logStart=%d entries=%d, want 4, 3 and 3", r.snapshotNum, r.logStart, len(r.opLog))
+	}
+	r.mu.Unlock()
+	if _, err := r.CommittedEntries(3, 5); !errors.Is(err, ErrCompacted) {
+		t.Errorf("reading compacted entries: err = %v", err)
+	}
+	if entries, err := r.CommittedEntries(4, 5); err != nil || len(entries) != 2 || entries[1].Op != 5 {
+		t.Errorf("CommittedEntries(4, 5) = %+v, %v", entries, err)
+	}
+	r.Stop()
+
+	// A replica created on the storage restores the snapshot, and applies
+	// the committed operation following it.
+	sm := &snapshottingCounter{}
+	restored := newBackup(sm)
+	defer restored.Stop()
+	restored.mu.Lock()
+	err := restored.restore()
+	restored.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(10)
+	restored.mu.Lock()
+	if sm.sum != 15 || restored.appliedNum != 5 || restored.opNum != 6 || restored.logStart != 3 {
+		t.Errorf("restored sum=%d appliedNum=%d opNum=%d logStart=%d, want 15, 5, 6 and 3", sm.sum, restored.appliedNum, restored.opNum, restored.logStart)
+	}
+	restored.mu.Unlock()
+	if e, ok := restored.clientTableEntry("", 1); !ok || e.reqNum != 6 {
+		t.Errorf("restored client entry = %+v, %v", e, ok)
+	}
+}
+
+// positiveCounter is a counter failing to apply the negative operations.
+type positiveCounter struct {
+	counter
+}
+
+func (c *positiveCounter) Apply(op interface{}) (interface{}, error) {
+	if op.(int) < 0 {
+		return nil, fmt.Errorf("%d is negative", op)
+	}
+	return c.counter.Apply(op)
+}
+
+func TestApplyErrors(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	sms := make([]*positiveCounter, 3)
+	for i := range sms {
+		sms[i] = &positiveCounter{}
+		r := h.cluster[i].Replica()
+		r.mu.Lock()
+		r.opts.StateMachine = sms[i]
+		r.mu.Unlock()
+	}
+
+	c := h.NewClient(1)
+	defer c.Close()
+	for _, tt := range []struct {
+		op   int
+		resp interface{}
+		err  error
+	}{
+		{1, 1, nil},
+		{-1, nil, ApplyError{Msg: "-1 is negative"}},
+		{2, 3, nil},
+	} {
+		if _, err := c.Submit(tt.op, 10); err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := c.Result(20); resp != tt.resp || err != tt.err {
+			t.Errorf("Result() of %d = %v, %v, want %v, %v", tt.op, resp, err, tt.resp, tt.err)
+		}
+	}
+
+	// The failed operation kept its slot and didn't stop the replication.
+	sleepMs(150)
+	for i, c := range h.CheckCommittedN(3) {
+		if want := []interface{}{1, ApplyError{Msg: "-1 is negative"}, 3}[i]; c.Resp != want {
+			t.Errorf("commit %d has response %v, want %v", i+1, c.Resp, want)
+		}
+	}
+	for i, sm := range sms {
+		h.cluster[i].Replica().mu.Lock()
+		if sm.sum != 3 {
+			t.Errorf("replica %d sum = %d, want 3", i, sm.sum)
+		}
+		h.cluster[i].Replica().mu.Unlock()
+	}
+}
+
+// hashingCounter is a counter implementing StateHasher, whose Apply
+// multiplies the operations by factor.
+type hashingCounter struct {
+	counter
+	factor int
+}
+
+func (c *hashingCounter) Apply(op interface{}) (interface{}, error) {
+	return c.counter.Apply(op.(int) * c.factor)
+}
+
+func (c *hashingCounter) Hash() []byte {
+	return []byte(strconv.Itoa(c.sum))
+}
+
+func TestDeterminismChecker(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// The state machine of replica 2 isn't the same as the others'.
+	for i := 0; i < 3; i++ {
+		r := h.cluster[i].Replica()
+		r.mu.Lock()
+		r.opts.StateMachine = &hashingCounter{factor: 1 + i/2}
+		r.opts.DeterminismCheckInterval = 2
+		r.mu.Unlock()
+	}
+	for i := 1; i <= 2; i++ {
+		if !h.SubmitToReplica(0, 1, i, i) {
+			t.Fatalf("request %d not accepted", i)
+		}
+	}
+
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-h.cluster[0].Replica().Events():
+			if e.Kind != EventNondeterminism {
+				continue
+			}
+			if evidence := e.Evidence.(NondeterminismEvidence); evidence.OpNum != 2 || evidence.PeerID != 2 {
+				t.Fatalf("nondeterminism evidence = %+v", evidence)
+			}
+			return
+		case <-timeout:
+			t.Fatal("no nondeterminism detected")
+		}
+	}
+}
+
+func TestStateHashesOnCommit(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// The <STATE-HASH>es are lost, the hashes on <COMMIT> still get through.
+	divergences := make(chan NondeterminismEvidence, 8)
+	for i := 0; i < 3; i++ {
+		h.InterceptInbound(i, func(next InboundHandler) InboundHandler {
+			return func(call InboundCall) error {
+				if call.Method == "StateHash" {
+					return nil
+				}
+				return next(call)
+			}
+		})
+		r := h.cluster[i].Replica()
+		r.mu.Lock()
+		r.opts.StateMachine = &hashingCounter{factor: 1 + i/2}
+		r.opts.DeterminismCheckInterval = 2
+		if i == 0 {
+			r.opts.OnDivergence = func(evidence NondeterminismEvidence) { divergences <- evidence }
+		}
+		r.mu.Unlock()
+	}
+	for i := 1; i <= 2; i++ {
+		if !h.SubmitToReplica(0, 1, i, i) {
+			t.Fatalf("request %d not accepted", i)
+		}
+	}
+
+	select {
+	case evidence := <-divergences:
+		if evidence.OpNum != 2 || evidence.PeerID != 2 {
+			t.Fatalf("divergence evidence = %+v", evidence)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no divergence detected")
+	}
+
+	// The next heartbeats don't report it again.
+	sleepMs(200)
+	if n := h.cluster[0].Replica().LocalStats().Divergences; n != 1 {
+		t.Errorf("primary counted %d divergences, want 1", n)
+	}
+}
+
+// resettingCounter is a hashingCounter whose factor is only wrong until it
+// is reset, as if its state had been corrupted.
+type resettingCounter struct {
+	hashingCounter
+}
+
+func (c *resettingCounter) Reset() {
+	c.sum = 0
+	c.factor = 1
+}
+
+func TestResyncDivergedStateMachine(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	for i := 0; i < 3; i++ {
+		r := h.cluster[i].Replica()
+		r.mu.Lock()
+		r.opts.StateMachine = &hashingCounter{factor: 1}
+		if i == 2 {
+			r.opts.StateMachine = &resettingCounter{hashingCounter{factor: 2}}
+		}
+		r.opts.DeterminismCheckInterval = 2
+		r.mu.Unlock()
+	}
+	commits, unsubscribe := h.cluster[2].Replica().Subscribe(CommitFilter{}, 16)
+	defer unsubscribe()
+	for i := 1; i <= 2; i++ {
+		if !h.SubmitToReplica(0, 1, i, i) {
+			t.Fatalf("request %d not accepted", i)
+		}
+	}
+
+	// The backup applies opNum=2 wrongly, then again once it resynced.
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case entry := <-commits:
+			if entry.OpNum != 2 || entry.Resp != 3 {
+				continue
+			}
+			if n := h.cluster[2].Replica().LocalStats().Resyncs; n != 1 {
+				t.Errorf("backup resynced %d times, want 1", n)
+			}
+			return
+		case <-timeout:
+			t.Fatal("diverged backup didn't resync")
+		}
+	}
+}
+
+// applyCounter counts how many times each operation was applied since it
+// was last reset.
+type applyCounter struct {
+	mu      sync.Mutex
+	applied map[interface{}]int
+}
+
+func (c *applyCounter) Apply(op interface{}) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.applied == nil {
+		c.applied = make(map[interface{}]int)
+	}
+	c.applied[op]++
+	return nil, nil
+}
+
+func (c *applyCounter) Reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied = nil
+}
+
+// counts returns how many times each operation was applied.
+func (c *applyCounter) counts() map[interface{}]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	counts := make(map[interface{}]int)
+	for op, n := range c.applied {
+		counts[op] = n
+	}
+	return counts
+}
+
+func TestHealedViolationAppliesOnce(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	sm := &applyCounter{}
+	backup := h.cluster[2].Replica()
+	backup.mu.Lock()
+	backup.opts.StateMachine = sm
+	backup.mu.Unlock()
+	for i := 1; i <= 3; i++ {
+		if !h.SubmitToReplica(0, 1, i, i) {
+			t.Fatalf("request %d not accepted", i)
+		}
+	}
+	waitApplied := func(when string) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			backup.mu.Lock()
+			status, appliedNum := backup.status, backup.appliedNum
+			backup.mu.Unlock()
+			if status == Normal && appliedNum == 3 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("backup status=%v appliedNum=%d %s", status, appliedNum, when)
+			}
+			sleepMs(10)
+		}
+	}
+	waitApplied("before the violation")
+
+	backup.mu.Lock()
+	backup.violateInvariant("test", "healed by recovering the state")
+	backup.mu.Unlock()
+	waitApplied("after healing")
+	for i := 1; i <= 3; i++ {
+		if n := sm.counts()[i]; n != 1 {
+			t.Errorf("op %d applied %d times since the reset, want 1", i, n)
+		}
+	}
+
+	// A state machine which can't be reset isn't healed, the replica stops.
+	other := h.cluster[1].Replica()
+	other.mu.Lock()
+	other.opts.StateMachine = &counter{}
+	other.violateInvariant("test", "can't be healed")
+	status := other.status
+	other.mu.Unlock()
+	if status != Dead {
+		t.Errorf("unhealable replica status=%v, want Dead", status)
+	}
+	select {
+	case e := <-other.Errors():
+		if e.Kind != FailureInvariant {
+			t.Errorf("reported a %v failure", e.Kind)
+		}
+	default:
+		t.Error("no failure reported")
+	}
+}
+
+func TestDecodedCache(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.opts.CompressionThreshold = 16
+	r.opts.DecodedCacheBytes = 1000
+	commitChan := make(chan CommitEntry)
+	r.commitChan = commitChan
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	go r.commitChanSender()
+	defer r.Stop()
+
+	// Only the first operation fits in the cache.
+	ops := []string{strings.Repeat("a", 600), strings.Repeat("b", 600), strings.Repeat("c", 600)}
+	for i, op := range ops {
+		var reply PrepareOKReply
+		args := PrepareArgs{OpNum: i + 1, CommitNum: i, ClientMessage: clientRequest{clientID: 1, reqNum: i + 1, reqOp: op}}
+		if err := r.Prepare(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if entry := <-commitChan; entry.ClientReq.reqOp != ops[i] {
+			t.Errorf("commit %d = %.10v", i+1, entry.ClientReq.reqOp)
+		}
+	}
+
+	sleepMs(10)
+	if stats := r.LocalStats(); stats.DecodeCacheHitRate != 0.5 {
+		t.Errorf("hit rate = %v, want 0.5", stats.DecodeCacheHitRate)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.decodedCacheBytes != 0 || r.opLog[0].decoded != nil {
+		t.Errorf("%d bytes still cached once the cached operation is applied", r.decodedCacheBytes)
+	}
+}
+
+func TestSubscribeFilters(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	go r.commitChanSender()
+	defer r.Stop()
+
+	writes, cancelWrites := r.Subscribe(CommitFilter{Namespaces: []string{"a"}, OpTypes: []interface{}{""}}, 4)
+	defer cancelWrites()
+	counts, cancelCounts := r.Subscribe(CommitFilter{OpTypes: []interface{}{0}}, 4)
+	defer cancelCounts()
+
+	reqs := []clientRequest{
+		{namespace: "a", clientID: 1, reqNum: 1, reqOp: "x"},
+		{namespace: "a", clientID: 1, reqNum: 2, reqOp: 1},
+		{namespace: "b", clientID: 1, reqNum: 1, reqOp: "y"},
+		{namespace: "b", clientID: 1, reqNum: 2, reqOp: 2},
+	}
+	for i, req := range reqs {
+		var reply PrepareOKReply
+		if err := r.Prepare(PrepareArgs{OpNum: i + 1, CommitNum: i, ClientMessage: req}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.mu.Lock()
+	r.commitNum = len(reqs)
+	r.notifyCommitReady()
+	r.mu.Unlock()
+
+	if entry := <-writes; entry.OpNum != 1 {
+		t.Errorf("writes of tenant a got opNum=%d, want 1", entry.OpNum)
+	}
+	for _, want := range []int{2, 4} {
+		if entry := <-counts; entry.OpNum != want {
+			t.Errorf("counts got opNum=%d, want %d", entry.OpNum, want)
+		}
+	}
+	sleepMs(10)
+	select {
+	case entry := <-writes:
+		t.Errorf("writes of tenant a got opNum=%d", entry.OpNum)
+	default:
+	}
+}
+
+func TestSubscribeFromReplays(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.opts.ReplayBufferSize = 2
+	r.opts.StateMachine = &counter{}
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	go r.commitChanSender()
+	defer r.Stop()
+
+	live, cancelLive := r.Subscribe(CommitFilter{}, 8)
+	defer cancelLive()
+	for i := 1; i <= 4; i++ {
+		var reply PrepareOKReply
+		req := clientRequest{clientID: 1, reqNum: i, reqOp: i}
+		if err := r.Prepare(PrepareArgs{OpNum: i, CommitNum: i - 1, ClientMessage: req}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.mu.Lock()
+	r.commitNum = 4
+	r.notifyCommitReady()
+	r.mu.Unlock()
+	for i := 1; i <= 4; i++ {
+		<-live
+	}
+
+	// opNum 3 and 4 are buffered, with their response.
+	buffered, cancelBuffered := r.SubscribeFrom(CommitFilter{}, 8, 3)
+	defer cancelBuffered()
+	for _, want := range []int{3, 4} {
+		if entry := <-buffered; entry.OpNum != want || entry.Resp == nil {
+			t.Errorf("buffered replay got opNum=%d resp=%v, want opNum=%d with a response", entry.OpNum, entry.Resp, want)
+		}
+	}
+
+	// opNum 1 isn't, it is replayed from the opLog.
+	replayed, cancelReplayed := r.SubscribeFrom(CommitFilter{}, 8, 1)
+	defer cancelReplayed()
+	for _, want := range []int{1, 2, 3, 4} {
+		if entry := <-replayed; entry.OpNum != want {
+			t.Errorf("replay from the opLog got opNum=%d, want %d", entry.OpNum, want)
+		}
+	}
+
+	// Then the subscribers receive the new operations.
+	var reply PrepareOKReply
+	req := clientRequest{clientID: 1, reqNum: 5, reqOp: 5}
+	if err := r.Prepare(PrepareArgs{OpNum: 5, CommitNum: 4, ClientMessage: req}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.commitNum = 5
+	r.notifyCommitReady()
+	r.mu.Unlock()
+	for _, ch := range []<-chan CommitEntry{live, buffered, replayed} {
+		if entry := <-ch; entry.OpNum != 5 {
+			t.Errorf("got opNum=%d after the replay, want 5", entry.OpNum)
+		}
+	}
+}
+
+func TestWatchResumes(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.opts.ReplayBufferSize = 2
+	r.opts.StateMachine = &counter{}
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	go r.commitChanSender()
+	defer r.Stop()
+
+	even := CommitFilter{Predicate: func(entry CommitEntry) bool { return entry.ClientReq.reqOp.(int)%2 == 0 }}
+	events, cancel, err := r.Watch(even, "", 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		var reply PrepareOKReply
+		req := clientRequest{clientID: 1, reqNum: i, reqOp: i}
+		if err := r.Prepare(PrepareArgs{OpNum: i, CommitNum: i - 1, ClientMessage: req}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.mu.Lock()
+	r.commitNum = 4
+	r.notifyCommitReady()
+	r.mu.Unlock()
+	var tokens []ResumeToken
+	for _, want := range []int{2, 4} {
+		event := <-events
+		if event.OpNum != want {
+			t.Errorf("watch got opNum=%d, want %d", event.OpNum, want)
+		}
+		tokens = append(tokens, event.Token)
+	}
+	cancel()
+	if _, ok := <-events; ok {
+		t.Error("events channel open after the cancellation")
+	}
+
+	// Resuming after opNum 2 receives opNum 4 again, from the opLog.
+	resumed, cancelResumed, err := r.Watch(even, tokens[0], 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cancelResumed()
+	if event := <-resumed; event.OpNum != 4 || event.Token != tokens[1] {
+		t.Errorf("resumed watch got opNum=%d token=%q, want opNum=4 token=%q", event.OpNum, event.Token, tokens[1])
+	}
+
+	if _, _, err := r.Watch(even, "7:1", 8); err != ErrInvalidToken {
+		t.Errorf("Watch with the token of another epoch: err = %v, want ErrInvalidToken", err)
+	}
+	r.mu.Lock()
+	r.opLog = r.opLog[2:]
+	r.logStart = 2
+	r.mu.Unlock()
+	if _, _, err := r.Watch(even, newResumeToken(0, 1), 8); err != ErrCompacted {
+		t.Errorf("Watch from a compacted opNum: err = %v, want ErrCompacted", err)
+	}
+}
+
+var (
+	chaosSeed   = flag.Int64("chaos.seed", 0, "seed of TestChaos, a random one if zero")
+	chaosFaults = flag.Int("chaos.faults", 0, "faults of TestChaos, as many as DefaultChaosOptions if zero")
+)
+
+// TestChaos is the chaos run, e.g. go test -run TestChaos -chaos.faults=5000
+// for the acceptance run, and -chaos.seed to replay the schedule of a failure.
+func TestChaos(t *testing.T) {
+	chaos := DefaultChaosOptions()
+	chaos.Seed = *chaosSeed
+	if chaos.Seed == 0 {
+		chaos.Seed = time.Now().UnixNano()
+	}
+	if *chaosFaults > 0 {
+		chaos.Faults = *chaosFaults
+	}
+	t.Logf("chaos seed %d", chaos.Seed)
+
+	// The view change messages carry the whole opLog, which only grows
+	// once a replica crashed: it never acknowledges the operations to
+	// compact. The default timeout is too short for them in a long run.
+	opts := DefaultOptions()
+	opts.ViewChangeTimeout = 500 * time.Millisecond
+	report, err := RunChaos(5, opts, chaos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Committed == 0 {
+		t.Errorf("nothing committed: %+v", report)
+	}
+	t.Logf("%+v", report)
+}
+
+func TestSessionHistory(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	clock := NewManualClock(time.Unix(0, 0))
+	r.clock = clock
+
+	// Client 7 sends a request every second, interleaved with client 8's.
+	for i := 1; i <= 6; i++ {
+		var reply PrepareOKReply
+		req := clientRequest{clientID: 7 + i%2, reqNum: (i + 1) / 2, reqOp: i}
+		if err := r.Prepare(PrepareArgs{OpNum: i, CommitNum: i - 1, ClientMessage: req}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		r.mu.Lock()
+		r.commitUpTo(i)
+		r.mu.Unlock()
+		clock.Step(time.Second)
+	}
+
+	var opNums []int
+	for _, p := range r.SessionHistory(DefaultNamespace, 8, time.Unix(1, 0), time.Unix(4, 0)) {
+		opNums = append(opNums, p.OpNum)
+	}
+	if fmt.Sprint(opNums) != "[3 5]" {
+		t.Errorf("client 8 between 1s and 4s: opNums = %v, want [3 5]", opNums)
+	}
+	if history := r.SessionHistory(DefaultNamespace, 7, time.Time{}, time.Time{}); len(history) != 3 || history[2].ReqNum != 3 {
+		t.Errorf("whole history of client 7 = %+v", history)
+	}
+	if history := r.SessionHistory("other", 7, time.Time{}, time.Time{}); history != nil {
+		t.Errorf("client 7 of another tenant has history %+v", history)
+	}
+}
+
+func TestConcurrentDuplicateAdmission(t *testing.T) {
+	r := newLonePrimary()
+	r.opts = DefaultOptions()
+
+	// Each request arrives at once through Submit and the Request RPC.
+	const clients, reqNums = 4, 25
+	var wg sync.WaitGroup
+	var accepted int32
+	for clientID := 1; clientID <= clients; clientID++ {
+		for _, viaRPC := range []bool{false, true} {
+			wg.Add(1)
+			go func(clientID int, viaRPC bool) {
+				defer wg.Done()
+				for reqNum := 1; reqNum <= reqNums; reqNum++ {
+					var err error
+					if viaRPC {
+						var reply RequestReply
+						r.Request(RequestArgs{ClientID: clientID, ReqNum: reqNum, Op: reqNum}, &reply)
+						if reply.Err != "" {
+							err = errors.New(reply.Err)
+						}
+					} else {
+						err = r.Submit(clientRequest{clientID: clientID, reqNum: reqNum, reqOp: reqNum})
+					}
+					if err == nil {
+						atomic.AddInt32(&accepted, 1)
+					}
+				}
+			}(clientID, viaRPC)
+		}
+	}
+	wg.Wait()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	seen := make(map[[2]int]bool)
+	for _, e := range r.opLog {
+		key := [2]int{e.clientID, e.reqNum}
+		if seen[key] {
+			t.Errorf("request %d of client %d appended twice", e.reqNum, e.clientID)
+		}
+		seen[key] = true
+	}
+	if int(accepted) != len(r.opLog) {
+		t.Errorf("%d requests accepted but %d appended", accepted, len(r.opLog))
+	}
+	r.status = Dead
+}
+
+func TestConcurrentPrepares(t *testing.T) {
+	r := newLonePrimary()
+	r.configuration[1] = "127.0.0.1:7001"
+	r.configuration[2] = "127.0.0.1:7002"
+	r.newCommitReadyChan = make(chan struct{}, 16)
+
+	for reqNum := 1; reqNum <= 3; reqNum++ {
+		if err := r.Submit(clientRequest{clientID: reqNum, reqNum: 1, reqOp: reqNum}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A <PREPARE-OK> acknowledges the operations before it too.
+	r.ackPrepare(1, 2)
+	if r.commitNum != 2 {
+		t.Fatalf("commitNum = %d, want 2", r.commitNum)
+	}
+	// The late ack of opNum=1 is ignored.
+	r.ackPrepare(1, 1)
+	r.ackPrepare(2, 1)
+	if r.commitNum != 2 {
+		t.Fatalf("commitNum = %d after the acks of a minority, want 2", r.commitNum)
+	}
+	r.ackPrepare(2, 3)
+	if r.commitNum != 3 || len(r.preparedAt) != 0 {
+		t.Fatalf("commitNum = %d with %d operations waiting, want 3 and none", r.commitNum, len(r.preparedAt))
+	}
+	if entry := r.tenantFor(DefaultNamespace).clientTable[2]; !entry.committed {
+		t.Error("request of opNum=2 not marked committed")
+	}
+}
+
+func TestReorderedPrepares(t *testing.T) {
+	r := newLonePrimary()
+	r.ID, r.primaryID = 1, 0
+	r.opts = DefaultOptions()
+	r.opts.ReorderWindow = 3
+
+	prepare := func(opNum int) PrepareOKReply {
+		var reply PrepareOKReply
+		args := PrepareArgs{OpNum: opNum, ClientMessage: clientRequest{clientID: 1, reqNum: opNum, reqOp: opNum}}
+		if err := r.Prepare(args, &reply); err != nil && err != ErrLogGap {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	// The <PREPARE>s of opNum=2 and 3 overtake the one of opNum=1.
+	for _, opNum := range []int{3, 2} {
+		if reply := prepare(opNum); reply.IsReplied {
+			t.Fatalf("PREPARE of opNum=%d acked ahead of the gap", opNum)
+		}
+	}
+	if reply := prepare(1); reply.OpNum != 3 {
+		t.Fatalf("PREPARE-OK acks opNum=%d once the gap is filled, want 3", reply.OpNum)
+	}
+
+	r.mu.Lock()
+	if r.status != Normal || r.opLog[1].op() != 2 || r.opLog[2].op() != 3 {
+		t.Fatalf("status=%v opLog=%+v", r.status, r.opLog)
+	}
+	r.mu.Unlock()
+
+	// A <PREPARE> beyond the window is pulled along with the gap, which
+	// falls back to a state transfer once it persists.
+	prepare(7)
+	r.mu.Lock()
+	if r.status != Normal || len(r.reordered) != 0 {
+		t.Fatalf("status=%v with %d buffered PREPAREs, want Normal and none", r.status, len(r.reordered))
+	}
+	r.mu.Unlock()
+	sleepMs(int(reorderGapTimeout / time.Millisecond))
+	prepare(5)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status != StateTransfer {
+		t.Fatalf("status = %v, want StateTransfer", r.status)
+	}
+	r.status = Dead
+}
+
+func TestPrepareRetransmission(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	sleepMs(100)
+
+	// Replica 1 misses the first <PREPARE>, and doesn't pull it either.
+	r := h.cluster[1].Replica()
+	r.mu.Lock()
+	r.opts.PullThreshold = 1 << 20
+	r.mu.Unlock()
+	var dropped int32
+	h.InterceptInbound(1, func(next InboundHandler) InboundHandler {
+		return func(call InboundCall) error {
+			if call.Method == "Prepare" && atomic.AddInt32(&dropped, 1) == 1 {
+				return nil
+			}
+			return next(call)
+		}
+	})
+	if !h.SubmitToReplica(0, 1, 1, "x") {
+		t.Fatal("request not accepted")
+	}
+	sleepMs(100)
+
+	if sent := h.cluster[0].MessagesSent()["Replica.Prepare"]; sent != 3 {
+		t.Errorf("primary sent %d <PREPARE>s, want 2 and a retransmission", sent)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.opNum != 1 || r.status != Normal {
+		t.Errorf("replica 1 opNum=%d status=%v after the retransmission", r.opNum, r.status)
+	}
+}
+
+func TestLatePrepareOKAfterViewChange(t *testing.T) {
+	r := newLonePrimary()
+	r.configuration = map[int]string{1: "", 2: "", 3: "", 4: ""}
+	r.viewNum = 1
+	for reqNum := 1; reqNum <= 3; reqNum++ {
+		r.appendPrepared(clientRequest{clientID: 1, reqNum: reqNum, reqOp: reqNum})
+	}
+	r.ackPrepare(1, 3)
+
+	// The primary is deposed while its <PREPARE>s are in flight, and
+	// becomes a backup of the next view.
+	r.viewNum = 2
+	r.setStatus(ViewChange)
+	r.primaryID = 1
+	r.setStatus(Normal)
+	r.prepareReplied(2, PrepareArgs{ViewNum: 1, OpNum: 3}, PrepareOKReply{IsReplied: true, ViewNum: 1, OpNum: 3})
+	if r.commitNum != 0 || len(r.ackedOpNums) != 0 {
+		t.Errorf("late <PREPARE-OK> committed up to opNum=%d, acks %v", r.commitNum, r.ackedOpNums)
+	}
+}
+
+// evenValidator only accepts the even ints. It reads the stats of its
+// replica, as a Validator calling back into the replica would.
+type evenValidator struct {
+	r *Replica
+}
+
+func (v evenValidator) Validate(op interface{}) error {
+	v.r.LocalStats()
+	if n, ok := op.(int); !ok || n%2 != 0 {
+		return fmt.Errorf("%v is not even", op)
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	r := newLonePrimary()
+	r.opts.Validator = evenValidator{r}
+	if err := r.Submit(clientRequest{namespace: "ns", clientID: 1, reqNum: 1, reqOp: 3}); !errors.Is(err, ErrInvalidOperation) {
+		t.Fatalf("invalid operation submitted: err = %v", err)
+	}
+	if err := r.Submit(clientRequest{namespace: "ns", clientID: 1, reqNum: 1, reqOp: 4}); err != nil {
+		t.Fatalf("valid operation rejected: %v", err)
+	}
+	r.mu.Lock()
+	opNum := r.opNum
+	r.mu.Unlock()
+	if opNum != 1 {
+		t.Errorf("opNum=%d, want only the valid operation prepared", opNum)
+	}
+	if m, _ := r.TenantMetrics("ns"); m.Invalid != 1 || m.Submitted != 2 {
+		t.Errorf("metrics = %+v, want 1 invalid of 2 submitted", m)
+	}
+}
+
+func TestSheddingHysteresis(t *testing.T) {
+	r := newLonePrimary()
+	r.opts.ShedHighWatermark = 10
+	r.opts.ShedLowWatermark = 5
+
+	submit := func(reqNum int) error {
+		return r.Submit(clientRequest{clientID: 1, reqNum: reqNum, reqOp: "x"})
+	}
+
+	r.commitNum = 9
+	if err := submit(1); err != nil {
+		t.Fatalf("lag below the high watermark: err = %v", err)
+	}
+	r.commitNum = 10
+	if err := submit(2); err != ErrOverloaded {
+		t.Fatalf("lag at the high watermark: err = %v", err)
+	}
+	r.appliedNum = 4
+	if err := submit(2); err != ErrOverloaded {
+		t.Fatalf("lag between the watermarks while shedding: err = %v", err)
+	}
+	r.appliedNum = 5
+	if err := submit(2); err != nil {
+		t.Fatalf("lag back to the low watermark: err = %v", err)
+	}
+}
+
+func TestSheddingStalledStateMachine(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	primary := h.cluster[0].Replica()
+	primary.mu.Lock()
+	primary.opts.ShedHighWatermark = 3
+	primary.opts.ShedLowWatermark = 1
+	primary.mu.Unlock()
+	submit := func(reqNum int) error {
+		return primary.Submit(clientRequest{clientID: 1, reqNum: reqNum, reqOp: reqNum})
+	}
+
+	// The commits keep on being replicated while the state machine of the
+	// primary doesn't take them, until the lag reaches the high watermark.
+	h.PauseCommits(0)
+	reqNum, shed := 0, false
+	for !shed && reqNum < 10 {
+		reqNum++
+		err := submit(reqNum)
+		if err != nil && err != ErrOverloaded {
+			t.Fatalf("Submit(%d): %v", reqNum, err)
+		}
+		shed = err == ErrOverloaded
+		sleepMs(30)
+	}
+	if !shed {
+		t.Fatalf("%d requests accepted with the state machine stalled", reqNum)
+	}
+
+	h.ResumeCommits(0)
+	sleepMs(100)
+	if err := submit(reqNum); err != nil {
+		t.Fatalf("Submit(%d) once the state machine caught up: %v", reqNum, err)
+	}
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	r := newLonePrimary()
+	for _, req := range []clientRequest{
+		{namespace: "ns", clientID: 1, reqNum: 1, reqOp: "op1"},
+		{namespace: "ns", clientID: 2, reqNum: 1, reqOp: []byte("op2")},
+		{namespace: "ns", clientID: 1, reqNum: 2, reqOp: 3},
+		{namespace: "ns", clientID: 1, reqNum: 3, reqOp: "op4"},
+	} {
+		if err := r.Submit(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.commitNum = 3
+	clients := r.tenantFor("ns").clientTable
+	clients[2] = clientTableEntry{reqNum: 1, committed: true, resp: "done", replied: true}
+
+	var buf bytes.Buffer
+	if err := r.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	imported := newLonePrimary()
+	if err := imported.Import(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if imported.commitNum != 3 || len(imported.opLog) != 3 || string(imported.opLog[1].op().([]byte)) != "op2" || imported.opLog[2].op() != 3 || imported.opLog[2].namespace != "ns" {
+		t.Fatalf("imported commitNum=%d log=%+v", imported.commitNum, imported.opLog)
+	}
+	// The clientTable comes along, so requests already committed by the
+	// exporting cluster are still recognized as duplicates.
+	if err := imported.Submit(clientRequest{namespace: "ns", clientID: 1, reqNum: 2, reqOp: 3}); err != ErrDuplicateRequest {
+		t.Fatalf("committed request resubmitted after the import: err = %v", err)
+	}
+	if err := imported.Submit(clientRequest{namespace: "ns", clientID: 1, reqNum: 3, reqOp: "op4"}); err != nil {
+		t.Fatalf("request not committed before the export rejected: %v", err)
+	}
+	if entry, _ := imported.clientTableEntry("ns", 2); entry.reqNum != 1 || !entry.committed || !entry.replied || entry.resp != "done" {
+		t.Fatalf("imported clientTable entry = %+v", entry)
+	}
+
+	// A version 1 export, whose snapshot field was reserved, is read if
+	// the field is empty.
+	asVersion1 := func(export []byte) []byte {
+		v1 := append([]byte(nil), export...)
+		binary.BigEndian.PutUint16(v1[len(exportMagic):], 1)
+		binary.BigEndian.PutUint32(v1[len(v1)-4:], crc32.ChecksumIEEE(v1[:len(v1)-4]))
+		return v1
+	}
+	if state, err := ReadExport(bytes.NewReader(asVersion1(buf.Bytes()))); err != nil || len(state.Entries) != 3 || state.Metadata.Version != exportVersion {
+		t.Fatalf("version 1 export read as version %d with %d entries; err = %v", state.Metadata.Version, len(state.Entries), err)
+	}
+	var withSnapshot bytes.Buffer
+	if err := WriteExport(&withSnapshot, ExportedState{Snapshot: []byte("snapshot")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadExport(bytes.NewReader(asVersion1(withSnapshot.Bytes()))); !errors.Is(err, ErrBadExport) {
+		t.Fatalf("version 1 export with a snapshot: err = %v", err)
+	}
+
+	corrupted := buf.Bytes()
+	corrupted[len(corrupted)-10] ^= 0xff
+	if _, err := ReadExport(bytes.NewReader(corrupted)); !errors.Is(err, ErrBadExport) {
+		t.Fatalf("corrupted export: err = %v", err)
+	}
+}
+
+func TestDuplicatePrepareIsReacked(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+
+	prepare := func(opNum int) PrepareOKReply {
+		var reply PrepareOKReply
+		args := PrepareArgs{ViewNum: 0, OpNum: opNum, ClientMessage: clientRequest{clientID: 1, reqNum: opNum, reqOp: opNum}}
+		if err := r.Prepare(args, &reply); err != nil && err != ErrLogGap {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	prepare(1)
+	prepare(2)
+	if reply := prepare(1); !reply.IsReplied || reply.OpNum != 2 {
+		t.Fatalf("duplicate PREPARE reply = %+v", reply)
+	}
+	if r.status != Normal || r.opNum != 2 || len(r.opLog) != 2 {
+		t.Fatalf("duplicate PREPARE changed the replica: status=%v opNum=%d log=%v", r.status, r.opNum, r.opLog)
+	}
+
+	// The gap is pulled rather than acked, and a duplicate of the buffered
+	// PREPARE is appended once the gap is filled.
+	if reply := prepare(4); reply.IsReplied || r.status != Normal || r.opNum != 2 {
+		t.Fatalf("PREPARE after a gap: reply = %+v, status = %v, opNum = %d", reply, r.status, r.opNum)
+	}
+	prepare(4)
+	if reply := prepare(3); !reply.IsReplied || reply.OpNum != 4 || len(r.opLog) != 4 {
+		t.Fatalf("PREPARE filling the gap: reply = %+v, log = %v", reply, r.opLog)
+	}
+	if reply := prepare(4); !reply.IsReplied || reply.OpNum != 4 || len(r.opLog) != 4 {
+		t.Fatalf("duplicate of the buffered PREPARE: reply = %+v, log = %v", reply, r.opLog)
+	}
+
+	// The primary tells a gap from a superseded view by the error.
+	gap := PrepareArgs{ViewNum: 0, OpNum: 6, ClientMessage: clientRequest{clientID: 1, reqNum: 6, reqOp: 6}}
+	if err := r.Prepare(gap, &PrepareOKReply{}); err != ErrLogGap {
+		t.Errorf("PREPARE after a gap: err = %v, want ErrLogGap", err)
+	}
+	r.viewNum = 1
+	if err := r.Prepare(PrepareArgs{ViewNum: 0, OpNum: 5}, &PrepareOKReply{}); err != ErrStaleView {
+		t.Errorf("PREPARE of a previous view: err = %v, want ErrStaleView", err)
+	}
+}
+
+func TestSequencingTokens(t *testing.T) {
+	r := newLonePrimary()
+	request := func(reqNum int, token SeqToken) (SeqToken, error) {
+		var reply RequestReply
+		r.Request(RequestArgs{ClientID: 7, ReqNum: reqNum, Op: reqNum, Token: token}, &reply)
+		if reply.Err != "" {
+			return reply.Token, requestError(reply.Err)
+		}
+		return reply.Token, nil
+	}
+
+	first, err := request(1, SeqToken{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := request(3, first); err != ErrOutOfOrder {
+		t.Fatalf("request skipping one: err = %v", err)
+	}
+	if _, err := request(2, SeqToken{}); err != ErrOutOfOrder {
+		t.Fatalf("second request without a token: err = %v", err)
+	}
+	second, err := request(2, first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Resent after a lost reply, the request gets its token back.
+	if token, err := request(2, first); err != ErrDuplicateRequest || token != second {
+		t.Fatalf("request resent: token = %+v, err = %v", token, err)
+	}
+	if token, err := request(1, SeqToken{}); err != ErrDuplicateRequest || token != (SeqToken{}) {
+		t.Fatalf("older request resent: token = %+v, err = %v", token, err)
+	}
+
+	// Losing the uncommitted tail of the log, as a view change could,
+	// breaks the sequence of the client.
+	r.opLog = r.opLog[:0]
+	r.opNum = 0
+	if _, err := request(3, second); err != ErrSequenceBroken {
+		t.Fatalf("request after its predecessor was lost: err = %v", err)
+	}
+}
+
+func TestClientFollowsPrimary(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	c := h.NewClient(1)
+	defer c.Close()
+	for i := 1; i <= 3; i++ {
+		token, err := c.Submit(i, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.ReqNum != i || token.OpNum != i {
+			t.Fatalf("token of request %d = %+v", i, token)
+		}
+	}
+
+	// The primary accepts request 4, but the client never hears about it.
+	primaryID, _ := h.CheckSinglePrimary()
+	if !h.SubmitToReplica(primaryID, 1, 4, 4) {
+		t.Fatal("request 4 not accepted")
+	}
+	for i := 4; i <= 5; i++ {
+		token, err := c.Submit(i, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token.ReqNum != i || token.OpNum != i {
+			t.Fatalf("token of request %d = %+v", i, token)
+		}
+	}
+
+	if _, err := c.Submit(6, 0); err == nil {
+		t.Fatal("submit without any attempt succeeded")
+	}
+	if _, err := NewClient(2, DefaultNamespace, nil); err == nil {
+		t.Fatal("client without any replica created")
+	}
+}
+
+func TestClientResult(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	c := h.NewClient(1)
+	defer c.Close()
+	if _, err := c.Result(1); err == nil {
+		t.Fatal("result before any request")
+	}
+	if _, err := c.Submit("op", 10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Result(1); err == nil {
+		t.Fatal("result before the state machine replied")
+	}
+
+	sleepMs(100)
+	h.mu.Lock()
+	entry := h.commits[0][0]
+	h.mu.Unlock()
+	for i := 0; i < 3; i++ {
+		h.cluster[i].Replica().Reply(entry, "done")
+	}
+	if resp, err := c.Result(10); err != nil || resp != "done" {
+		t.Fatalf("Result() = %v, %v", resp, err)
+	}
+}
+
+func TestClientResults(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	c := h.NewClient(1)
+	defer c.Close()
+	// The replicas reply to the commits of the requests submitted so far.
+	replied := 0
+	submit := func(ops ...string) {
+		for _, op := range ops {
+			if _, err := c.Submit(op, 10); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sleepMs(100)
+		h.mu.Lock()
+		entries := h.commits[0][replied:]
+		replied = len(h.commits[0])
+		h.mu.Unlock()
+		for _, entry := range entries {
+			for i := 0; i < 3; i++ {
+				h.cluster[i].Replica().Reply(entry, "done "+entry.ClientReq.reqOp.(string))
+			}
+		}
+	}
+	check := func(want ...ClientReply) {
+		replies, err := c.Results(10)
+		if err != nil || !reflect.DeepEqual(replies, want) {
+			t.Errorf("Results() = %+v, %v, want %+v", replies, err, want)
+		}
+	}
+
+	submit("a", "b", "c")
+	check(ClientReply{1, "done a"}, ClientReply{2, "done b"}, ClientReply{3, "done c"})
+	submit("d")
+	check(ClientReply{4, "done d"})
+}
+
+func TestWaitForCommit(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	c := h.NewClient(1)
+	defer c.Close()
+	token, err := c.Submit("op", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := c.WaitForCommit(ctx, 2, token.ViewStamp()); err != nil {
+		t.Fatalf("waiting on backup 2: %v", err)
+	}
+	if commitNum := h.cluster[2].Replica().CommitNum(); commitNum < token.OpNum {
+		t.Errorf("backup 2 commitNum = %d once waited for opNum=%d", commitNum, token.OpNum)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	next := ViewStamp{ViewNum: token.ViewNum, OpNum: token.OpNum + 1}
+	if err := c.WaitForCommit(ctx, 2, next); err != context.DeadlineExceeded {
+		t.Errorf("waiting for an operation never submitted: err = %v", err)
+	}
+	if !token.ViewStamp().Less(next) || !next.Less(ViewStamp{ViewNum: token.ViewNum + 1, OpNum: 1}) {
+		t.Errorf("viewstamps out of order around %v", next)
+	}
+
+	// Another operation committed at the opNum of the viewstamp replaced it.
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	superseded := ViewStamp{ViewNum: token.ViewNum + 1, OpNum: token.OpNum}
+	if err := c.WaitForCommit(ctx, 2, superseded); err != ErrViewStampSuperseded {
+		t.Errorf("waiting for %v: err = %v", superseded, err)
+	}
+	for _, commit := range h.CheckCommittedN(1) {
+		if commit.ViewStamp != token.ViewStamp() {
+			t.Errorf("committed %v, accepted as %v", commit.ViewStamp, token.ViewStamp())
+		}
+	}
+}
+
+func TestAddressChange(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	sleepMs(100)
+
+	// Replica 2 moved: its peers dial it at an address which is gone.
+	addr := h.cluster[2].GetListenAddr().String()
+	for i := 0; i < 2; i++ {
+		r := h.cluster[i].replica
+		r.mu.Lock()
+		r.configuration = map[int]string{1 - i: r.configuration[1-i], 2: "127.0.0.1:1"}
+		r.mu.Unlock()
+		h.cluster[i].DisconnectPeer(2)
+	}
+
+	r := h.cluster[2].replica
+	r.mu.Lock()
+	r.opts.AdvertiseAddr = addr
+	r.mu.Unlock()
+	go r.runAddressCheck()
+	sleepMs(300)
+
+	for i := 0; i < 2; i++ {
+		r := h.cluster[i].replica
+		r.mu.Lock()
+		got := r.configuration[2]
+		r.mu.Unlock()
+		if got != addr {
+			t.Errorf("replica %d has address %s for replica 2, want %s", i, got, addr)
+		}
+	}
+	// The primary reaches replica 2 again.
+	if !h.SubmitToReplica(0, 1, 1, "op") {
+		t.Fatal("request not accepted")
+	}
+	sleepMs(100)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.opNum != 2 {
+		t.Errorf("replica 2 opNum = %d, want 2", r.opNum)
+	}
+}
+
+func TestReconfigureTransitions(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	sleepMs(100)
+
+	// The backups don't take the PREPAREs for a while, so that the
+	// epochChange stays in flight.
+	var blocked int32 = 1
+	for i := 1; i <= 2; i++ {
+		h.InterceptInbound(i, func(next InboundHandler) InboundHandler {
+			return func(call InboundCall) error {
+				if call.Method == "Prepare" && atomic.LoadInt32(&blocked) == 1 {
+					return nil
+				}
+				return next(call)
+			}
+		})
+	}
+
+	primary := h.cluster[0].replica
+	statusOf := func(r *Replica) ReplicaStatus {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		return r.status
+	}
+	members := map[int]string{
+		0: h.cluster[0].GetListenAddr().String(),
+		1: h.cluster[1].GetListenAddr().String(),
+	}
+	if err := primary.Reconfigure(map[int]string{0: members[0], -1: "127.0.0.1:1"}); err == nil {
+		t.Error("epoch with a negative ID accepted")
+	}
+	if err := primary.Reconfigure(members); err != nil {
+		t.Fatal(err)
+	}
+	if status := statusOf(primary); status != Transitioning {
+		t.Fatalf("primary is %v during the transition", status)
+	}
+	if err := primary.Submit(clientRequest{clientID: 1, reqNum: 1, reqOp: "x"}); err != ErrNotNormal {
+		t.Errorf("request during the transition: err = %v, want ErrNotNormal", err)
+	}
+
+	atomic.StoreInt32(&blocked, 0)
+	sleepMs(200)
+	if status := statusOf(primary); status != Normal {
+		t.Fatalf("primary is %v once the epoch started", status)
+	}
+	if status := statusOf(h.cluster[2].replica); status != Dead {
+		t.Errorf("removed replica 2 is %v", status)
+	}
+	for i := 0; i <= 1; i++ {
+		r := h.cluster[i].replica
+		r.mu.Lock()
+		epochNum, clusterSize := r.epochNum, r.clusterSize()
+		r.mu.Unlock()
+		if epochNum != 1 || clusterSize != 2 {
+			t.Errorf("replica %d is in epoch %d with %d replicas, want epoch 1 with 2", i, epochNum, clusterSize)
+		}
+	}
+
+	// The group of two commits without replica 2.
+	if err := primary.Submit(clientRequest{clientID: 1, reqNum: 1, reqOp: "x"}); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(100)
+	if commitNum := primary.CommitNum(); commitNum != 2 {
+		t.Errorf("primary commitNum = %d, want 2", commitNum)
+	}
+}
+
+func TestClientMetrics(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// The client first believes backup 1 is the primary.
+	c := h.NewClient(1)
+	defer c.Close()
+	c.primaryID = 1
+	if _, err := c.Submit("op", 10); err != nil {
+		t.Fatal(err)
+	}
+
+	m := c.Metrics()
+	if m.Requests != 2 || m.Retries != 1 || m.Failovers != 1 || m.PrimaryID != 0 || m.Resyncs != 0 {
+		t.Errorf("metrics = %+v, want 2 requests with a retry after failing over to primary 0", m)
+	}
+	if m.AttemptLatencyP50 <= 0 || m.AttemptLatencyP99 < m.AttemptLatencyP50 {
+		t.Errorf("attempt latency p50 = %v, p99 = %v", m.AttemptLatencyP50, m.AttemptLatencyP99)
+	}
+}
+
+func TestBackupPullsMissingCommits(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	primaryID, _ := h.CheckSinglePrimary()
+	backupID := (primaryID + 1) % 3
+
+	// Short enough for the backup not to start a view change.
+	h.DisconnectPeer(backupID)
+	for i := 1; i <= 3; i++ {
+		if !h.SubmitToReplica(primaryID, 1, i, i) {
+			t.Fatalf("request %d not accepted", i)
+		}
+	}
+	sleepMs(20)
+	h.ReconnectPeer(backupID)
+	sleepMs(200)
+
+	backup := h.cluster[backupID].replica
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	if backup.opNum != 3 || backup.status != Normal {
+		t.Fatalf("backup opNum = %d, status = %v; want 3 and Normal", backup.opNum, backup.status)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+id: 1
+listen: ":7001"
+peers:
+  0: "127.0.0.1:7000"
+  2: "127.0.0.1:7002"
+timeouts:
+  view_change: 300ms
+features:
+  pull_threshold: 4
+  invariants: strict
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	opts := config.Options()
+	if opts.ViewChangeTimeout != 300*time.Millisecond || opts.PullThreshold != 4 || opts.InvariantMode != StrictInvariants {
+		t.Errorf("got options %+v", opts)
+	}
+	if opts.HeartbeatInterval != DefaultOptions().HeartbeatInterval {
+		t.Errorf("heartbeat = %v, want the default", opts.HeartbeatInterval)
+	}
+
+	for _, tc := range []struct {
+		yaml string
+		want string
+	}{
+		{`listen: ":7000"`, "id:"},
+		{"id: 0\nlisten: \":7000\"\npeers: {0: \"127.0.0.1:7000\"}", "peers:"},
+		{"id: 0\nlisten: \":7000\"\npeers: {1: \"127.0.0.1:7001\"}\ntimeouts: {view_chnage: 1s}", "view_chnage"},
+		{"id: 0\nlisten: \":7000\"\npeers: {1: \"127.0.0.1:7001\"}\ntls: {cert_file: /etc/vrr/replica.crt}", "tls"},
+		{"id: 0\nlisten: \":7000\"\npeers: {1: \"127.0.0.1:7001\"}\nfeatures: {invariants: paranoid}", "features.invariants"},
+		{"id: 0\nlisten: \":7000\"\npeers: {1: \"127.0.0.1:7001\"}\narchive: {bucket: vrr-archive}", "archive:"},
+	} {
+		if _, err := ParseConfig([]byte(tc.yaml)); err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("ParseConfig(%q) = %v, want error mentioning %q", tc.yaml, err, tc.want)
+		}
+	}
+}
+
+func TestNamedReplicas(t *testing.T) {
+	config, err := ParseConfig([]byte(`
+id: vrr-b.example.com
+listen: ":7001"
+peers:
+  vrr-a.example.com: "10.0.0.1:7000"
+  vrr-c.example.com: "10.0.0.3:7000"
+  7: "10.0.0.7:7000"
+gateway:
+  peers:
+    vrr-a.example.com: "http://10.0.0.1:8080"
+`))
+	if err != nil {
+		t.Fatalf("ParseConfig: %v", err)
+	}
+	a, _ := ParseID("vrr-a.example.com")
+	b, _ := ParseID("vrr-b.example.com")
+	if config.ID != b || config.Peers[a] != "10.0.0.1:7000" || config.Peers[7] != "10.0.0.7:7000" || config.Gateway.Peers[a] == "" {
+		t.Errorf("got ID %d, peers %v and gateway peers %v", config.ID, config.Peers, config.Gateway.Peers)
+	}
+	if config.Names[b] != "vrr-b.example.com" || len(config.Names) != 3 {
+		t.Errorf("got names %v", config.Names)
+	}
+	if a < NameIDBase || b < NameIDBase || a == b {
+		t.Errorf("names stand for IDs %d and %d", a, b)
+	}
+	if ID, err := ParseID("7"); err != nil || ID != 7 {
+		t.Errorf("ParseID(\"7\") = %d, %v", ID, err)
+	}
+}
+
+func TestCaptureProtocol(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "capture")
+
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	sleepMs(100)
+
+	backup := h.cluster[1].replica
+	if err := backup.CaptureProtocol(path, 200*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := backup.CaptureProtocol(path, time.Second); err == nil {
+		t.Error("second capture started while the first one runs")
+	}
+	if !h.SubmitToReplica(0, 1, 1, "x") {
+		t.Fatal("request not accepted")
+	}
+	sleepMs(300)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	messages, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prepares, commits := 0, 0
+	for _, m := range messages {
+		switch args := m.Args.(type) {
+		case PrepareArgs:
+			prepares++
+			if m.SenderID != 0 || args.ClientMessage.reqOp != "x" {
+				t.Errorf("captured PREPARE %+v from %d", args, m.SenderID)
+			}
+		case CommitArgs:
+			commits++
+		}
+	}
+	if prepares != 1 || commits == 0 {
+		t.Errorf("captured %d PREPAREs and %d COMMITs, want 1 and some", prepares, commits)
+	}
+
+	// The capture is over, another one can start.
+	if err := backup.CaptureProtocol(path, time.Millisecond); err != nil {
+		t.Errorf("capture after the first one ended: %v", err)
+	}
+	sleepMs(20)
+}
+
+func TestDataDirLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d, err := OpenDataDir(dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{d.LogDir(), d.SnapshotsDir()} {
+		if info, err := os.Stat(sub); err != nil || !info.IsDir() {
+			t.Errorf("%s: %v", sub, err)
+		}
+	}
+	if _, err := OpenDataDir(dir, 1); err != ErrDataDirLocked {
+		t.Errorf("opening a locked data directory: err = %v", err)
+	}
+	d.Close()
+
+	if _, err := OpenDataDir(dir, 2); err == nil {
+		t.Error("replica 2 opened the data directory of replica 1")
+	}
+	d, err = OpenDataDir(dir, 1)
+	if err != nil {
+		t.Fatalf("reopening the data directory: %v", err)
+	}
+	if meta := d.Meta(); meta.LayoutVersion != DataDirLayoutVersion || meta.ReplicaID != 1 {
+		t.Errorf("meta = %+v", meta)
+	}
+	d.Close()
+
+	// A layout from the future isn't touched.
+	meta := []byte(fmt.Sprintf(`{"layout_version": %d, "replica_id": 1}`, DataDirLayoutVersion+1))
+	if err := ioutil.WriteFile(filepath.Join(dir, dataDirMetaFile), meta, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenDataDir(dir, 1); err == nil {
+		t.Error("opened a data directory of a newer layout")
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(dir, SyncAlways, 0, WALSegments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []StoredEntry{{ClientID: 1, ReqNum: 1, Op: "a"}, {ClientID: 1, ReqNum: 2, Op: "b"}}
+	if err := wal.AppendLog(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.AppendLog(2, []StoredEntry{{ClientID: 2, ReqNum: 1, Op: "c"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.Set(storageViewNum, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := wal.AppendLog(4, nil); err == nil {
+		t.Error("appended past the end of the WAL")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A record torn by a crash is dropped.
+	f, err := os.OpenFile(filepath.Join(dir, walSegmentName(1)), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 42})
+	f.Close()
+
+	wal, err = OpenWAL(dir, SyncInterval, time.Millisecond, WALSegments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	if got, _ := wal.ReadLog(1); len(got) != 2 || got[0].Op != "a" || got[1].Op != "c" {
+		t.Errorf("replayed entries = %+v", got)
+	}
+	if value, _ := wal.Get(storageViewNum); string(value) != "3" {
+		t.Errorf("replayed viewNum = %q", value)
+	}
+	if err := wal.AppendLog(3, []StoredEntry{{ClientID: 2, ReqNum: 2, Op: "d"}}); err != nil {
+		t.Errorf("appending after the torn record: %v", err)
+	}
+
+	for s, want := range map[string]SyncPolicy{"always": SyncAlways, "never": SyncNever, "interval(5ms)": SyncInterval} {
+		if policy, _, err := parseSyncPolicy(s); err != nil || policy != want {
+			t.Errorf("parseSyncPolicy(%q) = %v, %v", s, policy, err)
+		}
+	}
+	if _, _, err := parseSyncPolicy("interval(0s)"); err == nil {
+		t.Error("parsed a zero sync interval")
+	}
+}
+
+func TestWALSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	segments := WALSegments{MaxBytes: 256, CompactEntries: 10}
+	wal, err := OpenWAL(dir, SyncNever, 0, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for opNum := 1; opNum <= 30; opNum++ {
+		if err := wal.AppendLog(opNum, []StoredEntry{{ClientID: 1, ReqNum: opNum, Op: "op"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := wal.Set(storageViewNum, []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := walSegmentSeqs(dir)
+	if len(rotated) < 3 {
+		t.Fatalf("segments = %v, want the WAL rotated", rotated)
+	}
+
+	// Once CompactLog dropped enough entries, the next segment starts with
+	// a checkpoint and the sealed ones are removed.
+	if err := wal.CompactLog(25); err != nil {
+		t.Fatal(err)
+	}
+	for opNum := 31; len(wal.sealed) > 0 || wal.seq == rotated[len(rotated)-1]; opNum++ {
+		if err := wal.AppendLog(opNum, []StoredEntry{{ClientID: 1, ReqNum: opNum, Op: "op"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if seqs, _ := walSegmentSeqs(dir); len(seqs) != 1 {
+		t.Errorf("segments after the compaction = %v", seqs)
+	}
+	end := wal.state.logEnd()
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = OpenWAL(dir, SyncNever, 0, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := wal.ReadLog(1); len(got) != end-25 || got[0].ReqNum != 26 {
+		t.Errorf("replayed %d entries from %+v, want %d from opNum=26", len(got), got[0], end-25)
+	}
+	if value, _ := wal.Get(storageViewNum); string(value) != "2" {
+		t.Errorf("replayed viewNum = %q", value)
+	}
+	wal.Close()
+
+	// The single file of layout version 1 becomes the first segment.
+	dataDir := filepath.Join(dir, "data")
+	logDir := filepath.Join(dataDir, dataDirLogDir)
+	if err := os.MkdirAll(logDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wal, err = OpenWAL(logDir, SyncAlways, 0, WALSegments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.Set(storageViewNum, []byte("7"))
+	wal.Close()
+	if err := os.Rename(filepath.Join(logDir, walSegmentName(1)), filepath.Join(logDir, "wal")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dataDir, dataDirMetaFile), []byte(`{"layout_version": 1, "replica_id": 1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	d, err := OpenDataDir(dataDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	wal, err = d.OpenWAL(SyncAlways, 0, WALSegments{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := wal.Get(storageViewNum); string(value) != "7" {
+		t.Errorf("viewNum after the migration = %q", value)
+	}
+}
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenBoltStorage(dir, SyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []StoredEntry{{OpNum: 1, Op: "a"}, {OpNum: 2, Op: "b"}, {OpNum: 3, Op: "c"}}
+	if err := s.AppendLog(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendLog(3, []StoredEntry{{OpNum: 3, Op: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendLog(5, nil); err == nil {
+		t.Error("appended past the end of the log")
+	}
+	if err := s.CompactLog(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetBatch(map[string][]byte{storageViewNum: []byte("2"), storageCommitNum: []byte("3")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenBoltStorage(dir, SyncInterval, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, _ := s.ReadLog(1); len(got) != 2 || got[0].Op != "b" || got[1].Op != "d" {
+		t.Errorf("reopened log = %+v", got)
+	}
+	if value, _ := s.Get(storageCommitNum); string(value) != "3" {
+		t.Errorf("reopened commitNum = %q", value)
+	}
+	if value, _ := s.Get("missing"); value != nil {
+		t.Errorf("missing key = %q", value)
+	}
+	// The log starts after a compaction past its end.
+	if err := s.CompactLog(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendLog(6, []StoredEntry{{OpNum: 6, Op: "e"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.ReadLog(1); len(got) != 1 || got[0].OpNum != 6 {
+		t.Errorf("log after compacting past its end = %+v", got)
+	}
+}
+
+func TestMmapStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-mmap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := OpenMmapStorage(dir, SyncAlways, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []StoredEntry{{OpNum: 1, Op: "a"}, {OpNum: 2, Op: "b"}, {OpNum: 3, Op: "c"}}
+	if err := s.AppendLog(1, entries); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendLog(3, []StoredEntry{{OpNum: 3, Op: "d"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendLog(5, nil); err == nil {
+		t.Error("appended past the end of the log")
+	}
+	if err := s.CompactLog(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set(storageCommitNum, []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// An index slot written before the crash of the entry it points to is
+	// dropped.
+	f, err := os.OpenFile(filepath.Join(dir, "mmap-1.idx"), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 1, 0, 0, 0, 0, 0})
+	f.Close()
+
+	s, err = OpenMmapStorage(dir, SyncInterval, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if got, _ := s.ReadLog(1); len(got) != 2 || got[0].Op != "b" || got[1].Op != "d" {
+		t.Errorf("reopened log = %+v", got)
+	}
+	if value, _ := s.Get(storageCommitNum); string(value) != "3" {
+		t.Errorf("reopened commitNum = %q", value)
+	}
+
+	// Once most entries are dropped, the live ones move to new files.
+	if err := s.CompactLog(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mmap-1.log")); !os.IsNotExist(err) {
+		t.Errorf("the files of the first generation are left: %v", err)
+	}
+	if err := s.AppendLog(4, []StoredEntry{{OpNum: 4, Op: "e"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.ReadLog(4); len(got) != 1 || got[0].Op != "e" {
+		t.Errorf("log from opNum=4 = %+v", got)
+	}
+	if got, _ := s.ReadLog(1); len(got) != 2 || got[0].Op != "d" {
+		t.Errorf("log after the compaction = %+v", got)
+	}
+	// The log starts after a compaction past its end.
+	if err := s.CompactLog(6); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AppendLog(7, []StoredEntry{{OpNum: 7, Op: "f"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := s.ReadLog(1); len(got) != 1 || got[0].OpNum != 7 {
+		t.Errorf("log after compacting past its end = %+v", got)
+	}
+}
+
+// objectStore is an ObjectStore in memory, failing the uploads while fail
+// is set.
+type objectStore struct {
+	objects map[string][]byte
+	fail    bool
+}
+
+func (s *objectStore) Put(ctx context.Context, key string, body []byte) error {
+	if s.fail {
+		return errors.New("bucket unreachable")
+	}
+	s.objects[key] = append([]byte(nil), body...)
+	return nil
+}
+
+// hungStore is an ObjectStore whose uploads never finish.
+type hungStore struct{}
+
+func (hungStore) Put(ctx context.Context, key string, body []byte) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wal, err := OpenWAL(dir, SyncNever, 0, WALSegments{MaxBytes: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wal.Close()
+	for opNum := 1; opNum <= 3; opNum++ {
+		if err := wal.AppendLog(opNum, []StoredEntry{{OpNum: opNum, Op: "op"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshot, _ := encodeSnapshot(snapshotState{OpNum: 2, State: []byte("state")})
+	if err := wal.Set(storageSnapshot, snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	store := &objectStore{objects: make(map[string][]byte), fail: true}
+	a := newArchiver(store, "prod", 1)
+	if err := a.ship(context.Background(), wal, 2); err == nil {
+		t.Error("shipped to an unreachable bucket")
+	}
+	// The failed uploads are retried on the next round.
+	store.fail = false
+	if err := a.ship(context.Background(), wal, 2); err != nil {
+		t.Fatal(err)
+	}
+	segment, _ := ioutil.ReadFile(filepath.Join(dir, walSegmentName(1)))
+	if got := store.objects["prod/replica-1/wal/"+walSegmentName(1)]; len(got) == 0 || !bytes.Equal(got, segment) {
+		t.Errorf("archived first segment = %q, want %q", got, segment)
+	}
+	if got := store.objects["prod/replica-1/snapshots/snapshot-0000000000000002"]; !bytes.Equal(got, snapshot) {
+		t.Errorf("archived snapshot = %q", got)
+	}
+	if len(store.objects) != 5 {
+		t.Errorf("archived %d objects, want the 4 sealed segments and the snapshot", len(store.objects))
+	}
+
+	// What was uploaded isn't uploaded again.
+	store.objects = make(map[string][]byte)
+	if err := a.ship(context.Background(), wal, 2); err != nil || len(store.objects) != 0 {
+		t.Errorf("second round archived %d objects, err = %v", len(store.objects), err)
+	}
+
+	// A hung upload is abandoned at the end of its round, and the archiver
+	// stops with the replica.
+	r := newTestBackup(wal, nil)
+	r.opts.ArchiveInterval = 20 * time.Millisecond
+	r.failures = make(chan BackgroundError, failuresBufferSize)
+	r.snapshotNum = 2
+	ctx, cancel := context.WithCancel(context.Background())
+	r.stopArchive = cancel
+	stopped := make(chan struct{})
+	go func() {
+		r.runArchiver(ctx, newArchiver(hungStore{}, "prod", 1))
+		close(stopped)
+	}()
+	select {
+	case e := <-r.Errors():
+		if e.Kind != FailureArchive || !errors.Is(e.Err, context.DeadlineExceeded) {
+			t.Errorf("hung upload reported as %v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("hung upload not abandoned")
+	}
+	r.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("archiver still running once the replica stopped")
+	}
+
+	var req *http.Request
+	var body []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		body, _ = ioutil.ReadAll(r.Body)
+	}))
+	defer server.Close()
+	s3 := &S3Store{Endpoint: server.URL, Bucket: "vrr-archive", Region: "eu-west-1", AccessKeyID: "AKID", SecretAccessKey: "secret"}
+	if err := s3.Put(context.Background(), "prod/replica-1/snapshots/snapshot 2", snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodPut || req.URL.EscapedPath() != "/vrr-archive/prod/replica-1/snapshots/snapshot%202" || !bytes.Equal(body, snapshot) {
+		t.Errorf("got %s %s with %q", req.Method, req.URL.EscapedPath(), body)
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || !strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		t.Errorf("Authorization = %q", auth)
+	}
+}
+
+func TestEventLogPersistsAndWraps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Events are dropped rather than waited for when the writer lags behind.
+	appendEvent := func(l *eventLog, e Event) {
+		for l.append(e) == errEventLogFull {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	l, err := openEventLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := eventLogSlots + 10
+	for i := 0; i < total; i++ {
+		appendEvent(l, Event{Time: time.Now(), ReplicaID: 2, Kind: EventPrepareAcked, Message: fmt.Sprintf("event %d", i)})
+	}
+	l.close()
+
+	// Reopening continues after the most recent event rather than
+	// overwriting from the start.
+	l, err = openEventLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendEvent(l, Event{Time: time.Now(), ReplicaID: 2, Kind: EventStatusChange, Message: strings.Repeat("x", 2*eventLogSlotSize)})
+	l.close()
+
+	events, err := ReadEventLog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != eventLogSlots {
+		t.Fatalf("got %d events, want %d", len(events), eventLogSlots)
+	}
+	if want := fmt.Sprintf("event %d", total-eventLogSlots+1); events[0].Message != want {
+		t.Errorf("oldest event is %q, want %q", events[0].Message, want)
+	}
+	last := events[len(events)-1]
+	if last.Kind != EventStatusChange || last.ReplicaID != 2 || len(last.Message) != eventLogMaxMsgLen {
+		t.Errorf("unexpected last event %+v", last)
+	}
+}
+
+// TestMessageComplexity guards against changes multiplying the messages
+// the protocol needs in the normal case, e.g. sending heartbeats twice.
+func TestMessageComplexity(t *testing.T) {
+	const n = 3
+	const ops = 20
+	const heartbeats = 20
+
+	// The clock only moves when stepped, so the heartbeats sent
+	// don't depend on how fast the test runs.
+	clock := NewManualClock(time.Unix(0, 0))
+	opts := DefaultOptions()
+	opts.Clock = clock
+	g, err := NewEmbeddedGroup(n, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+
+	messagesSent := func() map[string]int {
+		sent := make(map[string]int)
+		for _, s := range g.servers {
+			for method, count := range s.MessagesSent() {
+				sent[method] += count
+			}
+		}
+		return sent
+	}
+
+	before := messagesSent()
+	for i := 1; i <= ops; i++ {
+		if err := g.Submit(DefaultNamespace, 1, i, i); err != nil {
+			t.Fatalf("Submit(%d): %v", i, err)
+		}
+		for commit := range g.Commits() {
+			if commit.ReplicaID == 0 {
+				break
+			}
+		}
+	}
+	go func() {
+		for range g.Commits() {
+		}
+	}()
+	for i := 0; i < heartbeats; i++ {
+		clock.Step(opts.HeartbeatInterval)
+		sleepMs(5)
+	}
+	after := messagesSent()
+
+	sent := func(method string) int { return after[method] - before[method] }
+
+	if prepares := sent("Replica.Prepare"); prepares > ops*(n-1) {
+		t.Errorf("%d <PREPARE>s for %d operations, want at most one per operation and backup", prepares, ops)
+	}
+	if commits := sent("Replica.Commit"); commits > heartbeats*(n-1) {
+		t.Errorf("%d <COMMIT>s in %d heartbeat intervals, want at most one per interval and backup", commits, heartbeats)
+	}
+	if viewChanges := sent("Replica.StartViewChange"); viewChanges != 0 {
+		t.Errorf("%d <START-VIEW-CHANGE>s with a healthy primary", viewChanges)
+	}
+	tlog("messages per commit: %.1f", float64(sent("Replica.Prepare")+sent("Replica.Commit"))/float64(ops))
+}
+
+func TestEmbeddedGroup(t *testing.T) {
+	if _, err := NewEmbeddedGroup(2, DefaultOptions()); err == nil {
+		t.Fatal("group of 2 replicas, which can't tolerate any failure, created")
+	}
+
+	g, err := NewEmbeddedGroup(3, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+
+	for i := 1; i <= 3; i++ {
+		if err := g.Submit(DefaultNamespace, 1, i, i*10); err != nil {
+			t.Fatalf("Submit(%d): %v", i, err)
+		}
+		sleepMs(10)
+	}
+
+	// Every replica delivers the commits, in order, tagged with its ID.
+	delivered := make(map[int][]interface{})
+	for i := 0; i < 3*3; i++ {
+		select {
+		case c := <-g.Commits():
+			delivered[c.ReplicaID] = append(delivered[c.ReplicaID], c.ClientReq.reqOp)
+		case <-time.After(time.Second):
+			t.Fatalf("only %d commits delivered: %v", i, delivered)
+		}
+	}
+	for replicaID := 0; replicaID < 3; replicaID++ {
+		if ops := delivered[replicaID]; len(ops) != 3 || ops[0] != 10 || ops[2] != 30 {
+			t.Errorf("replica %d delivered %v", replicaID, ops)
+		}
+	}
+}
+
+func TestManualClockDrivesTimeouts(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	opts := DefaultOptions()
+	opts.Clock = clock
+	g, err := NewEmbeddedGroup(3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+
+	viewChangeStarted := func() bool {
+		started := false
+		for i := 1; i < 3; i++ {
+			for {
+				select {
+				case e := <-g.Replica(i).Events():
+					if e.Kind == EventStatusChange && e.Evidence.(StatusChangeEvidence).To == ViewChange {
+						started = true
+					}
+					continue
+				default:
+				}
+				break
+			}
+		}
+		return started
+	}
+
+	// However long the primary stays silent, nothing times out
+	// as long as the clock doesn't move.
+	g.Replica(0).Stop()
+	sleepMs(2 * int(opts.ViewChangeTimeout/time.Millisecond))
+	if viewChangeStarted() {
+		t.Fatal("view change started without the clock moving")
+	}
+
+	for elapsed := time.Duration(0); elapsed < 4*opts.ViewChangeTimeout; elapsed += 5 * time.Millisecond {
+		clock.Step(5 * time.Millisecond)
+		sleepMs(1)
+	}
+	if !viewChangeStarted() {
+		t.Fatal("no view change once the clock moved past the timeout")
+	}
+}
+
+func TestStatsProgress(t *testing.T) {
+	clock := NewManualClock(time.Unix(0, 0))
+	opts := DefaultOptions()
+	opts.Clock = clock
+	g, err := NewEmbeddedGroup(3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+
+	for i := 1; i <= 3; i++ {
+		if err := g.Submit(DefaultNamespace, 1, i, i); err != nil {
+			t.Fatalf("Submit(%d): %v", i, err)
+		}
+		// Backups may deliver the operation before the primary.
+		for commit := range g.Commits() {
+			if commit.ReplicaID == 0 {
+				break
+			}
+		}
+	}
+	clock.Step(100 * time.Millisecond)
+
+	stats := g.Replica(0).LocalStats()
+	if stats.CommittedInView != 3 || stats.CommitRate != 3 || stats.SinceLastCommit != 100*time.Millisecond {
+		t.Errorf("unexpected primary stats %+v", stats)
+	}
+}
+
+func TestStatsRatesAndLatency(t *testing.T) {
+	r := newLonePrimary()
+	clock := NewManualClock(time.Unix(0, 0))
+	r.clock = clock
+
+	// More requests than the statistics keep samples of.
+	for i := 1; i <= 2*statsWindowSize; i++ {
+		if err := r.Submit(clientRequest{clientID: 1, reqNum: i, reqOp: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Submit(clientRequest{clientID: 1, reqNum: 1, reqOp: 1}); err != ErrDuplicateRequest {
+		t.Fatalf("duplicate request: err = %v", err)
+	}
+	if stats := r.LocalStats(); stats.SubmitRate != 2*statsWindowSize {
+		t.Errorf("SubmitRate = %v, want %d accepted requests per second", stats.SubmitRate, 2*statsWindowSize)
+	}
+	clock.Step(statsRateWindow)
+	if stats := r.LocalStats(); stats.SubmitRate != 0 {
+		t.Errorf("SubmitRate = %v a window later", stats.SubmitRate)
+	}
+
+	// The latency starts with Submit, the middlewares included.
+	opts := DefaultOptions()
+	opts.Clock = NewManualClock(time.Unix(0, 0))
+	opts.SubmitMiddlewares = []SubmitMiddleware{func(next SubmitFunc) SubmitFunc {
+		return func(req SubmitRequest) error {
+			opts.Clock.(*ManualClock).Step(20 * time.Millisecond)
+			return next(req)
+		}
+	}}
+	g, err := NewEmbeddedGroup(3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+	if err := g.Submit(DefaultNamespace, 1, 1, "op"); err != nil {
+		t.Fatal(err)
+	}
+	<-g.Commits()
+	if stats := g.Replica(0).LocalStats(); stats.CommitLatencyP50 < 20*time.Millisecond {
+		t.Errorf("CommitLatencyP50 = %v, want the time spent in the middleware counted", stats.CommitLatencyP50)
+	}
+}
+
+func TestCommittedEntries(t *testing.T) {
+	r := newLonePrimary()
+	for i := 1; i <= 3; i++ {
+		if err := r.Submit(clientRequest{namespace: "ns", clientID: 1, reqNum: i, reqOp: []byte{byte(i)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r.commitNum = 2
+
+	entries, err := r.CommittedEntries(1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[1].OpNum != 2 || entries[1].ReqNum != 2 || !bytes.Equal(entries[1].Op.([]byte), []byte{2}) {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+	entries[1].Op.([]byte)[0] = 42
+	if r.opLog[1].op().([]byte)[0] != 2 {
+		t.Fatal("modifying a returned operation altered the log")
+	}
+
+	if _, err := r.CommittedEntries(2, 3); !errors.Is(err, ErrNotCommitted) {
+		t.Fatalf("reading an uncommitted entry: err = %v", err)
+	}
+	if _, err := r.CommittedEntries(2, 1); err == nil {
+		t.Fatal("reading an empty range succeeded")
+	}
+}
+
+func TestUnknownPeerPolicy(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.configuration[0] = "127.0.0.1:7000"
+	r.primarySightings = make(map[int]primarySighting)
+	r.events = make(chan Event, eventsBufferSize)
+	r.server.replica = r
+
+	credentials := []byte("secret")
+	commitFrom := func(senderID int) error {
+		rpp := &RPCProxy{s: r.server, identity: &PeerIdentity{ReplicaID: senderID, Credentials: credentials}}
+		var reply CommitReply
+		return rpp.Commit(CommitArgs{ViewNum: 0, PrimaryID: senderID}, &reply)
+	}
+
+	for _, policy := range []UnknownPeerPolicy{RejectUnknownPeers, LogAndRejectUnknownPeers} {
+		r.opts.UnknownPeerPolicy = policy
+		if err := commitFrom(0); err != nil {
+			t.Errorf("%v: known peer rejected: %v", policy, err)
+		}
+		if err := commitFrom(5); !errors.Is(err, ErrUnknownPeer) {
+			t.Errorf("%v: unknown peer: err = %v", policy, err)
+		}
+	}
+
+	r.opts.UnknownPeerPolicy = AcceptAuthenticatedUnknownPeers
+	r.opts.AuthenticatePeer = func(peer PeerIdentity) bool { return string(peer.Credentials) == "secret" }
+	if err := commitFrom(5); err != nil {
+		t.Errorf("authenticated peer rejected: %v", err)
+	}
+	credentials = []byte("guess")
+	if err := commitFrom(6); !errors.Is(err, ErrUnknownPeer) {
+		t.Errorf("unauthenticated peer: err = %v", err)
+	}
+
+	r.opts.UnknownPeerPolicy = AcceptUnknownPeers
+	if err := commitFrom(6); err != nil {
+		t.Errorf("unknown peer rejected in lab mode: %v", err)
+	}
+}
+
+// raftProto encodes the fields of a protobuf message, varints for the
+// uint64 values and bytes for the []byte ones, by field number.
+func raftProto(fields ...interface{}) []byte {
+	var buf []byte
+	for i := 0; i < len(fields); i += 2 {
+		num := uint64(fields[i].(int))
+		switch v := fields[i+1].(type) {
+		case uint64:
+			buf = appendUvarint(buf, num<<3)
+			buf = appendUvarint(buf, v)
+		case []byte:
+			buf = appendUvarint(buf, num<<3|2)
+			buf = appendUvarint(buf, uint64(len(v)))
+			buf = append(buf, v...)
+		}
+	}
+	return buf
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+// raftWALFile is a WAL file of etcd holding the records, by type and data.
+func raftWALFile(records ...interface{}) []byte {
+	var file []byte
+	var crc uint32
+	for i := 0; i < len(records); i += 2 {
+		typ, data := uint64(records[i].(int)), records[i+1].([]byte)
+		if typ != raftCRCRecord {
+			crc = crc32.Update(crc, raftCRCTable, data)
+		}
+		record := raftProto(1, typ, 2, uint64(crc), 3, data)
+		lenField := uint64(len(record))
+		pad := (8 - len(record)%8) % 8
+		if pad > 0 {
+			lenField |= uint64(0x80|pad) << 56
+		}
+		var frame [8]byte
+		binary.LittleEndian.PutUint64(frame[:], lenField)
+		file = append(append(append(file, frame[:]...), record...), make([]byte, pad)...)
+	}
+	return file
+}
+
+func TestReadRaftWAL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vrr-raft")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	entry := func(typ, term, index uint64, data string) []byte {
+		return raftProto(1, typ, 2, term, 3, index, 4, []byte(data))
+	}
+
+	// A new leader overwrites the uncommitted entry 4, its empty entry and
+	// the configuration change aren't kept.
+	walDir := filepath.Join(dir, "wal")
+	os.Mkdir(walDir, 0755)
+	wal := raftWALFile(
+		raftCRCRecord, []byte(nil),
+		raftMetadataRecord, []byte("node"),
+		raftSnapshotRecord, raftProto(1, uint64(0), 2, uint64(0)),
+		raftEntryRecord, entry(0, 1, 1, ""),
+		raftEntryRecord, entry(0, 1, 2, "a"),
+		raftEntryRecord, entry(1, 1, 3, "cc"),
+		raftEntryRecord, entry(0, 1, 4, "b"),
+		raftEntryRecord, entry(0, 2, 4, "c"),
+		raftEntryRecord, entry(0, 2, 5, "d"),
+		raftStateRecord, raftProto(1, uint64(2), 3, uint64(4)),
+	)
+	walFile := filepath.Join(walDir, "0000000000000000-0000000000000000.wal")
+	ioutil.WriteFile(walFile, wal, 0644)
+	state, report, err := ReadRaftWAL(walDir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ExportedEntry{
+		{OpNum: 1, ClientID: RaftClientID, ReqNum: 1, Op: []byte("a")},
+		{OpNum: 2, ClientID: RaftClientID, ReqNum: 2, Op: []byte("c")},
+	}
+	if !reflect.DeepEqual(state.Entries, want) || report.Skipped != 2 || report.Overwritten != 1 || report.CommitIndex != 4 {
+		t.Errorf("read %+v; report %+v", state.Entries, report)
+	}
+
+	wal[bytes.Index(wal, []byte("cc"))] ^= 1
+	ioutil.WriteFile(walFile, wal, 0644)
+	if _, _, err := ReadRaftWAL(walDir, ""); !errors.Is(err, ErrBadRaftWAL) {
+		t.Errorf("reading a corrupt WAL: err = %v", err)
+	}
+
+	// The entries follow the snapshot the WAL recorded.
+	snapDir := filepath.Join(dir, "snap")
+	os.Mkdir(snapDir, 0755)
+	wal = raftWALFile(
+		raftCRCRecord, []byte(nil),
+		raftSnapshotRecord, raftProto(1, uint64(3), 2, uint64(1)),
+		raftEntryRecord, entry(0, 1, 4, "x"),
+		raftStateRecord, raftProto(1, uint64(1), 3, uint64(4)),
+	)
+	ioutil.WriteFile(walFile, wal, 0644)
+	if _, _, err := ReadRaftWAL(walDir, snapDir); !errors.Is(err, ErrBadRaftWAL) {
+		t.Errorf("reading a WAL without its snapshot: err = %v", err)
+	}
+	snapshot := raftProto(1, []byte("state"), 2, raftProto(2, uint64(3), 3, uint64(1)))
+	snapFile := raftProto(1, uint64(crc32.Checksum(snapshot, raftCRCTable)), 2, snapshot)
+	ioutil.WriteFile(filepath.Join(snapDir, "0000000000000001-0000000000000003.snap"), snapFile, 0644)
+	state, _, err = ReadRaftWAL(walDir, snapDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err := decodeSnapshot(state.Snapshot); err != nil || s.OpNum != 3 || string(s.State) != "state" {
+		t.Errorf("snapshot = %+v, %v", s, err)
+	}
+	if len(state.Entries) != 1 || state.Entries[0].OpNum != 4 {
+		t.Errorf("entries after the snapshot = %+v", state.Entries)
+	}
+}
+
+func TestForceNewCluster(t *testing.T) {
+	survivor := newLonePrimary()
+	for reqNum := 1; reqNum <= 2; reqNum++ {
+		if err := survivor.Submit(clientRequest{clientID: 1, reqNum: reqNum, reqOp: reqNum}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	survivor.commitNum = 2
+	var export bytes.Buffer
+	if err := survivor.Export(&export); err != nil {
+		t.Fatal(err)
+	}
+
+	r := newLonePrimary()
+	r.events = make(chan Event, eventsBufferSize)
+	if err := r.ForceNewCluster(bytes.NewReader(export.Bytes()), "lost 2 of 3 replicas"); err == nil {
+		t.Fatal("new cluster forced without a cluster epoch")
+	}
+	r.opts.ClusterEpoch = 1
+	if err := r.ForceNewCluster(bytes.NewReader(export.Bytes()), ""); err == nil {
+		t.Fatal("new cluster forced without a reason")
+	}
+	if err := r.ForceNewCluster(bytes.NewReader(export.Bytes()), "lost 2 of 3 replicas"); err != nil {
+		t.Fatal(err)
+	}
+	if r.commitNum != 2 {
+		t.Errorf("seed commitNum = %d, want 2", r.commitNum)
+	}
+	if e := <-r.events; e.Kind != EventForcedNewCluster || e.Evidence.(ForcedNewClusterEvidence).Reason != "lost 2 of 3 replicas" {
+		t.Errorf("audit event = %+v", e)
+	}
+
+	// A member of the old cluster coming back is fenced off.
+	r.primarySightings = make(map[int]primarySighting)
+	r.server.replica = r
+	commitFrom := func(epoch uint64) error {
+		rpp := &RPCProxy{s: r.server, identity: &PeerIdentity{ReplicaID: 1, ClusterEpoch: epoch}}
+		return rpp.Commit(CommitArgs{ViewNum: 0, PrimaryID: 1}, &CommitReply{})
+	}
+	if err := commitFrom(0); !errors.Is(err, ErrFencedPeer) {
+		t.Errorf("old member: err = %v", err)
+	}
+	if err := commitFrom(1); err != nil {
+		t.Errorf("new member rejected: %v", err)
+	}
+}
+
+func TestInboundLimits(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.configuration[0] = "127.0.0.1:7000"
+	r.configuration[2] = "127.0.0.1:7002"
+	r.primarySightings = make(map[int]primarySighting)
+	r.events = make(chan Event, eventsBufferSize)
+	r.server.replica = r
+	r.opts.MaxInboundPerPeer = 1
+	r.opts.MaxInboundQueuePerPeer = 1
+
+	// The <COMMIT>s of replica 0 are held until release is closed.
+	release := make(chan struct{})
+	r.opts.InboundInterceptors = []InboundInterceptor{func(next InboundHandler) InboundHandler {
+		return func(call InboundCall) error {
+			if call.SenderID == 0 {
+				<-release
+			}
+			return next(call)
+		}
+	}}
+	commitFrom := func(senderID int) error {
+		rpp := &RPCProxy{s: r.server, identity: &PeerIdentity{ReplicaID: senderID}}
+		return rpp.Commit(CommitArgs{ViewNum: 0, PrimaryID: senderID}, &CommitReply{})
+	}
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- commitFrom(0) }()
+	}
+	sleepMs(20)
+	if err := commitFrom(0); err != ErrPeerBusy {
+		t.Errorf("third message in flight: err = %v", err)
+	}
+	if err := commitFrom(2); err != nil {
+		t.Errorf("message of another peer: err = %v", err)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Errorf("held message: err = %v", err)
+		}
+	}
+
+	// The sender backs off from a busy peer.
+	r.server.noteBusy(2, errors.New(ErrPeerBusy.Error()))
+	if err := r.server.Call(2, "Replica.Commit", CommitArgs{}, &CommitReply{}); !errors.Is(err, ErrPeerBusy) {
+		t.Errorf("call to a busy peer: err = %v", err)
+	}
+}
+
+func TestPacedStateTransfer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Replica 2 misses the operations, then catches up by a state transfer
+	// paced to about an operation per chunk.
+	var isolated int32 = 1
+	chunks := make(chan NewStateArgs, 32)
+	h.InterceptInbound(2, func(next InboundHandler) InboundHandler {
+		return func(call InboundCall) error {
+			if atomic.LoadInt32(&isolated) == 1 && (call.Method == "Prepare" || call.Method == "Commit") {
+				return nil
+			}
+			if args, ok := call.Args.(NewStateArgs); ok {
+				chunks <- args
+			}
+			return next(call)
+		}
+	})
+	h.cluster[0].Replica().SetStateTransferRate(2, 1000)
+	for i := 1; i <= 10; i++ {
+		if !h.SubmitToReplica(0, 1, i, strings.Repeat("x", 100)) {
+			t.Fatalf("request %d not accepted", i)
+		}
+	}
+
+	backup := h.cluster[2].Replica()
+	backup.mu.Lock()
+	backup.startStateTransfer(backup.viewNum, 0)
+	backup.mu.Unlock()
+	atomic.StoreInt32(&isolated, 0)
+	start := time.Now()
+
+	timeout := time.After(3 * time.Second)
+	for n := 1; ; n++ {
+		select {
+		case args := <-chunks:
+			if len(args.OpLog) != 1 || args.OpNum != n || args.More != (n < 10) {
+				t.Fatalf("chunk %d: opNum=%d entries=%d more=%v", n, args.OpNum, len(args.OpLog), args.More)
+			}
+		case <-timeout:
+			t.Fatalf("only %d chunks of the state transferred", n-1)
+		}
+		if n == 10 {
+			break
+		}
+	}
+	// A second worth of bytes goes at once, the rest at the paced rate.
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("state transferred in %v, not paced", elapsed)
+	}
+	sleepMs(50)
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	if backup.status != Normal || backup.opNum != 10 {
+		t.Errorf("backup status=%v opNum=%d after the state transfer", backup.status, backup.opNum)
+	}
+}
+
+func TestStateTransferStatus(t *testing.T) {
+	newBackup := func() *Replica {
+		r := newTestBackup(nil, nil)
+		r.clock = NewManualClock(time.Unix(0, 0))
+		r.mu.Lock()
+		r.startStateTransfer(0, 0)
+		r.mu.Unlock()
+		return r
+	}
+	newState := NewStateArgs{ViewNum: 0, ReplicaID: 0, OpLog: []opLogEntry{{clientID: 1, reqNum: 1, operation: "a"}}, OpNum: 1}
+
+	r := newBackup()
+	if r.status != StateTransfer || r.isRecovering() {
+		t.Fatalf("status = %v during state transfer", r.status)
+	}
+	var reply NewStateReply
+	if err := r.NewState(newState, &reply); err != nil || !reply.IsReplied || r.status != Normal || r.opNum != 1 {
+		t.Fatalf("NEW-STATE: err = %v reply = %+v status = %v opNum = %d", err, reply, r.status, r.opNum)
+	}
+
+	// A crash recovery takes over the state transfer, the <NEW-STATE>
+	// can't be installed on the state the replica forgot.
+	r = newBackup()
+	r.StartRecovery()
+	reply = NewStateReply{}
+	if err := r.NewState(newState, &reply); err != nil || reply.IsReplied || r.status != Recovery || r.opNum != 0 {
+		t.Fatalf("NEW-STATE while recovering: err = %v reply = %+v status = %v opNum = %d", err, reply, r.status, r.opNum)
+	}
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.clock = NewManualClock(time.Unix(0, 0))
+	r.mu.Lock()
+	r.startStateTransfer(0, 0)
+	r.mu.Unlock()
+
+	data, err := encodeSnapshot(snapshotState{
+		OpNum:   5,
+		State:   []byte("15"),
+		Clients: []snapshotClient{{Namespace: DefaultNamespace, ClientID: 1, ReqNum: 5, Resp: 15, Replied: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	install := func(offset, end int) InstallSnapshotReply {
+		var reply InstallSnapshotReply
+		args := InstallSnapshotArgs{SnapshotNum: 5, Offset: offset, Data: data[offset:end], Done: end == len(data)}
+		if err := r.InstallSnapshot(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if reply := install(0, 4); !reply.IsReplied || reply.NextOffset != 4 {
+		t.Fatalf("first chunk: %+v", reply)
+	}
+	// A chunk past what the replica holds is refused, telling where to
+	// resume.
+	if reply := install(8, len(data)); reply.IsReplied || reply.NextOffset != 4 {
+		t.Fatalf("chunk past the received ones: %+v", reply)
+	}
+	if reply := install(4, len(data)); !reply.IsReplied {
+		t.Fatalf("last chunk: %+v", reply)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.opNum != 5 || r.commitNum != 5 || r.logStart != 5 || r.status != StateTransfer || r.incomingSnapshot != nil {
+		t.Errorf("opNum=%d commitNum=%d logStart=%d status=%v after the snapshot", r.opNum, r.commitNum, r.logStart, r.status)
+	}
+	if e := r.tenantFor(DefaultNamespace).clientTable[1]; e.reqNum != 5 || !e.committed || e.resp != 15 {
+		t.Errorf("client entry %+v after the snapshot", e)
+	}
+	if string(r.pendingSnapshot) != "15" {
+		t.Errorf("state machine restored from %q", r.pendingSnapshot)
+	}
+}
+
+func TestStateTransferFillsGap(t *testing.T) {
+	opts := DefaultOptions()
+	opts.Clock = NewManualClock(time.Unix(0, 0))
+	g, err := NewEmbeddedGroup(3, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+	go func() {
+		for range g.Commits() {
+		}
+	}()
+
+	// Backup 2 misses the first operation.
+	g.servers[0].SetLinkProfile(2, LinkProfile{Name: "cut", Loss: 1})
+	if err := g.Submit(DefaultNamespace, 1, 1, "a"); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(20)
+	g.servers[0].ClearLinkProfile(2)
+
+	// The next <PREPARE> reveals the gap.
+	if err := g.Submit(DefaultNamespace, 1, 2, "b"); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(50)
+	if err := g.Submit(DefaultNamespace, 1, 3, "c"); err != nil {
+		t.Fatal(err)
+	}
+	sleepMs(20)
+
+	backup := g.Replica(2)
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	if backup.status != Normal || backup.opNum != 3 || backup.opLog[0].op() != "a" || backup.opLog[2].op() != "c" {
+		t.Fatalf("backup status=%v opNum=%d log=%+v", backup.status, backup.opNum, backup.opLog)
+	}
+}
+
+func TestCrashRecovery(t *testing.T) {
+	g, err := NewEmbeddedGroup(3, DefaultOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer g.Shutdown()
+	go func() {
+		for range g.Commits() {
+		}
+	}()
+
+	for i := 1; i <= 3; i++ {
+		if err := g.Submit(DefaultNamespace, 1, i, i); err != nil {
+			t.Fatal(err)
+		}
+		sleepMs(10)
+	}
+
+	backup := g.Replica(2)
+	backup.StartRecovery()
+	backup.mu.Lock()
+	if backup.status != Recovery || backup.opNum != 0 {
+		t.Errorf("recovering backup status=%v opNum=%d", backup.status, backup.opNum)
+	}
+	backup.mu.Unlock()
+
+	sleepMs(100)
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	if backup.status != Normal || backup.isRecovering() || backup.opNum != 3 || backup.commitNum != 3 || backup.primaryID != 0 {
+		t.Fatalf("recovered backup status=%v opNum=%d commitNum=%d primary=%d", backup.status, backup.opNum, backup.commitNum, backup.primaryID)
+	}
+}
+
+func TestSubmitMiddlewares(t *testing.T) {
+	r := newLonePrimary()
+
+	var calls []string
+	errUnauthenticated := errors.New("unauthenticated")
+	logging := func(next SubmitFunc) SubmitFunc {
+		return func(req SubmitRequest) error {
+			calls = append(calls, "logging")
+			return next(req)
+		}
+	}
+	auth := func(next SubmitFunc) SubmitFunc {
+		return func(req SubmitRequest) error {
+			calls = append(calls, "auth")
+			if req.Annotations["token"] != "secret" {
+				return errUnauthenticated
+			}
+			req.Op = strings.ToUpper(req.Op.(string))
+			return next(req)
+		}
+	}
+	r.opts.SubmitMiddlewares = []SubmitMiddleware{logging, auth}
+
+	req := clientRequest{clientID: 1, reqNum: 1, reqOp: "op"}
+	if _, err := r.submit(req, nil, nil); err != errUnauthenticated {
+		t.Fatalf("request without token: err = %v", err)
+	}
+	if len(r.opLog) != 0 {
+		t.Fatal("rejected request was appended")
+	}
+	if _, err := r.submit(req, map[string]string{"token": "secret"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if r.opLog[0].op() != "OP" {
+		t.Errorf("appended %v, want the operation altered by the middleware", r.opLog[0].op())
+	}
+	if got := strings.Join(calls, ","); got != "logging,auth,logging,auth" {
+		t.Errorf("middlewares called in order %s", got)
+	}
+}
+
+func TestBackupsApplyCommits(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	for i := 1; i <= 5; i++ {
+		if !h.SubmitToReplica(0, 1, i, i) {
+			t.Fatalf("request %d not accepted", i)
+		}
+		sleepMs(10)
+	}
+	// The backups learn about the last commits from the next heartbeat.
+	sleepMs(150)
+
+	for i, c := range h.CheckCommittedN(5) {
+		if c.ClientReq.reqOp != i+1 || c.OpNum != i+1 || c.CommitNum != i+1 {
+			t.Errorf("commit %d is %+v, want operation, opNum and commitNum %d", i, c, i+1)
+		}
+	}
+}
+
+func TestInboundInterceptors(t *testing.T) {
+	r := newLonePrimary()
+	r.server.replica = r
+	proxyOf := func(senderID int) *RPCProxy {
+		return &RPCProxy{s: r.server, identity: &PeerIdentity{ReplicaID: senderID}}
+	}
+
+	var calls []string
+	record := func(name string) InboundInterceptor {
+		return func(next InboundHandler) InboundHandler {
+			return func(call InboundCall) error {
+				calls = append(calls, fmt.Sprintf("%s:%s:%d", name, call.Method, call.SenderID))
+				return next(call)
+			}
+		}
+	}
+	errForbidden := errors.New("forbidden")
+	r.opts.InboundInterceptors = []InboundInterceptor{record("opts1"), record("opts2")}
+	r.server.AddInboundInterceptor(record("server"))
+	r.server.AddInboundInterceptor(func(next InboundHandler) InboundHandler {
+		return func(call InboundCall) error {
+			switch call.SenderID {
+			case 7:
+				return errForbidden
+			case 5:
+				return nil
+			}
+			return next(call)
+		}
+	})
+
+	var reply HelloReply
+	if err := proxyOf(3).Hello(HelloArgs{ID: 3}, &reply); err != nil || reply.ID != r.ID {
+		t.Fatalf("Hello from 3: err = %v reply = %+v", err, reply)
+	}
+	if err := proxyOf(7).Hello(HelloArgs{ID: 7}, &reply); err != errForbidden {
+		t.Fatalf("Hello from 7: err = %v", err)
+	}
+	if err := proxyOf(5).Hello(HelloArgs{ID: 5}, &reply); err != ErrMessageDropped {
+		t.Fatalf("Hello from 5: err = %v", err)
+	}
+	if err := proxyOf(4).Hello(HelloArgs{ID: 3}, &reply); err != ErrPeerIdentity {
+		t.Fatalf("Hello from 3 on the connection of 4: err = %v", err)
+	}
+	if got := strings.Join(calls, ","); got != "server:Hello:3,opts1:Hello:3,opts2:Hello:3,server:Hello:7,server:Hello:5" {
+		t.Errorf("interceptors called in order %s", got)
+	}
+}
+
+func TestInterceptedPrepareIsRecovered(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+
+	// Backup 2 loses the first <PREPARE>, the primary only sees ErrMessageDropped.
+	var dropped int32
+	h.InterceptInbound(2, func(next InboundHandler) InboundHandler {
+		return func(call InboundCall) error {
+			if call.Method == "Prepare" && atomic.CompareAndSwapInt32(&dropped, 0, 1) {
+				return nil
+			}
+			return next(call)
+		}
+	})
+
+	for i := 1; i <= 3; i++ {
+		h.SubmitToReplica(0, 1, i, i)
+		sleepMs(50)
+	}
+	sleepMs(100)
+
+	if atomic.LoadInt32(&dropped) != 1 {
+		t.Fatal("no <PREPARE> dropped")
+	}
+	backup := h.cluster[2].Replica()
+	backup.mu.Lock()
+	defer backup.mu.Unlock()
+	if backup.status != Normal || backup.opNum != 3 {
+		t.Fatalf("backup status=%v opNum=%d", backup.status, backup.opNum)
+	}
+}
+
+func TestInvariantModes(t *testing.T) {
+	newBackup := func(mode InvariantMode) *Replica {
+		r := newTestBackup(nil, nil)
+		r.opts.InvariantMode = mode
+		var reply PrepareOKReply
+		if err := r.Prepare(PrepareArgs{OpNum: 1, ClientMessage: clientRequest{clientID: 1, reqNum: 1, reqOp: "x"}}, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	// opNum=1 of view 0 comes back as another request.
+	diverging := PrepareArgs{OpNum: 1, ClientMessage: clientRequest{clientID: 2, reqNum: 1, reqOp: "y"}}
+
+	r := newBackup(LenientInvariants)
+	if err := r.Prepare(diverging, &PrepareOKReply{}); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	if r.status != StateTransfer || r.opNum != 0 || r.resyncs != 1 {
+		t.Errorf("lenient replica status=%v opNum=%d resyncs=%d, want it transferring the diverged suffix", r.status, r.opNum, r.resyncs)
+	}
+	r.status = Dead
+	r.mu.Unlock()
+	// ResyncFull heals it by recovering the whole state instead.
+	r2 := newBackup(LenientInvariants)
+	r2.opts.ResyncPolicy = ResyncFull
+	r2.opts.StateMachine = &resettingCounter{}
+	if err := r2.Prepare(diverging, &PrepareOKReply{}); err != nil {
+		t.Fatal(err)
+	}
+	r2.mu.Lock()
+	if r2.status != Recovery || r2.opNum != 0 {
+		t.Errorf("lenient replica status=%v opNum=%d, want it recovering", r2.status, r2.opNum)
+	}
+	r2.status = Dead
+	r2.mu.Unlock()
+
+	violation := false
+	for len(r.events) > 0 {
+		if e := <-r.events; e.Kind == EventInvariantViolation {
+			violation = e.Evidence.(InvariantViolationEvidence).Invariant == "log divergence"
+		}
+	}
+	if !violation {
+		t.Error("no log divergence event")
+	}
+
+	// A backup of view 2 is sent the <START-VIEW> of view 1, delayed rather
+	// than a regression: it is dropped.
+	r = newBackup(StrictInvariants)
+	r.viewNum = 2
+	if err := r.StartView(StartViewArgs{ViewNum: 1, OpNum: 1, PrimaryID: 1}, &StartViewReply{}); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	if r.status != Normal || r.viewNum != 2 {
+		t.Errorf("replica status=%v viewNum=%d after a stale START-VIEW", r.status, r.viewNum)
+	}
+	r.status = Dead
+	r.mu.Unlock()
+
+	r = newBackup(StrictInvariants)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("strict replica didn't panic on a log divergence")
+			}
+		}()
+		r.Prepare(diverging, &PrepareOKReply{})
+	}()
+}
+
+func TestStorageRestore(t *testing.T) {
+	storage := NewMemoryStorage()
+	r := newTestBackup(storage, nil)
+	for i, req := range []clientRequest{{clientID: 1, reqNum: 1, reqOp: "a"}, {clientID: 2, reqNum: 1, reqOp: "b"}} {
+		if err := r.Prepare(PrepareArgs{OpNum: i + 1, CommitNum: i, ClientMessage: req}, &PrepareOKReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.StartViewChange(StartViewChangeArgs{ViewNum: 1, ReplicaID: 2}, &StartViewChangeReply{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replica created on the storage takes up the view change.
+	restored := newTestBackup(storage, nil)
+	if err := restored.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.opNum != 2 || restored.commitNum != 1 || restored.viewNum != 1 || restored.status != ViewChange {
+		t.Errorf("restored opNum=%d commitNum=%d viewNum=%d status=%v", restored.opNum, restored.commitNum, restored.viewNum, restored.status)
+	}
+	if e, ok := restored.clientTableEntry("", 2); !ok || e.reqNum != 1 || e.committed {
+		t.Errorf("restored client 2 entry = %+v, %v", e, ok)
+	}
+
+	// A new view drops the uncommitted operation from the storage too.
+	err := restored.StartView(StartViewArgs{ViewNum: 1, OpLog: restored.opLog[:1], OpNum: 1, CommitNum: 1, PrimaryID: 1}, &StartViewReply{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := storage.ReadLog(1); err != nil || len(entries) != 1 || entries[0].Op != "a" {
+		t.Errorf("stored entries = %+v, %v", entries, err)
+	}
+	if err := storage.AppendLog(3, nil); err == nil {
+		t.Error("appended past the end of the stored log")
+	}
+
+	// The primary of view 1 restarted doesn't take its view up again.
+	again := newTestBackup(storage, nil)
+	if err := again.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if again.viewNum != 2 || again.status != ViewChange || again.primaryID != 1 {
+		t.Errorf("restored primary viewNum=%d status=%v primaryID=%d, want 2, ViewChange and 1", again.viewNum, again.status, again.primaryID)
+	}
+
+	// An entry not matching its CRC isn't replayed, nor the ones after it.
+	entries, _ := storage.ReadLog(1)
+	if entries[0].CRC == 0 {
+		t.Fatal("stored the entry without its CRC")
+	}
+	entries = append(entries, StoredEntry{OpNum: 2, ClientID: 2, ReqNum: 1, Op: "b", CRC: 42})
+	if err := storage.AppendLog(2, entries[1:]); err != nil {
+		t.Fatal(err)
+	}
+	corrupt := newTestBackup(storage, nil)
+	if err := corrupt.restore(); err != errCorruptLog {
+		t.Errorf("restoring a corrupt opLog: err = %v", err)
+	}
+	if corrupt.opNum != 1 || corrupt.commitNum != 0 {
+		t.Errorf("restored a corrupt opLog up to opNum=%d commitNum=%d, want 1 and 0", corrupt.opNum, corrupt.commitNum)
+	}
+}
+
+func TestFaultyStorage(t *testing.T) {
+	prepare := func(r *Replica, opNum int) {
+		req := clientRequest{clientID: 1, reqNum: opNum, reqOp: opNum}
+		r.Prepare(PrepareArgs{OpNum: opNum, CommitNum: opNum - 1, ClientMessage: req}, &PrepareOKReply{})
+	}
+
+	// The replica failing to append stops, without the entry.
+	diskFull := errors.New("disk full")
+	storage := NewFaultyStorage(nil)
+	storage.FailAppend(2, diskFull)
+	r := newTestBackup(storage, nil)
+	r.failures = make(chan BackgroundError, 1)
+	for opNum := 1; opNum <= 3; opNum++ {
+		prepare(r, opNum)
+	}
+	select {
+	case failure := <-r.Errors():
+		if failure.Kind != FailureStorage || !errors.Is(failure, diskFull) {
+			t.Errorf("reported %v", failure)
+		}
+	default:
+		t.Error("storage failure not reported")
+	}
+	r.mu.Lock()
+	if r.status != Dead {
+		t.Errorf("replica failing to append is %v", r.status)
+	}
+	r.mu.Unlock()
+	if entries, _ := storage.ReadLog(1); len(entries) != 2 {
+		t.Errorf("%d entries stored, want 2", len(entries))
+	}
+
+	// The AppendLog torn by the crash keeps its first entries, and the
+	// replica restarted on the state takes up from there.
+	storage = NewFaultyStorage(nil)
+	r = newTestBackup(storage, nil)
+	prepare(r, 1)
+	entries := []StoredEntry{{OpNum: 2, ClientID: 1, ReqNum: 2, Op: 2}, {OpNum: 3, ClientID: 1, ReqNum: 3, Op: 3}}
+	if err := storage.AppendLog(2, entries); err != nil {
+		t.Fatal(err)
+	}
+	state := storage.Crash(1)
+	if err := storage.Set(storageCommitNum, []byte("1")); err != ErrStorageCrashed {
+		t.Errorf("write after the crash: err = %v, want ErrStorageCrashed", err)
+	}
+	restored := newTestBackup(NewFaultyStorage(state), nil)
+	if err := restored.restore(); err != nil {
+		t.Fatal(err)
+	}
+	if restored.opNum != 2 {
+		t.Errorf("restored opNum = %d, want 2", restored.opNum)
+	}
+}
+
+func TestClientTableAcrossViewChange(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	for i, req := range []clientRequest{{clientID: 1, reqNum: 1, reqOp: "a"}, {clientID: 2, reqNum: 1, reqOp: "b"}} {
+		if err := r.Prepare(PrepareArgs{OpNum: i + 1, ClientMessage: req}, &PrepareOKReply{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The new view kept the request of client 1, which another replica
+	// applied, and dropped the one of client 2.
+	args := StartViewArgs{
+		ViewNum:   1,
+		OpLog:     []opLogEntry{{clientID: 1, reqNum: 1, operation: "a"}},
+		OpNum:     1,
+		CommitNum: 1,
+		PrimaryID: 2,
+		Responses: []clientResponse{{ClientID: 1, ReqNum: 1, Resp: "A"}, {ClientID: 2, ReqNum: 1, Resp: "B"}},
+	}
+	if err := r.StartView(args, &StartViewReply{}); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := r.clientTableEntry("", 1); !ok || e.reqNum != 1 || !e.committed || !e.replied || e.resp != "A" {
+		t.Errorf("client 1 entry = %+v, %v", e, ok)
+	}
+	if e, ok := r.clientTableEntry("", 2); ok {
+		t.Errorf("client 2 entry = %+v of a dropped request", e)
+	}
+
+	// The replica passes the response on to the next view.
+	r.mu.Lock()
+	responses := r.clientResponses()
+	r.mu.Unlock()
+	if len(responses) != 1 || responses[0] != args.Responses[0] {
+		t.Errorf("responses = %+v", responses)
+	}
+}
+
+func TestDoViewChangeLogSelection(t *testing.T) {
+	r := newLonePrimary()
+	r.configuration = map[int]string{1: "127.0.0.1:7001", 2: "127.0.0.1:7002"}
+	logOf := func(n int) []opLogEntry {
+		return make([]opLogEntry, n)
+	}
+	for _, args := range []DoViewChangeArgs{
+		// The longest log, but from an older view.
+		{ReplicaID: 1, ViewNum: 3, OldViewNum: 1, OpNum: 5, CommitNum: 4, OpLog: logOf(5)},
+		{ReplicaID: 2, ViewNum: 3, OldViewNum: 2, OpNum: 3, CommitNum: 2, OpLog: logOf(3)},
+		{ReplicaID: 2, ViewNum: 3, OldViewNum: 2, OpNum: 3, CommitNum: 2, OpLog: logOf(3)},
+		{ReplicaID: 0, ViewNum: 3, OldViewNum: 2, OpNum: 4, CommitNum: 3, OpLog: logOf(4)},
+	} {
+		r.considerDoViewChange(args)
+	}
+	if r.doViewChangeCount != 3 {
+		t.Errorf("counted %d DO-VIEW-CHANGEs, want one per sender", r.doViewChangeCount)
+	}
+	if r.tempOldViewNum != 2 || r.tempOpNum != 4 || len(r.tempOpLog) != 4 || r.tempCommitNum != 4 {
+		t.Errorf("selected the log of view %d with opNum=%d and commitNum=%d", r.tempOldViewNum, r.tempOpNum, r.tempCommitNum)
+	}
+}
+
+func TestLastNormalView(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	r.opts = DefaultOptions()
+
+	// The view changes to 1 then 2 fail before the replica is Normal again.
+	for viewNum := 1; viewNum <= 2; viewNum++ {
+		var reply StartViewChangeReply
+		if err := r.StartViewChange(StartViewChangeArgs{ViewNum: viewNum, ReplicaID: 2}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.lastNormalViewNum != 0 {
+		t.Errorf("last normal view = %d in view 2, want 0", r.lastNormalViewNum)
+	}
+
+	var reply StartViewReply
+	if err := r.StartView(StartViewArgs{ViewNum: 3, PrimaryID: 0}, &reply); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.lastNormalViewNum != 3 {
+		t.Errorf("last normal view = %d once view 3 started, want 3", r.lastNormalViewNum)
+	}
+	// Stops the view change timer.
+	r.status = Dead
+}
+
+func TestPrepareCommitsPiggybackedCommitNum(t *testing.T) {
+	r := newLonePrimary()
+	r.ID = 1
+	// Nobody reads the commits until all the PREPAREs are handled.
+	commitChan := make(chan CommitEntry)
+	r.commitChan = commitChan
+	r.newCommitReadyChan = make(chan struct{}, 16)
+	go r.commitChanSender()
+	defer r.Stop()
+
+	for opNum := 1; opNum <= 3; opNum++ {
+		var reply PrepareOKReply
+		args := PrepareArgs{ViewNum: 0, OpNum: opNum, CommitNum: opNum - 1, ClientMessage: clientRequest{clientID: 1, reqNum: opNum, reqOp: opNum}}
+		if err := r.Prepare(args, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r.mu.Lock()
+	if r.commitNum != 2 || r.appliedNum != 0 {
+		t.Fatalf("commitNum=%d appliedNum=%d, want 2 and 0", r.commitNum, r.appliedNum)
+	}
+	r.mu.Unlock()
+	for opNum := 1; opNum <= 2; opNum++ {
+		if entry := <-commitChan; entry.OpNum != opNum || entry.CommitNum != opNum || entry.ClientReq.reqOp != opNum {
+			t.Errorf("commit %d = %+v", opNum, entry)
+		}
+	}
+	sleepMs(10)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.appliedNum != 2 {
+		t.Errorf("appliedNum=%d once the commits are taken, want 2", r.appliedNum)
+	}
+}
+
+func TestCapability(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	primaryID, _ := h.CheckSinglePrimary()
+	for i := 0; i < 3; i++ {
+		if c := h.cluster[i].replica.Capability(); c != CapabilityWrites {
+			t.Errorf("replica %d has capability %v, want Writes", i, c)
+		}
+	}
+
+	// The primary cut off the others can't write any more, while they start
+	// a view of their own.
+	h.DisconnectPeer(primaryID)
+	sleepMs(500)
+	if c := h.cluster[primaryID].replica.Capability(); c != CapabilityStaleReads {
+		t.Errorf("isolated primary has capability %v, want StaleReads", c)
+	}
+	newPrimaryID, _ := h.CheckSinglePrimary()
+	if c := h.cluster[newPrimaryID].replica.Capability(); c != CapabilityWrites {
+		t.Errorf("new primary has capability %v, want Writes", c)
+	}
+
+	h.CrashPeer(primaryID)
+	if c := h.cluster[primaryID].replica.Capability(); c != CapabilityUnavailable {
+		t.Errorf("crashed replica has capability %v, want Unavailable", c)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	primaryID, _ := h.CheckSinglePrimary()
+	backupID := (primaryID + 1) % 3
+	submit := func(reqNum int) {
+		if !h.SubmitToReplica(primaryID, 1, reqNum, reqNum) {
+			t.Fatalf("request %d not accepted", reqNum)
+		}
+	}
+
+	submit(1)
+	sleepMs(100)
+	if err := h.cluster[backupID].Restart(); err != ErrNotStopped {
+		t.Errorf("restarting a running replica: err = %v, want ErrNotStopped", err)
+	}
+
+	// The backup restarted on its storage takes up from there, and catches
+	// up with the operation it missed.
+	h.CrashPeer(backupID)
+	submit(2)
+	sleepMs(100)
+	h.RestartPeer(backupID)
+	submit(3)
+	sleepMs(300)
+	h.CheckCommittedN(3)
+
+	// The backup which lost its storage recovers its state from the others.
+	h.CrashPeer(backupID)
+	stopped := h.cluster[backupID].replica
+	stopped.mu.Lock()
+	stopped.storage = NewMemoryStorage()
+	stopped.mu.Unlock()
+	h.RestartPeer(backupID)
+	submit(4)
+	sleepMs(300)
+	h.CheckCommittedN(4)
+}
+
+func TestErrorsReportUnreachablePeer(t *testing.T) {
+	h := NewHarness(t, 3)
+	defer h.Shutdown()
+	primaryID, _ := h.CheckSinglePrimary()
+	backupID := (primaryID + 1) % 3
+	failures := h.cluster[primaryID].Replica().Errors()
+
+	h.DisconnectPeer(backupID)
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case failure := <-failures:
+			if failure.Kind == FailurePeer && failure.PeerID == backupID {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("backup %d not reported unreachable", backupID)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package vrrkv
+
+import (
+	"fmt"
+	"sync"
+
+	vrr "github.com/joshuabezaleel/test-vrr"
+)
+
+// KV reads and writes the Store of the replication group through a
+// vrr.Client, one operation at a time. Its methods are safe for concurrent
+// use, the operations being submitted in turn.
+type KV struct {
+	mu       sync.Mutex
+	client   *vrr.Client
+	attempts int
+}
+
+// New returns a KV submitting its operations through the client, trying each
+// at most attempts times, see vrr.Client.Submit.
+func New(client *vrr.Client, attempts int) (*KV, error) {
+	if attempts <= 0 {
+		return nil, fmt.Errorf("attempts must be positive, got %d", attempts)
+	}
+	return &KV{client: client, attempts: attempts}, nil
+}
+
+// Put sets the value of the key, and returns the revision of the store once
+// set.
+func (kv *KV) Put(key string, value []byte) (int64, error) {
+	result, err := kv.do(Put{Key: key, Value: value})
+	return result.Revision, err
+}
+
+// Delete deletes the key, and tells whether it was set.
+func (kv *KV) Delete(key string) (bool, error) {
+	result, err := kv.do(Delete{Key: key})
+	return result.Found, err
+}
+
+// Get returns the value of the key, reflecting every write committed before.
+func (kv *KV) Get(key string) ([]byte, bool, error) {
+	result, err := kv.do(Get{Key: key})
+	return result.Value, result.Found, err
+}
+
+// do submits the operation and waits for its Result.
+func (kv *KV) do(op interface{}) (Result, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	if _, err := kv.client.Submit(op, kv.attempts); err != nil {
+		return Result{}, err
+	}
+	resp, err := kv.client.Result(kv.attempts)
+	if err != nil {
+		return Result{}, err
+	}
+	result, ok := resp.(Result)
+	if !ok {
+		return Result{}, fmt.Errorf("vrrkv: unexpected response %T, is the state machine a Store?", resp)
+	}
+	return result, nil
+}
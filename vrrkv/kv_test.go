@@ -0,0 +1,124 @@
+package vrrkv
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	vrr "github.com/joshuabezaleel/test-vrr"
+)
+
+// newGroup starts a group of three replicas running a Store each, and
+// returns a KV of a client of the group.
+func newGroup(t *testing.T) ([]*vrr.Server, []*Store, *KV) {
+	ready := make(chan interface{})
+	servers := make([]*vrr.Server, 3)
+	stores := make([]*Store, 3)
+	addresses := make(map[int]string)
+	for i := range servers {
+		commitChan := make(chan vrr.CommitEntry)
+		go func() {
+			for range commitChan {
+			}
+		}()
+		servers[i] = vrr.NewServer(ready, commitChan)
+		servers[i].Serve()
+		stores[i] = NewStore()
+		addresses[i] = servers[i].GetListenAddr().String()
+	}
+	for i, s := range servers {
+		configuration := make(map[int]string)
+		for j, peer := range servers {
+			if j != i {
+				configuration[j] = addresses[j]
+				if err := s.ConnectToPeer(j, peer.GetListenAddr()); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		opts := vrr.DefaultOptions()
+		opts.StateMachine = stores[i]
+		opts.Validator = stores[i]
+		if err := s.Configure(i, configuration, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(ready)
+
+	client, err := vrr.NewClient(1, vrr.DefaultNamespace, addresses)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kv, err := New(client, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return servers, stores, kv
+}
+
+func shutdown(servers []*vrr.Server, kv *KV) {
+	kv.client.Close()
+	for _, s := range servers {
+		s.DisconnectAll()
+	}
+	for _, s := range servers {
+		s.Replica().Stop()
+		s.Shutdown()
+	}
+}
+
+func TestKV(t *testing.T) {
+	servers, stores, kv := newGroup(t)
+	defer shutdown(servers, kv)
+	events, cancel := stores[2].Watch("a/", 8)
+	defer cancel()
+
+	if revision, err := kv.Put("a/1", []byte("one")); err != nil || revision != 1 {
+		t.Fatalf("Put = %d, %v", revision, err)
+	}
+	if _, err := kv.Put("b/1", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if value, found, err := kv.Get("a/1"); err != nil || !found || string(value) != "one" {
+		t.Fatalf("Get = %q, %v, %v", value, found, err)
+	}
+	if found, err := kv.Delete("a/1"); err != nil || !found {
+		t.Fatalf("Delete = %v, %v", found, err)
+	}
+	if _, found, err := kv.Get("a/1"); err != nil || found {
+		t.Fatalf("Get after Delete = %v, %v", found, err)
+	}
+	if _, err := kv.Put("", nil); err == nil {
+		t.Error("Put of an empty key accepted")
+	}
+
+	// The backup applies the changes of the watched prefix in order.
+	for _, want := range []Event{{EventPut, "a/1", []byte("one"), 1}, {EventDelete, "a/1", nil, 3}} {
+		select {
+		case e := <-events:
+			if e.Type != want.Type || e.Key != want.Key || !bytes.Equal(e.Value, want.Value) || e.Revision != want.Revision {
+				t.Errorf("got event %+v, want %+v", e, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no event for %+v", want)
+		}
+	}
+	if value, ok := stores[2].Get("b/1"); !ok || string(value) != "other" {
+		t.Errorf("backup reads %q, %v", value, ok)
+	}
+	if !bytes.Equal(stores[0].Hash(), stores[2].Hash()) {
+		t.Error("the stores of the primary and the backup differ")
+	}
+
+	snapshot, err := stores[0].Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := NewStore()
+	if err := restored.Restore(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored.Hash(), stores[0].Hash()) || restored.Revision() != 3 {
+		t.Errorf("restored revision %d, want 3", restored.Revision())
+	}
+}
@@ -0,0 +1,292 @@
+// Package vrrkv is a replicated map of byte values by string keys, for the
+// applications which don't need a state machine of their own: every replica
+// runs a Store as its Options.StateMachine and Options.Validator, and the
+// clients read and write it through a KV.
+//
+// It also serves as a reference implementation of the extension points of a
+// state machine: Store applies the operations (vrr.StateMachine), rejects the
+// malformed ones on the primary before they are replicated (vrr.Validator),
+// checkpoints and restores its state (vrr.Snapshotter), starts over on a
+// resync (vrr.StateResetter) and hashes its state for the determinism
+// checker (vrr.StateHasher).
+//
+// The reads of a KV go through the opLog like the writes, so that they see
+// every write committed before them. The replicas, and the processes running
+// them, also read their own Store directly, and watch its changes, without
+// the round trip, but may lag behind the primary.
+package vrrkv
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	vrr "github.com/joshuabezaleel/test-vrr"
+)
+
+func init() {
+	gob.Register(Put{})
+	gob.Register(Delete{})
+	gob.Register(Get{})
+	gob.Register(Result{})
+}
+
+// Put sets the value of the key.
+type Put struct {
+	Key   string
+	Value []byte
+}
+
+// Delete deletes the key.
+type Delete struct {
+	Key string
+}
+
+// Get reads the value of the key.
+type Get struct {
+	Key string
+}
+
+// Result is the response of a Store to an operation: the value the key had
+// before it, if Found, and the Revision of the store once applied.
+type Result struct {
+	Value    []byte
+	Found    bool
+	Revision int64
+}
+
+// ErrEmptyKey is returned for the operations without a key.
+var ErrEmptyKey = errors.New("vrrkv: empty key")
+
+// EventType is the kind of change of a key.
+type EventType int
+
+const (
+	EventPut EventType = iota
+	EventDelete
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPut:
+		return "Put"
+	case EventDelete:
+		return "Delete"
+	default:
+		panic("unreachable")
+	}
+}
+
+// Event is a change of a key, as applied by the Store. Revision counts the
+// changes of the store, this one included.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    []byte
+	Revision int64
+}
+
+// watcher is a Watch of the keys with the prefix.
+type watcher struct {
+	prefix string
+	events chan Event
+	done   chan struct{}
+}
+
+// Store is the replicated map, the state machine of a replica. Its methods
+// are safe for concurrent use.
+type Store struct {
+	mu       sync.RWMutex
+	data     map[string][]byte
+	revision int64
+	watchers []*watcher
+}
+
+// NewStore returns an empty store.
+func NewStore() *Store {
+	return &Store{data: make(map[string][]byte)}
+}
+
+// Validate rejects the operations which aren't of the store or lack a key.
+func (s *Store) Validate(op interface{}) error {
+	var key string
+	switch op := op.(type) {
+	case Put:
+		key = op.Key
+	case Delete:
+		key = op.Key
+	case Get:
+		key = op.Key
+	default:
+		return fmt.Errorf("vrrkv: unknown operation %T", op)
+	}
+	if key == "" {
+		return ErrEmptyKey
+	}
+	return nil
+}
+
+// Apply applies the operation, returning its Result.
+func (s *Store) Apply(op interface{}) (interface{}, error) {
+	if err := s.Validate(op); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	var event *Event
+	var result Result
+	switch op := op.(type) {
+	case Put:
+		result.Value, result.Found = s.data[op.Key]
+		s.data[op.Key] = op.Value
+		s.revision++
+		event = &Event{Type: EventPut, Key: op.Key, Value: op.Value, Revision: s.revision}
+	case Delete:
+		result.Value, result.Found = s.data[op.Key]
+		if result.Found {
+			delete(s.data, op.Key)
+			s.revision++
+			event = &Event{Type: EventDelete, Key: op.Key, Revision: s.revision}
+		}
+	case Get:
+		result.Value, result.Found = s.data[op.Key]
+	}
+	result.Revision = s.revision
+	watchers := s.watchers
+	s.mu.Unlock()
+
+	if event != nil {
+		for _, w := range watchers {
+			if strings.HasPrefix(event.Key, w.prefix) {
+				select {
+				case w.events <- *event:
+				case <-w.done:
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Get returns the value of the key in the store of this replica.
+func (s *Store) Get(key string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, ok := s.data[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), value...), true
+}
+
+// Revision returns the count of the changes applied to the store.
+func (s *Store) Revision() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.revision
+}
+
+// Watch returns a channel receiving the changes of the keys with the prefix,
+// in order, as this replica applies them, along with the function cancelling
+// the watch. Like a vrr.Replica.Subscribe, a watcher must keep up: applying
+// the operations waits for it once its buffer is full. The changes of a
+// Restore or a Reset aren't received; the channel isn't closed by the
+// cancellation.
+func (s *Store) Watch(prefix string, buffer int) (<-chan Event, func()) {
+	w := &watcher{
+		prefix: prefix,
+		events: make(chan Event, buffer),
+		done:   make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.watchers = append(s.watchers, w)
+	s.mu.Unlock()
+
+	cancel := func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		for i, other := range s.watchers {
+			if other == w {
+				s.watchers = append(s.watchers[:i:i], s.watchers[i+1:]...)
+				close(w.done)
+				return
+			}
+		}
+	}
+	return w.events, cancel
+}
+
+// storeSnapshot is the state of a store as checkpointed.
+type storeSnapshot struct {
+	Revision int64
+	Data     map[string][]byte
+}
+
+// Snapshot returns the state of the store.
+func (s *Store) Snapshot() ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(storeSnapshot{Revision: s.revision, Data: s.data}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Restore replaces the state of the store with the snapshot.
+func (s *Store) Restore(snapshot []byte) error {
+	var state storeSnapshot
+	if err := gob.NewDecoder(bytes.NewReader(snapshot)).Decode(&state); err != nil {
+		return fmt.Errorf("vrrkv: malformed snapshot: %v", err)
+	}
+	if state.Data == nil {
+		state.Data = make(map[string][]byte)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.revision = state.Data, state.Revision
+	return nil
+}
+
+// Reset empties the store, for the replica to apply its opLog again.
+func (s *Store) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data, s.revision = make(map[string][]byte), 0
+}
+
+// Hash returns a hash of the keys, values and revision of the store.
+func (s *Store) Hash() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	h := sha256.New()
+	binary.Write(h, binary.BigEndian, s.revision)
+	for _, key := range keys {
+		// The lengths keep the key and value boundaries apart.
+		binary.Write(h, binary.BigEndian, int64(len(key)))
+		h.Write([]byte(key))
+		binary.Write(h, binary.BigEndian, int64(len(s.data[key])))
+		h.Write(s.data[key])
+	}
+	return h.Sum(nil)
+}
+
+var (
+	_ vrr.StateMachine  = (*Store)(nil)
+	_ vrr.Validator     = (*Store)(nil)
+	_ vrr.Snapshotter   = (*Store)(nil)
+	_ vrr.StateResetter = (*Store)(nil)
+	_ vrr.StateHasher   = (*Store)(nil)
+)
@@ -0,0 +1,131 @@
+package vrr
+
+import (
+	"context"
+	"net/rpc"
+	"time"
+)
+
+// maxWaitForCommit bounds how long a replica waits for a commit on behalf of
+// a client, which may have given up meanwhile.
+const maxWaitForCommit = time.Minute
+
+// WaitForCommit blocks until the replica committed the operation of the
+// viewstamp, e.g. the one of the SeqToken of a request before reading from a
+// backup, or until ctx is done or the replica stopped. It fails with
+// ErrViewStampSuperseded once another operation committed in its place.
+func (r *Replica) WaitForCommit(ctx context.Context, vs ViewStamp) error {
+	for {
+		r.mu.Lock()
+		if r.commitNum >= vs.OpNum {
+			err := r.checkViewStamp(vs)
+			r.mu.Unlock()
+			return err
+		}
+		if r.status == Dead {
+			r.mu.Unlock()
+			return ErrReplicaStopped
+		}
+		if r.commitAdvanced == nil {
+			r.commitAdvanced = make(chan struct{})
+		}
+		advanced := r.commitAdvanced
+		r.mu.Unlock()
+
+		select {
+		case <-advanced:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// checkViewStamp tells whether the committed operation at the opNum of the
+// viewstamp is the one of the viewstamp, when the opLog still holds it.
+// Expects r.mu to be locked.
+func (r *Replica) checkViewStamp(vs ViewStamp) error {
+	if vs.OpNum <= r.logStart {
+		return nil
+	}
+	if r.logEntry(vs.OpNum).viewNum != vs.ViewNum {
+		return ErrViewStampSuperseded
+	}
+	return nil
+}
+
+// notifyCommitWaiters wakes up the WaitForCommit calls, once commitNum
+// advanced or the replica stopped. Expects r.mu to be locked.
+func (r *Replica) notifyCommitWaiters() {
+	if r.commitAdvanced != nil {
+		close(r.commitAdvanced)
+		r.commitAdvanced = nil
+	}
+}
+
+type WaitForCommitArgs struct {
+	OpNum   int
+	ViewNum int
+
+	// Timeout is how long the client waits, at most maxWaitForCommit.
+	Timeout time.Duration
+}
+
+type WaitForCommitReply struct {
+	CommitNum int
+
+	// Err is the message of the error ending the wait, if any.
+	Err string
+}
+
+// waitForCommitRequest serves WaitForCommit to the clients.
+func (r *Replica) waitForCommitRequest(args WaitForCommitArgs, reply *WaitForCommitReply) error {
+	timeout := args.Timeout
+	if timeout <= 0 || timeout > maxWaitForCommit {
+		timeout = maxWaitForCommit
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := r.WaitForCommit(ctx, ViewStamp{ViewNum: args.ViewNum, OpNum: args.OpNum})
+	reply.CommitNum = r.CommitNum()
+	if err != nil {
+		reply.Err = err.Error()
+	}
+	return nil
+}
+
+// WaitForCommit blocks until the replica committed the operation of the
+// viewstamp, e.g. the one of Token once Submit returned, so that reading
+// from that replica afterwards sees the operation. It fails once ctx is
+// done, or with ErrViewStampSuperseded, see Replica.WaitForCommit.
+func (c *Client) WaitForCommit(ctx context.Context, replicaID int, vs ViewStamp) error {
+	c.mu.Lock()
+	peer, err := c.peer(replicaID)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	args := WaitForCommitArgs{OpNum: vs.OpNum, ViewNum: vs.ViewNum}
+	if deadline, ok := ctx.Deadline(); ok {
+		args.Timeout = time.Until(deadline)
+	}
+	var reply WaitForCommitReply
+	call := peer.Go("Replica.WaitForCommit", args, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	if call.Error != nil {
+		return call.Error
+	}
+	if reply.Err != "" {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return requestError(reply.Err)
+	}
+	return nil
+}
@@ -0,0 +1,464 @@
+package vrr
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A replica with a data directory keeps its state in a write-ahead log in
+// the log/ directory, see WAL: every write of the Storage is a
+// record appended to the last segment file, and the state is rebuilt by
+// replaying them when the replica starts. How soon a record is on the disk is the
+// SyncPolicy of the replica, trading the durability of the latest writes
+// for latency: under SyncAlways the write returns once the record is
+// synced, so a backup only sends its <PREPARE-OK> for an operation it can't
+// forget; under SyncInterval or SyncNever a crash of the machine may lose
+// the operations the replica acked, which the other replicas of the quorum
+// still hold.
+//
+// A record is its length followed by the gob encoding of a walRecord, on its
+// own so that each one can be decoded alone. The operations must thus be
+// gob-encodable, as for the wire. A record torn by a crash at the end of the
+// log is dropped when it is replayed.
+//
+// The records of the entries CompactLog drops, once snapshotted, stay in
+// the segments, which would otherwise grow for as long as the cluster runs,
+// and so would the replay. A segment past WALSegments.MaxBytes is sealed and
+// the next one started; when enough was written or compacted since, see
+// WALSegments, the next one starts with a checkpoint of the whole state
+// instead, which replaces the records of the sealed segments, so they are
+// removed. A crash before they all are leaves some to replay before the
+// checkpoint, which resets the state they built.
+
+// walSegmentPrefix is the name of the segment files, before their sequence
+// number.
+const walSegmentPrefix = "wal-"
+
+func walSegmentName(seq int) string {
+	return fmt.Sprintf("%s%016d", walSegmentPrefix, seq)
+}
+
+// WALSegments is how a WAL is split into segment files, and when it is
+// compacted.
+type WALSegments struct {
+	// MaxBytes is the size past which a segment is sealed and the next one
+	// started. Zero keeps a single segment, which is never compacted.
+	MaxBytes int
+
+	// CompactBytes compacts the WAL when it seals a segment once the
+	// records written since the last checkpoint add up to so many bytes,
+	// and CompactEntries once CompactLog dropped so many entries since.
+	// Zero disables either.
+	CompactBytes   int
+	CompactEntries int
+}
+
+// SyncPolicy is when the writes of the WAL are synced to the disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways syncs every write before it returns.
+	SyncAlways SyncPolicy = iota
+
+	// SyncInterval syncs the writes every Options.SyncInterval.
+	SyncInterval
+
+	// SyncNever leaves the syncs to the operating system.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "Always"
+	case SyncInterval:
+		return "Interval"
+	case SyncNever:
+		return "Never"
+	default:
+		panic("unreachable")
+	}
+}
+
+// parseSyncPolicy parses a SyncPolicy as configured: always, never, or
+// interval(t) with t a time.Duration.
+func parseSyncPolicy(s string) (SyncPolicy, time.Duration, error) {
+	switch {
+	case s == "always":
+		return SyncAlways, 0, nil
+	case s == "never":
+		return SyncNever, 0, nil
+	case strings.HasPrefix(s, "interval(") && strings.HasSuffix(s, ")"):
+		interval, err := time.ParseDuration(s[len("interval(") : len(s)-1])
+		if err != nil {
+			return 0, 0, err
+		}
+		if interval <= 0 {
+			return 0, 0, fmt.Errorf("interval must be positive, got %v", interval)
+		}
+		return SyncInterval, interval, nil
+	default:
+		return 0, 0, fmt.Errorf("%q is not one of always, interval(t), never", s)
+	}
+}
+
+// walRecord is a write of the WAL: a Set of the key, an AppendLog, a
+// CompactLog or a checkpoint of the state, holding its Values and the
+// Entries of the log after opNum UpTo.
+type walRecord struct {
+	Key   string
+	Value []byte
+
+	Append  bool
+	First   int
+	Entries []StoredEntry
+
+	Compact bool
+	UpTo    int
+
+	Checkpoint bool
+	Values     map[string][]byte
+}
+
+// ErrWALClosed is returned by the writes of a closed WAL.
+var ErrWALClosed = errors.New("vrr: WAL is closed")
+
+// WAL is a Storage in a write-ahead log split into segment files. The state
+// is also kept in memory, where it is read from.
+type WAL struct {
+	state    *MemoryStorage
+	dir      string
+	segments WALSegments
+
+	mu sync.Mutex
+	// file is the last segment, numbered seq, of size bytes; sealed are the
+	// sequence numbers of the older ones, from the oldest.
+	file   *os.File
+	seq    int
+	size   int64
+	sealed []int
+	// written and dropped are the bytes of the records and the entries
+	// compacted since the last checkpoint.
+	written int64
+	dropped int
+	policy  SyncPolicy
+	dirty   bool
+	done    chan struct{}
+}
+
+// OpenWAL opens the WAL in the directory, creating it if needed, and
+// replays it.
+func OpenWAL(dir string, policy SyncPolicy, interval time.Duration, segments WALSegments) (*WAL, error) {
+	seqs, err := walSegmentSeqs(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &WAL{state: NewMemoryStorage(), dir: dir, segments: segments, seq: 1, policy: policy}
+	if len(seqs) > 0 {
+		w.seq, w.sealed = seqs[len(seqs)-1], seqs[:len(seqs)-1]
+	}
+	for _, seq := range w.sealed {
+		if err := w.replaySealed(seq); err != nil {
+			return nil, fmt.Errorf("%s: %v", walSegmentName(seq), err)
+		}
+	}
+	file, err := os.OpenFile(filepath.Join(dir, walSegmentName(w.seq)), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w.file = file
+	if err := w.replay(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %v", file.Name(), err)
+	}
+	if policy == SyncInterval {
+		w.done = make(chan struct{})
+		go w.syncEvery(interval, w.done)
+	}
+	return w, nil
+}
+
+// walSegmentSeqs returns the sequence numbers of the segments in the
+// directory, in order.
+func walSegmentSeqs(dir string) ([]int, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, file := range files {
+		if !strings.HasPrefix(file.Name(), walSegmentPrefix) {
+			continue
+		}
+		seq, err := strconv.Atoi(strings.TrimPrefix(file.Name(), walSegmentPrefix))
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+// replaySealed applies the records of the sealed segment to the state. A
+// sealed segment was synced whole, so a torn record is a corruption.
+func (w *WAL) replaySealed(seq int) error {
+	file, err := os.Open(filepath.Join(w.dir, walSegmentName(seq)))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size, torn, err := w.replaySegment(file)
+	if err == nil && torn {
+		err = fmt.Errorf("torn record at offset %d of a sealed segment", size)
+	}
+	return err
+}
+
+// replay applies the records of the file to the state, and truncates the
+// file after the last whole one.
+func (w *WAL) replay() error {
+	size, _, err := w.replaySegment(w.file)
+	if err != nil {
+		return err
+	}
+	if err := w.file.Truncate(size); err != nil {
+		return err
+	}
+	w.size = size
+	_, err = w.file.Seek(size, io.SeekStart)
+	return err
+}
+
+// replaySegment applies the records read from the segment to the state,
+// until the end or a torn record, and returns the size of the whole ones.
+func (w *WAL) replaySegment(segment io.Reader) (size int64, torn bool, err error) {
+	reader := bufio.NewReader(segment)
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			return size, err != io.EOF, nil
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return size, true, nil
+		}
+		var record walRecord
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&record); err != nil {
+			return size, true, nil
+		}
+		if err := w.apply(record); err != nil {
+			return size, false, err
+		}
+		size += 4 + int64(length)
+		if !record.Checkpoint {
+			w.written += 4 + int64(length)
+		}
+	}
+}
+
+func (w *WAL) apply(record walRecord) error {
+	switch {
+	case record.Append:
+		return w.state.AppendLog(record.First, record.Entries)
+	case record.Compact:
+		held := w.state.logLen()
+		err := w.state.CompactLog(record.UpTo)
+		w.dropped += held - w.state.logLen()
+		return err
+	case record.Checkpoint:
+		w.state.reset(record.Values, record.UpTo, record.Entries)
+		w.written, w.dropped = 0, 0
+		return nil
+	default:
+		return w.state.Set(record.Key, record.Value)
+	}
+}
+
+// encodeWALRecord returns the record as written to a segment.
+func encodeWALRecord(record walRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint32(data, uint32(len(data)-4))
+	return data, nil
+}
+
+// write appends the record to the file, syncing it as the policy says, and
+// applies it to the state. The file is sealed once it is full.
+func (w *WAL) write(record walRecord) error {
+	data, err := encodeWALRecord(record)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return ErrWALClosed
+	}
+	// A record the state refuses must not be replayed.
+	if end := w.state.logEnd(); record.Append && (record.First < 1 || record.First > end+1) {
+		return fmt.Errorf("vrr: can't append at opNum=%d to a log ending at opNum=%d", record.First, end)
+	}
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	if w.policy == SyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return err
+		}
+	} else {
+		w.dirty = true
+	}
+	w.size += int64(len(data))
+	w.written += int64(len(data))
+	if err := w.apply(record); err != nil {
+		return err
+	}
+	if w.segments.MaxBytes > 0 && w.size >= int64(w.segments.MaxBytes) {
+		return w.rotate()
+	}
+	return nil
+}
+
+// rotate seals the file and starts the next segment, with a checkpoint if
+// the WAL is due a compaction. Expects w.mu to be locked.
+func (w *WAL) rotate() error {
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.dirty = false
+	next, err := os.OpenFile(filepath.Join(w.dir, walSegmentName(w.seq+1)), os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if err := w.file.Close(); err != nil {
+		next.Close()
+		return err
+	}
+	w.sealed = append(w.sealed, w.seq)
+	w.file, w.seq, w.size = next, w.seq+1, 0
+
+	compact := w.segments.CompactBytes > 0 && w.written >= int64(w.segments.CompactBytes) ||
+		w.segments.CompactEntries > 0 && w.dropped >= w.segments.CompactEntries
+	if !compact {
+		return nil
+	}
+	return w.checkpoint()
+}
+
+// checkpoint writes the state at the start of the file, synced, and removes
+// the sealed segments, whose records it replaces. Expects w.mu to be
+// locked.
+func (w *WAL) checkpoint() error {
+	state := w.state.clone()
+	data, err := encodeWALRecord(walRecord{Checkpoint: true, Values: state.values, UpTo: state.start, Entries: state.entries})
+	if err != nil {
+		return err
+	}
+	if _, err := w.file.Write(data); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	w.size += int64(len(data))
+	w.written, w.dropped = 0, 0
+	for len(w.sealed) > 0 {
+		err := os.Remove(filepath.Join(w.dir, walSegmentName(w.sealed[0])))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		w.sealed = w.sealed[1:]
+	}
+	return nil
+}
+
+// sealedSegments returns the sequence numbers of the sealed segments, from
+// the oldest.
+func (w *WAL) sealedSegments() []int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]int(nil), w.sealed...)
+}
+
+// syncEvery syncs the file every interval, if it was written to, until the
+// WAL is closed.
+func (w *WAL) syncEvery(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.sync()
+		}
+	}
+}
+
+// sync syncs the file if it was written to since the last sync.
+func (w *WAL) sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil || !w.dirty {
+		return nil
+	}
+	w.dirty = false
+	return w.file.Sync()
+}
+
+func (w *WAL) Get(key string) ([]byte, error) {
+	return w.state.Get(key)
+}
+
+func (w *WAL) Set(key string, value []byte) error {
+	return w.write(walRecord{Key: key, Value: value})
+}
+
+func (w *WAL) AppendLog(first int, entries []StoredEntry) error {
+	return w.write(walRecord{Append: true, First: first, Entries: entries})
+}
+
+func (w *WAL) ReadLog(from int) ([]StoredEntry, error) {
+	return w.state.ReadLog(from)
+}
+
+func (w *WAL) CompactLog(upTo int) error {
+	return w.write(walRecord{Compact: true, UpTo: upTo})
+}
+
+// Close syncs and closes the file.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	if w.done != nil {
+		close(w.done)
+	}
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	w.file = nil
+	return err
+}
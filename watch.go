@@ -0,0 +1,118 @@
+package vrr
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Reactive applications, e.g. invalidating a cache or firing triggers on the
+// writes of some keys, Watch the operations a replica applies rather than
+// Subscribe to them: every operation is received with a ResumeToken, which
+// the watcher keeps once the operation is processed, and the next Watch
+// given the token resumes right after it. Delivery is at least once: the
+// operations received but not processed before the watcher stopped are
+// received again, and the watcher must tolerate them, but none is skipped.
+//
+// A token holds the ClusterEpoch of the replica and the opNum to resume
+// from, so that it can be given to any replica of the cluster. The replica
+// resumes like SubscribeFrom, except for the operations it no longer holds
+// in its opLog or replay buffer: Watch returns ErrCompacted rather than
+// skipping them, and the watcher rebuilds its state from the state machine
+// before watching again with no token.
+
+// ErrInvalidToken is returned by Watch for the tokens it didn't produce, or
+// produced for another ClusterEpoch.
+var ErrInvalidToken = errors.New("vrr: invalid resume token")
+
+// ResumeToken is where a Watch resumes, see WatchEvent. The empty token
+// resumes from the operations applied next.
+type ResumeToken string
+
+func newResumeToken(epoch uint64, opNum int) ResumeToken {
+	return ResumeToken(fmt.Sprintf("%d:%d", epoch, opNum))
+}
+
+// parse returns the opNum of the token, for a replica of the ClusterEpoch.
+func (t ResumeToken) parse(epoch uint64) (int, error) {
+	fields := strings.Split(string(t), ":")
+	if len(fields) != 2 {
+		return 0, ErrInvalidToken
+	}
+	tokenEpoch, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil || tokenEpoch != epoch {
+		return 0, ErrInvalidToken
+	}
+	opNum, err := strconv.Atoi(fields[1])
+	if err != nil || opNum < 1 {
+		return 0, ErrInvalidToken
+	}
+	return opNum, nil
+}
+
+// WatchEvent is an operation received by a watcher, with the Token resuming
+// after it.
+type WatchEvent struct {
+	CommitEntry
+	Token ResumeToken
+}
+
+// Watch returns a channel receiving the applied operations which match the
+// filter, in order, from the token on, along with the function cancelling
+// the watch. Like a subscriber, a watcher must keep up: applying the
+// operations waits for it once its buffer is full.
+//
+// The channel is closed by the cancellation, and if the operations from the
+// token are dropped from the opLog before they are replayed, which Watch
+// can't tell in advance; the watcher handles the latter as ErrCompacted.
+func (r *Replica) Watch(filter CommitFilter, from ResumeToken, buffer int) (<-chan WatchEvent, func(), error) {
+	r.mu.Lock()
+	epoch := r.opts.ClusterEpoch
+	replayFrom := 0
+	if from != "" {
+		opNum, err := from.parse(epoch)
+		if err != nil {
+			r.mu.Unlock()
+			return nil, nil, err
+		}
+		if !r.canReplay(opNum) {
+			r.mu.Unlock()
+			return nil, nil, ErrCompacted
+		}
+		replayFrom = opNum
+	}
+	s := newCommitSubscription(filter, buffer)
+	s.replayFrom = replayFrom
+	s.strict = true
+	r.subscriptions = append(r.subscriptions, s)
+	if replayFrom > 0 {
+		r.notifyCommitReady()
+	}
+	r.mu.Unlock()
+
+	// The events are converted by their own goroutine, rather than by
+	// commitChanSender, so that the buffer of the watcher is all it waits
+	// for.
+	events := make(chan WatchEvent)
+	go func() {
+		defer close(events)
+		for {
+			select {
+			case entry, ok := <-s.entries:
+				if !ok {
+					return
+				}
+				event := WatchEvent{CommitEntry: entry, Token: newResumeToken(epoch, entry.OpNum+1)}
+				select {
+				case events <- event:
+				case <-s.done:
+					return
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return events, r.unsubscriber(s), nil
+}